@@ -408,7 +408,10 @@ func (a *ANX) SendAuthenticatedHTTPRequest(path string, params map[string]interf
 		log.Printf("Request JSON: %s\n", PayloadJson)
 	}
 
-	hmac := GetHMAC(HASH_SHA512, []byte(path+string("\x00")+string(PayloadJson)), []byte(a.APISecret))
+	hmac, err := GetHMAC(HASH_SHA512, []byte(path+string("\x00")+string(PayloadJson)), []byte(a.APISecret))
+	if err != nil {
+		return err
+	}
 	headers := make(map[string]string)
 	headers["Rest-Key"] = a.APIKey
 	headers["Rest-Sign"] = Base64Encode([]byte(hmac))
@@ -893,7 +893,10 @@ func (b *Bitfinex) SendAuthenticatedHTTPRequest(method, path string, params map[
 	}
 
 	PayloadBase64 := Base64Encode(PayloadJson)
-	hmac := GetHMAC(HASH_SHA512_384, []byte(PayloadBase64), []byte(b.APISecret))
+	hmac, err := GetHMAC(HASH_SHA512_384, []byte(PayloadBase64), []byte(b.APISecret))
+	if err != nil {
+		return err
+	}
 	headers := make(map[string]string)
 	headers["X-BFX-APIKEY"] = b.APIKey
 	headers["X-BFX-PAYLOAD"] = PayloadBase64
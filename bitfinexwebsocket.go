@@ -131,7 +131,11 @@ func (b *Bitfinex) WebsocketSendAuth() error {
 	payload := "AUTH" + strconv.FormatInt(time.Now().UnixNano(), 10)[:13]
 	request["event"] = "auth"
 	request["apiKey"] = b.APIKey
-	request["authSig"] = HexEncodeToString(GetHMAC(HASH_SHA512_384, []byte(payload), []byte(b.APISecret)))
+	hmac, err := GetHMAC(HASH_SHA512_384, []byte(payload), []byte(b.APISecret))
+	if err != nil {
+		return err
+	}
+	request["authSig"] = HexEncodeToString(hmac)
 	request["authPayload"] = payload
 	return b.WebsocketSend(request)
 }
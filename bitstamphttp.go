@@ -462,7 +462,10 @@ func (b *Bitstamp) SendAuthenticatedHTTPRequest(path string, values url.Values,
 
 	values.Set("key", b.APIKey)
 	values.Set("nonce", nonce)
-	hmac := GetHMAC(HASH_SHA256, []byte(nonce+b.ClientID+b.APIKey), []byte(b.APISecret))
+	hmac, err := GetHMAC(HASH_SHA256, []byte(nonce+b.ClientID+b.APIKey), []byte(b.APISecret))
+	if err != nil {
+		return err
+	}
 	values.Set("signature", strings.ToUpper(HexEncodeToString(hmac)))
 	path = BITSTAMP_API_URL + path
 
@@ -717,7 +717,10 @@ func (b *BTCC) SendAuthenticatedHTTPRequest(method string, params []interface{})
 		log.Println(encoded)
 	}
 
-	hmac := GetHMAC(HASH_SHA1, []byte(encoded), []byte(b.APISecret))
+	hmac, err := GetHMAC(HASH_SHA1, []byte(encoded), []byte(b.APISecret))
+	if err != nil {
+		return err
+	}
 	postData := make(map[string]interface{})
 	postData["method"] = method
 	postData["params"] = params
@@ -461,7 +461,10 @@ func (b *BTCE) SendAuthenticatedHTTPRequest(method string, values url.Values, re
 	values.Set("method", method)
 
 	encoded := values.Encode()
-	hmac := GetHMAC(HASH_SHA512, []byte(encoded), []byte(b.APISecret))
+	hmac, err := GetHMAC(HASH_SHA512, []byte(encoded), []byte(b.APISecret))
+	if err != nil {
+		return err
+	}
 
 	if b.Verbose {
 		log.Printf("Sending POST request to %s calling method %s with params %s\n", BTCE_API_PRIVATE_URL, method, encoded)
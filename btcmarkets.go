@@ -2,15 +2,35 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/gorilla/websocket"
+	"io"
+	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 const (
 	BTCMARKETS_API_URL             = "https://api.btcmarkets.net"
 	BTCMARKETS_API_VERSION         = "0"
+	BTCMARKETS_USER_AGENT          = "gocryptotrader/BTCMarkets"
+	BTCMARKETS_MARKET_TICK         = "/market/%s/%s/tick"
+	BTCMARKETS_MARKET_ORDERBOOK    = "/market/%s/%s/orderbook"
+	BTCMARKETS_MARKET_TRADES       = "/market/%s/%s/trades"
+	BTCMARKETS_MARKETS_ACTIVE      = "/v2/market/active"
 	BTCMARKETS_ACCOUNT_BALANCE     = "/account/balance"
 	BTCMARKETS_ORDER_CREATE        = "/order/create"
 	BTCMARKETS_ORDER_CANCEL        = "/order/cancel"
@@ -18,21 +38,190 @@ const (
 	BTCMARKETS_ORDER_OPEN          = "/order/open"
 	BTCMARKETS_ORDER_TRADE_HISTORY = "/order/trade/history"
 	BTCMARKETS_ORDER_DETAIL        = "/order/detail"
+	BTCMARKETS_FUND_TRANSFERS      = "/v2/fundtransfer/history"
+
+	BTCMARKETS_DEFAULT_MAX_CONCURRENT_REQUESTS = 5
+	BTCMARKETS_DEFAULT_POLLING_DELAY           = time.Second * 10
+	BTCMARKETS_DEFAULT_POLLING_JITTER          = 10
+	BTCMARKETS_DEFAULT_BREAKER_THRESHOLD       = 5
+	BTCMARKETS_DEFAULT_BREAKER_COOLDOWN        = time.Second * 30
+	BTCMARKETS_DEFAULT_NONCE_FLUSH_INTERVAL    = time.Second * 10
+	BTCMARKETS_DEFAULT_PRICE_DECIMALS          = 2
+	BTCMARKETS_DEFAULT_VOLUME_DECIMALS         = 8
+	BTCMARKETS_TICKER_SUBSCRIBER_BUFFER        = 10
+	BTCMARKETS_MAX_UNAVAILABLE_BACKOFF         = 32
+	BTCMARKETS_RECENT_CLIENT_REQUEST_IDS       = 1000
+	BTCMARKETS_DEFAULT_ORDER_RETRIES           = 2
+	BTCMARKETS_DEFAULT_ORDER_RETRY_DELAY       = time.Millisecond * 500
+	BTCMARKETS_MAX_ORDER_RETRY_BACKOFF         = 8
+	BTCMARKETS_DEFAULT_MAX_IDLE_CONNS          = 100
+	BTCMARKETS_DEFAULT_MAX_IDLE_CONNS_PER_HOST = 10
+	BTCMARKETS_DEFAULT_IDLE_CONN_TIMEOUT       = time.Second * 90
+	BTCMARKETS_DEFAULT_REQUEST_TIMEOUT         = time.Second * 30
+
+	BTCMARKETS_ORDER_STATUS_NEW                 = "New"
+	BTCMARKETS_ORDER_STATUS_PLACED              = "Placed"
+	BTCMARKETS_ORDER_STATUS_PARTIALLY_MATCHED   = "Partially Matched"
+	BTCMARKETS_ORDER_STATUS_FULLY_MATCHED       = "Fully Matched"
+	BTCMARKETS_ORDER_STATUS_CANCELLED           = "Cancelled"
+	BTCMARKETS_ORDER_STATUS_PARTIALLY_CANCELLED = "Partially Cancelled"
+	BTCMARKETS_ORDER_STATUS_FAILED              = "Failed"
+	BTCMARKETS_ORDER_STATUS_ERROR               = "Error"
+
+	BTCMARKETS_MARKET_STATUS_ONLINE      = "Online"
+	BTCMARKETS_MARKET_STATUS_POST_ONLY   = "Post Only"
+	BTCMARKETS_MARKET_STATUS_LIMIT_ONLY  = "Limit Only"
+	BTCMARKETS_MARKET_STATUS_CANCEL_ONLY = "Cancel Only"
+	BTCMARKETS_MARKET_STATUS_OFFLINE     = "Offline"
+
+	BTCMARKETS_INSTRUMENT_STATUS_ONLINE    = "Online"
+	BTCMARKETS_INSTRUMENT_STATUS_POST_ONLY = "PostOnly"
+	BTCMARKETS_INSTRUMENT_STATUS_LIMIT     = "Limit"
+	BTCMARKETS_INSTRUMENT_STATUS_HALTED    = "Halted"
+
+	BTCMARKETS_ORDER_SIDE_BID    BTCMarketsOrderSide = "Bid"
+	BTCMARKETS_ORDER_SIDE_ASK    BTCMarketsOrderSide = "Ask"
+	BTCMARKETS_ORDER_TYPE_LIMIT  BTCMarketsOrderType = "Limit"
+	BTCMARKETS_ORDER_TYPE_MARKET BTCMarketsOrderType = "Market"
+
+	BTCMARKETS_UNIT        = 100000000
+	BTCMARKETS_ORDER_LIMIT = 200
+
+	BTCMARKETS_DEFAULT_TICKER_CACHE_TTL    = time.Second * 10
+	BTCMARKETS_DEFAULT_ORDERBOOK_CACHE_TTL = time.Second * 5
+	BTCMARKETS_DEFAULT_FX_CACHE_TTL        = time.Minute * 5
+	BTCMARKETS_DEFAULT_MARKETS_CACHE_TTL   = time.Second * 30
+	BTCMARKETS_DEFAULT_DUST_THRESHOLD      = 0.00001
+	BTCMARKETS_DEFAULT_REPORTING_CURRENCY  = "USD"
+)
+
+var (
+	ErrBTCMarketsOrderbookEmpty    = errors.New("Orderbook side is empty.")
+	ErrBTCMarketsNoFills           = errors.New("Order has no fills.")
+	ErrBTCMarketsOrderFilled       = errors.New("Order has already been filled.")
+	ErrBTCMarketsUnknownInstrument = errors.New("No rules known for instrument.")
+	ErrBTCMarketsUnknownCurrency   = errors.New("Unknown currency code.")
+	ErrBTCMarketsOrderNotFound     = errors.New("Order not found.")
+	ErrSlippageExceeded            = errors.New("Estimated slippage exceeds the maximum allowed.")
+	ErrBTCMarketsBalanceNotFound   = errors.New("No balance held for currency.")
+	ErrTradingDisabled             = errors.New("Trading is disabled for pair.")
+	ErrBTCMarketsNoTradesInWindow  = errors.New("No trades within the window.")
+	ErrInsufficientKeyPermissions  = errors.New("API key does not have trading permission.")
+	ErrBTCMarketsAuthAPIDisabled   = errors.New("BTC Markets authenticated API support is disabled, call EnableAuthenticatedAPI before setting API keys.")
 )
 
 type BTCMarkets struct {
-	Name                    string
-	Enabled                 bool
-	Verbose                 bool
-	Websocket               bool
-	RESTPollingDelay        time.Duration
+	Name          string
+	APIUrl        string
+	ProxyURL      string
+	HTTPClient    *http.Client
+	Metrics       RequestMetrics
+	Middleware    []HTTPMiddleware
+	UserAgent     string
+	SendRequestID bool
+	Enabled       bool
+	Verbose       bool
+	LogSecrets    bool
+	Websocket     bool
+	WebsocketURL  string
+	// RESTPollingDelay is the interval between ticker polls in Run. The
+	// exchange config stores it as a number of seconds.
+	RESTPollingDelay      time.Duration
+	PollingJitter         float64
+	PairsRefreshInterval  time.Duration
+	MaxConcurrentRequests int
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	IdleConnTimeout       time.Duration
+	// RequestTimeout bounds each HTTP request. Order create requests are
+	// only retried after a timeout, so OrderRetries has no effect when it
+	// is zero.
+	RequestTimeout          time.Duration
+	OrderRetries            int
+	OrderRetryDelay         time.Duration
+	Breaker                 CircuitBreaker
+	Nonce                   Nonce
 	Fee                     float64
+	FeeTable                map[string]float64
 	Ticker                  map[string]BTCMarketsTicker
+	TickerLastFetch         map[string]time.Time
+	TickerCachePath         string
+	TickerCacheTTL          time.Duration
+	Orderbook               map[string]BTCMarketsOrderbook
+	OrderbookLastFetch      map[string]time.Time
+	OrderbookCacheTTL       time.Duration
+	FXCacheTTL              time.Duration
+	MarketsCacheTTL         time.Duration
+	ResponseCacheTTL        map[string]time.Duration
+	Converter               CurrencyConverter
+	ReportingCurrency       string
+	DustThreshold           float64
+	InstrumentRules         map[string]BTCMarketsInstrumentRules
+	RoundingMode            BTCMarketsRoundingMode
 	AuthenticatedAPISupport bool
+	SecretIsBase64          bool
+	RequireEnabledPairs     bool
+	WarmupOrderbooks        bool
+	CancelOnDisconnect      bool
+	PaperTrading            bool
+	Paper                   BTCMarketsPaperAccount
 	APIKey, APISecret       string
+	KeyPermissions          BTCMarketsKeyPermissions
 	BaseCurrencies          []string
 	AvailablePairs          []string
 	EnabledPairs            []string
+	PairDelimiter           string
+	// TradingEnabledPairs, if set, restricts placing, amending and
+	// cancelling orders to these pairs so the rest can be polled but not
+	// traded.
+	TradingEnabledPairs []string
+	// OnTickerUpdate, if set, is called by UpdateTicker for every cached
+	// ticker: on Run's polling goroutines after each successful fetch, from
+	// Warmup, and on the websocket goroutine via ProcessTicker. It may be
+	// called concurrently and is called without the ticker lock held, so it
+	// can call back into the exchange.
+	OnTickerUpdate func(pair string, t BTCMarketsTicker)
+	tickerMtx      sync.Mutex
+	orderbookMtx   sync.Mutex
+	fxMtx          sync.Mutex
+	pairsMtx       sync.RWMutex
+	feeMtx         sync.RWMutex
+	rulesMtx       sync.RWMutex
+	fxRates        map[string]BTCMarketsFXRate
+	fxFailures     map[string]bool
+	respCacheMtx   sync.Mutex
+	respCache      map[string]BTCMarketsCachedResponse
+	marketsMtx     sync.Mutex
+	markets        []BTCMarketsMarket
+	marketsFetched time.Time
+	trailingMtx    sync.Mutex
+	trailingStops  map[string]BTCMarketsTrailingStop
+	trailingDone   map[string]chan struct{}
+	runMtx         sync.Mutex
+	runWg          sync.WaitGroup
+	stopped        bool
+	polling        bool
+	unavailable    Backoff
+	backoffDelay   time.Duration
+	wsConn         *websocket.Conn
+	wsSnapshotIDs  map[string]int64
+	shutdown       chan struct{}
+	clientReqMtx   sync.Mutex
+	clientReqIDs   map[string]bool
+	clientReqOrder []string
+	tradesMtx      sync.Mutex
+	lastTradeIDs   map[string]int64
+	tickerSubsMtx  sync.Mutex
+	tickerSubs     map[string]map[int]chan BTCMarketsTicker
+	tickerSubID    int
+	allTickers     chan BTCMarketsTicker
+	eventsMtx      sync.Mutex
+	statusMtx      sync.Mutex
+	lastPoll       map[string]time.Time
+	lastError      error
+	lastErrorTime  time.Time
+	events         chan BTCMarketsEvent
+	droppedEvents  int64
 }
 
 type BTCMarketsTicker struct {
@@ -44,6 +233,170 @@ type BTCMarketsTicker struct {
 	Timestamp  int64
 }
 
+// Time returns Timestamp, an epoch in seconds, in UTC. It returns the zero
+// time if Timestamp is unset.
+func (t BTCMarketsTicker) Time() time.Time {
+	if t.Timestamp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(t.Timestamp, 0).UTC()
+}
+
+// BTCMarketsOrderSide is an order side. It is sent and decoded in the casing
+// BTC Markets expects, whatever casing it was given in.
+type BTCMarketsOrderSide string
+
+// Canonical returns s in the casing BTC Markets expects, or s unchanged if it
+// isn't a known side.
+func (s BTCMarketsOrderSide) Canonical() BTCMarketsOrderSide {
+	for _, x := range []BTCMarketsOrderSide{BTCMARKETS_ORDER_SIDE_BID, BTCMARKETS_ORDER_SIDE_ASK} {
+		if strings.EqualFold(string(s), string(x)) {
+			return x
+		}
+	}
+	return s
+}
+
+func (s BTCMarketsOrderSide) IsValid() bool {
+	return s == BTCMARKETS_ORDER_SIDE_BID || s == BTCMARKETS_ORDER_SIDE_ASK
+}
+
+func (s BTCMarketsOrderSide) MarshalJSON() ([]byte, error) {
+	return json.Marshal(string(s.Canonical()))
+}
+
+func (s *BTCMarketsOrderSide) UnmarshalJSON(data []byte) error {
+	var side string
+	err := json.Unmarshal(data, &side)
+	if err != nil {
+		return err
+	}
+	*s = BTCMarketsOrderSide(side).Canonical()
+	return nil
+}
+
+// BTCMarketsOrderType is an order type, canonicalized like
+// BTCMarketsOrderSide.
+type BTCMarketsOrderType string
+
+// Canonical returns t in the casing BTC Markets expects, or t unchanged if it
+// isn't a known type.
+func (t BTCMarketsOrderType) Canonical() BTCMarketsOrderType {
+	for _, x := range []BTCMarketsOrderType{BTCMARKETS_ORDER_TYPE_LIMIT, BTCMARKETS_ORDER_TYPE_MARKET} {
+		if strings.EqualFold(string(t), string(x)) {
+			return x
+		}
+	}
+	return t
+}
+
+func (t BTCMarketsOrderType) IsValid() bool {
+	return t == BTCMARKETS_ORDER_TYPE_LIMIT || t == BTCMARKETS_ORDER_TYPE_MARKET
+}
+
+func (t BTCMarketsOrderType) MarshalJSON() ([]byte, error) {
+	return json.Marshal(string(t.Canonical()))
+}
+
+func (t *BTCMarketsOrderType) UnmarshalJSON(data []byte) error {
+	var orderType string
+	err := json.Unmarshal(data, &orderType)
+	if err != nil {
+		return err
+	}
+	*t = BTCMarketsOrderType(orderType).Canonical()
+	return nil
+}
+
+// BTCMarketsFloat64 decodes a JSON number given either bare or quoted.
+type BTCMarketsFloat64 float64
+
+func (f *BTCMarketsFloat64) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "" || s == "null" {
+		*f = 0
+		return nil
+	}
+
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return fmt.Errorf("invalid number %s", data)
+	}
+	*f = BTCMarketsFloat64(value)
+	return nil
+}
+
+// UnmarshalJSON accepts the price fields and timestamp as numbers or quoted
+// numbers.
+func (t *BTCMarketsTicker) UnmarshalJSON(data []byte) error {
+	type ticker BTCMarketsTicker
+	aux := struct {
+		*ticker
+		BestBID   BTCMarketsFloat64
+		BestAsk   BTCMarketsFloat64
+		LastPrice BTCMarketsFloat64
+		Timestamp BTCMarketsFloat64
+	}{ticker: (*ticker)(t)}
+
+	err := json.Unmarshal(data, &aux)
+	if err != nil {
+		return err
+	}
+
+	t.BestBID = float64(aux.BestBID)
+	t.BestAsk = float64(aux.BestAsk)
+	t.LastPrice = float64(aux.LastPrice)
+	t.Timestamp = int64(aux.Timestamp)
+	return nil
+}
+
+type BTCMarketsTickerCacheEntry struct {
+	Ticker    BTCMarketsTicker
+	LastFetch time.Time
+}
+
+type BTCMarketsFXRate struct {
+	Rate    float64
+	Fetched time.Time
+}
+
+// BTCMarketsCachedResponse is a raw public GET response body kept for reuse
+// within the endpoint's ResponseCacheTTL.
+type BTCMarketsCachedResponse struct {
+	Body    []byte
+	Fetched time.Time
+}
+
+type BTCMarketsInstrumentRules struct {
+	Instrument     string
+	Currency       string
+	MinVolume      float64
+	MaxVolume      float64
+	MinNotional    float64
+	PriceIncrement float64
+	PriceDecimals  int
+	VolumeDecimals int
+}
+
+var BTCMarketsDefaultInstrumentRules = map[string]BTCMarketsInstrumentRules{
+	"BTC": {Instrument: "BTC", Currency: "AUD", MinVolume: 0.001, MinNotional: 0.01, PriceIncrement: 0.01, PriceDecimals: 2, VolumeDecimals: 8},
+	"LTC": {Instrument: "LTC", Currency: "AUD", MinVolume: 0.001, MinNotional: 0.01, PriceIncrement: 0.01, PriceDecimals: 2, VolumeDecimals: 8},
+	"ETH": {Instrument: "ETH", Currency: "AUD", MinVolume: 0.001, MinNotional: 0.01, PriceIncrement: 0.01, PriceDecimals: 2, VolumeDecimals: 8},
+}
+
+// BTCMarketsMarket describes a listed market. Fields other than Instrument
+// and Currency are zero when not supplied by the endpoint; a blank Status is
+// treated as online.
+type BTCMarketsMarket struct {
+	Instrument     string  `json:"instrument"`
+	Currency       string  `json:"currency"`
+	MinOrderAmount float64 `json:"minOrderAmount"`
+	MaxOrderAmount float64 `json:"maxOrderAmount"`
+	PriceDecimals  int     `json:"priceDecimals"`
+	AmountDecimals int     `json:"amountDecimals"`
+	Status         string  `json:"status"`
+}
+
 type BTCMarketsTrade struct {
 	TradeID int64   `json:"tid"`
 	Amount  float64 `json:"amount"`
@@ -51,12 +404,78 @@ type BTCMarketsTrade struct {
 	Date    int64   `json:"date"`
 }
 
+// Time returns Date, an epoch in seconds, in UTC.
+func (tr BTCMarketsTrade) Time() time.Time {
+	return time.Unix(tr.Date, 0).UTC()
+}
+
 type BTCMarketsOrderbook struct {
 	Currency   string      `json:"currency"`
 	Instrument string      `json:"instrument"`
 	Timestamp  int64       `json:"timestamp"`
 	Asks       [][]float64 `json:"asks"`
 	Bids       [][]float64 `json:"bids"`
+	Crossed    bool        `json:"-"` // best bid at or above best ask, see IsCrossed
+}
+
+type BTCMarketsAccountBalance struct {
+	Balance      float64 `json:"balance"`
+	PendingFunds float64 `json:"pendingFunds"`
+	Currency     string  `json:"currency"`
+}
+
+// BTCMarketsFundTransfer is a deposit or withdrawal. Amount and Fee are in
+// API units.
+type BTCMarketsFundTransfer struct {
+	ID                  int64   `json:"fundTransferId"`
+	TransferType        string  `json:"transferType"`
+	Status              string  `json:"status"`
+	CreationTime        int64   `json:"creationTime"`
+	LastUpdate          int64   `json:"lastUpdate"`
+	Currency            string  `json:"currency"`
+	Amount              float64 `json:"amount"`
+	Fee                 float64 `json:"fee"`
+	Description         string  `json:"description"`
+	CryptoPaymentDetail struct {
+		Address string `json:"address"`
+		TxID    string `json:"txId"`
+	} `json:"cryptoPaymentDetail"`
+}
+
+// BTCMarketsOrderOptions holds optional order flags. PostOnly orders are
+// rejected rather than matched as a taker; Hidden orders aren't shown in the
+// public orderbook.
+type BTCMarketsOrderOptions struct {
+	PostOnly bool
+	Hidden   bool
+}
+
+// BTCMarketsOrderRequest is an order for PlaceOrders. Price and Volume are in
+// API units, as for Order.
+type BTCMarketsOrderRequest struct {
+	Currency        string
+	Instrument      string
+	Price           int64
+	Volume          int64
+	OrderSide       BTCMarketsOrderSide
+	OrderType       BTCMarketsOrderType
+	ClientRequestID string
+	Options         BTCMarketsOrderOptions
+}
+
+// BTCMarketsOrderResult is the outcome of one PlaceOrders request: the order
+// ID and client request ID used on success, or the error that stopped it.
+type BTCMarketsOrderResult struct {
+	ID              int
+	ClientRequestID string
+	Err             error
+}
+
+type BTCMarketsCancelResult struct {
+	Success      bool   `json:"success"`
+	ErrorCode    int    `json:"errorCode"`
+	ErrorMessage string `json:"errorMessage"`
+	ID           int64  `json:"id"`
 }
 
 type BTCMarketsTradeResponse struct {
@@ -69,28 +488,262 @@ type BTCMarketsTradeResponse struct {
 }
 
 type BTCMarketsOrderResponse struct {
-	ID              float64 `json:"id"`
-	Currency        string  `json:"currency"`
-	Instrument      string  `json:"instrument"`
-	OrderSide       string  `json:"orderSide"`
-	OrderType       string  `json:"ordertype"`
-	CreationTime    float64 `json:"creationTime"`
-	Status          string  `json:"status"`
-	ErrorMessage    string  `json:"errorMessage"`
-	Price           float64 `json:"price"`
-	Volume          float64 `json:"volume"`
-	OpenVolume      float64 `json:"openVolume"`
-	ClientRequestId string  `json:"clientRequestId"`
+	ID              float64                   `json:"id"`
+	Currency        string                    `json:"currency"`
+	Instrument      string                    `json:"instrument"`
+	OrderSide       BTCMarketsOrderSide       `json:"orderSide"`
+	OrderType       BTCMarketsOrderType       `json:"ordertype"`
+	CreationTime    float64                   `json:"creationTime"`
+	Status          string                    `json:"status"`
+	ErrorMessage    string                    `json:"errorMessage"`
+	Price           float64                   `json:"price"`
+	Volume          float64                   `json:"volume"`
+	OpenVolume      float64                   `json:"openVolume"`
+	ClientRequestId string                    `json:"clientRequestId"`
+	Trades          []BTCMarketsTradeResponse `json:"trades"`
+}
+
+// UnmarshalJSON accepts the numeric fields as numbers or quoted numbers.
+func (o *BTCMarketsOrderResponse) UnmarshalJSON(data []byte) error {
+	type order BTCMarketsOrderResponse
+	aux := struct {
+		*order
+		ID           BTCMarketsFloat64 `json:"id"`
+		CreationTime BTCMarketsFloat64 `json:"creationTime"`
+		Price        BTCMarketsFloat64 `json:"price"`
+		Volume       BTCMarketsFloat64 `json:"volume"`
+		OpenVolume   BTCMarketsFloat64 `json:"openVolume"`
+	}{order: (*order)(o)}
+
+	err := json.Unmarshal(data, &aux)
+	if err != nil {
+		return err
+	}
+
+	o.ID = float64(aux.ID)
+	o.CreationTime = float64(aux.CreationTime)
+	o.Price = float64(aux.Price)
+	o.Volume = float64(aux.Volume)
+	o.OpenVolume = float64(aux.OpenVolume)
+	return nil
 }
 
+// CreatedAt converts CreationTime, a millisecond epoch, to a UTC time.
+func (o BTCMarketsOrderResponse) CreatedAt() time.Time {
+	return time.Unix(0, int64(o.CreationTime)*int64(time.Millisecond)).UTC()
+}
+
+// SetDefaults resets b to its default configuration. The HTTP transport keeps
+// up to 100 idle connections, 10 of them per host, for 90 seconds, which is
+// enough to reuse connections across MaxConcurrentRequests without holding
+// sockets open long after polling stops.
 func (b *BTCMarkets) SetDefaults() {
 	b.Name = "BTC Markets"
+	b.APIUrl = BTCMARKETS_API_URL
+	b.MaxIdleConns = BTCMARKETS_DEFAULT_MAX_IDLE_CONNS
+	b.MaxIdleConnsPerHost = BTCMARKETS_DEFAULT_MAX_IDLE_CONNS_PER_HOST
+	b.IdleConnTimeout = BTCMARKETS_DEFAULT_IDLE_CONN_TIMEOUT
+	b.RequestTimeout = BTCMARKETS_DEFAULT_REQUEST_TIMEOUT
+	b.HTTPClient = &http.Client{}
+	b.ConfigureTransport()
+	b.Metrics = NopRequestMetrics{}
+	b.UserAgent = BTCMARKETS_USER_AGENT
 	b.Enabled = true
 	b.Fee = 0.85
 	b.Verbose = false
 	b.Websocket = false
-	b.RESTPollingDelay = 10
+	b.SecretIsBase64 = true
+	b.WebsocketURL = BTCMARKETS_WEBSOCKET
+	b.RESTPollingDelay = BTCMARKETS_DEFAULT_POLLING_DELAY
+	b.PollingJitter = BTCMARKETS_DEFAULT_POLLING_JITTER
+	b.MaxConcurrentRequests = BTCMARKETS_DEFAULT_MAX_CONCURRENT_REQUESTS
+	b.OrderRetries = BTCMARKETS_DEFAULT_ORDER_RETRIES
+	b.OrderRetryDelay = BTCMARKETS_DEFAULT_ORDER_RETRY_DELAY
+	b.Breaker.Threshold = BTCMARKETS_DEFAULT_BREAKER_THRESHOLD
+	b.Breaker.Cooldown = BTCMARKETS_DEFAULT_BREAKER_COOLDOWN
+	b.Nonce.FlushInterval = BTCMARKETS_DEFAULT_NONCE_FLUSH_INTERVAL
 	b.Ticker = make(map[string]BTCMarketsTicker)
+	b.TickerLastFetch = make(map[string]time.Time)
+	b.Orderbook = make(map[string]BTCMarketsOrderbook)
+	b.OrderbookLastFetch = make(map[string]time.Time)
+	b.TickerCacheTTL = BTCMARKETS_DEFAULT_TICKER_CACHE_TTL
+	b.OrderbookCacheTTL = BTCMARKETS_DEFAULT_ORDERBOOK_CACHE_TTL
+	b.FXCacheTTL = BTCMARKETS_DEFAULT_FX_CACHE_TTL
+	b.MarketsCacheTTL = BTCMARKETS_DEFAULT_MARKETS_CACHE_TTL
+	b.Converter = DefaultCurrencyConverter
+	b.ReportingCurrency = BTCMARKETS_DEFAULT_REPORTING_CURRENCY
+	b.DustThreshold = BTCMARKETS_DEFAULT_DUST_THRESHOLD
+	b.RoundingMode = BTCMARKETS_ROUND_NEAREST
+	b.InstrumentRules = make(map[string]BTCMarketsInstrumentRules)
+	for x, y := range BTCMarketsDefaultInstrumentRules {
+		b.InstrumentRules[x] = y
+	}
+	b.shutdown = make(chan struct{})
+}
+
+// SetDefaultsIfUnset applies the defaults from SetDefaults only to fields that
+// are still at their zero value, so it is safe to call after config has been
+// loaded. Enabled, Verbose, Websocket and SecretIsBase64 are left untouched
+// since an explicit false can't be told apart from an unset value.
+func (b *BTCMarkets) SetDefaultsIfUnset() {
+	if b.Name == "" {
+		b.Name = "BTC Markets"
+	}
+	if b.APIUrl == "" {
+		b.APIUrl = BTCMARKETS_API_URL
+	}
+	if b.MaxIdleConns == 0 {
+		b.MaxIdleConns = BTCMARKETS_DEFAULT_MAX_IDLE_CONNS
+	}
+	if b.MaxIdleConnsPerHost == 0 {
+		b.MaxIdleConnsPerHost = BTCMARKETS_DEFAULT_MAX_IDLE_CONNS_PER_HOST
+	}
+	if b.IdleConnTimeout == 0 {
+		b.IdleConnTimeout = BTCMARKETS_DEFAULT_IDLE_CONN_TIMEOUT
+	}
+	if b.RequestTimeout == 0 {
+		b.RequestTimeout = BTCMARKETS_DEFAULT_REQUEST_TIMEOUT
+	}
+	if b.HTTPClient == nil {
+		b.HTTPClient = &http.Client{}
+		b.ConfigureTransport()
+	}
+	if b.Metrics == nil {
+		b.Metrics = NopRequestMetrics{}
+	}
+	if b.UserAgent == "" {
+		b.UserAgent = BTCMARKETS_USER_AGENT
+	}
+	b.feeMtx.Lock()
+	if b.Fee == 0 {
+		b.Fee = 0.85
+	}
+	b.feeMtx.Unlock()
+	if b.WebsocketURL == "" {
+		b.WebsocketURL = BTCMARKETS_WEBSOCKET
+	}
+	if b.RESTPollingDelay == 0 {
+		b.RESTPollingDelay = BTCMARKETS_DEFAULT_POLLING_DELAY
+	}
+	if b.MaxConcurrentRequests == 0 {
+		b.MaxConcurrentRequests = BTCMARKETS_DEFAULT_MAX_CONCURRENT_REQUESTS
+	}
+	if b.OrderRetryDelay == 0 {
+		b.OrderRetryDelay = BTCMARKETS_DEFAULT_ORDER_RETRY_DELAY
+	}
+	if b.Breaker.Threshold == 0 {
+		b.Breaker.Threshold = BTCMARKETS_DEFAULT_BREAKER_THRESHOLD
+	}
+	if b.Breaker.Cooldown == 0 {
+		b.Breaker.Cooldown = BTCMARKETS_DEFAULT_BREAKER_COOLDOWN
+	}
+	if b.Nonce.FlushInterval == 0 {
+		b.Nonce.FlushInterval = BTCMARKETS_DEFAULT_NONCE_FLUSH_INTERVAL
+	}
+	if b.TickerCacheTTL == 0 {
+		b.TickerCacheTTL = BTCMARKETS_DEFAULT_TICKER_CACHE_TTL
+	}
+	if b.OrderbookCacheTTL == 0 {
+		b.OrderbookCacheTTL = BTCMARKETS_DEFAULT_ORDERBOOK_CACHE_TTL
+	}
+	if b.FXCacheTTL == 0 {
+		b.FXCacheTTL = BTCMARKETS_DEFAULT_FX_CACHE_TTL
+	}
+	if b.MarketsCacheTTL == 0 {
+		b.MarketsCacheTTL = BTCMARKETS_DEFAULT_MARKETS_CACHE_TTL
+	}
+	if b.Converter == nil {
+		b.Converter = DefaultCurrencyConverter
+	}
+	if b.ReportingCurrency == "" {
+		b.ReportingCurrency = BTCMARKETS_DEFAULT_REPORTING_CURRENCY
+	}
+	if b.DustThreshold == 0 {
+		b.DustThreshold = BTCMARKETS_DEFAULT_DUST_THRESHOLD
+	}
+	// The zero RoundingMode is already BTCMARKETS_ROUND_NEAREST, so only
+	// values outside the known modes are reset.
+	if b.RoundingMode < BTCMARKETS_ROUND_NEAREST || b.RoundingMode > BTCMARKETS_ROUND_CEIL {
+		b.RoundingMode = BTCMARKETS_ROUND_NEAREST
+	}
+
+	b.tickerMtx.Lock()
+	if b.Ticker == nil {
+		b.Ticker = make(map[string]BTCMarketsTicker)
+	}
+	if b.TickerLastFetch == nil {
+		b.TickerLastFetch = make(map[string]time.Time)
+	}
+	b.tickerMtx.Unlock()
+
+	b.orderbookMtx.Lock()
+	if b.Orderbook == nil {
+		b.Orderbook = make(map[string]BTCMarketsOrderbook)
+	}
+	if b.OrderbookLastFetch == nil {
+		b.OrderbookLastFetch = make(map[string]time.Time)
+	}
+	b.orderbookMtx.Unlock()
+
+	b.rulesMtx.Lock()
+	if b.InstrumentRules == nil {
+		b.InstrumentRules = make(map[string]BTCMarketsInstrumentRules)
+		for x, y := range BTCMarketsDefaultInstrumentRules {
+			b.InstrumentRules[x] = y
+		}
+	}
+	b.rulesMtx.Unlock()
+
+	b.runMtx.Lock()
+	if b.shutdown == nil {
+		b.shutdown = make(chan struct{})
+	}
+	b.runMtx.Unlock()
+}
+
+func (b *BTCMarkets) SetURL(url string) {
+	b.APIUrl = url
+}
+
+func (b *BTCMarkets) SetProxy(proxy string) error {
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return fmt.Errorf("%s invalid proxy URL %s. Error: %s", b.GetName(), proxy, err)
+	}
+
+	if proxyURL.Host == "" || (proxyURL.Scheme != "http" && proxyURL.Scheme != "https" && proxyURL.Scheme != "socks5") {
+		return fmt.Errorf("%s invalid proxy URL %s. Expected http, https or socks5 scheme and host.", b.GetName(), proxy)
+	}
+
+	b.ProxyURL = proxy
+	b.HTTPClient = &http.Client{}
+	b.ConfigureTransport()
+	b.HTTPClient.Transport.(*http.Transport).Proxy = http.ProxyURL(proxyURL)
+	return nil
+}
+
+// ConfigureTransport sets HTTPClient's timeout to RequestTimeout and applies
+// MaxIdleConns, MaxIdleConnsPerHost and IdleConnTimeout to its transport,
+// giving it a copy of the default transport if it has none. A custom, non
+// *http.Transport RoundTripper is left alone. Call it again after changing
+// the fields, before making requests.
+func (b *BTCMarkets) ConfigureTransport() {
+	if b.HTTPClient == nil {
+		b.HTTPClient = &http.Client{}
+	}
+	b.HTTPClient.Timeout = b.RequestTimeout
+
+	if b.HTTPClient.Transport == nil {
+		b.HTTPClient.Transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+
+	transport, ok := b.HTTPClient.Transport.(*http.Transport)
+	if !ok {
+		return
+	}
+	transport.MaxIdleConns = b.MaxIdleConns
+	transport.MaxIdleConnsPerHost = b.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = b.IdleConnTimeout
 }
 
 func (b *BTCMarkets) GetName() string {
@@ -105,190 +758,2550 @@ func (b *BTCMarkets) IsEnabled() bool {
 	return b.Enabled
 }
 
-func (b *BTCMarkets) SetAPIKeys(apiKey, apiSecret string) {
+func (b *BTCMarkets) EnableAuthenticatedAPI() {
+	b.AuthenticatedAPISupport = true
+}
+
+// SetAPIKeys sets the API key and secret. BTC Markets issues the secret as a
+// base64 encoded private key, which is decoded here when SecretIsBase64 is
+// set. Otherwise the secret is taken to be already decoded and used as is.
+func (b *BTCMarkets) SetAPIKeys(apiKey, apiSecret string) error {
 	if !b.AuthenticatedAPISupport {
-		return
+		return ErrBTCMarketsAuthAPIDisabled
+	}
+
+	if !b.SecretIsBase64 {
+		b.APIKey = apiKey
+		b.APISecret = apiSecret
+		return nil
 	}
 
-	b.APIKey = apiKey
 	result, err := Base64Decode(apiSecret)
 
 	if err != nil {
-		log.Printf("%s unable to decode secret key.\n", b.GetName())
-		b.Enabled = false
-		return
+		return fmt.Errorf("%s unable to decode secret key. Error: %s", b.GetName(), err)
 	}
 
+	b.APIKey = apiKey
 	b.APISecret = string(result)
+	return nil
 }
 
-func (b *BTCMarkets) GetFee() float64 {
-	return b.Fee
+// BTCMarketsKeyPermissions is the scope of the configured API key. BTC
+// Markets has no endpoint to query a key's scope, so it must be set to match
+// the key. An unknown scope is treated as able to trade, leaving the exchange
+// to reject requests the key isn't allowed to make.
+type BTCMarketsKeyPermissions string
+
+const (
+	BTCMARKETS_KEY_PERMISSIONS_UNKNOWN   BTCMarketsKeyPermissions = ""
+	BTCMARKETS_KEY_PERMISSIONS_READ_ONLY BTCMarketsKeyPermissions = "read"
+	BTCMARKETS_KEY_PERMISSIONS_TRADE     BTCMarketsKeyPermissions = "trade"
+)
+
+func (p BTCMarketsKeyPermissions) IsValid() bool {
+	switch p {
+	case BTCMARKETS_KEY_PERMISSIONS_UNKNOWN, BTCMARKETS_KEY_PERMISSIONS_READ_ONLY, BTCMARKETS_KEY_PERMISSIONS_TRADE:
+		return true
+	}
+	return false
 }
 
-func (b *BTCMarkets) Run() {
-	if b.Verbose {
-		log.Printf("%s polling delay: %ds.\n", b.GetName(), b.RESTPollingDelay)
-		log.Printf("%s %d currencies enabled: %s.\n", b.GetName(), len(b.EnabledPairs), b.EnabledPairs)
+// CanTrade reports whether the key may place and cancel orders. Paper
+// trading never uses the key, so it is always allowed.
+func (b *BTCMarkets) CanTrade() bool {
+	return b.PaperTrading || b.KeyPermissions != BTCMARKETS_KEY_PERMISSIONS_READ_ONLY
+}
+
+// SetAPIKeysFromEnv reads the API key and secret, decoded as SecretIsBase64
+// directs, from the <prefix>_API_KEY and <prefix>_API_SECRET environment variables.
+func (b *BTCMarkets) SetAPIKeysFromEnv(prefix string) error {
+	keyVar, secretVar := prefix+"_API_KEY", prefix+"_API_SECRET"
+
+	apiKey := os.Getenv(keyVar)
+	if apiKey == "" {
+		return fmt.Errorf("%s environment variable %s is not set.", b.GetName(), keyVar)
 	}
 
-	for b.Enabled {
-		for _, x := range b.EnabledPairs {
-			currency := x
-			go func() {
-				ticker, err := b.GetTicker(currency)
-				if err != nil {
-					log.Println(err)
-					return
-				}
-				b.Ticker[currency] = ticker
-				BTCMarketsLastUSD, _ := ConvertCurrency(ticker.LastPrice, "AUD", "USD")
-				BTCMarketsBestBidUSD, _ := ConvertCurrency(ticker.BestBID, "AUD", "USD")
-				BTCMarketsBestAskUSD, _ := ConvertCurrency(ticker.BestAsk, "AUD", "USD")
-				log.Printf("BTC Markets %s: Last %f (%f) Bid %f (%f) Ask %f (%f)\n", currency, BTCMarketsLastUSD, ticker.LastPrice, BTCMarketsBestBidUSD, ticker.BestBID, BTCMarketsBestAskUSD, ticker.BestAsk)
-				AddExchangeInfo(b.GetName(), currency[0:3], currency[3:], ticker.LastPrice, 0)
-				AddExchangeInfo(b.GetName(), currency[0:3], "USD", BTCMarketsLastUSD, 0)
-			}()
-		}
-		time.Sleep(time.Second * b.RESTPollingDelay)
+	apiSecret := os.Getenv(secretVar)
+	if apiSecret == "" {
+		return fmt.Errorf("%s environment variable %s is not set.", b.GetName(), secretVar)
 	}
+	return b.SetAPIKeys(apiKey, apiSecret)
 }
 
-func (b *BTCMarkets) GetTicker(symbol string) (BTCMarketsTicker, error) {
-	ticker := BTCMarketsTicker{}
-	path := fmt.Sprintf("/market/%s/AUD/tick", symbol)
-	err := SendHTTPGetRequest(BTCMARKETS_API_URL+path, true, &ticker)
-	if err != nil {
-		return BTCMarketsTicker{}, err
-	}
-	return ticker, nil
+func (b *BTCMarkets) GetEnabledPairs() []string {
+	b.pairsMtx.RLock()
+	defer b.pairsMtx.RUnlock()
+	return append([]string{}, b.EnabledPairs...)
 }
 
-func (b *BTCMarkets) GetOrderbook(symbol string) (BTCMarketsOrderbook, error) {
-	orderbook := BTCMarketsOrderbook{}
-	path := fmt.Sprintf("/market/%s/AUD/orderbook", symbol)
-	err := SendHTTPGetRequest(BTCMARKETS_API_URL+path, true, &orderbook)
-	if err != nil {
-		return BTCMarketsOrderbook{}, err
+func (b *BTCMarkets) IsPairEnabled(pair string) bool {
+	b.pairsMtx.RLock()
+	defer b.pairsMtx.RUnlock()
+	key := b.PairKey(pair)
+	for _, x := range b.EnabledPairs {
+		if b.PairKey(x) == key {
+			return true
+		}
 	}
-	return orderbook, nil
+	return false
 }
 
-func (b *BTCMarkets) GetTrades(symbol, since string) ([]BTCMarketsTrade, error) {
-	trades := []BTCMarketsTrade{}
-	path := ""
-	if len(since) > 0 {
-		path = fmt.Sprintf("/market/%s/AUD/trades?since=%s", symbol, since)
-	} else {
-		path = fmt.Sprintf("/market/%s/AUD/trades", symbol)
-	}
-	err := SendHTTPGetRequest(BTCMARKETS_API_URL+path, true, &trades)
-	if err != nil {
-		return nil, err
+// HasTickerSource reports whether ticker updates for pair are expected, that
+// is whether it is enabled and Run is polling or the websocket is connected.
+func (b *BTCMarkets) HasTickerSource(pair string) bool {
+	if b.IsStopped() || !b.IsPairEnabled(pair) {
+		return false
 	}
-	return trades, nil
+	return b.IsPolling() || b.WebsocketConnected()
 }
 
-func (b *BTCMarkets) Order(currency, instrument string, price, amount int64, orderSide, orderType, clientReq string) (int, error) {
-	type Order struct {
-		Currency        string `json:"currency"`
-		Instrument      string `json:"instrument"`
-		Price           int64  `json:"price"`
-		Volume          int64  `json:"volume"`
-		OrderSide       string `json:"orderSide"`
-		OrderType       string `json:"ordertype"`
-		ClientRequestId string `json:"clientRequestId"`
-	}
-	order := Order{}
-	order.Currency = currency
-	order.Instrument = instrument
-	order.Price = price
-	order.Volume = amount
-	order.OrderSide = orderSide
-	order.OrderType = orderType
-	order.ClientRequestId = clientReq
+// IsPolling reports whether Run is polling tickers.
+func (b *BTCMarkets) IsPolling() bool {
+	b.runMtx.Lock()
+	defer b.runMtx.Unlock()
+	return b.polling
+}
 
-	JSONPayload, err := JSONEncode(order)
-	if err != nil {
-		return 0, err
-	}
+// IsTradingEnabled reports whether orders may be placed or cancelled on the
+// currency/instrument pair. Every pair is tradable while TradingEnabledPairs
+// is empty.
+func (b *BTCMarkets) IsTradingEnabled(currency, instrument string) bool {
+	b.pairsMtx.RLock()
+	defer b.pairsMtx.RUnlock()
 
-	type Response struct {
-		Success         bool   `json:"success"`
-		ErrorCode       int    `json:"errorCode"`
-		ErrorMessage    string `json:"errorMessage"`
-		ID              int    `json:"id"`
-		ClientRequestID string `json:"clientRequestId"`
+	if len(b.TradingEnabledPairs) == 0 {
+		return true
 	}
-	var resp Response
 
-	err = b.SendAuthenticatedRequest("POST", BTCMARKETS_ORDER_CREATE, JSONPayload, &resp)
+	for _, x := range b.TradingEnabledPairs {
+		pair, err := b.ParsePair(NormalizeCurrency(x))
+		if err == nil && pair.Base == instrument && pair.Quote == currency {
+			return true
+		}
+	}
+	return false
+}
 
+// ParsePair parses pair with ParseCurrencyPair using PairDelimiter. Pairs
+// given as a bare base currency, as EnabledPairs has historically held them,
+// are quoted in AUD.
+func (b *BTCMarkets) ParsePair(pair string) (CurrencyPair, error) {
+	parsed, err := ParseCurrencyPair(pair, b.PairDelimiter)
 	if err != nil {
-		return 0, err
+		return CurrencyPair{}, err
 	}
-
-	if !resp.Success {
-		return 0, fmt.Errorf("%s Unable to place order. Error message: %s\n", b.GetName(), resp.ErrorMessage)
+	if parsed.Quote == "" {
+		parsed.Quote = "AUD"
 	}
-	return resp.ID, nil
+	return parsed, nil
 }
 
-func (b *BTCMarkets) CancelOrder(orderID []int64) (bool, error) {
-	type CancelOrder struct {
-		OrderIDs []int64 `json:"orderIds"`
+// FormatPair joins pair with PairDelimiter, or "-" if it is unset.
+func (b *BTCMarkets) FormatPair(pair CurrencyPair) string {
+	if b.PairDelimiter == "" {
+		return pair.Format("-")
 	}
-	orders := CancelOrder{}
-	orders.OrderIDs = append(orders.OrderIDs, orderID...)
+	return pair.Format(b.PairDelimiter)
+}
 
-	JSONPayload, err := JSONEncode(orders)
+// PairKey returns pair parsed by ParsePair and formatted by FormatPair, so
+// "btc", "BTC-AUD" and "btc/aud" share the key "BTC-AUD". It is the key used
+// for the ticker and orderbook caches and ticker subscriptions. Pairs which
+// can't be parsed are returned unchanged.
+func (b *BTCMarkets) PairKey(pair string) string {
+	parsed, err := b.ParsePair(NormalizeCurrency(pair))
 	if err != nil {
-		return false, err
+		return pair
 	}
+	return b.FormatPair(parsed)
+}
 
-	type Response struct {
-		Success      bool   `json:"success"`
-		ErrorCode    int    `json:"errorCode"`
-		ErrorMessage string `json:"errorMessage"`
-		Responses    []struct {
-			Success      bool   `json:"success"`
-			ErrorCode    int    `json:"errorCode"`
-			ErrorMessage string `json:"errorMessage"`
-			ID           int64  `json:"id"`
+// GetEnabledCurrencyPairs returns EnabledPairs parsed by ParsePair, skipping
+// and logging any that can't be parsed.
+func (b *BTCMarkets) GetEnabledCurrencyPairs() []CurrencyPair {
+	pairs := []CurrencyPair{}
+	for _, x := range b.GetEnabledPairs() {
+		pair, err := b.ParsePair(x)
+		if err != nil {
+			log.Printf("%s invalid enabled pair %s. Error: %s\n", b.GetName(), x, err)
+			continue
 		}
-		ClientRequestID string `json:"clientRequestId"`
+		pairs = append(pairs, pair)
 	}
-	var resp Response
-
-	err = b.SendAuthenticatedRequest("POST", BTCMARKETS_ORDER_CANCEL, JSONPayload, &resp)
+	return pairs
+}
 
+// ValidatePair checks both currencies of pair with ValidateCurrency.
+func (b *BTCMarkets) ValidatePair(pair CurrencyPair) error {
+	err := b.ValidateCurrency(pair.Base)
 	if err != nil {
-		return false, err
+		return err
 	}
+	return b.ValidateCurrency(pair.Quote)
+}
 
-	if !resp.Success {
-		return false, fmt.Errorf("%s Unable to cancel order. Error message: %s\n", b.GetName(), resp.ErrorMessage)
+// ValidateCurrency checks a normalized currency code against AUD and the
+// available, enabled and base currencies, including either side of any pairs
+// they hold. Any code is accepted until at least one of those lists has been
+// populated.
+func (b *BTCMarkets) ValidateCurrency(code string) error {
+	b.pairsMtx.RLock()
+	defer b.pairsMtx.RUnlock()
+
+	if code == "AUD" {
+		return nil
 	}
 
-	ordersToBeCancelled := len(orderID)
-	ordersCancelled := 0
-	for _, y := range resp.Responses {
-		if y.Success {
-			ordersCancelled++
-			log.Printf("%s Cancelled order %d.\n", b.GetName(), y.ID)
-		} else {
-			log.Printf("%s Unable to cancel order %d. Error message: %s\n", b.GetName(), y.ID, y.ErrorMessage)
+	known := false
+	for _, list := range [][]string{b.AvailablePairs, b.EnabledPairs, b.BaseCurrencies} {
+		for _, x := range list {
+			known = true
+			if x == code {
+				return nil
+			}
+			pair, err := ParseCurrencyPair(x, b.PairDelimiter)
+			if err == nil && (pair.Base == code || pair.Quote == code) {
+				return nil
+			}
 		}
 	}
 
-	if ordersCancelled == ordersToBeCancelled {
-		return true, nil
-	} else {
-		return false, fmt.Errorf("%s Unable to cancel order(s).", b.GetName())
+	if !known {
+		return nil
 	}
+	return ErrBTCMarketsUnknownCurrency
 }
 
-func (b *BTCMarkets) GetOrders(currency, instrument string, limit, since int64, historic bool) {
+func (b *BTCMarkets) EnablePair(pair string) error {
+	b.pairsMtx.Lock()
+	defer b.pairsMtx.Unlock()
+
+	key := b.PairKey(pair)
+	available := false
+	for _, x := range b.AvailablePairs {
+		if b.PairKey(x) == key {
+			available = true
+			break
+		}
+	}
+
+	if !available {
+		return fmt.Errorf("%s pair %s is not available.", b.GetName(), pair)
+	}
+
+	for _, x := range b.EnabledPairs {
+		if b.PairKey(x) == key {
+			return nil
+		}
+	}
+
+	pairs := append([]string{}, b.EnabledPairs...)
+	b.EnabledPairs = append(pairs, pair)
+	return nil
+}
+
+func (b *BTCMarkets) DisablePair(pair string) {
+	b.pairsMtx.Lock()
+	defer b.pairsMtx.Unlock()
+
+	key := b.PairKey(pair)
+	pairs := []string{}
+	for _, x := range b.EnabledPairs {
+		if b.PairKey(x) != key {
+			pairs = append(pairs, x)
+		}
+	}
+	b.EnabledPairs = pairs
+}
+
+// GetMarkets returns the markets listed by the active markets endpoint,
+// including any that are offline.
+func (b *BTCMarkets) GetMarkets() ([]BTCMarketsMarket, error) {
+	type Response struct {
+		Success      bool               `json:"success"`
+		ErrorCode    int                `json:"errorCode"`
+		ErrorMessage string             `json:"errorMessage"`
+		Markets      []BTCMarketsMarket `json:"markets"`
+	}
+	var resp Response
+
+	err := b.SendPublicRequest(BTCMARKETS_MARKETS_ACTIVE, BTCMARKETS_MARKETS_ACTIVE, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if !resp.Success {
+		return nil, fmt.Errorf("%s Unable to get active markets. Error message: %s", b.GetName(), resp.ErrorMessage)
+	}
+
+	b.marketsMtx.Lock()
+	b.markets = resp.Markets
+	b.marketsFetched = time.Now()
+	b.marketsMtx.Unlock()
+	return resp.Markets, nil
+}
+
+// GetMarketsCached returns the markets from the last GetMarkets call if it
+// was made within MarketsCacheTTL, otherwise it calls GetMarkets.
+func (b *BTCMarkets) GetMarketsCached() ([]BTCMarketsMarket, error) {
+	b.marketsMtx.Lock()
+	markets := b.markets
+	fresh := markets != nil && time.Since(b.marketsFetched) < b.MarketsCacheTTL
+	b.marketsMtx.Unlock()
+
+	if fresh {
+		return markets, nil
+	}
+	return b.GetMarkets()
+}
+
+// GetInstrumentStatus returns the trading status of instrument, a pair as
+// accepted by ParsePair, as one of the BTCMARKETS_INSTRUMENT_STATUS_*
+// values. Cancel only, offline and unrecognised market statuses are all
+// reported as halted; a blank status is online.
+func (b *BTCMarkets) GetInstrumentStatus(instrument string) (string, error) {
+	pair, err := b.ParsePair(NormalizeCurrency(instrument))
+	if err != nil {
+		return "", err
+	}
+
+	markets, err := b.GetMarketsCached()
+	if err != nil {
+		return "", err
+	}
+
+	for _, x := range markets {
+		if x.Instrument == pair.Base && x.Currency == pair.Quote {
+			return GetBTCMarketsInstrumentStatus(x.Status), nil
+		}
+	}
+	return "", fmt.Errorf("%s market %s not found.", b.GetName(), pair)
+}
+
+// GetBTCMarketsInstrumentStatus maps a market status from the active markets
+// endpoint to a BTCMARKETS_INSTRUMENT_STATUS_* value.
+func GetBTCMarketsInstrumentStatus(status string) string {
+	switch status {
+	case "", BTCMARKETS_MARKET_STATUS_ONLINE:
+		return BTCMARKETS_INSTRUMENT_STATUS_ONLINE
+	case BTCMARKETS_MARKET_STATUS_POST_ONLY:
+		return BTCMARKETS_INSTRUMENT_STATUS_POST_ONLY
+	case BTCMARKETS_MARKET_STATUS_LIMIT_ONLY:
+		return BTCMARKETS_INSTRUMENT_STATUS_LIMIT
+	}
+	return BTCMARKETS_INSTRUMENT_STATUS_HALTED
+}
+
+// RefreshAvailablePairs updates AvailablePairs, EnabledPairs and the
+// instrument rules from GetMarkets. Offline AUD markets are not available.
+func (b *BTCMarkets) RefreshAvailablePairs() error {
+	markets, err := b.GetMarkets()
+	if err != nil {
+		return err
+	}
+
+	available := []string{}
+	for _, x := range markets {
+		if x.Currency != "AUD" {
+			continue
+		}
+
+		if x.MinOrderAmount > 0 {
+			rules, err := b.GetInstrumentRules(x.Instrument)
+			if err != nil {
+				rules = BTCMarketsInstrumentRules{Instrument: x.Instrument, Currency: x.Currency}
+			}
+			rules.MinVolume = x.MinOrderAmount
+			rules.MaxVolume = x.MaxOrderAmount
+			if x.PriceDecimals > 0 {
+				rules.PriceIncrement = math.Pow10(-x.PriceDecimals)
+				rules.PriceDecimals = x.PriceDecimals
+			}
+			if x.AmountDecimals > 0 {
+				rules.VolumeDecimals = x.AmountDecimals
+			}
+			b.SetInstrumentRules(rules)
+		}
+
+		if x.Status != BTCMARKETS_MARKET_STATUS_OFFLINE {
+			available = append(available, x.Instrument)
+		}
+	}
+
+	b.pairsMtx.Lock()
+	defer b.pairsMtx.Unlock()
+
+	enabled := []string{}
+	for _, x := range b.EnabledPairs {
+		listed := false
+		for _, y := range available {
+			if b.PairKey(x) == b.PairKey(y) {
+				listed = true
+				break
+			}
+		}
+
+		if !listed {
+			log.Printf("%s pair %s is no longer listed, disabling.\n", b.GetName(), x)
+			continue
+		}
+		enabled = append(enabled, x)
+	}
+
+	b.AvailablePairs = available
+	b.EnabledPairs = enabled
+	return nil
+}
+
+func (b *BTCMarkets) GetFee() float64 {
+	b.feeMtx.RLock()
+	defer b.feeMtx.RUnlock()
+	return b.Fee
+}
+
+func (b *BTCMarkets) SetFee(fee float64) {
+	b.feeMtx.Lock()
+	defer b.feeMtx.Unlock()
+	b.Fee = fee
+}
+
+// GetTradingFee returns the fee for instrument from FeeTable, falling back to
+// Fee when the instrument has no entry.
+func (b *BTCMarkets) GetTradingFee(instrument string) float64 {
+	b.feeMtx.RLock()
+	defer b.feeMtx.RUnlock()
+
+	fee, ok := b.FeeTable[instrument]
+	if !ok {
+		return b.Fee
+	}
+	return fee
+}
+
+func (b *BTCMarkets) SetTradingFee(instrument string, fee float64) {
+	b.feeMtx.Lock()
+	defer b.feeMtx.Unlock()
+
+	if b.FeeTable == nil {
+		b.FeeTable = make(map[string]float64)
+	}
+	b.FeeTable[instrument] = fee
+}
+
+// SetResponseCacheTTL sets how long public GET responses for endpoint, one of
+// the BTCMARKETS_* path constants, are reused. A TTL of 0 disables caching.
+func (b *BTCMarkets) SetResponseCacheTTL(endpoint string, ttl time.Duration) {
+	b.respCacheMtx.Lock()
+	defer b.respCacheMtx.Unlock()
+
+	if b.ResponseCacheTTL == nil {
+		b.ResponseCacheTTL = make(map[string]time.Duration)
+	}
+	b.ResponseCacheTTL[endpoint] = ttl
+}
+
+// ClearResponseCache discards all cached public GET responses.
+func (b *BTCMarkets) ClearResponseCache() {
+	b.respCacheMtx.Lock()
+	b.respCache = nil
+	b.respCacheMtx.Unlock()
+}
+
+func (b *BTCMarkets) getCachedResponse(endpoint, url string) ([]byte, time.Duration, bool) {
+	b.respCacheMtx.Lock()
+	defer b.respCacheMtx.Unlock()
+
+	ttl := b.ResponseCacheTTL[endpoint]
+	if ttl <= 0 {
+		return nil, 0, false
+	}
+
+	cached, ok := b.respCache[url]
+	if !ok || time.Since(cached.Fetched) >= ttl {
+		return nil, ttl, false
+	}
+	return cached.Body, ttl, true
+}
+
+func (b *BTCMarkets) setCachedResponse(url string, body []byte) {
+	b.respCacheMtx.Lock()
+	defer b.respCacheMtx.Unlock()
+
+	if b.respCache == nil {
+		b.respCache = make(map[string]BTCMarketsCachedResponse)
+	}
+	b.respCache[url] = BTCMarketsCachedResponse{Body: body, Fetched: time.Now()}
+}
+
+// Run polls the enabled pairs until Stop is called. A warning is logged if
+// no pairs are enabled, and Run returns straight away in that case when
+// RequireEnabledPairs is set.
+func (b *BTCMarkets) Run() {
+	if b.Verbose {
+		log.Printf("%s Websocket: %s.", b.GetName(), IsEnabled(b.Websocket))
+		log.Printf("%s polling delay: %s.\n", b.GetName(), b.RESTPollingDelay)
+		pairs := b.GetEnabledPairs()
+		log.Printf("%s %d currencies enabled: %s.\n", b.GetName(), len(pairs), pairs)
+	}
+
+	if len(b.GetEnabledPairs()) == 0 {
+		log.Printf("%s WARNING -- no currency pairs are enabled, check the exchange config.\n", b.GetName())
+		if b.RequireEnabledPairs {
+			return
+		}
+	}
+
+	if b.Websocket {
+		go b.WebsocketClient()
+	}
+
+	if b.TickerCachePath != "" {
+		err := b.LoadTickers(b.TickerCachePath)
+		if err != nil {
+			log.Printf("%s unable to load cached tickers. Error: %s\n", b.GetName(), err)
+		}
+	}
+
+	if b.Enabled {
+		b.runMtx.Lock()
+		if b.stopped {
+			b.runMtx.Unlock()
+			return
+		}
+		b.polling = true
+		b.runWg.Add(1)
+		b.runMtx.Unlock()
+
+		defer func() {
+			b.runMtx.Lock()
+			b.polling = false
+			b.runMtx.Unlock()
+		}()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-b.shutdown:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		err := b.Warmup(ctx)
+		cancel()
+		b.runWg.Done()
+		if err != nil {
+			log.Printf("%s warmup incomplete. Error: %s\n", b.GetName(), err)
+		}
+
+		select {
+		case <-b.shutdown:
+			return
+		case <-time.After(b.GetPollingDelay()):
+		}
+	}
+
+	lastPairsRefresh := time.Now()
+	for b.Enabled {
+		if b.PairsRefreshInterval > 0 && time.Since(lastPairsRefresh) >= b.PairsRefreshInterval {
+			err := b.RefreshAvailablePairs()
+			if err != nil {
+				log.Println(err)
+			}
+			lastPairsRefresh = time.Now()
+		}
+
+		b.runMtx.Lock()
+		if b.stopped {
+			b.runMtx.Unlock()
+			return
+		}
+		b.runWg.Add(1)
+		b.runMtx.Unlock()
+
+		pairs := b.GetEnabledPairs()
+		go func() {
+			defer b.runWg.Done()
+			tickers, err := b.GetTickers(pairs)
+			if err != nil {
+				b.SetLastError(err)
+			}
+			if err == ErrExchangeUnavailable {
+				b.runMtx.Lock()
+				b.unavailable.Min = b.RESTPollingDelay
+				b.unavailable.Max = b.RESTPollingDelay * BTCMARKETS_MAX_UNAVAILABLE_BACKOFF
+				b.backoffDelay = b.unavailable.Next()
+				if b.unavailable.Attempts() == 1 {
+					log.Printf("%s exchange unavailable, backing off.\n", b.GetName())
+				}
+				b.runMtx.Unlock()
+				return
+			}
+			b.runMtx.Lock()
+			b.unavailable.Reset()
+			b.backoffDelay = 0
+			b.runMtx.Unlock()
+			if err != nil {
+				log.Println(err)
+			}
+			entries := []ExchangeInfo{}
+			for _, x := range pairs {
+				ticker, ok := tickers[x]
+				if !ok {
+					continue
+				}
+				b.RecordPoll(b.PairKey(x))
+				entries = append(entries, b.UpdateTicker(x, ticker)...)
+			}
+			AddExchangeInfoBatch(entries)
+			if b.TickerCachePath != "" {
+				err = b.SaveTickers(b.TickerCachePath)
+				if err != nil {
+					log.Printf("%s unable to save cached tickers. Error: %s\n", b.GetName(), err)
+				}
+			}
+		}()
+
+		select {
+		case <-b.shutdown:
+			return
+		case <-time.After(b.GetPollingDelay()):
+		}
+	}
+}
+
+// Warmup fetches the ticker, and the orderbook if WarmupOrderbooks is set, of
+// every enabled pair once so the caches are populated before Run's first
+// polling interval has passed. It stops early if ctx is cancelled.
+func (b *BTCMarkets) Warmup(ctx context.Context) error {
+	pairs := b.GetEnabledPairs()
+	errs := []string{}
+	entries := []ExchangeInfo{}
+	mtx := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	limit := b.MaxConcurrentRequests
+	if limit <= 0 {
+		limit = BTCMARKETS_DEFAULT_MAX_CONCURRENT_REQUESTS
+	}
+	sem := make(chan struct{}, limit)
+
+	for _, x := range pairs {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return ctx.Err()
+		}
+
+		wg.Add(1)
+		go func(pair string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			ticker, err := b.GetTickerContext(ctx, pair)
+			if err == nil && b.WarmupOrderbooks {
+				_, err = b.GetOrderbookContext(ctx, pair)
+			}
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s", pair, err))
+				return
+			}
+			b.RecordPoll(b.PairKey(pair))
+			entries = append(entries, b.UpdateTicker(pair, ticker)...)
+		}(x)
+	}
+	wg.Wait()
+	AddExchangeInfoBatch(entries)
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if len(errs) > 0 {
+		return errors.New(JoinStrings(errs, ", "))
+	}
+	return nil
+}
+
+// GetPollingDelay returns the delay before the next ticker poll, doubling it
+// (up to BTCMARKETS_MAX_UNAVAILABLE_BACKOFF times) for each consecutive poll
+// that found the exchange unavailable. The delay is then randomly adjusted by
+// up to PollingJitter percent either way so pollers don't fire in lockstep.
+func (b *BTCMarkets) GetPollingDelay() time.Duration {
+	b.runMtx.Lock()
+	defer b.runMtx.Unlock()
+
+	delay := b.RESTPollingDelay
+	if b.backoffDelay > delay {
+		delay = b.backoffDelay
+	}
+
+	if b.PollingJitter > 0 {
+		jitter := float64(delay) * b.PollingJitter / 100 * (2*rand.Float64() - 1)
+		delay += time.Duration(jitter)
+	}
+	return delay
+}
+
+// BTCMarketsStatus is a point-in-time summary of the exchange's state.
+// LastPoll holds the time of the last successful ticker update per pair.
+type BTCMarketsStatus struct {
+	Enabled            bool
+	WebsocketConnected bool
+	Circuit            CircuitState
+	LastPoll           map[string]time.Time
+	LastError          string
+	LastErrorTime      time.Time
+	Tickers            int
+	Orderbooks         int
+}
+
+func (b *BTCMarkets) Status() BTCMarketsStatus {
+	status := BTCMarketsStatus{
+		Enabled:            b.IsEnabled(),
+		WebsocketConnected: b.WebsocketConnected(),
+		Circuit:            b.Breaker.State(),
+		LastPoll:           make(map[string]time.Time),
+	}
+
+	b.statusMtx.Lock()
+	for x, y := range b.lastPoll {
+		status.LastPoll[x] = y
+	}
+	if b.lastError != nil {
+		status.LastError = b.lastError.Error()
+		status.LastErrorTime = b.lastErrorTime
+	}
+	b.statusMtx.Unlock()
+
+	b.tickerMtx.Lock()
+	status.Tickers = len(b.Ticker)
+	b.tickerMtx.Unlock()
+
+	b.orderbookMtx.Lock()
+	status.Orderbooks = len(b.Orderbook)
+	b.orderbookMtx.Unlock()
+	return status
+}
+
+// RecordPoll records a successful ticker update for pair.
+func (b *BTCMarkets) RecordPoll(pair string) {
+	b.statusMtx.Lock()
+	defer b.statusMtx.Unlock()
+
+	if b.lastPoll == nil {
+		b.lastPoll = make(map[string]time.Time)
+	}
+	b.lastPoll[pair] = time.Now()
+}
+
+func (b *BTCMarkets) SetLastError(err error) {
+	b.statusMtx.Lock()
+	defer b.statusMtx.Unlock()
+	b.lastError = err
+	b.lastErrorTime = time.Now()
+}
+
+func (b *BTCMarkets) Stop() {
+	b.runMtx.Lock()
+	defer b.runMtx.Unlock()
+	if !b.stopped {
+		b.stopped = true
+		if b.shutdown != nil {
+			close(b.shutdown)
+		}
+		if b.wsConn != nil {
+			b.wsConn.Close()
+		}
+		err := b.Nonce.Flush()
+		if err != nil {
+			log.Printf("%s unable to persist nonce. Error: %s\n", b.GetName(), err)
+		}
+	}
+}
+
+func (b *BTCMarkets) IsStopped() bool {
+	b.runMtx.Lock()
+	defer b.runMtx.Unlock()
+	return b.stopped
+}
+
+func (b *BTCMarkets) Shutdown(ctx context.Context) error {
+	b.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		b.runWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops Run, releases idle HTTP connections and clears cached data.
+// The instance must not be used after Close. Calling Close more than once is
+// safe.
+func (b *BTCMarkets) Close() error {
+	b.Stop()
+
+	if b.HTTPClient != nil {
+		b.HTTPClient.CloseIdleConnections()
+	}
+
+	b.tickerMtx.Lock()
+	b.Ticker = make(map[string]BTCMarketsTicker)
+	b.TickerLastFetch = make(map[string]time.Time)
+	b.tickerMtx.Unlock()
+
+	b.orderbookMtx.Lock()
+	b.Orderbook = make(map[string]BTCMarketsOrderbook)
+	b.OrderbookLastFetch = make(map[string]time.Time)
+	b.wsSnapshotIDs = nil
+	b.orderbookMtx.Unlock()
+
+	b.fxMtx.Lock()
+	b.fxRates = nil
+	b.fxFailures = nil
+	b.fxMtx.Unlock()
+
+	b.marketsMtx.Lock()
+	b.markets = nil
+	b.marketsMtx.Unlock()
+
+	b.trailingMtx.Lock()
+	for _, x := range b.trailingDone {
+		close(x)
+	}
+	b.trailingStops = nil
+	b.trailingDone = nil
+	b.trailingMtx.Unlock()
+
+	b.ClearResponseCache()
+	return nil
+}
+
+func (b *BTCMarkets) ProcessTicker(currency string, ticker BTCMarketsTicker) {
+	AddExchangeInfoBatch(b.UpdateTicker(currency, ticker))
+}
+
+// UpdateTicker does everything ProcessTicker does except add to the exchange
+// info store, returning the entries instead so a polling cycle can add them
+// all at once. The ticker is cached and published under the pair's PairKey.
+func (b *BTCMarkets) UpdateTicker(currency string, ticker BTCMarketsTicker) []ExchangeInfo {
+	pair, err := b.ParsePair(NormalizeCurrency(currency))
+	if err != nil {
+		log.Printf("%s unable to parse pair %s. Error: %s\n", b.GetName(), currency, err)
+		return nil
+	}
+	currency = b.FormatPair(pair)
+
+	b.tickerMtx.Lock()
+	b.Ticker[currency] = ticker
+	b.TickerLastFetch[currency] = time.Now()
+	b.tickerMtx.Unlock()
+	if b.OnTickerUpdate != nil {
+		b.OnTickerUpdate(currency, ticker)
+	}
+	b.PublishTicker(currency, ticker)
+	entries := []ExchangeInfo{{Exchange: b.GetName(), CryptoCurrency: pair.Base, FiatCurrency: pair.Quote, Price: ticker.LastPrice}}
+
+	reporting := b.ReportingCurrency
+	if reporting == "" {
+		reporting = BTCMARKETS_DEFAULT_REPORTING_CURRENCY
+	}
+
+	rate, err := b.GetFXRate("AUD", reporting)
+	if err != nil {
+		if b.RecordFXFailure(currency, true) {
+			log.Printf("%s unable to convert %s prices to %s: %s\n", b.GetName(), currency, reporting, err)
+		}
+		log.Printf("BTC Markets %s: Last %f Bid %f Ask %f\n", currency, ticker.LastPrice, ticker.BestBID, ticker.BestAsk)
+		return entries
+	}
+	b.RecordFXFailure(currency, false)
+	BTCMarketsLastConverted := ticker.LastPrice * rate
+	BTCMarketsBestBidConverted := ticker.BestBID * rate
+	BTCMarketsBestAskConverted := ticker.BestAsk * rate
+	log.Printf("BTC Markets %s: Last %f (%f) Bid %f (%f) Ask %f (%f) AUD%s %f\n", currency, BTCMarketsLastConverted, ticker.LastPrice, BTCMarketsBestBidConverted, ticker.BestBID, BTCMarketsBestAskConverted, ticker.BestAsk, reporting, rate)
+	return append(entries, ExchangeInfo{Exchange: b.GetName(), CryptoCurrency: pair.Base, FiatCurrency: reporting, Price: BTCMarketsLastConverted})
+}
+
+// SubscribeTicker returns a channel receiving every ticker update for pair,
+// whether from Run or the websocket, and a function to unsubscribe. Updates
+// are dropped rather than blocking if the subscriber falls behind.
+func (b *BTCMarkets) SubscribeTicker(pair string) (<-chan BTCMarketsTicker, func()) {
+	pair = b.PairKey(pair)
+	ch := make(chan BTCMarketsTicker, BTCMARKETS_TICKER_SUBSCRIBER_BUFFER)
+
+	b.tickerSubsMtx.Lock()
+	if b.tickerSubs == nil {
+		b.tickerSubs = make(map[string]map[int]chan BTCMarketsTicker)
+	}
+	if b.tickerSubs[pair] == nil {
+		b.tickerSubs[pair] = make(map[int]chan BTCMarketsTicker)
+	}
+	b.tickerSubID++
+	id := b.tickerSubID
+	b.tickerSubs[pair][id] = ch
+	b.tickerSubsMtx.Unlock()
+
+	once := sync.Once{}
+	unsubscribe := func() {
+		once.Do(func() {
+			b.tickerSubsMtx.Lock()
+			defer b.tickerSubsMtx.Unlock()
+			delete(b.tickerSubs[pair], id)
+			if len(b.tickerSubs[pair]) == 0 {
+				delete(b.tickerSubs, pair)
+			}
+			close(ch)
+		})
+	}
+	return ch, unsubscribe
+}
+
+// AllTickers returns a single channel receiving ticker updates for every
+// pair, each tagged with its Instrument and Currency. Like SubscribeTicker,
+// updates are dropped rather than blocking if the reader falls behind.
+func (b *BTCMarkets) AllTickers() <-chan BTCMarketsTicker {
+	b.tickerSubsMtx.Lock()
+	defer b.tickerSubsMtx.Unlock()
+
+	if b.allTickers == nil {
+		b.allTickers = make(chan BTCMarketsTicker, BTCMARKETS_TICKER_SUBSCRIBER_BUFFER*len(b.GetEnabledPairs())+BTCMARKETS_TICKER_SUBSCRIBER_BUFFER)
+	}
+	return b.allTickers
+}
+
+func (b *BTCMarkets) PublishTicker(pair string, ticker BTCMarketsTicker) {
+	pair = b.PairKey(pair)
+	b.tickerSubsMtx.Lock()
+	defer b.tickerSubsMtx.Unlock()
+
+	for _, x := range b.tickerSubs[pair] {
+		select {
+		case x <- ticker:
+		default:
+		}
+	}
+
+	if b.allTickers == nil {
+		return
+	}
+	parsed, err := b.ParsePair(pair)
+	if err == nil && ticker.Instrument == "" {
+		ticker.Instrument = parsed.Base
+	}
+	if err == nil && ticker.Currency == "" {
+		ticker.Currency = parsed.Quote
+	}
+	select {
+	case b.allTickers <- ticker:
+	default:
+	}
+}
+
+func (b *BTCMarkets) SetFXCacheTTL(ttl time.Duration) {
+	b.fxMtx.Lock()
+	b.FXCacheTTL = ttl
+	b.fxMtx.Unlock()
+}
+
+// RecordFXFailure records whether converting pair's prices failed and
+// reports whether this is a new failure, so UpdateTicker logs it once rather
+// than on every poll until a conversion succeeds again.
+func (b *BTCMarkets) RecordFXFailure(pair string, failed bool) bool {
+	b.fxMtx.Lock()
+	defer b.fxMtx.Unlock()
+
+	if !failed {
+		delete(b.fxFailures, pair)
+		return false
+	}
+
+	if b.fxFailures == nil {
+		b.fxFailures = make(map[string]bool)
+	}
+	if b.fxFailures[pair] {
+		return false
+	}
+	b.fxFailures[pair] = true
+	return true
+}
+
+// GetFXRate returns the from/to conversion rate, reusing a cached rate until
+// it is older than FXCacheTTL. Rates are fetched from Converter, or
+// DefaultCurrencyConverter if it is nil. The last, bid and ask prices are all
+// converted with this rate, so a zero, negative or non-finite rate is
+// returned as an error rather than cached.
+func (b *BTCMarkets) GetFXRate(from, to string) (float64, error) {
+	b.fxMtx.Lock()
+	defer b.fxMtx.Unlock()
+
+	if b.fxRates == nil {
+		b.fxRates = make(map[string]BTCMarketsFXRate)
+	}
+
+	pair := from + to
+	cached, ok := b.fxRates[pair]
+	if ok && time.Since(cached.Fetched) < b.FXCacheTTL {
+		return cached.Rate, nil
+	}
+
+	converter := b.Converter
+	if converter == nil {
+		converter = DefaultCurrencyConverter
+	}
+
+	rate, err := converter.Convert(1, from, to)
+	if err != nil {
+		return 0, err
+	}
+	if rate <= 0 || math.IsNaN(rate) || math.IsInf(rate, 0) {
+		return 0, fmt.Errorf("%s invalid %s/%s rate %f.", b.GetName(), from, to, rate)
+	}
+
+	b.fxRates[pair] = BTCMarketsFXRate{Rate: rate, Fetched: time.Now()}
+	return rate, nil
+}
+
+// LastFXRate returns the most recent from/to rate used for conversions and
+// when it was fetched.
+func (b *BTCMarkets) LastFXRate(from, to string) (rate float64, at time.Time, ok bool) {
+	b.fxMtx.Lock()
+	defer b.fxMtx.Unlock()
+
+	cached, ok := b.fxRates[from+to]
+	return cached.Rate, cached.Fetched, ok
+}
+
+func (b *BTCMarkets) GetTicker(symbol string) (BTCMarketsTicker, error) {
+	return b.GetTickerContext(context.Background(), symbol)
+}
+
+func (b *BTCMarkets) GetTickerContext(ctx context.Context, symbol string) (BTCMarketsTicker, error) {
+	if b.PaperTrading {
+		err := b.Paper.Chaos.Apply(ctx)
+		if err != nil {
+			return BTCMarketsTicker{}, err
+		}
+	}
+
+	pair, err := b.ParsePair(NormalizeCurrency(symbol))
+	if err != nil {
+		return BTCMarketsTicker{}, err
+	}
+	err = b.ValidatePair(pair)
+	if err != nil {
+		return BTCMarketsTicker{}, err
+	}
+
+	ticker := BTCMarketsTicker{}
+	path := fmt.Sprintf(BTCMARKETS_MARKET_TICK, pair.Base, pair.Quote)
+	err = b.SendPublicRequestContext(ctx, BTCMARKETS_MARKET_TICK, path, &ticker)
+	if err != nil {
+		return BTCMarketsTicker{}, err
+	}
+
+	err = b.ValidateTicker(ticker)
+	if err != nil {
+		return BTCMarketsTicker{}, fmt.Errorf("%s invalid ticker for %s. Error: %s", b.GetName(), symbol, err)
+	}
+	return ticker, nil
+}
+
+// GetQuote returns the best bid, best ask and last price for pair along with
+// the ticker's timestamp. A cached ticker younger than TickerCacheTTL is used
+// when available, otherwise a fresh ticker is fetched and cached.
+func (b *BTCMarkets) GetQuote(pair string) (bid, ask, last float64, ts time.Time, err error) {
+	pair = b.PairKey(pair)
+	b.tickerMtx.Lock()
+	ticker, ok := b.Ticker[pair]
+	fetched := b.TickerLastFetch[pair]
+	b.tickerMtx.Unlock()
+
+	if !ok || time.Since(fetched) >= b.TickerCacheTTL {
+		ticker, err = b.GetTicker(pair)
+		if err != nil {
+			return 0, 0, 0, time.Time{}, err
+		}
+		fetched = time.Now()
+
+		b.tickerMtx.Lock()
+		if b.Ticker == nil {
+			b.Ticker = make(map[string]BTCMarketsTicker)
+			b.TickerLastFetch = make(map[string]time.Time)
+		}
+		b.Ticker[pair] = ticker
+		b.TickerLastFetch[pair] = fetched
+		b.tickerMtx.Unlock()
+	}
+
+	ts = fetched
+	if ticker.Timestamp > 0 {
+		ts = ticker.Time()
+	}
+	return ticker.BestBID, ticker.BestAsk, ticker.LastPrice, ts, nil
+}
+
+// BTCMarketsTopOfBook is a market snapshot combining the best orderbook level
+// on each side with the ticker's last price and timestamp.
+type BTCMarketsTopOfBook struct {
+	BestBid        float64
+	BestAsk        float64
+	BidSize        float64
+	AskSize        float64
+	LastTradePrice float64
+	Timestamp      time.Time
+}
+
+func (b *BTCMarkets) GetTopOfBook(pair string) (BTCMarketsTopOfBook, error) {
+	return b.GetTopOfBookContext(context.Background(), pair)
+}
+
+// GetTopOfBookContext fetches a fresh ticker and orderbook for pair in
+// parallel and combines them. Prices and sizes come from the top orderbook
+// level; an empty side leaves them zero.
+func (b *BTCMarkets) GetTopOfBookContext(ctx context.Context, pair string) (BTCMarketsTopOfBook, error) {
+	var ticker BTCMarketsTicker
+	var orderbook BTCMarketsOrderbook
+	var tickerErr, orderbookErr error
+	var wg sync.WaitGroup
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		ticker, tickerErr = b.GetTickerContext(ctx, pair)
+	}()
+	go func() {
+		defer wg.Done()
+		orderbook, orderbookErr = b.GetOrderbookContext(ctx, pair)
+	}()
+	wg.Wait()
+
+	if tickerErr != nil {
+		return BTCMarketsTopOfBook{}, tickerErr
+	}
+	if orderbookErr != nil {
+		return BTCMarketsTopOfBook{}, orderbookErr
+	}
+
+	top := BTCMarketsTopOfBook{LastTradePrice: ticker.LastPrice, Timestamp: ticker.Time()}
+	top.BestBid, top.BidSize, _ = orderbook.BestBid()
+	top.BestAsk, top.AskSize, _ = orderbook.BestAsk()
+	if top.Timestamp.IsZero() {
+		top.Timestamp = time.Now().UTC()
+	}
+	return top, nil
+}
+
+func (b *BTCMarkets) ValidateTicker(ticker BTCMarketsTicker) error {
+	if ticker.Instrument == "" {
+		return errors.New("instrument is empty")
+	}
+	if ticker.BestBID == 0 && ticker.BestAsk == 0 && ticker.LastPrice == 0 {
+		return errors.New("all prices are zero")
+	}
+	return nil
+}
+
+func (b *BTCMarkets) SaveTickers(path string) error {
+	entries := make(map[string]BTCMarketsTickerCacheEntry)
+	b.tickerMtx.Lock()
+	for x, y := range b.Ticker {
+		entries[x] = BTCMarketsTickerCacheEntry{Ticker: y, LastFetch: b.TickerLastFetch[x]}
+	}
+	b.tickerMtx.Unlock()
+
+	payload, err := JSONEncode(entries)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, payload, 0644)
+}
+
+func (b *BTCMarkets) LoadTickers(path string) error {
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	entries := make(map[string]BTCMarketsTickerCacheEntry)
+	err = JSONDecode(file, &entries)
+	if err != nil {
+		return err
+	}
+
+	b.tickerMtx.Lock()
+	defer b.tickerMtx.Unlock()
+	for x, y := range entries {
+		b.Ticker[b.PairKey(x)] = y.Ticker
+		b.TickerLastFetch[b.PairKey(x)] = y.LastFetch
+	}
+	return nil
+}
+
+func (b *BTCMarkets) ExportTickers(format string, w io.Writer) error {
+	b.tickerMtx.Lock()
+	tickers := make(map[string]BTCMarketsTicker)
+	pairs := []string{}
+	for x, y := range b.Ticker {
+		tickers[x] = y
+		pairs = append(pairs, x)
+	}
+	b.tickerMtx.Unlock()
+	sort.Strings(pairs)
+
+	switch format {
+	case "json":
+		payload, err := JSONEncode(tickers)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(payload)
+		return err
+	case "csv":
+		writer := csv.NewWriter(w)
+		err := writer.Write([]string{"pair", "bestBid", "bestAsk", "lastPrice", "timestamp"})
+		if err != nil {
+			return err
+		}
+
+		for _, x := range pairs {
+			ticker := tickers[x]
+			err = writer.Write([]string{
+				x,
+				strconv.FormatFloat(ticker.BestBID, 'f', -1, 64),
+				strconv.FormatFloat(ticker.BestAsk, 'f', -1, 64),
+				strconv.FormatFloat(ticker.LastPrice, 'f', -1, 64),
+				strconv.FormatInt(ticker.Timestamp, 10),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+	default:
+		return fmt.Errorf("%s unsupported ticker export format %s.", b.GetName(), format)
+	}
+}
+
+// BTCMarkets has no multi-market tick endpoint, so GetTickers fans out
+// individual tick requests, at most MaxConcurrentRequests at a time. On
+// partial failure the successfully fetched tickers are still returned.
+func (b *BTCMarkets) GetTickers(pairs []string) (map[string]BTCMarketsTicker, error) {
+	tickers := make(map[string]BTCMarketsTicker)
+	errs := []string{}
+	unavailable := 0
+	mtx := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	limit := b.MaxConcurrentRequests
+	if limit <= 0 {
+		limit = BTCMARKETS_DEFAULT_MAX_CONCURRENT_REQUESTS
+	}
+	sem := make(chan struct{}, limit)
+
+	for _, x := range pairs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(pair string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			ticker, err := b.GetTicker(pair)
+			mtx.Lock()
+			defer mtx.Unlock()
+			if err != nil {
+				if err == ErrExchangeUnavailable {
+					unavailable++
+				}
+				errs = append(errs, fmt.Sprintf("%s: %s", pair, err))
+				return
+			}
+			tickers[pair] = ticker
+		}(x)
+	}
+	wg.Wait()
+
+	if unavailable > 0 && unavailable == len(errs) && len(tickers) == 0 {
+		return tickers, ErrExchangeUnavailable
+	}
+
+	if len(errs) > 0 {
+		return tickers, fmt.Errorf("%s unable to fetch ticker(s). Error: %s", b.GetName(), JoinStrings(errs, ", "))
+	}
+	return tickers, nil
+}
+
+func (b *BTCMarkets) GetOrderbook(symbol string) (BTCMarketsOrderbook, error) {
+	return b.GetOrderbookContext(context.Background(), symbol)
+}
+
+func (b *BTCMarkets) GetOrderbookContext(ctx context.Context, symbol string) (BTCMarketsOrderbook, error) {
+	pair, err := b.ParsePair(NormalizeCurrency(symbol))
+	if err != nil {
+		return BTCMarketsOrderbook{}, err
+	}
+	err = b.ValidatePair(pair)
+	if err != nil {
+		return BTCMarketsOrderbook{}, err
+	}
+
+	orderbook := BTCMarketsOrderbook{}
+	path := fmt.Sprintf(BTCMARKETS_MARKET_ORDERBOOK, pair.Base, pair.Quote)
+	err = b.SendPublicRequestContext(ctx, BTCMARKETS_MARKET_ORDERBOOK, path, &orderbook)
+	if err != nil {
+		return BTCMarketsOrderbook{}, err
+	}
+
+	symbol = b.FormatPair(pair)
+	orderbook.Crossed = b.CheckOrderbook(symbol, orderbook)
+
+	b.orderbookMtx.Lock()
+	if b.Orderbook == nil {
+		b.Orderbook = make(map[string]BTCMarketsOrderbook)
+		b.OrderbookLastFetch = make(map[string]time.Time)
+	}
+	b.Orderbook[symbol] = orderbook
+	b.OrderbookLastFetch[symbol] = time.Now()
+	b.orderbookMtx.Unlock()
+	return orderbook, nil
+}
+
+// GetOrderbookDepth returns the orderbook for symbol quoted in quote,
+// truncated to depth levels per side. If quote is empty symbol is a pair as
+// accepted by ParsePair. BTC Markets doesn't support a depth parameter on the
+// orderbook endpoint, so the full book is fetched, and cached, by GetOrderbook
+// before truncating.
+func (b *BTCMarkets) GetOrderbookDepth(symbol, quote string, depth int) (BTCMarketsOrderbook, error) {
+	if depth <= 0 {
+		return BTCMarketsOrderbook{}, fmt.Errorf("%s invalid orderbook depth %d.", b.GetName(), depth)
+	}
+
+	if quote != "" {
+		symbol = b.FormatPair(CurrencyPair{Base: NormalizeCurrency(symbol), Quote: NormalizeCurrency(quote)})
+	}
+	orderbook, err := b.GetOrderbook(symbol)
+	if err != nil {
+		return BTCMarketsOrderbook{}, err
+	}
+
+	if len(orderbook.Asks) > depth {
+		orderbook.Asks = orderbook.Asks[:depth]
+	}
+	if len(orderbook.Bids) > depth {
+		orderbook.Bids = orderbook.Bids[:depth]
+	}
+	return orderbook, nil
+}
+
+func (b *BTCMarkets) GetOrderbookCached(symbol string) (BTCMarketsOrderbook, error) {
+	symbol = b.PairKey(symbol)
+	b.orderbookMtx.Lock()
+	orderbook, ok := b.Orderbook[symbol]
+	fresh := ok && time.Since(b.OrderbookLastFetch[symbol]) < b.OrderbookCacheTTL
+	b.orderbookMtx.Unlock()
+
+	if fresh {
+		return orderbook, nil
+	}
+	return b.GetOrderbook(symbol)
+}
+
+// IsCrossed reports whether the best bid is at or above the best ask, which
+// usually means the book is stale. A book with an empty side is never crossed.
+func (o BTCMarketsOrderbook) IsCrossed() (crossed bool, bestBid, bestAsk float64) {
+	bidFound, askFound := false, false
+	for _, x := range o.Bids {
+		if len(x) >= 1 && (!bidFound || x[0] > bestBid) {
+			bestBid, bidFound = x[0], true
+		}
+	}
+	for _, x := range o.Asks {
+		if len(x) >= 1 && (!askFound || x[0] < bestAsk) {
+			bestAsk, askFound = x[0], true
+		}
+	}
+	return bidFound && askFound && bestBid >= bestAsk, bestBid, bestAsk
+}
+
+// CheckOrderbook logs a warning and returns true if orderbook is crossed or
+// locked. GetOrderbook records the result in the book's Crossed field rather
+// than failing, so callers that can't use stale data should check it.
+func (b *BTCMarkets) CheckOrderbook(symbol string, orderbook BTCMarketsOrderbook) bool {
+	crossed, bid, ask := orderbook.IsCrossed()
+	if !crossed {
+		return false
+	}
+
+	state := "crossed"
+	if bid == ask {
+		state = "locked"
+	}
+	log.Printf("%s warning: %s orderbook is %s, best bid %f best ask %f.\n", b.GetName(), symbol, state, bid, ask)
+	return true
+}
+
+func (b *BTCMarkets) GetLowestAsk(pair string) (price, amount float64, err error) {
+	orderbook, err := b.GetOrderbookCached(pair)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	price, amount, found := orderbook.BestAsk()
+	if !found {
+		return 0, 0, ErrBTCMarketsOrderbookEmpty
+	}
+	return price, amount, nil
+}
+
+func (b *BTCMarkets) GetHighestBid(pair string) (price, amount float64, err error) {
+	orderbook, err := b.GetOrderbookCached(pair)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	price, amount, found := orderbook.BestBid()
+	if !found {
+		return 0, 0, ErrBTCMarketsOrderbookEmpty
+	}
+	return price, amount, nil
+}
+
+// BestAsk returns the lowest ask price and its volume, ignoring malformed
+// levels. found is false if there are no asks.
+func (o BTCMarketsOrderbook) BestAsk() (price, amount float64, found bool) {
+	for _, x := range o.Asks {
+		if len(x) < 2 {
+			continue
+		}
+		if !found || x[0] < price {
+			price, amount, found = x[0], x[1], true
+		}
+	}
+	return price, amount, found
+}
+
+// BestBid returns the highest bid price and its volume, ignoring malformed
+// levels. found is false if there are no bids.
+func (o BTCMarketsOrderbook) BestBid() (price, amount float64, found bool) {
+	for _, x := range o.Bids {
+		if len(x) < 2 {
+			continue
+		}
+		if !found || x[0] > price {
+			price, amount, found = x[0], x[1], true
+		}
+	}
+	return price, amount, found
+}
+
+// OrderbookImbalance returns (bidVolume - askVolume) / (bidVolume +
+// askVolume) over the best depth levels of each side of the cached orderbook,
+// ranging from -1 (all asks) to 1 (all bids). An empty side counts as zero
+// volume; ErrBTCMarketsOrderbookEmpty is returned if both are empty.
+func (b *BTCMarkets) OrderbookImbalance(pair string, depth int) (float64, error) {
+	if depth <= 0 {
+		return 0, fmt.Errorf("%s invalid orderbook depth %d.", b.GetName(), depth)
+	}
+
+	orderbook, err := b.GetOrderbookCached(pair)
+	if err != nil {
+		return 0, err
+	}
+
+	bidVolume := SumBTCMarketsLevels(orderbook.Bids, depth, true)
+	askVolume := SumBTCMarketsLevels(orderbook.Asks, depth, false)
+	if bidVolume+askVolume == 0 {
+		return 0, ErrBTCMarketsOrderbookEmpty
+	}
+	return (bidVolume - askVolume) / (bidVolume + askVolume), nil
+}
+
+// SumBTCMarketsLevels sums the volume of the best depth price levels, the
+// highest first if descending is set and the lowest first otherwise.
+func SumBTCMarketsLevels(levels [][]float64, depth int, descending bool) float64 {
+	sorted := [][]float64{}
+	for _, x := range levels {
+		if len(x) >= 2 {
+			sorted = append(sorted, x)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if descending {
+			return sorted[i][0] > sorted[j][0]
+		}
+		return sorted[i][0] < sorted[j][0]
+	})
+
+	volume := 0.0
+	for i := 0; i < len(sorted) && i < depth; i++ {
+		volume += sorted[i][1]
+	}
+	return volume
+}
+
+func (b *BTCMarkets) GetTrades(symbol, since string) ([]BTCMarketsTrade, error) {
+	return b.GetTradesContext(context.Background(), symbol, since)
+}
+
+func (b *BTCMarkets) GetTradesContext(ctx context.Context, symbol, since string) ([]BTCMarketsTrade, error) {
+	pair, err := b.ParsePair(NormalizeCurrency(symbol))
+	if err != nil {
+		return nil, err
+	}
+	err = b.ValidatePair(pair)
+	if err != nil {
+		return nil, err
+	}
+
+	trades := []BTCMarketsTrade{}
+	path := fmt.Sprintf(BTCMARKETS_MARKET_TRADES, pair.Base, pair.Quote)
+	if len(since) > 0 {
+		path += "?since=" + since
+	}
+	err = b.SendPublicRequestContext(ctx, BTCMARKETS_MARKET_TRADES, path, &trades)
+	if err != nil {
+		return nil, err
+	}
+	return trades, nil
+}
+
+// GetTradesSince returns the trades for symbol after the trade sinceTradeID.
+// The trades endpoint's since parameter is a trade ID; it has no time-based
+// query.
+func (b *BTCMarkets) GetTradesSince(symbol string, sinceTradeID int64) ([]BTCMarketsTrade, error) {
+	return b.GetTrades(symbol, strconv.FormatInt(sinceTradeID, 10))
+}
+
+// GetRecentTrades returns the trades for symbol that haven't been returned by
+// a previous call. The since parameter narrows the request and trades at or
+// below the last seen trade ID are filtered out in case the API includes the
+// boundary trade.
+func (b *BTCMarkets) GetRecentTrades(symbol string) ([]BTCMarketsTrade, error) {
+	symbol = b.PairKey(symbol)
+	b.tradesMtx.Lock()
+	last, ok := b.lastTradeIDs[symbol]
+	b.tradesMtx.Unlock()
+
+	since := ""
+	if ok {
+		since = strconv.FormatInt(last, 10)
+	}
+
+	trades, err := b.GetTrades(symbol, since)
+	if err != nil {
+		return nil, err
+	}
+
+	b.tradesMtx.Lock()
+	defer b.tradesMtx.Unlock()
+
+	if b.lastTradeIDs == nil {
+		b.lastTradeIDs = make(map[string]int64)
+	}
+	last, ok = b.lastTradeIDs[symbol]
+
+	recent := []BTCMarketsTrade{}
+	for _, x := range trades {
+		if ok && x.TradeID <= last {
+			continue
+		}
+		recent = append(recent, x)
+		if x.TradeID > b.lastTradeIDs[symbol] {
+			b.lastTradeIDs[symbol] = x.TradeID
+		}
+	}
+	return recent, nil
+}
+
+// BuildCandles aggregates trades into interval candles aligned to UTC
+// interval boundaries. Empty intervals between trades are filled with the
+// previous close and zero volume.
+func BuildCandles(trades []BTCMarketsTrade, interval time.Duration) []Candle {
+	return BuildCandlesFill(trades, interval, true)
+}
+
+// BuildCandlesFill is BuildCandles with control over whether empty intervals
+// are filled; when fill is false they are omitted.
+func BuildCandlesFill(trades []BTCMarketsTrade, interval time.Duration, fill bool) []Candle {
+	candles := []Candle{}
+	if len(trades) == 0 || interval <= 0 {
+		return candles
+	}
+
+	sorted := append([]BTCMarketsTrade{}, trades...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Date == sorted[j].Date {
+			return sorted[i].TradeID < sorted[j].TradeID
+		}
+		return sorted[i].Date < sorted[j].Date
+	})
+
+	for _, x := range sorted {
+		start := x.Time().Truncate(interval)
+
+		if len(candles) > 0 {
+			last := &candles[len(candles)-1]
+			if last.Time.Equal(start) {
+				last.High = math.Max(last.High, x.Price)
+				last.Low = math.Min(last.Low, x.Price)
+				last.Close = x.Price
+				last.Volume += x.Amount
+				continue
+			}
+
+			if fill {
+				prev := last.Close
+				for t := last.Time.Add(interval); t.Before(start); t = t.Add(interval) {
+					candles = append(candles, Candle{Time: t, Open: prev, High: prev, Low: prev, Close: prev})
+				}
+			}
+		}
+
+		candles = append(candles, Candle{Time: start, Open: x.Price, High: x.Price, Low: x.Price, Close: x.Price, Volume: x.Amount})
+	}
+	return candles
+}
+
+// BTCMarkets24hStats summarises the trades in a 24 hour window. Change is
+// Last minus Open.
+type BTCMarkets24hStats struct {
+	Open          float64
+	High          float64
+	Low           float64
+	Last          float64
+	Volume        float64
+	Change        float64
+	ChangePercent float64
+	Trades        int
+}
+
+// Get24hStats returns 24 hour stats for pair. The BTC Markets API has no
+// stats endpoint, so they are computed from the public trades, which only
+// cover the most recent trades and may span less than 24 hours on busy
+// markets.
+func (b *BTCMarkets) Get24hStats(pair string) (BTCMarkets24hStats, error) {
+	trades, err := b.GetTrades(pair, "")
+	if err != nil {
+		return BTCMarkets24hStats{}, err
+	}
+	return Compute24hStats(trades, time.Now()), nil
+}
+
+// Compute24hStats computes stats from the trades dated within the 24 hours
+// before now.
+func Compute24hStats(trades []BTCMarketsTrade, now time.Time) BTCMarkets24hStats {
+	from := now.Add(-24 * time.Hour).Unix()
+	window := []BTCMarketsTrade{}
+	for _, x := range trades {
+		if x.Date >= from && x.Date <= now.Unix() {
+			window = append(window, x)
+		}
+	}
+
+	stats := BTCMarkets24hStats{}
+	if len(window) == 0 {
+		return stats
+	}
+
+	sort.SliceStable(window, func(i, j int) bool {
+		if window[i].Date == window[j].Date {
+			return window[i].TradeID < window[j].TradeID
+		}
+		return window[i].Date < window[j].Date
+	})
+
+	stats.Open = window[0].Price
+	stats.Last = window[len(window)-1].Price
+	stats.High = window[0].Price
+	stats.Low = window[0].Price
+	stats.Trades = len(window)
+	for _, x := range window {
+		stats.High = math.Max(stats.High, x.Price)
+		stats.Low = math.Min(stats.Low, x.Price)
+		stats.Volume += x.Amount
+	}
+
+	stats.Change = stats.Last - stats.Open
+	if stats.Open != 0 {
+		stats.ChangePercent = stats.Change / stats.Open * 100
+	}
+	return stats
+}
+
+// RecentVWAP returns the volume-weighted average price of symbol's public
+// trades dated within window of now. Like Get24hStats it is limited to the
+// trades the API returns, so long windows on busy markets may be truncated.
+func (b *BTCMarkets) RecentVWAP(symbol string, window time.Duration) (float64, error) {
+	if window <= 0 {
+		return 0, fmt.Errorf("%s invalid VWAP window %s.", b.GetName(), window)
+	}
+
+	trades, err := b.GetTrades(symbol, "")
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	return ComputeVWAP(trades, now.Add(-window), now)
+}
+
+// ComputeVWAP returns the volume-weighted average price of the trades dated
+// within [from, to]. ErrBTCMarketsNoTradesInWindow is returned if there are
+// none, or they have no volume.
+func ComputeVWAP(trades []BTCMarketsTrade, from, to time.Time) (float64, error) {
+	notional, volume := 0.0, 0.0
+	for _, x := range trades {
+		if x.Date < from.Unix() || x.Date > to.Unix() {
+			continue
+		}
+		notional += x.Price * x.Amount
+		volume += x.Amount
+	}
+
+	if volume <= 0 {
+		return 0, ErrBTCMarketsNoTradesInWindow
+	}
+	return notional / volume, nil
+}
+
+// FormatPrice formats price with the instrument's PriceDecimals, falling back
+// to BTCMARKETS_DEFAULT_PRICE_DECIMALS for unknown instruments.
+func (b *BTCMarkets) FormatPrice(instrument string, price float64) string {
+	decimals := BTCMARKETS_DEFAULT_PRICE_DECIMALS
+	rules, err := b.GetInstrumentRules(instrument)
+	if err == nil && rules.PriceDecimals > 0 {
+		decimals = rules.PriceDecimals
+	}
+	return strconv.FormatFloat(price, 'f', decimals, 64)
+}
+
+// FormatVolume formats volume with the instrument's VolumeDecimals, falling
+// back to BTCMARKETS_DEFAULT_VOLUME_DECIMALS for unknown instruments.
+func (b *BTCMarkets) FormatVolume(instrument string, volume float64) string {
+	decimals := BTCMARKETS_DEFAULT_VOLUME_DECIMALS
+	rules, err := b.GetInstrumentRules(instrument)
+	if err == nil && rules.VolumeDecimals > 0 {
+		decimals = rules.VolumeDecimals
+	}
+	return strconv.FormatFloat(volume, 'f', decimals, 64)
+}
+
+func (b *BTCMarkets) GetInstrumentRules(instrument string) (BTCMarketsInstrumentRules, error) {
+	b.rulesMtx.RLock()
+	defer b.rulesMtx.RUnlock()
+
+	rules, ok := b.InstrumentRules[instrument]
+	if !ok {
+		return BTCMarketsInstrumentRules{}, ErrBTCMarketsUnknownInstrument
+	}
+	return rules, nil
+}
+
+// SetInstrumentRules adds or replaces the rules for rules.Instrument.
+func (b *BTCMarkets) SetInstrumentRules(rules BTCMarketsInstrumentRules) {
+	b.rulesMtx.Lock()
+	defer b.rulesMtx.Unlock()
+
+	if b.InstrumentRules == nil {
+		b.InstrumentRules = make(map[string]BTCMarketsInstrumentRules)
+	}
+	b.InstrumentRules[rules.Instrument] = rules
+}
+
+// GetMinMaxOrderSize returns the volume bounds for instrument. The maximum is
+// +Inf where BTCMarkets doesn't publish one.
+func (b *BTCMarkets) GetMinMaxOrderSize(instrument string) (min, max float64, err error) {
+	rules, err := b.GetInstrumentRules(instrument)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	max = rules.MaxVolume
+	if max <= 0 {
+		max = math.Inf(1)
+	}
+	return rules.MinVolume, max, nil
+}
+
+// ValidateOrder checks price and volume against the instrument's rules.
+// Instruments without known rules are not validated. A zero price, as used by
+// market orders, skips the price checks.
+func (b *BTCMarkets) ValidateOrder(instrument string, price, volume float64) error {
+	rules, err := b.GetInstrumentRules(instrument)
+	if err != nil {
+		return nil
+	}
+
+	if volume < rules.MinVolume {
+		return fmt.Errorf("%s order volume %f is below the %s minimum of %f.", b.GetName(), volume, instrument, rules.MinVolume)
+	}
+
+	if rules.MaxVolume > 0 && volume > rules.MaxVolume {
+		return fmt.Errorf("%s order volume %f is above the %s maximum of %f.", b.GetName(), volume, instrument, rules.MaxVolume)
+	}
+
+	if price == 0 {
+		return nil
+	}
+
+	if price*volume < rules.MinNotional {
+		return fmt.Errorf("%s order value %f is below the %s minimum of %f.", b.GetName(), price*volume, instrument, rules.MinNotional)
+	}
+
+	increment := ConvertToBTCMarketsUnits(rules.PriceIncrement)
+	if increment > 0 && ConvertToBTCMarketsUnits(price)%increment != 0 {
+		return fmt.Errorf("%s order price %f is not a multiple of the %s price increment %f.", b.GetName(), price, instrument, rules.PriceIncrement)
+	}
+	return nil
+}
+
+// OrderCost previews an order's notional value and estimated fee using
+// GetTradingFee. The total is what a bid spends (notional plus fee) or what an
+// ask receives (notional less fee). Price and volume are decimal values.
+func (b *BTCMarkets) OrderCost(instrument string, price, volume float64, side BTCMarketsOrderSide) (notional, estFee, total float64, err error) {
+	if price <= 0 || volume <= 0 {
+		return 0, 0, 0, fmt.Errorf("%s invalid order price %f or volume %f.", b.GetName(), price, volume)
+	}
+
+	notional = price * volume
+	estFee = CalculateFee(notional, b.GetTradingFee(instrument))
+
+	switch side.Canonical() {
+	case BTCMARKETS_ORDER_SIDE_BID:
+		total = notional + estFee
+	case BTCMARKETS_ORDER_SIDE_ASK:
+		total = notional - estFee
+	default:
+		return 0, 0, 0, fmt.Errorf("%s invalid order side %s.", b.GetName(), side)
+	}
+	return notional, estFee, total, nil
+}
+
+// NetProceeds returns what selling volume at price yields after fees, i.e. the
+// OrderCost total for an ask. BTCMarkets fees don't distinguish maker from
+// taker, so GetTradingFee is the taker rate.
+func (b *BTCMarkets) NetProceeds(instrument string, price, volume float64) (float64, error) {
+	_, _, total, err := b.OrderCost(instrument, price, volume, BTCMARKETS_ORDER_SIDE_ASK)
+	return total, err
+}
+
+// HasSufficientBalance reports whether the available balance (balance less
+// pending funds) covers the order on instrument, a pair as accepted by
+// ParsePair: the quote currency cost including fees for a bid, or the base
+// currency volume for an ask. When it doesn't, the shortfall in that currency
+// is returned.
+func (b *BTCMarkets) HasSufficientBalance(instrument string, side BTCMarketsOrderSide, price, volume float64) (bool, float64, error) {
+	pair, err := b.ParsePair(NormalizeCurrency(instrument))
+	if err != nil {
+		return false, 0, err
+	}
+
+	side = side.Canonical()
+	currency, required := pair.Base, volume
+	if side == BTCMARKETS_ORDER_SIDE_BID {
+		_, _, total, err := b.OrderCost(pair.Base, price, volume, side)
+		if err != nil {
+			return false, 0, err
+		}
+		currency, required = pair.Quote, total
+	} else if side != BTCMARKETS_ORDER_SIDE_ASK {
+		return false, 0, fmt.Errorf("%s invalid order side %s.", b.GetName(), side)
+	}
+
+	available, _, err := b.GetBalanceFor(currency)
+	if err != nil && err != ErrBTCMarketsBalanceNotFound {
+		return false, 0, err
+	}
+
+	if available < required {
+		return false, required - available, nil
+	}
+	return true, 0, nil
+}
+
+// RecordClientRequestID remembers the most recent client request IDs and
+// reports whether clientReq has already been used.
+func (b *BTCMarkets) RecordClientRequestID(clientReq string) bool {
+	b.clientReqMtx.Lock()
+	defer b.clientReqMtx.Unlock()
+
+	if b.clientReqIDs == nil {
+		b.clientReqIDs = make(map[string]bool)
+	}
+
+	if b.clientReqIDs[clientReq] {
+		return true
+	}
+
+	if len(b.clientReqOrder) >= BTCMARKETS_RECENT_CLIENT_REQUEST_IDS {
+		delete(b.clientReqIDs, b.clientReqOrder[0])
+		b.clientReqOrder = b.clientReqOrder[1:]
+	}
+	b.clientReqIDs[clientReq] = true
+	b.clientReqOrder = append(b.clientReqOrder, clientReq)
+	return false
+}
+
+// Order places an order and returns the order ID along with the client request
+// ID used. A UUID is generated when clientReq is empty.
+func (b *BTCMarkets) Order(currency, instrument string, price, amount int64, orderSide BTCMarketsOrderSide, orderType BTCMarketsOrderType, clientReq string) (int, string, error) {
+	return b.OrderWithOptions(currency, instrument, price, amount, orderSide, orderType, clientReq, BTCMarketsOrderOptions{})
+}
+
+// OrderWithOptions is Order with optional order flags. PostOnly is only valid
+// for limit orders. The flags aren't simulated when paper trading.
+//
+// If the create request times out, the order may still have been placed, so
+// the open orders and order history are searched for clientReq before the
+// request is retried, up to OrderRetries times with an exponential backoff.
+// Requests time out after RequestTimeout.
+func (b *BTCMarkets) OrderWithOptions(currency, instrument string, price, amount int64, orderSide BTCMarketsOrderSide, orderType BTCMarketsOrderType, clientReq string, opts BTCMarketsOrderOptions) (int, string, error) {
+	orderSide = orderSide.Canonical()
+	orderType = orderType.Canonical()
+	if !orderSide.IsValid() {
+		return 0, clientReq, fmt.Errorf("%s invalid order side %s.", b.GetName(), orderSide)
+	}
+	if !orderType.IsValid() {
+		return 0, clientReq, fmt.Errorf("%s invalid order type %s.", b.GetName(), orderType)
+	}
+
+	if opts.PostOnly && orderType != BTCMARKETS_ORDER_TYPE_LIMIT {
+		return 0, clientReq, fmt.Errorf("%s post-only is only supported for limit orders.", b.GetName())
+	}
+
+	if !b.CanTrade() {
+		return 0, clientReq, ErrInsufficientKeyPermissions
+	}
+
+	currency = NormalizeCurrency(currency)
+	instrument = NormalizeCurrency(instrument)
+	for _, x := range []string{currency, instrument} {
+		err := b.ValidateCurrency(x)
+		if err != nil {
+			return 0, clientReq, err
+		}
+	}
+
+	if !b.IsTradingEnabled(currency, instrument) {
+		return 0, clientReq, ErrTradingDisabled
+	}
+
+	if clientReq == "" {
+		uuid, err := GetUUID()
+		if err != nil {
+			return 0, "", err
+		}
+		clientReq = uuid
+	}
+
+	err := b.ValidateOrder(instrument, ConvertFromBTCMarketsUnits(price), ConvertFromBTCMarketsUnits(amount))
+	if err != nil {
+		return 0, clientReq, err
+	}
+
+	if b.RecordClientRequestID(clientReq) {
+		log.Printf("%s WARNING -- client request ID %s has already been used.\n", b.GetName(), clientReq)
+	}
+
+	if b.PaperTrading {
+		err = b.Paper.Chaos.Apply(context.Background())
+		if err != nil {
+			return 0, clientReq, err
+		}
+
+		orderbook, err := b.GetOrderbook(instrument)
+		if err != nil {
+			return 0, clientReq, err
+		}
+		orderID, err := b.Paper.Order(orderbook, currency, instrument, price, amount, orderSide, orderType, clientReq, b.GetTradingFee(instrument))
+		return orderID, clientReq, err
+	}
+
+	type Order struct {
+		Currency        string              `json:"currency"`
+		Instrument      string              `json:"instrument"`
+		Price           int64               `json:"price"`
+		Volume          int64               `json:"volume"`
+		OrderSide       BTCMarketsOrderSide `json:"orderSide"`
+		OrderType       BTCMarketsOrderType `json:"ordertype"`
+		ClientRequestId string              `json:"clientRequestId"`
+		PostOnly        bool                `json:"postOnly,omitempty"`
+		Hidden          bool                `json:"hidden,omitempty"`
+	}
+	order := Order{}
+	order.Currency = currency
+	order.Instrument = instrument
+	order.Price = price
+	order.Volume = amount
+	order.OrderSide = orderSide
+	order.OrderType = orderType
+	order.ClientRequestId = clientReq
+	order.PostOnly = opts.PostOnly
+	order.Hidden = opts.Hidden
+
+	JSONPayload, err := JSONEncode(order)
+	if err != nil {
+		return 0, clientReq, err
+	}
+
+	type Response struct {
+		Success         bool   `json:"success"`
+		ErrorCode       int    `json:"errorCode"`
+		ErrorMessage    string `json:"errorMessage"`
+		ID              int    `json:"id"`
+		ClientRequestID string `json:"clientRequestId"`
+	}
+	var resp Response
+
+	backoff := Backoff{Min: b.OrderRetryDelay, Max: b.OrderRetryDelay * BTCMARKETS_MAX_ORDER_RETRY_BACKOFF}
+	for {
+		err = b.SendAuthenticatedRequest("POST", BTCMARKETS_ORDER_CREATE, JSONPayload, &resp)
+		if err == nil || !IsTimeoutError(err) || backoff.Attempts() >= b.OrderRetries {
+			break
+		}
+
+		time.Sleep(backoff.Next())
+		existing, found, lookupErr := b.FindOrderByClientID(currency, instrument, clientReq)
+		if lookupErr != nil {
+			return 0, clientReq, fmt.Errorf("%s Order request timed out and unable to check whether it was placed. Error: %s", b.GetName(), lookupErr)
+		}
+		if found {
+			return int(existing.ID), clientReq, nil
+		}
+
+		if b.Verbose {
+			log.Printf("%s order request %s timed out and no matching order was found, retrying.\n", b.GetName(), clientReq)
+		}
+	}
+
+	if err != nil {
+		return 0, clientReq, err
+	}
+
+	if !resp.Success {
+		return 0, clientReq, fmt.Errorf("%s Unable to place order. Error message: %s\n", b.GetName(), resp.ErrorMessage)
+	}
+	return resp.ID, clientReq, nil
+}
+
+func (b *BTCMarkets) PlaceOrder(currency, instrument string, price, amount int64, orderSide BTCMarketsOrderSide, orderType BTCMarketsOrderType, clientReq string) (BTCMarketsOrderResponse, error) {
+	orderID, _, err := b.Order(currency, instrument, price, amount, orderSide, orderType, clientReq)
+	if err != nil {
+		return BTCMarketsOrderResponse{}, err
+	}
+
+	orders, err := b.GetOrderDetail([]int64{int64(orderID)})
+	if err != nil {
+		return BTCMarketsOrderResponse{ID: float64(orderID)}, fmt.Errorf("%s Order %d placed but unable to get order detail. Error: %s", b.GetName(), orderID, err)
+	}
+
+	if len(orders) == 0 {
+		return BTCMarketsOrderResponse{ID: float64(orderID)}, fmt.Errorf("%s Order %d placed but not returned by order detail.", b.GetName(), orderID)
+	}
+	return orders[0], nil
+}
+
+// PlaceOrders places orders concurrently, at most MaxConcurrentRequests at a
+// time, and returns a result for each in the same order. A failed order
+// doesn't stop the others; if any fail an error summarising them is returned
+// alongside the results.
+func (b *BTCMarkets) PlaceOrders(orders []BTCMarketsOrderRequest) ([]BTCMarketsOrderResult, error) {
+	results := make([]BTCMarketsOrderResult, len(orders))
+	wg := sync.WaitGroup{}
+	limit := b.MaxConcurrentRequests
+	if limit <= 0 {
+		limit = BTCMARKETS_DEFAULT_MAX_CONCURRENT_REQUESTS
+	}
+	sem := make(chan struct{}, limit)
+
+	for i, x := range orders {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, order BTCMarketsOrderRequest) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			id, clientReq, err := b.OrderWithOptions(order.Currency, order.Instrument, order.Price, order.Volume, order.OrderSide, order.OrderType, order.ClientRequestID, order.Options)
+			results[i] = BTCMarketsOrderResult{ID: id, ClientRequestID: clientReq, Err: err}
+		}(i, x)
+	}
+	wg.Wait()
+
+	errs := []string{}
+	for i, x := range results {
+		if x.Err != nil {
+			errs = append(errs, fmt.Sprintf("%d: %s", i, x.Err))
+		}
+	}
+	if len(errs) > 0 {
+		return results, fmt.Errorf("%s unable to place %d of %d orders. Error: %s", b.GetName(), len(errs), len(orders), JoinStrings(errs, ", "))
+	}
+	return results, nil
+}
+
+// EstimateMarketBuy walks the asks of orderbook, cheapest first, to estimate
+// the volume bought and average price paid when spending spend of the quote
+// currency at market. ErrSlippageExceeded is returned if the asks can't
+// absorb the whole spend.
+func EstimateMarketBuy(orderbook BTCMarketsOrderbook, spend float64) (volume, avgPrice, bestPrice float64, err error) {
+	asks := [][]float64{}
+	for _, x := range orderbook.Asks {
+		if len(x) >= 2 && x[0] > 0 {
+			asks = append(asks, x)
+		}
+	}
+	if len(asks) == 0 {
+		return 0, 0, 0, ErrBTCMarketsOrderbookEmpty
+	}
+	sort.Slice(asks, func(i, j int) bool {
+		return asks[i][0] < asks[j][0]
+	})
+
+	remaining := spend
+	for _, x := range asks {
+		if remaining <= 0 {
+			break
+		}
+		levelVolume := math.Min(x[1], remaining/x[0])
+		volume += levelVolume
+		remaining -= levelVolume * x[0]
+	}
+
+	if remaining > spend*1e-9 {
+		return 0, 0, 0, ErrSlippageExceeded
+	}
+	return volume, spend / volume, asks[0][0], nil
+}
+
+// EstimateFillLikelihood returns how much of a limit order for volume at
+// price would fill immediately against the cached orderbook. The remainder,
+// volume less fillableNow, would rest on the book.
+func (b *BTCMarkets) EstimateFillLikelihood(instrument string, side BTCMarketsOrderSide, price, volume float64) (fillableNow float64, err error) {
+	orderbook, err := b.GetOrderbookCached(instrument)
+	if err != nil {
+		return 0, err
+	}
+
+	side = side.Canonical()
+	var levels [][]float64
+	switch side {
+	case BTCMARKETS_ORDER_SIDE_BID:
+		levels = orderbook.Asks
+	case BTCMARKETS_ORDER_SIDE_ASK:
+		levels = orderbook.Bids
+	default:
+		return 0, fmt.Errorf("%s invalid order side %s.", b.GetName(), side)
+	}
+
+	for _, x := range levels {
+		if len(x) < 2 {
+			continue
+		}
+		if (side == BTCMARKETS_ORDER_SIDE_BID && x[0] <= price) || (side == BTCMARKETS_ORDER_SIDE_ASK && x[0] >= price) {
+			fillableNow += x[1]
+		}
+	}
+	return math.Min(fillableNow, volume), nil
+}
+
+// MarketBuyWithSlippage buys instrument with spend AUD as a limit order
+// priced at the worst acceptable price, maxSlippagePct percent above the best
+// ask, for the volume EstimateMarketBuy expects spend to buy from the cached
+// orderbook. ErrSlippageExceeded is returned without placing an order if the
+// estimated average price is more than maxSlippagePct above the best ask.
+// Fees are not included in spend.
+func (b *BTCMarkets) MarketBuyWithSlippage(instrument string, spend float64, maxSlippagePct float64) (int, error) {
+	if spend <= 0 || maxSlippagePct < 0 {
+		return 0, fmt.Errorf("%s invalid spend %f or slippage %f.", b.GetName(), spend, maxSlippagePct)
+	}
+
+	orderbook, err := b.GetOrderbookCached(instrument)
+	if err != nil {
+		return 0, err
+	}
+
+	volume, avgPrice, bestPrice, err := EstimateMarketBuy(orderbook, spend)
+	if err != nil {
+		return 0, err
+	}
+
+	limit := bestPrice * (1 + maxSlippagePct/100)
+	if avgPrice > limit {
+		return 0, ErrSlippageExceeded
+	}
+
+	price := NewBTCMarketsAmountRounded(limit, BTCMARKETS_ROUND_FLOOR)
+	rules, err := b.GetInstrumentRules(instrument)
+	if err == nil && rules.PriceIncrement > 0 {
+		increment := BTCMarketsAmount(ConvertToBTCMarketsUnits(rules.PriceIncrement))
+		price -= price % increment
+	}
+
+	orderID, _, err := b.Order("AUD", instrument, int64(price), int64(NewBTCMarketsAmountRounded(volume, BTCMARKETS_ROUND_FLOOR)), BTCMARKETS_ORDER_SIDE_BID, BTCMARKETS_ORDER_TYPE_LIMIT, "")
+	return orderID, err
+}
+
+func (b *BTCMarkets) AverageFillPrice(orderID int64) (float64, error) {
+	gross, _, err := b.GetAverageFillPrices(orderID)
+	return gross, err
+}
+
+func (b *BTCMarkets) AverageFillPriceNetOfFees(orderID int64) (float64, error) {
+	_, net, err := b.GetAverageFillPrices(orderID)
+	return net, err
+}
+
+// GetAverageFillPrices returns the volume-weighted average fill price of an
+// order, both gross and with fees applied (added for bids, subtracted for
+// asks). Prices are in the API's 1e8 integer units.
+func (b *BTCMarkets) GetAverageFillPrices(orderID int64) (gross, net float64, err error) {
+	orders, err := b.GetOrderDetail([]int64{orderID})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if len(orders) == 0 {
+		return 0, 0, fmt.Errorf("%s Order %d not found.", b.GetName(), orderID)
+	}
+
+	notional, volume, fees := 0.0, 0.0, 0.0
+	for _, x := range orders[0].Trades {
+		notional += x.Price * x.Volume / BTCMARKETS_UNIT
+		volume += x.Volume
+		fees += x.Fee
+	}
+
+	if volume == 0 {
+		return 0, 0, ErrBTCMarketsNoFills
+	}
+
+	if orders[0].OrderSide == BTCMARKETS_ORDER_SIDE_ASK {
+		fees = -fees
+	}
+	gross = notional * BTCMARKETS_UNIT / volume
+	net = (notional + fees) * BTCMARKETS_UNIT / volume
+	return gross, net, nil
+}
+
+func (b *BTCMarkets) CancelOrder(orderID []int64) (bool, error) {
+	results, err := b.CancelOrders(orderID)
+
+	if err != nil {
+		return false, err
+	}
+
+	ordersToBeCancelled := len(orderID)
+	ordersCancelled := 0
+	for _, y := range results {
+		if y.Success {
+			ordersCancelled++
+			log.Printf("%s Cancelled order %d.\n", b.GetName(), y.ID)
+		} else {
+			log.Printf("%s Unable to cancel order %d. Error message: %s\n", b.GetName(), y.ID, y.ErrorMessage)
+		}
+	}
+
+	if ordersCancelled == ordersToBeCancelled {
+		return true, nil
+	} else {
+		return false, fmt.Errorf("%s Unable to cancel order(s).", b.GetName())
+	}
+}
+
+// BTCMarketsAmount is a fixed-point quantity in the API's 1e8 integer units.
+// Converting through its decimal representation avoids the off-by-one unit
+// errors that come from multiplying float64 values directly (0.07 BTC, for
+// example, is 6999999.999999999 units as a float product).
+type BTCMarketsAmount int64
+
+// BTCMarketsRoundingMode selects how values with more than eight decimal
+// places are rounded to whole API units. Floor never overstates a volume, so
+// it can't exceed an available balance but may fall below a minimum order
+// value; Ceil is the reverse. Nearest rounds halves away from zero.
+type BTCMarketsRoundingMode int
+
+const (
+	BTCMARKETS_ROUND_NEAREST BTCMarketsRoundingMode = iota
+	BTCMARKETS_ROUND_FLOOR
+	BTCMARKETS_ROUND_CEIL
+)
+
+// NewBTCMarketsAmount converts value to the nearest whole API unit.
+func NewBTCMarketsAmount(value float64) BTCMarketsAmount {
+	return NewBTCMarketsAmountRounded(value, BTCMARKETS_ROUND_NEAREST)
+}
+
+// NewBTCMarketsAmountRounded converts value to whole API units using mode.
+// Rounding is applied to the shortest decimal representation of value, so
+// 0.000000005 is treated as exactly half a unit.
+func NewBTCMarketsAmountRounded(value float64, mode BTCMarketsRoundingMode) BTCMarketsAmount {
+	s := strconv.FormatFloat(value, 'f', -1, 64)
+	rest := ""
+	if i := strings.Index(s, "."); i >= 0 && len(s)-i-1 > 8 {
+		s, rest = s[:i+9], s[i+9:]
+	}
+
+	amount, err := ParseBTCMarketsAmount(s)
+	if err != nil || strings.Trim(rest, "0") == "" {
+		return amount
+	}
+
+	switch mode {
+	case BTCMARKETS_ROUND_FLOOR:
+		if value < 0 {
+			amount--
+		}
+	case BTCMARKETS_ROUND_CEIL:
+		if value > 0 {
+			amount++
+		}
+	default:
+		if rest[0] >= '5' {
+			if value < 0 {
+				amount--
+			} else {
+				amount++
+			}
+		}
+	}
+	return amount
+}
+
+// ParseBTCMarketsAmount parses a decimal string with at most eight fractional
+// digits without going through float64.
+func ParseBTCMarketsAmount(value string) (BTCMarketsAmount, error) {
+	s := strings.TrimSpace(value)
+	negative := strings.HasPrefix(s, "-")
+	if negative {
+		s = s[1:]
+	} else {
+		s = strings.TrimPrefix(s, "+")
+	}
+
+	whole, frac := s, ""
+	if i := strings.Index(s, "."); i >= 0 {
+		whole, frac = s[:i], s[i+1:]
+	}
+
+	if (whole == "" && frac == "") || len(frac) > 8 {
+		return 0, fmt.Errorf("Invalid BTCMarkets amount %q.", value)
+	}
+
+	units := int64(0)
+	if whole != "" {
+		w, err := strconv.ParseUint(whole, 10, 63)
+		if err != nil || w > math.MaxInt64/BTCMARKETS_UNIT {
+			return 0, fmt.Errorf("Invalid BTCMarkets amount %q.", value)
+		}
+		units = int64(w) * BTCMARKETS_UNIT
+	}
+
+	if frac != "" {
+		f, err := strconv.ParseUint(frac+strings.Repeat("0", 8-len(frac)), 10, 63)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid BTCMarkets amount %q.", value)
+		}
+		units += int64(f)
+	}
+
+	if negative {
+		units = -units
+	}
+	return BTCMarketsAmount(units), nil
+}
+
+func (a BTCMarketsAmount) Float64() float64 {
+	amount, _ := strconv.ParseFloat(a.String(), 64)
+	return amount
+}
+
+func (a BTCMarketsAmount) String() string {
+	sign, units := "", int64(a)
+	if units < 0 {
+		sign, units = "-", -units
+	}
+	return fmt.Sprintf("%s%d.%08d", sign, units/BTCMARKETS_UNIT, units%BTCMARKETS_UNIT)
+}
+
+func ConvertToBTCMarketsUnits(value float64) int64 {
+	return int64(NewBTCMarketsAmount(value))
+}
+
+// ConvertOrderUnits converts an order price or volume to API units using the
+// exchange's RoundingMode.
+func (b *BTCMarkets) ConvertOrderUnits(value float64) int64 {
+	return int64(NewBTCMarketsAmountRounded(value, b.RoundingMode))
+}
+
+func ConvertFromBTCMarketsUnits(value int64) float64 {
+	return BTCMarketsAmount(value).Float64()
+}
+
+// AmendOrder cancels orderID and places a replacement with the same side and
+// type at newPrice/newVolume. If the order has already filled,
+// ErrBTCMarketsOrderFilled is returned and no replacement is placed.
+func (b *BTCMarkets) AmendOrder(orderID int64, newPrice, newVolume float64) (int, error) {
+	if !b.CanTrade() {
+		return 0, ErrInsufficientKeyPermissions
+	}
+
+	orders, err := b.GetOrderDetail([]int64{orderID})
+	if err != nil {
+		return 0, err
+	}
+
+	if len(orders) == 0 {
+		return 0, fmt.Errorf("%s Order %d not found.", b.GetName(), orderID)
+	}
+
+	order := orders[0]
+	if !b.IsTradingEnabled(order.Currency, order.Instrument) {
+		return 0, ErrTradingDisabled
+	}
+	if order.Status == BTCMARKETS_ORDER_STATUS_FULLY_MATCHED {
+		return 0, ErrBTCMarketsOrderFilled
+	}
+
+	results, err := b.cancelOrders([]int64{orderID})
+	if err != nil {
+		return 0, err
+	}
+
+	if len(results) == 0 || !results[0].Success {
+		orders, err = b.GetOrderDetail([]int64{orderID})
+		if err == nil && len(orders) > 0 && orders[0].Status == BTCMARKETS_ORDER_STATUS_FULLY_MATCHED {
+			return 0, ErrBTCMarketsOrderFilled
+		}
+		return 0, fmt.Errorf("%s Unable to cancel order %d for amendment.", b.GetName(), orderID)
+	}
+
+	newOrderID, _, err := b.Order(order.Currency, order.Instrument, b.ConvertOrderUnits(newPrice), b.ConvertOrderUnits(newVolume), order.OrderSide, order.OrderType, "")
+	if err != nil {
+		return 0, fmt.Errorf("%s Order %d cancelled but unable to place replacement. Error: %s", b.GetName(), orderID, err)
+	}
+	return newOrderID, nil
+}
+
+// CancelOrders cancels orderID. While TradingEnabledPairs is set the orders
+// are fetched first and ErrTradingDisabled is returned, cancelling nothing,
+// if any of them is on a pair that isn't tradable.
+func (b *BTCMarkets) CancelOrders(orderID []int64) ([]BTCMarketsCancelResult, error) {
+	if !b.CanTrade() {
+		return nil, ErrInsufficientKeyPermissions
+	}
+
+	b.pairsMtx.RLock()
+	restricted := len(b.TradingEnabledPairs) > 0
+	b.pairsMtx.RUnlock()
+
+	if restricted {
+		orders, err := b.GetOrderDetail(orderID)
+		if err != nil {
+			return nil, err
+		}
+		for _, x := range orders {
+			if !b.IsTradingEnabled(x.Currency, x.Instrument) {
+				return nil, ErrTradingDisabled
+			}
+		}
+	}
+	return b.cancelOrders(orderID)
+}
+
+func (b *BTCMarkets) cancelOrders(orderID []int64) ([]BTCMarketsCancelResult, error) {
+	if b.PaperTrading {
+		return b.Paper.CancelOrders(orderID), nil
+	}
+
+	type CancelOrder struct {
+		OrderIDs []int64 `json:"orderIds"`
+	}
+	orders := CancelOrder{}
+	orders.OrderIDs = append(orders.OrderIDs, orderID...)
+
+	JSONPayload, err := JSONEncode(orders)
+	if err != nil {
+		return nil, err
+	}
+
+	type Response struct {
+		Success         bool                     `json:"success"`
+		ErrorCode       int                      `json:"errorCode"`
+		ErrorMessage    string                   `json:"errorMessage"`
+		Responses       []BTCMarketsCancelResult `json:"responses"`
+		ClientRequestID string                   `json:"clientRequestId"`
+	}
+	var resp Response
+
+	err = b.SendAuthenticatedRequest("POST", BTCMARKETS_ORDER_CANCEL, JSONPayload, &resp)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !resp.Success {
+		return nil, fmt.Errorf("%s Unable to cancel order. Error message: %s\n", b.GetName(), resp.ErrorMessage)
+	}
+	return resp.Responses, nil
+}
+
+func (b *BTCMarkets) CancelAllOrders(currency, instrument string) ([]BTCMarketsCancelResult, error) {
+	if !b.CanTrade() {
+		return nil, ErrInsufficientKeyPermissions
+	}
+	if !b.IsTradingEnabled(currency, instrument) {
+		return nil, ErrTradingDisabled
+	}
+
+	orders, err := b.GetOpenOrders(currency, instrument)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(orders) == 0 {
+		return []BTCMarketsCancelResult{}, nil
+	}
+
+	orderIDs := []int64{}
+	for _, x := range orders {
+		orderIDs = append(orderIDs, int64(x.ID))
+	}
+
+	results, err := b.cancelOrders(orderIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, x := range results {
+		if !x.Success {
+			return results, fmt.Errorf("%s Unable to cancel all %s/%s orders.", b.GetName(), instrument, currency)
+		}
+	}
+	return results, nil
+}
+
+func (b *BTCMarkets) GetOrders(currency, instrument string, limit, since int64, historic bool) ([]BTCMarketsOrderResponse, error) {
+	if b.PaperTrading {
+		return b.Paper.GetOrders(currency, instrument, limit, since, historic), nil
+	}
+
 	request := make(map[string]interface{})
 	request["currency"] = currency
 	request["instrument"] = instrument
@@ -297,8 +3310,7 @@ func (b *BTCMarkets) GetOrders(currency, instrument string, limit, since int64,
 
 	JSONPayload, err := JSONEncode(request)
 	if err != nil {
-		log.Println(err)
-		return
+		return nil, err
 	}
 
 	path := BTCMARKETS_ORDER_OPEN
@@ -306,14 +3318,197 @@ func (b *BTCMarkets) GetOrders(currency, instrument string, limit, since int64,
 		path = BTCMARKETS_ORDER_HISTORY
 	}
 
-	err = b.SendAuthenticatedRequest("POST", path, JSONPayload, nil)
+	type Response struct {
+		Success      bool                      `json:"success"`
+		ErrorCode    int                       `json:"errorCode"`
+		ErrorMessage string                    `json:"errorMessage"`
+		Orders       []BTCMarketsOrderResponse `json:"orders"`
+	}
+	var resp Response
+
+	err = b.SendAuthenticatedRequest("POST", path, JSONPayload, &resp)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !resp.Success {
+		return nil, fmt.Errorf("%s Unable to get orders. Error message: %s", b.GetName(), resp.ErrorMessage)
+	}
+	return resp.Orders, nil
+}
+
+func (b *BTCMarkets) GetOpenOrders(currency, instrument string) ([]BTCMarketsOrderResponse, error) {
+	orders, err := b.GetOrders(currency, instrument, BTCMARKETS_ORDER_LIMIT, 0, false)
+	if err != nil {
+		return nil, err
+	}
+
+	open := []BTCMarketsOrderResponse{}
+	for _, x := range orders {
+		if x.Status == BTCMARKETS_ORDER_STATUS_PLACED || x.Status == BTCMARKETS_ORDER_STATUS_PARTIALLY_MATCHED {
+			open = append(open, x)
+		}
+	}
+	return open, nil
+}
+
+// GetOrderByClientID returns the order placed with clientID, searching the
+// open orders and then the order history of each enabled pair.
+// ErrBTCMarketsOrderNotFound is returned if no order matches.
+func (b *BTCMarkets) GetOrderByClientID(clientID string) (BTCMarketsOrderResponse, error) {
+	match := func(order BTCMarketsOrderResponse) bool {
+		return order.ClientRequestId == clientID
+	}
+
+	for _, historic := range []bool{false, true} {
+		for _, x := range b.GetEnabledCurrencyPairs() {
+			order, ok, err := b.FindOrder(x.Quote, x.Base, historic, match)
+			if err != nil {
+				return BTCMarketsOrderResponse{}, err
+			}
+			if ok {
+				return order, nil
+			}
+		}
+	}
+	return BTCMarketsOrderResponse{}, ErrBTCMarketsOrderNotFound
+}
+
+// FindOrderByClientID searches the open orders and then the order history of
+// a single currency/instrument pair for the order placed with clientID.
+func (b *BTCMarkets) FindOrderByClientID(currency, instrument, clientID string) (BTCMarketsOrderResponse, bool, error) {
+	match := func(order BTCMarketsOrderResponse) bool {
+		return order.ClientRequestId == clientID
+	}
+
+	for _, historic := range []bool{false, true} {
+		order, ok, err := b.FindOrder(currency, instrument, historic, match)
+		if err != nil || ok {
+			return order, ok, err
+		}
+	}
+	return BTCMarketsOrderResponse{}, false, nil
+}
+
+// FindOrder pages through the open orders, or the order history if historic
+// is set, and returns the first order for which match returns true.
+func (b *BTCMarkets) FindOrder(currency, instrument string, historic bool, match func(BTCMarketsOrderResponse) bool) (BTCMarketsOrderResponse, bool, error) {
+	since := int64(0)
+	for {
+		orders, err := b.GetOrders(currency, instrument, BTCMARKETS_ORDER_LIMIT, since, historic)
+		if err != nil {
+			return BTCMarketsOrderResponse{}, false, err
+		}
+
+		last := since
+		for _, x := range orders {
+			if match(x) {
+				return x, true, nil
+			}
+			if int64(x.ID) > last {
+				last = int64(x.ID)
+			}
+		}
+
+		if len(orders) < BTCMARKETS_ORDER_LIMIT || last == since {
+			return BTCMarketsOrderResponse{}, false, nil
+		}
+		since = last
+	}
+}
+
+// GetClosedOrders pages through the order history and returns the orders in a
+// final state that were created within [from, to].
+func (b *BTCMarkets) GetClosedOrders(currency, instrument string, from, to time.Time) ([]BTCMarketsOrderResponse, error) {
+	closed := []BTCMarketsOrderResponse{}
+	since := int64(0)
+	for {
+		orders, err := b.GetOrders(currency, instrument, BTCMARKETS_ORDER_LIMIT, since, true)
+		if err != nil {
+			return nil, err
+		}
+
+		last := since
+		for _, x := range orders {
+			if int64(x.ID) > last {
+				last = int64(x.ID)
+			}
+
+			created := x.CreatedAt()
+			if created.Before(from) || created.After(to) || !IsBTCMarketsOrderStatusFinal(x.Status) {
+				continue
+			}
+			closed = append(closed, x)
+		}
+
+		if len(orders) < BTCMARKETS_ORDER_LIMIT || last == since {
+			return closed, nil
+		}
+		since = last
+	}
+}
+
+// ExportOrderHistoryCSV writes the orders returned by GetClosedOrders to w as
+// CSV, oldest first, with a header row. Dates are RFC3339 in UTC and amounts
+// are decimal values. Volume is the filled volume and price the average fill
+// price, falling back to the order price for orders with no fills; fee is the
+// total fee charged on the fills.
+func (b *BTCMarkets) ExportOrderHistoryCSV(w io.Writer, currency, instrument string, from, to time.Time) error {
+	orders, err := b.GetClosedOrders(currency, instrument, from, to)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(orders, func(i, j int) bool {
+		return orders[i].CreationTime < orders[j].CreationTime
+	})
 
+	writer := csv.NewWriter(w)
+	err = writer.Write([]string{"date", "side", "type", "price", "volume", "fee", "status", "orderID"})
 	if err != nil {
-		log.Println(err)
+		return err
+	}
+
+	format := func(value float64) string {
+		return strconv.FormatFloat(ConvertFromBTCMarketsUnits(int64(math.Round(value))), 'f', -1, 64)
+	}
+
+	for _, x := range orders {
+		price, volume, notional, fee := x.Price, 0.0, 0.0, 0.0
+		for _, y := range x.Trades {
+			volume += y.Volume
+			notional += y.Price * y.Volume
+			fee += y.Fee
+		}
+		if volume > 0 {
+			price = notional / volume
+		} else if len(x.Trades) == 0 {
+			volume = x.Volume - x.OpenVolume
+		}
+
+		err = writer.Write([]string{
+			x.CreatedAt().Format(time.RFC3339),
+			string(x.OrderSide),
+			string(x.OrderType),
+			format(price),
+			format(volume),
+			format(fee),
+			x.Status,
+			strconv.FormatInt(int64(x.ID), 10),
+		})
+		if err != nil {
+			return err
+		}
 	}
+	writer.Flush()
+	return writer.Error()
 }
 
-func (b *BTCMarkets) GetOrderDetail(orderID []int64) {
+func (b *BTCMarkets) GetOrderDetail(orderID []int64) ([]BTCMarketsOrderResponse, error) {
+	if b.PaperTrading {
+		return b.Paper.GetOrderDetail(orderID), nil
+	}
+
 	type OrderDetail struct {
 		OrderIDs []int64 `json:"orderIds"`
 	}
@@ -322,46 +3517,324 @@ func (b *BTCMarkets) GetOrderDetail(orderID []int64) {
 
 	JSONPayload, err := JSONEncode(orders)
 	if err != nil {
-		log.Println(err)
-		return
+		return nil, err
 	}
 
-	err = b.SendAuthenticatedRequest("POST", BTCMARKETS_ORDER_DETAIL, JSONPayload, nil)
+	type Response struct {
+		Success      bool                      `json:"success"`
+		ErrorCode    int                       `json:"errorCode"`
+		ErrorMessage string                    `json:"errorMessage"`
+		Orders       []BTCMarketsOrderResponse `json:"orders"`
+	}
+	var resp Response
+
+	err = b.SendAuthenticatedRequest("POST", BTCMARKETS_ORDER_DETAIL, JSONPayload, &resp)
 
 	if err != nil {
-		log.Println(err)
+		return nil, err
+	}
+
+	if !resp.Success {
+		return nil, fmt.Errorf("%s Unable to get order detail. Error message: %s", b.GetName(), resp.ErrorMessage)
+	}
+	return resp.Orders, nil
+}
+
+func IsBTCMarketsOrderStatusFinal(status string) bool {
+	switch status {
+	case BTCMARKETS_ORDER_STATUS_FULLY_MATCHED, BTCMARKETS_ORDER_STATUS_CANCELLED, BTCMARKETS_ORDER_STATUS_PARTIALLY_CANCELLED, BTCMARKETS_ORDER_STATUS_FAILED, BTCMARKETS_ORDER_STATUS_ERROR:
+		return true
+	}
+	return false
+}
+
+func (b *BTCMarkets) WaitForOrder(orderID int64, poll, timeout time.Duration) (BTCMarketsOrderResponse, error) {
+	return b.WaitForOrderContext(context.Background(), orderID, poll, timeout)
+}
+
+// WaitForOrderContext polls GetOrderDetail every poll interval until the order
+// reaches a final status, the timeout elapses or ctx is cancelled. The last
+// known order state is returned alongside any error.
+func (b *BTCMarkets) WaitForOrderContext(ctx context.Context, orderID int64, poll, timeout time.Duration) (BTCMarketsOrderResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+
+	order := BTCMarketsOrderResponse{}
+	for {
+		orders, err := b.GetOrderDetail([]int64{orderID})
+		if err != nil {
+			return order, err
+		}
+
+		if len(orders) == 0 {
+			return order, fmt.Errorf("%s Order %d not found.", b.GetName(), orderID)
+		}
+
+		if orders[0].Status != order.Status || orders[0].OpenVolume != order.OpenVolume {
+			b.PublishOrderEvent(orders[0])
+		}
+
+		order = orders[0]
+		if IsBTCMarketsOrderStatusFinal(order.Status) {
+			return order, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return order, ctx.Err()
+		case <-ticker.C:
+		}
 	}
 }
 
-func (b *BTCMarkets) GetAccountBalance() {
-	type Balance struct {
-		Balance      float64 `json:"balance"`
-		PendingFunds float64 `json:"pendingFunds"`
-		Currency     string  `json:"currency"`
+func (b *BTCMarkets) GetAccountBalance() ([]BTCMarketsAccountBalance, error) {
+	if b.PaperTrading {
+		return b.Paper.GetBalances(), nil
 	}
 
-	balance := []Balance{}
+	balance := []BTCMarketsAccountBalance{}
 	err := b.SendAuthenticatedRequest("GET", BTCMARKETS_ACCOUNT_BALANCE, nil, &balance)
 
 	if err != nil {
-		log.Println(err)
+		return nil, err
+	}
+	return balance, nil
+}
+
+// GetFundTransferHistory returns up to limit deposits and withdrawals with
+// an ID greater than since, so passing the last ID seen pages through the
+// history like GetOrders.
+func (b *BTCMarkets) GetFundTransferHistory(limit, since int64) ([]BTCMarketsFundTransfer, error) {
+	if b.PaperTrading {
+		return []BTCMarketsFundTransfer{}, nil
+	}
+
+	values := url.Values{}
+	values.Set("limit", strconv.FormatInt(limit, 10))
+	values.Set("since", strconv.FormatInt(since, 10))
+	path := BTCMARKETS_FUND_TRANSFERS + "?" + values.Encode()
+
+	type Response struct {
+		Success       bool                     `json:"success"`
+		ErrorCode     int                      `json:"errorCode"`
+		ErrorMessage  string                   `json:"errorMessage"`
+		FundTransfers []BTCMarketsFundTransfer `json:"fundTransfers"`
+	}
+	var resp Response
+
+	err := b.SendAuthenticatedRequest("GET", path, nil, &resp)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !resp.Success {
+		return nil, fmt.Errorf("%s Unable to get fund transfer history. Error message: %s", b.GetName(), resp.ErrorMessage)
+	}
+	return resp.FundTransfers, nil
+}
+
+// GetBalanceFor returns the available balance (balance less pending funds)
+// and pending funds held in currency as decimal values.
+// ErrBTCMarketsBalanceNotFound is returned if the account has no balance
+// entry for currency.
+func (b *BTCMarkets) GetBalanceFor(currency string) (available, pending float64, err error) {
+	balances, err := b.GetAccountBalance()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	currency = NormalizeCurrency(currency)
+	for _, x := range balances {
+		if x.Currency == currency {
+			available = ConvertFromBTCMarketsUnits(int64(x.Balance - x.PendingFunds))
+			pending = ConvertFromBTCMarketsUnits(int64(x.PendingFunds))
+			return available, pending, nil
+		}
+	}
+	return 0, 0, ErrBTCMarketsBalanceNotFound
+}
+
+// PortfolioValue sums the account balances into quote. Non-AUD balances are
+// priced by their AUD ticker, then AUD is converted to quote if required.
+// Balances below DustThreshold are skipped. Assets that can't be priced are
+// listed in the returned error alongside the total of those that could.
+func (b *BTCMarkets) PortfolioValue(quote string) (float64, error) {
+	balances, err := b.GetAccountBalance()
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0.0
+	unpriced := []string{}
+	for _, x := range balances {
+		amount := ConvertFromBTCMarketsUnits(int64(x.Balance))
+		if amount == 0 || math.Abs(amount) < b.DustThreshold {
+			continue
+		}
+
+		if x.Currency == quote {
+			total += amount
+			continue
+		}
+
+		value := amount
+		if x.Currency != "AUD" {
+			_, _, last, _, err := b.GetQuote(x.Currency)
+			if err != nil {
+				unpriced = append(unpriced, fmt.Sprintf("%s: %s", x.Currency, err))
+				continue
+			}
+			value = amount * last
+		}
+
+		if quote != "AUD" {
+			rate, err := b.GetFXRate("AUD", quote)
+			if err != nil {
+				unpriced = append(unpriced, fmt.Sprintf("%s: %s", x.Currency, err))
+				continue
+			}
+			value *= rate
+		}
+		total += value
+	}
+
+	if len(unpriced) > 0 {
+		return total, fmt.Errorf("%s unable to price asset(s). Error: %s", b.GetName(), JoinStrings(unpriced, ", "))
+	}
+	return total, nil
+}
+
+func (b *BTCMarkets) ObserveRequest(endpoint string, duration time.Duration, err error) {
+	if b.Metrics == nil {
+		return
+	}
+	b.Metrics.ObserveRequest(endpoint, duration, err)
+}
+
+func (b *BTCMarkets) GetHTTPClient() *http.Client {
+	middleware := append([]HTTPMiddleware{b.SetRequestHeaders}, b.Middleware...)
+	return WrapHTTPClient(b.HTTPClient, middleware)
+}
+
+func (b *BTCMarkets) SetRequestHeaders(next RoundTripperFunc) RoundTripperFunc {
+	return func(req *http.Request) (*http.Response, error) {
+		req = req.Clone(req.Context())
+		if b.UserAgent != "" {
+			req.Header.Set("User-Agent", b.UserAgent)
+		}
+
+		if b.SendRequestID {
+			requestID, err := GetUUID()
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("X-Request-ID", requestID)
+		}
+		return next(req)
+	}
+}
+
+func (b *BTCMarkets) SendPublicRequest(endpoint, path string, result interface{}) error {
+	return b.SendPublicRequestContext(context.Background(), endpoint, path, result)
+}
+
+func (b *BTCMarkets) SendPublicRequestContext(ctx context.Context, endpoint, path string, result interface{}) error {
+	url := b.APIUrl + path
+	body, ttl, ok := b.getCachedResponse(endpoint, url)
+	if ok {
+		return JSONDecodeWithContext(path, body, result)
+	}
+
+	err := b.Breaker.Allow()
+	if err != nil {
+		return err
+	}
+
+	raw := json.RawMessage{}
+	start := time.Now()
+	err = SendHTTPGetRequestWithContext(ctx, b.GetHTTPClient(), url, true, &raw)
+	b.Breaker.Record(err)
+	b.ObserveRequest(endpoint, time.Since(start), err)
+	if err != nil {
+		return err
+	}
+
+	err = JSONDecodeWithContext(path, raw, result)
+	if err != nil {
+		return err
 	}
+	if ttl > 0 {
+		b.setCachedResponse(url, raw)
+	}
+	return nil
 }
 
 func (b *BTCMarkets) SendAuthenticatedRequest(reqType, path string, data []byte, result interface{}) error {
-	nonce := strconv.FormatInt(time.Now().UnixNano(), 10)[0:13]
-	request := ""
+	resp, err := b.SendAuthenticatedRequestRaw(reqType, path, data)
 
-	if data != nil {
-		request = path + "\n" + nonce + "\n" + string(data)
-	} else {
-		request = path + "\n" + nonce + "\n"
+	if err != nil {
+		return err
+	}
+
+	return JSONDecodeWithContext(path, resp, result)
+}
+
+// GetNonce returns the next value for the timestamp header, a millisecond
+// timestamp that always increases, even across restarts when Nonce.Path is
+// set.
+func (b *BTCMarkets) GetNonce() string {
+	return strconv.FormatInt(b.Nonce.Get(), 10)
+}
+
+// LogSecret returns secret redacted by RedactSecret for verbose logging,
+// unless LogSecrets is set.
+func (b *BTCMarkets) LogSecret(secret string) string {
+	if b.LogSecrets {
+		return secret
+	}
+	return RedactSecret(secret)
+}
+
+// BuildSignaturePayload returns "path\nnonce\nbody", the string signed by
+// BuildSignature.
+func BuildSignaturePayload(path, nonce string, body []byte) string {
+	return path + "\n" + nonce + "\n" + string(body)
+}
+
+// BuildSignature returns the Base64 HMAC-SHA512 of BuildSignaturePayload keyed
+// with the decoded API secret, as sent in the signature header.
+func (b *BTCMarkets) BuildSignature(path, nonce string, body []byte) (string, error) {
+	hmac, err := GetHMAC(HASH_SHA512, []byte(BuildSignaturePayload(path, nonce, body)), []byte(b.APISecret))
+	if err != nil {
+		return "", err
+	}
+	return Base64Encode(hmac), nil
+}
+
+func (b *BTCMarkets) SendAuthenticatedRequestRaw(reqType, path string, data []byte) (raw []byte, err error) {
+	err = b.Breaker.Allow()
+	if err != nil {
+		return nil, err
 	}
 
-	hmac := GetHMAC(HASH_SHA512, []byte(request), []byte(b.APISecret))
+	start := time.Now()
+	defer func() {
+		b.Breaker.Record(err)
+		b.ObserveRequest(path, time.Since(start), err)
+	}()
+
+	nonce := b.GetNonce()
+	signature, err := b.BuildSignature(path, nonce, data)
+	if err != nil {
+		return nil, err
+	}
 
 	if b.Verbose {
-		log.Printf("Sending %s request to URL %s with params %s\n", reqType, BTCMARKETS_API_URL+path, request)
+		log.Printf("Sending %s request to URL %s with params %s, apikey %s and signature %s\n", reqType, b.APIUrl+path, BuildSignaturePayload(path, nonce, data), b.LogSecret(b.APIKey), b.LogSecret(signature))
 	}
 
 	headers := make(map[string]string)
@@ -370,23 +3843,21 @@ func (b *BTCMarkets) SendAuthenticatedRequest(reqType, path string, data []byte,
 	headers["Content-Type"] = "application/json"
 	headers["apikey"] = b.APIKey
 	headers["timestamp"] = nonce
-	headers["signature"] = Base64Encode(hmac)
+	headers["signature"] = signature
 
-	resp, err := SendHTTPRequest(reqType, BTCMARKETS_API_URL+path, headers, bytes.NewBuffer(data))
+	resp, err := SendHTTPRequestWithClient(b.GetHTTPClient(), reqType, b.APIUrl+path, headers, bytes.NewBuffer(data))
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if b.Verbose {
 		log.Printf("Recieved raw: %s\n", resp)
 	}
 
-	err = JSONDecode([]byte(resp), &result)
-
-	if err != nil {
-		return err
+	if !IsJSONResponse([]byte(resp)) {
+		return nil, ErrExchangeUnavailable
 	}
 
-	return nil
+	return []byte(resp), nil
 }
@@ -0,0 +1,4455 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testBTCMarketsAPIKey    = "test-api-key"
+	testBTCMarketsAPISecret = "test-api-secret"
+
+	testBTCMarketsTicker    = `{"bestBid":100.5,"bestAsk":101.25,"lastPrice":101,"currency":"AUD","instrument":"BTC","timestamp":1500000000}`
+	testBTCMarketsOrderbook = `{"currency":"AUD","instrument":"BTC","timestamp":1500000000,"asks":[[101.25,0.5],[102,1]],"bids":[[100.5,2],[100,3]]}`
+	testBTCMarketsTrades    = `[{"tid":2,"amount":0.25,"price":101,"date":1500000010},{"tid":1,"amount":1,"price":100,"date":1500000000}]`
+	testBTCMarketsBalances  = `[{"balance":150000000000,"pendingFunds":0,"currency":"AUD"},{"balance":200000000,"pendingFunds":50000000,"currency":"BTC"}]`
+)
+
+// newTestBTCMarkets returns a BTCMarkets with its defaults set and APIUrl
+// pointed at an httptest.Server running handler. The server is closed when
+// the test finishes.
+func newTestBTCMarkets(t *testing.T, handler http.HandlerFunc) *BTCMarkets {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	b := &BTCMarkets{}
+	b.SetDefaults()
+	b.SetURL(server.URL)
+	return b
+}
+
+// newTestBTCMarketsAuth is newTestBTCMarkets with authenticated API support
+// enabled and the test API key and secret set.
+func newTestBTCMarketsAuth(t *testing.T, handler http.HandlerFunc) *BTCMarkets {
+	t.Helper()
+
+	b := newTestBTCMarkets(t, handler)
+	b.EnableAuthenticatedAPI()
+	err := b.SetAPIKeys(testBTCMarketsAPIKey, base64.StdEncoding.EncodeToString([]byte(testBTCMarketsAPISecret)))
+	if err != nil {
+		t.Fatalf("SetAPIKeys: %s", err)
+	}
+	return b
+}
+
+// respondWith returns a handler that replies to every request with status and
+// body.
+func respondWith(status int, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}
+}
+
+// testBTCMarketsRoutes returns a handler serving body for each exact request
+// path and 404 for anything else.
+func testBTCMarketsRoutes(routes map[string]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, ok := routes[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(body))
+	}
+}
+
+func TestSetDefaultsAPIUrl(t *testing.T) {
+	b := BTCMarkets{}
+	b.SetDefaults()
+	if b.APIUrl != BTCMARKETS_API_URL {
+		t.Fatalf("APIUrl = %q, want %q", b.APIUrl, BTCMARKETS_API_URL)
+	}
+
+	b.SetURL("http://localhost:1234")
+	if b.APIUrl != "http://localhost:1234" {
+		t.Fatalf("APIUrl = %q after SetURL", b.APIUrl)
+	}
+}
+
+func TestGetTicker(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		want    BTCMarketsTicker
+		wantErr error
+		anyErr  bool
+	}{
+		{
+			name:   "success",
+			status: http.StatusOK,
+			body:   testBTCMarketsTicker,
+			want:   BTCMarketsTicker{BestBID: 100.5, BestAsk: 101.25, LastPrice: 101, Currency: "AUD", Instrument: "BTC", Timestamp: 1500000000},
+		},
+		{name: "http error", status: http.StatusInternalServerError, body: `{}`, anyErr: true},
+		{name: "unavailable", status: http.StatusServiceUnavailable, body: `down for maintenance`, wantErr: ErrExchangeUnavailable},
+		{name: "html body", status: http.StatusOK, body: `<html>maintenance</html>`, wantErr: ErrExchangeUnavailable},
+		{name: "malformed json", status: http.StatusOK, body: `{"bestBid":`, anyErr: true},
+		{name: "wrong types", status: http.StatusOK, body: `{"bestBid":"abc","instrument":"BTC"}`, anyErr: true},
+		{name: "invalid ticker", status: http.StatusOK, body: `{"bestBid":1,"bestAsk":2,"lastPrice":1.5}`, anyErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := ""
+			b := newTestBTCMarkets(t, func(w http.ResponseWriter, r *http.Request) {
+				path = r.URL.Path
+				respondWith(test.status, test.body)(w, r)
+			})
+
+			ticker, err := b.GetTicker("BTC")
+			if path != "/market/BTC/AUD/tick" {
+				t.Errorf("requested %q", path)
+			}
+			if test.wantErr != nil && err != test.wantErr {
+				t.Fatalf("err = %v, want %v", err, test.wantErr)
+			}
+			if test.anyErr && err == nil {
+				t.Fatal("expected an error")
+			}
+			if test.wantErr == nil && !test.anyErr {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ticker != test.want {
+					t.Fatalf("ticker = %+v, want %+v", ticker, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestGetOrderbook(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		want    BTCMarketsOrderbook
+		wantErr error
+		anyErr  bool
+	}{
+		{
+			name:   "success",
+			status: http.StatusOK,
+			body:   testBTCMarketsOrderbook,
+			want: BTCMarketsOrderbook{
+				Currency:   "AUD",
+				Instrument: "BTC",
+				Timestamp:  1500000000,
+				Asks:       [][]float64{{101.25, 0.5}, {102, 1}},
+				Bids:       [][]float64{{100.5, 2}, {100, 3}},
+			},
+		},
+		{name: "http error", status: http.StatusBadGateway, body: `{}`, anyErr: true},
+		{name: "unavailable", status: http.StatusServiceUnavailable, body: `{}`, wantErr: ErrExchangeUnavailable},
+		{name: "html body", status: http.StatusOK, body: `<!DOCTYPE html>`, wantErr: ErrExchangeUnavailable},
+		{name: "malformed json", status: http.StatusOK, body: `{"asks":[[1,2],`, anyErr: true},
+		{name: "wrong types", status: http.StatusOK, body: `{"asks":"none"}`, anyErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := ""
+			b := newTestBTCMarkets(t, func(w http.ResponseWriter, r *http.Request) {
+				path = r.URL.Path
+				respondWith(test.status, test.body)(w, r)
+			})
+
+			orderbook, err := b.GetOrderbook("BTC")
+			if path != "/market/BTC/AUD/orderbook" {
+				t.Errorf("requested %q", path)
+			}
+			if test.wantErr != nil && err != test.wantErr {
+				t.Fatalf("err = %v, want %v", err, test.wantErr)
+			}
+			if test.anyErr && err == nil {
+				t.Fatal("expected an error")
+			}
+			if test.wantErr == nil && !test.anyErr {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(orderbook, test.want) {
+					t.Fatalf("orderbook = %+v, want %+v", orderbook, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestGetTrades(t *testing.T) {
+	tests := []struct {
+		name    string
+		since   string
+		status  int
+		body    string
+		want    []BTCMarketsTrade
+		wantURL string
+		wantErr error
+		anyErr  bool
+	}{
+		{
+			name:    "success",
+			status:  http.StatusOK,
+			body:    testBTCMarketsTrades,
+			want:    []BTCMarketsTrade{{TradeID: 2, Amount: 0.25, Price: 101, Date: 1500000010}, {TradeID: 1, Amount: 1, Price: 100, Date: 1500000000}},
+			wantURL: "/market/BTC/AUD/trades",
+		},
+		{
+			name:    "since",
+			since:   "1",
+			status:  http.StatusOK,
+			body:    `[]`,
+			want:    []BTCMarketsTrade{},
+			wantURL: "/market/BTC/AUD/trades?since=1",
+		},
+		{name: "http error", status: http.StatusNotFound, body: `{}`, wantURL: "/market/BTC/AUD/trades", anyErr: true},
+		{name: "unavailable", status: http.StatusServiceUnavailable, body: ``, wantURL: "/market/BTC/AUD/trades", wantErr: ErrExchangeUnavailable},
+		{name: "malformed json", status: http.StatusOK, body: `[{"tid":1,`, wantURL: "/market/BTC/AUD/trades", anyErr: true},
+		{name: "wrong types", status: http.StatusOK, body: `{"tid":1}`, wantURL: "/market/BTC/AUD/trades", anyErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			url := ""
+			b := newTestBTCMarkets(t, func(w http.ResponseWriter, r *http.Request) {
+				url = r.URL.RequestURI()
+				respondWith(test.status, test.body)(w, r)
+			})
+
+			trades, err := b.GetTrades("BTC", test.since)
+			if url != test.wantURL {
+				t.Errorf("requested %q, want %q", url, test.wantURL)
+			}
+			if test.wantErr != nil && err != test.wantErr {
+				t.Fatalf("err = %v, want %v", err, test.wantErr)
+			}
+			if test.anyErr && err == nil {
+				t.Fatal("expected an error")
+			}
+			if test.wantErr == nil && !test.anyErr {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(trades, test.want) {
+					t.Fatalf("trades = %+v, want %+v", trades, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSetAPIKeysInvalidSecret(t *testing.T) {
+	b := BTCMarkets{}
+	b.SetDefaults()
+	b.Enabled = true
+	b.EnableAuthenticatedAPI()
+
+	err := b.SetAPIKeys(testBTCMarketsAPIKey, "not base64!!")
+	if err == nil {
+		t.Fatal("SetAPIKeys accepted an invalid base64 secret")
+	}
+	if !strings.HasPrefix(err.Error(), b.GetName()) {
+		t.Errorf("error %q doesn't name the exchange", err)
+	}
+	if !b.Enabled {
+		t.Error("SetAPIKeys disabled the exchange")
+	}
+	if b.APIKey != "" || b.APISecret != "" {
+		t.Errorf("keys set after a failed decode: %q %q", b.APIKey, b.APISecret)
+	}
+}
+
+func TestSetAPIKeysAuthDisabled(t *testing.T) {
+	b := BTCMarkets{}
+	b.SetDefaults()
+
+	err := b.SetAPIKeys(testBTCMarketsAPIKey, base64.StdEncoding.EncodeToString([]byte(testBTCMarketsAPISecret)))
+	if err != ErrBTCMarketsAuthAPIDisabled {
+		t.Fatalf("SetAPIKeys error = %v, want ErrBTCMarketsAuthAPIDisabled", err)
+	}
+	if b.APIKey != "" || b.APISecret != "" {
+		t.Errorf("keys set while authenticated API support is disabled: %q %q", b.APIKey, b.APISecret)
+	}
+
+	b.EnableAuthenticatedAPI()
+	err = b.SetAPIKeys(testBTCMarketsAPIKey, base64.StdEncoding.EncodeToString([]byte(testBTCMarketsAPISecret)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.APIKey != testBTCMarketsAPIKey || b.APISecret != testBTCMarketsAPISecret {
+		t.Errorf("keys = %q %q", b.APIKey, b.APISecret)
+	}
+}
+
+func TestSendAuthenticatedRequestSigning(t *testing.T) {
+	var header http.Header
+	var method, path string
+	var body []byte
+	b := newTestBTCMarketsAuth(t, func(w http.ResponseWriter, r *http.Request) {
+		header, method, path = r.Header, r.Method, r.URL.Path
+		body, _ = ioutil.ReadAll(r.Body)
+		w.Write([]byte(`{"success":true,"orders":[]}`))
+	})
+
+	_, err := b.GetOpenOrders("AUD", "BTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if method != "POST" || path != BTCMARKETS_ORDER_OPEN {
+		t.Fatalf("request = %s %s", method, path)
+	}
+	if header.Get("apikey") != testBTCMarketsAPIKey {
+		t.Errorf("apikey = %q", header.Get("apikey"))
+	}
+	if header.Get("Content-Type") != "application/json" {
+		t.Errorf("Content-Type = %q", header.Get("Content-Type"))
+	}
+
+	nonce := header.Get("timestamp")
+	if nonce == "" {
+		t.Fatal("missing timestamp header")
+	}
+
+	mac := hmac.New(sha512.New, []byte(testBTCMarketsAPISecret))
+	mac.Write([]byte(path + "\n" + nonce + "\n" + string(body)))
+	want := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	if header.Get("signature") != want {
+		t.Fatalf("signature = %q, want %q", header.Get("signature"), want)
+	}
+}
+
+func TestMiddlewareSeesSignedRequest(t *testing.T) {
+	var served int32
+	b := newTestBTCMarketsAuth(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&served, 1)
+		w.Write([]byte(`{"success":true,"orders":[]}`))
+	})
+
+	var order []string
+	var header http.Header
+	var body []byte
+	b.Middleware = []HTTPMiddleware{
+		func(next RoundTripperFunc) RoundTripperFunc {
+			return func(req *http.Request) (*http.Response, error) {
+				order = append(order, "first")
+				header = req.Header.Clone()
+				body, _ = ioutil.ReadAll(req.Body)
+				req.Body = ioutil.NopCloser(bytes.NewReader(body))
+				return next(req)
+			}
+		},
+		func(next RoundTripperFunc) RoundTripperFunc {
+			return func(req *http.Request) (*http.Response, error) {
+				order = append(order, "second")
+				return next(req)
+			}
+		},
+	}
+
+	_, err := b.GetOpenOrders("AUD", "BTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(order, []string{"first", "second"}) {
+		t.Errorf("middleware order = %v", order)
+	}
+	if atomic.LoadInt32(&served) != 1 {
+		t.Errorf("server saw %d requests, want 1", served)
+	}
+
+	mac := hmac.New(sha512.New, []byte(testBTCMarketsAPISecret))
+	mac.Write([]byte(BTCMARKETS_ORDER_OPEN + "\n" + header.Get("timestamp") + "\n" + string(body)))
+	want := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	if header.Get("signature") == "" || header.Get("signature") != want {
+		t.Errorf("middleware signature = %q, want %q", header.Get("signature"), want)
+	}
+	if header.Get("apikey") != testBTCMarketsAPIKey {
+		t.Errorf("middleware apikey = %q", header.Get("apikey"))
+	}
+}
+
+func TestMiddlewareMocksResponse(t *testing.T) {
+	b := newTestBTCMarkets(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Unexpected request %s reached the server.", r.URL.Path)
+	})
+	b.Middleware = []HTTPMiddleware{
+		func(next RoundTripperFunc) RoundTripperFunc {
+			return func(req *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{"Content-Type": []string{"application/json"}},
+					Body:       ioutil.NopCloser(strings.NewReader(testBTCMarketsTicker)),
+					Request:    req,
+				}, nil
+			}
+		},
+	}
+
+	ticker, err := b.GetTicker("BTC-AUD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ticker.Instrument != "BTC" || ticker.Currency != "AUD" {
+		t.Errorf("ticker = %+v", ticker)
+	}
+}
+
+func TestGetAccountBalance(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		want    []BTCMarketsAccountBalance
+		wantErr error
+		anyErr  bool
+	}{
+		{
+			name:   "success",
+			status: http.StatusOK,
+			body:   testBTCMarketsBalances,
+			want: []BTCMarketsAccountBalance{
+				{Balance: 150000000000, PendingFunds: 0, Currency: "AUD"},
+				{Balance: 200000000, PendingFunds: 50000000, Currency: "BTC"},
+			},
+		},
+		{name: "unavailable", status: http.StatusServiceUnavailable, body: `{}`, wantErr: ErrExchangeUnavailable},
+		{name: "html body", status: http.StatusBadGateway, body: `<html>bad gateway</html>`, wantErr: ErrExchangeUnavailable},
+		{name: "malformed json", status: http.StatusOK, body: `[{"balance":`, anyErr: true},
+		{name: "api error", status: http.StatusOK, body: `{"success":false,"errorCode":1,"errorMessage":"Authentication failed."}`, anyErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			method, path := "", ""
+			b := newTestBTCMarketsAuth(t, func(w http.ResponseWriter, r *http.Request) {
+				method, path = r.Method, r.URL.Path
+				respondWith(test.status, test.body)(w, r)
+			})
+
+			balances, err := b.GetAccountBalance()
+			if method != "GET" || path != BTCMARKETS_ACCOUNT_BALANCE {
+				t.Errorf("request = %s %s", method, path)
+			}
+			if test.wantErr != nil && err != test.wantErr {
+				t.Fatalf("err = %v, want %v", err, test.wantErr)
+			}
+			if test.anyErr && err == nil {
+				t.Fatal("expected an error")
+			}
+			if test.wantErr == nil && !test.anyErr {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(balances, test.want) {
+					t.Fatalf("balances = %+v, want %+v", balances, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestOrder(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		wantID int
+		anyErr bool
+	}{
+		{name: "success", body: `{"success":true,"id":12345,"clientRequestId":"abc"}`, wantID: 12345},
+		{name: "rejected", body: `{"success":false,"errorCode":3,"errorMessage":"Invalid argument."}`, anyErr: true},
+		{name: "malformed json", body: `{"success":tr`, anyErr: true},
+		{name: "html body", body: `maintenance`, anyErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var body []byte
+			path := ""
+			b := newTestBTCMarketsAuth(t, func(w http.ResponseWriter, r *http.Request) {
+				path = r.URL.Path
+				body, _ = ioutil.ReadAll(r.Body)
+				w.Write([]byte(test.body))
+			})
+
+			id, clientReq, err := b.Order("AUD", "BTC", 10000000000, 100000000, BTCMARKETS_ORDER_SIDE_BID, BTCMARKETS_ORDER_TYPE_LIMIT, "abc")
+			if path != BTCMARKETS_ORDER_CREATE {
+				t.Errorf("requested %q", path)
+			}
+			if clientReq != "abc" {
+				t.Errorf("clientReq = %q", clientReq)
+			}
+			if test.anyErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != test.wantID {
+				t.Fatalf("id = %d, want %d", id, test.wantID)
+			}
+
+			want := `{"currency":"AUD","instrument":"BTC","price":10000000000,"volume":100000000,"orderSide":"Bid","ordertype":"Limit","clientRequestId":"abc"}`
+			if string(body) != want {
+				t.Fatalf("body = %s, want %s", body, want)
+			}
+		})
+	}
+}
+
+func TestGetBestLevels(t *testing.T) {
+	var requests int32
+	body := testBTCMarketsOrderbook
+	b := newTestBTCMarkets(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte(body))
+	})
+	b.OrderbookCacheTTL = time.Minute
+
+	price, amount, err := b.GetLowestAsk("BTC-AUD")
+	if err != nil || price != 101.25 || amount != 0.5 {
+		t.Errorf("GetLowestAsk = %f %f %v, want 101.25 0.5", price, amount, err)
+	}
+	price, amount, err = b.GetHighestBid("btc/aud")
+	if err != nil || price != 100.5 || amount != 2 {
+		t.Errorf("GetHighestBid = %f %f %v, want 100.5 2", price, amount, err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("orderbook fetched %d times, want 1 while the cache is fresh", n)
+	}
+
+	b.OrderbookCacheTTL = 0
+	body = `{"currency":"AUD","instrument":"BTC","timestamp":1500000000,"asks":[],"bids":[]}`
+	_, _, err = b.GetLowestAsk("BTC-AUD")
+	if err != ErrBTCMarketsOrderbookEmpty {
+		t.Errorf("GetLowestAsk on empty book = %v, want ErrBTCMarketsOrderbookEmpty", err)
+	}
+	_, _, err = b.GetHighestBid("BTC-AUD")
+	if err != ErrBTCMarketsOrderbookEmpty {
+		t.Errorf("GetHighestBid on empty book = %v, want ErrBTCMarketsOrderbookEmpty", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("orderbook fetched %d times, want 3 without a cache", n)
+	}
+}
+
+func TestAverageFillPrice(t *testing.T) {
+	fills := `"trades":[` +
+		`{"id":1,"price":10000000000,"volume":50000000,"fee":10000000},` +
+		`{"id":2,"price":10200000000,"volume":30000000,"fee":10000000},` +
+		`{"id":3,"price":10500000000,"volume":20000000,"fee":10000000}]`
+
+	tests := []struct {
+		name    string
+		body    string
+		gross   float64
+		net     float64
+		wantErr error
+		anyErr  bool
+	}{
+		{
+			name:  "bid",
+			body:  `{"success":true,"orders":[{"id":7,"orderSide":"Bid",` + fills + `}]}`,
+			gross: 101.6 * BTCMARKETS_UNIT,
+			net:   101.9 * BTCMARKETS_UNIT,
+		},
+		{
+			name:  "ask",
+			body:  `{"success":true,"orders":[{"id":7,"orderSide":"Ask",` + fills + `}]}`,
+			gross: 101.6 * BTCMARKETS_UNIT,
+			net:   101.3 * BTCMARKETS_UNIT,
+		},
+		{name: "no fills", body: `{"success":true,"orders":[{"id":7,"orderSide":"Bid","trades":[]}]}`, wantErr: ErrBTCMarketsNoFills},
+		{name: "not found", body: `{"success":true,"orders":[]}`, anyErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newTestBTCMarketsAuth(t, respondWith(http.StatusOK, test.body))
+
+			gross, net, err := b.GetAverageFillPrices(7)
+			if test.wantErr != nil || test.anyErr {
+				if err == nil || (test.wantErr != nil && err != test.wantErr) {
+					t.Fatalf("error = %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(gross-test.gross) > 1 || math.Abs(net-test.net) > 1 {
+				t.Errorf("GetAverageFillPrices = %f %f, want %f %f", gross, net, test.gross, test.net)
+			}
+
+			price, err := b.AverageFillPrice(7)
+			if err != nil || price != gross {
+				t.Errorf("AverageFillPrice = %f %v, want %f", price, err, gross)
+			}
+			price, err = b.AverageFillPriceNetOfFees(7)
+			if err != nil || price != net {
+				t.Errorf("AverageFillPriceNetOfFees = %f %v, want %f", price, err, net)
+			}
+		})
+	}
+}
+
+const testBTCMarketsMixedOrders = `{"success":true,"orders":[` +
+	`{"id":1,"currency":"AUD","instrument":"BTC","status":"Placed"},` +
+	`{"id":2,"currency":"AUD","instrument":"BTC","status":"Fully Matched"},` +
+	`{"id":3,"currency":"AUD","instrument":"BTC","status":"Partially Matched"},` +
+	`{"id":4,"currency":"AUD","instrument":"BTC","status":"Cancelled"},` +
+	`{"id":5,"currency":"AUD","instrument":"BTC","status":"New"}]}`
+
+func TestGetOpenOrders(t *testing.T) {
+	var path string
+	var body []byte
+	b := newTestBTCMarketsAuth(t, func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		body, _ = ioutil.ReadAll(r.Body)
+		w.Write([]byte(testBTCMarketsMixedOrders))
+	})
+
+	orders, err := b.GetOpenOrders("AUD", "BTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != BTCMARKETS_ORDER_OPEN {
+		t.Errorf("path = %q, want %q", path, BTCMARKETS_ORDER_OPEN)
+	}
+	if !strings.Contains(string(body), `"currency":"AUD"`) || !strings.Contains(string(body), `"instrument":"BTC"`) {
+		t.Errorf("request body = %s", body)
+	}
+
+	ids := []float64{}
+	for _, x := range orders {
+		ids = append(ids, x.ID)
+	}
+	if !reflect.DeepEqual(ids, []float64{1, 3}) {
+		t.Errorf("open order IDs = %v, want [1 3]", ids)
+	}
+}
+
+func TestCancelAllOrders(t *testing.T) {
+	tests := []struct {
+		name       string
+		open       string
+		cancel     string
+		wantCancel string
+		wantIDs    []int64
+		wantErr    bool
+	}{
+		{
+			name:       "cancels open orders in one batch",
+			open:       testBTCMarketsMixedOrders,
+			cancel:     `{"success":true,"responses":[{"success":true,"id":1},{"success":true,"id":3}]}`,
+			wantCancel: `{"orderIds":[1,3]}`,
+			wantIDs:    []int64{1, 3},
+		},
+		{
+			name:    "nothing open",
+			open:    `{"success":true,"orders":[{"id":2,"status":"Fully Matched"}]}`,
+			wantIDs: []int64{},
+		},
+		{
+			name:       "partial failure",
+			open:       testBTCMarketsMixedOrders,
+			cancel:     `{"success":true,"responses":[{"success":true,"id":1},{"success":false,"id":3,"errorMessage":"Order is not open."}]}`,
+			wantCancel: `{"orderIds":[1,3]}`,
+			wantIDs:    []int64{1, 3},
+			wantErr:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var cancels []string
+			b := newTestBTCMarketsAuth(t, func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case BTCMARKETS_ORDER_OPEN:
+					w.Write([]byte(test.open))
+				case BTCMARKETS_ORDER_CANCEL:
+					body, _ := ioutil.ReadAll(r.Body)
+					cancels = append(cancels, string(body))
+					w.Write([]byte(test.cancel))
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			})
+
+			results, err := b.CancelAllOrders("AUD", "BTC")
+			if (err != nil) != test.wantErr {
+				t.Fatalf("CancelAllOrders error = %v, want error %v", err, test.wantErr)
+			}
+
+			ids := []int64{}
+			for _, x := range results {
+				ids = append(ids, x.ID)
+			}
+			if !reflect.DeepEqual(ids, test.wantIDs) {
+				t.Errorf("result IDs = %v, want %v", ids, test.wantIDs)
+			}
+
+			if test.wantCancel == "" {
+				if len(cancels) != 0 {
+					t.Errorf("cancel requests = %v, want none", cancels)
+				}
+				return
+			}
+			if !reflect.DeepEqual(cancels, []string{test.wantCancel}) {
+				t.Errorf("cancel requests = %v, want [%s]", cancels, test.wantCancel)
+			}
+		})
+	}
+}
+
+func TestCrossedOrderbook(t *testing.T) {
+	const crossed = `{"currency":"AUD","instrument":"BTC","bids":[[101,1],[99,1]],"asks":[[100,1],[102,1]]}`
+	b := newTestBTCMarketsAuth(t, testBTCMarketsRoutes(map[string]string{
+		"/market/BTC/AUD/orderbook": crossed,
+		BTCMARKETS_ORDER_CREATE:     `{"success":true,"id":7,"clientRequestId":"abc"}`,
+	}))
+	b.AvailablePairs = []string{"BTC"}
+	b.OrderbookCacheTTL = time.Minute
+
+	orderbook, err := b.GetOrderbook("BTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !orderbook.Crossed || len(orderbook.Bids) != 2 || len(orderbook.Asks) != 2 {
+		t.Fatalf("orderbook = %+v", orderbook)
+	}
+
+	orderbook, err = b.GetOrderbookCached("BTC")
+	if err != nil || !orderbook.Crossed {
+		t.Fatalf("cached orderbook = %+v, err = %v", orderbook, err)
+	}
+
+	price, amount, err := b.GetLowestAsk("BTC")
+	if err != nil || price != 100 || amount != 1 {
+		t.Fatalf("GetLowestAsk = %f %f %v", price, amount, err)
+	}
+
+	price, amount, err = b.GetHighestBid("BTC")
+	if err != nil || price != 101 || amount != 1 {
+		t.Fatalf("GetHighestBid = %f %f %v", price, amount, err)
+	}
+
+	imbalance, err := b.OrderbookImbalance("BTC", 2)
+	if err != nil || imbalance != 0 {
+		t.Fatalf("OrderbookImbalance = %f %v", imbalance, err)
+	}
+
+	fillable, err := b.EstimateFillLikelihood("BTC", BTCMARKETS_ORDER_SIDE_BID, 101, 5)
+	if err != nil || fillable != 1 {
+		t.Fatalf("EstimateFillLikelihood = %f %v", fillable, err)
+	}
+
+	orderID, err := b.MarketBuyWithSlippage("BTC", 50, 1)
+	if err != nil || orderID != 7 {
+		t.Fatalf("MarketBuyWithSlippage = %d %v", orderID, err)
+	}
+}
+
+func TestOrderbookIsCrossed(t *testing.T) {
+	tests := []struct {
+		name      string
+		orderbook BTCMarketsOrderbook
+		crossed   bool
+	}{
+		{name: "normal", orderbook: BTCMarketsOrderbook{Bids: [][]float64{{1, 1}}, Asks: [][]float64{{2, 1}}}},
+		{name: "locked", orderbook: BTCMarketsOrderbook{Bids: [][]float64{{2, 1}}, Asks: [][]float64{{2, 1}}}, crossed: true},
+		{name: "crossed", orderbook: BTCMarketsOrderbook{Bids: [][]float64{{3, 1}}, Asks: [][]float64{{2, 1}}}, crossed: true},
+		{name: "empty side", orderbook: BTCMarketsOrderbook{Bids: [][]float64{{3, 1}}}},
+	}
+
+	for _, test := range tests {
+		crossed, _, _ := test.orderbook.IsCrossed()
+		if crossed != test.crossed {
+			t.Errorf("%s: IsCrossed = %t, want %t", test.name, crossed, test.crossed)
+		}
+	}
+}
+
+func TestPairKey(t *testing.T) {
+	b := BTCMarkets{}
+	b.SetDefaults()
+
+	tests := []struct {
+		pair string
+		want string
+	}{
+		{pair: "BTC", want: "BTC-AUD"},
+		{pair: "btc", want: "BTC-AUD"},
+		{pair: " Btc ", want: "BTC-AUD"},
+		{pair: "BTC-AUD", want: "BTC-AUD"},
+		{pair: "btc/aud", want: "BTC-AUD"},
+		{pair: "BTCAUD", want: "BTC-AUD"},
+		{pair: "ETH-BTC", want: "ETH-BTC"},
+		{pair: "BTC-AUD-USD", want: "BTC-AUD-USD"},
+	}
+
+	for _, test := range tests {
+		if key := b.PairKey(test.pair); key != test.want {
+			t.Errorf("PairKey(%q) = %q, want %q", test.pair, key, test.want)
+		}
+	}
+
+	b.PairDelimiter = "/"
+	if key := b.PairKey("btc/aud"); key != "BTC/AUD" {
+		t.Errorf("PairKey with delimiter = %q", key)
+	}
+	if key := b.PairKey(b.PairKey("btc")); key != "BTC/AUD" {
+		t.Errorf("PairKey isn't idempotent, got %q", key)
+	}
+}
+
+func TestEnablePairCanonical(t *testing.T) {
+	b := BTCMarkets{}
+	b.SetDefaults()
+	b.AvailablePairs = []string{"BTC", "LTC"}
+	b.EnabledPairs = []string{}
+
+	err := b.EnablePair("BTC-AUD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.EnablePair("btc/aud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(b.EnabledPairs, []string{"BTC-AUD"}) {
+		t.Fatalf("EnabledPairs = %v", b.EnabledPairs)
+	}
+	if !b.IsPairEnabled("BTC") {
+		t.Fatal("BTC isn't enabled")
+	}
+	if b.EnablePair("ETH-AUD") == nil {
+		t.Fatal("enabled an unavailable pair")
+	}
+
+	b.DisablePair("btc")
+	if len(b.EnabledPairs) != 0 {
+		t.Fatalf("EnabledPairs = %v", b.EnabledPairs)
+	}
+}
+
+func TestRefreshAvailablePairsCanonical(t *testing.T) {
+	b := newTestBTCMarkets(t, testBTCMarketsRoutes(map[string]string{
+		BTCMARKETS_MARKETS_ACTIVE: `{"success":true,"markets":[{"instrument":"BTC","currency":"AUD","status":"Online"},{"instrument":"XRP","currency":"AUD","status":"Offline"}]}`,
+	}))
+	b.EnabledPairs = []string{"BTC-AUD", "xrp/aud"}
+
+	err := b.RefreshAvailablePairs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(b.AvailablePairs, []string{"BTC"}) || !reflect.DeepEqual(b.EnabledPairs, []string{"BTC-AUD"}) {
+		t.Fatalf("AvailablePairs = %v, EnabledPairs = %v", b.AvailablePairs, b.EnabledPairs)
+	}
+}
+
+func TestTickerCacheKeys(t *testing.T) {
+	b := BTCMarkets{}
+	b.SetDefaults()
+
+	tickers, unsubscribe := b.SubscribeTicker("btc")
+	defer unsubscribe()
+
+	b.UpdateTicker("BTC", BTCMarketsTicker{LastPrice: 1})
+	b.UpdateTicker("btc/aud", BTCMarketsTicker{LastPrice: 2})
+	err := b.WebsocketHandleMessage([]byte(`{"marketId":"BTC-AUD","bestBid":"2","bestAsk":"4","lastPrice":"3","timestamp":"2019-01-01T00:00:00Z","messageType":"tick"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(b.Ticker) != 1 || b.Ticker["BTC-AUD"].LastPrice != 3 {
+		t.Fatalf("Ticker = %+v", b.Ticker)
+	}
+
+	for _, want := range []float64{1, 2, 3} {
+		ticker := <-tickers
+		if ticker.LastPrice != want {
+			t.Fatalf("LastPrice = %f, want %f", ticker.LastPrice, want)
+		}
+	}
+}
+
+func TestGetOrderByClientIDPairs(t *testing.T) {
+	var bodies []string
+	b := newTestBTCMarketsAuth(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if r.URL.Path == BTCMARKETS_ORDER_HISTORY {
+			w.Write([]byte(`{"success":true,"orders":[{"id":3,"clientRequestId":"abc","status":"Cancelled"}]}`))
+			return
+		}
+		w.Write([]byte(`{"success":true,"orders":[]}`))
+	})
+	b.EnabledPairs = []string{"ETH-BTC"}
+
+	order, err := b.GetOrderByClientID("abc")
+	if err != nil || order.ID != 3 {
+		t.Fatalf("order = %+v, err = %v", order, err)
+	}
+	for _, x := range bodies {
+		if !strings.Contains(x, `"currency":"BTC","instrument":"ETH"`) {
+			t.Fatalf("request body = %s", x)
+		}
+	}
+}
+
+func TestFXRateCache(t *testing.T) {
+	calls := 0
+	b := BTCMarkets{}
+	b.SetDefaults()
+	b.Converter = CurrencyConverterFunc(func(amount float64, from, to string) (float64, error) {
+		calls++
+		return amount * 0.7, nil
+	})
+
+	if b.FXCacheTTL != BTCMARKETS_DEFAULT_FX_CACHE_TTL {
+		t.Errorf("FXCacheTTL = %s, want %s", b.FXCacheTTL, BTCMARKETS_DEFAULT_FX_CACHE_TTL)
+	}
+
+	for i := 0; i < 10; i++ {
+		entries := b.UpdateTicker("BTC", BTCMarketsTicker{LastPrice: 100, BestBID: 99, BestAsk: 101})
+		if len(entries) != 2 || math.Abs(entries[1].Price-70) > 1e-9 {
+			t.Fatalf("entries = %+v", entries)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("converter called %d times within the TTL, want 1", calls)
+	}
+
+	b.SetFXCacheTTL(0)
+	b.UpdateTicker("BTC", BTCMarketsTicker{LastPrice: 100})
+	if calls != 2 {
+		t.Errorf("converter called %d times after the rate went stale, want 2", calls)
+	}
+}
+
+func TestLastFXRate(t *testing.T) {
+	b := BTCMarkets{}
+	b.SetDefaults()
+	b.Converter = CurrencyConverterFunc(func(amount float64, from, to string) (float64, error) {
+		if from != "AUD" || to != "USD" {
+			t.Errorf("converting %s to %s, want AUD to USD", from, to)
+		}
+		return amount * 0.65, nil
+	})
+
+	if _, _, ok := b.LastFXRate("AUD", "USD"); ok {
+		t.Fatal("LastFXRate reported a rate before any conversion")
+	}
+
+	before := time.Now()
+	entries := b.UpdateTicker("BTC", BTCMarketsTicker{LastPrice: 200})
+	rate, at, ok := b.LastFXRate("AUD", "USD")
+	if !ok || rate != 0.65 {
+		t.Fatalf("LastFXRate = %f %s %v, want 0.65", rate, at, ok)
+	}
+	if at.Before(before) || at.After(time.Now()) {
+		t.Errorf("LastFXRate fetched at %s, want during UpdateTicker", at)
+	}
+	if len(entries) != 2 || entries[1].Price != 200*rate {
+		t.Errorf("entries = %+v, want the USD price converted at %f", entries, rate)
+	}
+}
+
+func TestUpdateTickerConversionFailure(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		name string
+		rate float64
+		err  error
+	}{
+		{name: "converter error", err: errors.New("no rates")},
+		{name: "zero rate"},
+		{name: "negative rate", rate: -1},
+		{name: "NaN rate", rate: math.NaN()},
+	}
+
+	for _, test := range tests {
+		logged.Reset()
+		b := BTCMarkets{}
+		b.SetDefaults()
+		b.Converter = CurrencyConverterFunc(func(amount float64, from, to string) (float64, error) {
+			return amount * test.rate, test.err
+		})
+
+		for i := 0; i < 3; i++ {
+			entries := b.UpdateTicker("BTC", BTCMarketsTicker{LastPrice: 100, BestBID: 99, BestAsk: 101})
+			if len(entries) != 1 || entries[0].FiatCurrency != "AUD" || entries[0].Price != 100 {
+				t.Fatalf("%s: entries = %+v", test.name, entries)
+			}
+		}
+
+		if n := strings.Count(logged.String(), "unable to convert BTC-AUD prices to USD"); n != 1 {
+			t.Fatalf("%s: logged the failure %d times, want 1", test.name, n)
+		}
+	}
+
+	logged.Reset()
+	rate, fail := 0.5, true
+	b := BTCMarkets{}
+	b.SetDefaults()
+	b.FXCacheTTL = 0
+	b.Converter = CurrencyConverterFunc(func(amount float64, from, to string) (float64, error) {
+		if fail {
+			return 0, errors.New("no rates")
+		}
+		return amount * rate, nil
+	})
+
+	b.UpdateTicker("BTC", BTCMarketsTicker{LastPrice: 100})
+	fail = false
+	entries := b.UpdateTicker("BTC", BTCMarketsTicker{LastPrice: 100})
+	if len(entries) != 2 || entries[1].FiatCurrency != "USD" || entries[1].Price != 50 {
+		t.Fatalf("entries = %+v", entries)
+	}
+	fail = true
+	b.UpdateTicker("BTC", BTCMarketsTicker{LastPrice: 100})
+	if n := strings.Count(logged.String(), "unable to convert"); n != 2 {
+		t.Fatalf("logged %d failures, want one per failure after a success", n)
+	}
+}
+
+func TestHasSufficientBalance(t *testing.T) {
+	b := BTCMarkets{}
+	b.SetDefaults()
+	b.SetFee(1)
+	b.PaperTrading = true
+	b.Paper.SetBalance("AUD", ConvertToBTCMarketsUnits(1009))
+	b.Paper.SetBalance("BTC", ConvertToBTCMarketsUnits(2))
+	b.Paper.SetBalance("ETH", ConvertToBTCMarketsUnits(5))
+
+	tests := []struct {
+		instrument string
+		side       BTCMarketsOrderSide
+		price      float64
+		volume     float64
+		ok         bool
+		shortfall  float64
+	}{
+		{instrument: "BTC", side: BTCMARKETS_ORDER_SIDE_BID, price: 1000, volume: 1, shortfall: 1},
+		{instrument: "btc/aud", side: "bid", price: 990, volume: 1, ok: true},
+		{instrument: "BTC-AUD", side: BTCMARKETS_ORDER_SIDE_ASK, price: 1000, volume: 2, ok: true},
+		{instrument: "BTC-AUD", side: BTCMARKETS_ORDER_SIDE_ASK, price: 1000, volume: 3, shortfall: 1},
+		{instrument: "ETH-BTC", side: BTCMARKETS_ORDER_SIDE_BID, price: 0.5, volume: 3, ok: true},
+		{instrument: "ETH-BTC", side: BTCMARKETS_ORDER_SIDE_BID, price: 0.5, volume: 4, shortfall: 0.02},
+		{instrument: "ETH-BTC", side: BTCMARKETS_ORDER_SIDE_ASK, price: 0.5, volume: 5, ok: true},
+		{instrument: "ETH-BTC", side: BTCMARKETS_ORDER_SIDE_ASK, price: 0.5, volume: 6, shortfall: 1},
+	}
+
+	for _, test := range tests {
+		ok, shortfall, err := b.HasSufficientBalance(test.instrument, test.side, test.price, test.volume)
+		if err != nil {
+			t.Fatalf("%s %s: %s", test.instrument, test.side, err)
+		}
+		if ok != test.ok || math.Abs(shortfall-test.shortfall) > 1e-9 {
+			t.Errorf("%s %s %f: ok %t shortfall %f, want %t %f", test.instrument, test.side, test.volume, ok, shortfall, test.ok, test.shortfall)
+		}
+	}
+
+	if _, _, err := b.HasSufficientBalance("BTC", "sideways", 1, 1); err == nil {
+		t.Fatal("accepted an invalid side")
+	}
+}
+
+func TestOrderRetryAfterTimeout(t *testing.T) {
+	b := BTCMarkets{}
+	b.SetDefaults()
+	if b.HTTPClient.Timeout != BTCMARKETS_DEFAULT_REQUEST_TIMEOUT {
+		t.Fatalf("HTTPClient.Timeout = %s", b.HTTPClient.Timeout)
+	}
+
+	tests := []struct {
+		name        string
+		placed      bool
+		wantCreates int32
+	}{
+		{name: "placed before timeout", placed: true, wantCreates: 1},
+		{name: "not placed", wantCreates: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var creates int32
+			var mtx sync.Mutex
+			clientReq := ""
+			b := newTestBTCMarketsAuth(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == BTCMARKETS_ORDER_CREATE {
+					if atomic.AddInt32(&creates, 1) == 1 {
+						order := struct {
+							ClientRequestID string `json:"clientRequestId"`
+						}{}
+						body, _ := ioutil.ReadAll(r.Body)
+						JSONDecode(body, &order)
+						if test.placed {
+							mtx.Lock()
+							clientReq = order.ClientRequestID
+							mtx.Unlock()
+						}
+						time.Sleep(200 * time.Millisecond)
+					}
+					w.Write([]byte(`{"success":true,"id":9}`))
+					return
+				}
+
+				mtx.Lock()
+				defer mtx.Unlock()
+				if r.URL.Path == BTCMARKETS_ORDER_HISTORY && clientReq != "" {
+					w.Write([]byte(`{"success":true,"orders":[{"id":9,"clientRequestId":"` + clientReq + `","status":"Placed"}]}`))
+					return
+				}
+				w.Write([]byte(`{"success":true,"orders":[]}`))
+			})
+			b.RequestTimeout = 50 * time.Millisecond
+			b.ConfigureTransport()
+			b.OrderRetryDelay = time.Millisecond
+
+			id, _, err := b.Order("AUD", "BTC", 100000000, 100000000, BTCMARKETS_ORDER_SIDE_BID, BTCMARKETS_ORDER_TYPE_LIMIT, "")
+			if err != nil || id != 9 {
+				t.Fatalf("Order = %d %v", id, err)
+			}
+			if n := atomic.LoadInt32(&creates); n != test.wantCreates {
+				t.Fatalf("sent %d create requests, want %d", n, test.wantCreates)
+			}
+		})
+	}
+}
+
+func TestGetOrderbookDepth(t *testing.T) {
+	const orderbook = `{"currency":"BTC","instrument":"ETH","asks":[[0.031,1],[0.032,2],[0.033,3]],"bids":[[0.03,1],[0.029,2],[0.028,3]]}`
+	b := newTestBTCMarkets(t, testBTCMarketsRoutes(map[string]string{
+		"/market/ETH/BTC/orderbook": orderbook,
+		"/market/BTC/AUD/orderbook": testBTCMarketsOrderbook,
+	}))
+
+	tests := []struct {
+		symbol string
+		quote  string
+		depth  int
+		asks   int
+		bids   int
+	}{
+		{symbol: "eth", quote: "btc", depth: 2, asks: 2, bids: 2},
+		{symbol: "ETH", quote: "BTC", depth: 5, asks: 3, bids: 3},
+		{symbol: "eth/btc", depth: 1, asks: 1, bids: 1},
+		{symbol: "btc", depth: 1, asks: 1, bids: 1},
+	}
+
+	for _, test := range tests {
+		book, err := b.GetOrderbookDepth(test.symbol, test.quote, test.depth)
+		if err != nil {
+			t.Fatalf("%s/%s: %s", test.symbol, test.quote, err)
+		}
+		if len(book.Asks) != test.asks || len(book.Bids) != test.bids {
+			t.Errorf("%s/%s depth %d: %d asks %d bids", test.symbol, test.quote, test.depth, len(book.Asks), len(book.Bids))
+		}
+	}
+
+	if _, err := b.GetOrderbookDepth("BTC", "AUD", 0); err == nil {
+		t.Fatal("accepted a zero depth")
+	}
+	if _, err := b.GetOrderbookDepth("", "AUD", 1); err == nil {
+		t.Fatal("accepted an empty symbol")
+	}
+}
+
+func TestGetTradesSince(t *testing.T) {
+	url := ""
+	b := newTestBTCMarkets(t, func(w http.ResponseWriter, r *http.Request) {
+		url = r.URL.RequestURI()
+		w.Write([]byte(testBTCMarketsTrades))
+	})
+
+	_, err := b.GetTradesSince("BTC", 1234567890123)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "/market/BTC/AUD/trades?since=1234567890123" {
+		t.Fatalf("requested %q", url)
+	}
+
+	_, err = b.GetTradesSince("eth/btc", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "/market/ETH/BTC/trades?since=5" {
+		t.Fatalf("requested %q", url)
+	}
+}
+
+func TestGetTickers(t *testing.T) {
+	tests := []struct {
+		name    string
+		pairs   []string
+		failing map[string]int
+		want    []string
+		wantErr error
+		anyErr  bool
+	}{
+		{name: "success", pairs: []string{"BTC", "LTC", "ETH"}, want: []string{"BTC", "LTC", "ETH"}},
+		{name: "partial failure", pairs: []string{"BTC", "LTC", "ETH"}, failing: map[string]int{"LTC": http.StatusInternalServerError}, want: []string{"BTC", "ETH"}, anyErr: true},
+		{name: "unavailable", pairs: []string{"BTC", "LTC"}, failing: map[string]int{"BTC": http.StatusServiceUnavailable, "LTC": http.StatusServiceUnavailable}, wantErr: ErrExchangeUnavailable},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newTestBTCMarkets(t, func(w http.ResponseWriter, r *http.Request) {
+				instrument := strings.Split(r.URL.Path, "/")[2]
+				if status, ok := test.failing[instrument]; ok {
+					w.WriteHeader(status)
+					return
+				}
+				w.Write([]byte(`{"bestBid":1,"bestAsk":2,"lastPrice":1.5,"currency":"AUD","instrument":"` + instrument + `"}`))
+			})
+
+			tickers, err := b.GetTickers(test.pairs)
+			if test.wantErr != nil && err != test.wantErr {
+				t.Fatalf("err = %v, want %v", err, test.wantErr)
+			}
+			if test.anyErr && err == nil {
+				t.Fatal("expected an error")
+			}
+			if test.wantErr == nil && !test.anyErr && err != nil {
+				t.Fatal(err)
+			}
+
+			if len(tickers) != len(test.want) {
+				t.Fatalf("tickers = %+v", tickers)
+			}
+			for _, x := range test.want {
+				if tickers[x].Instrument != x {
+					t.Fatalf("tickers[%s] = %+v", x, tickers[x])
+				}
+			}
+		})
+	}
+}
+
+func TestSaveLoadTickers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tickers.json")
+
+	b := BTCMarkets{}
+	b.SetDefaults()
+	b.UpdateTicker("BTC", BTCMarketsTicker{BestBID: 4, BestAsk: 6, LastPrice: 5, Currency: "AUD", Instrument: "BTC", Timestamp: 1500000000})
+	b.UpdateTicker("LTC", BTCMarketsTicker{LastPrice: 7, Currency: "AUD", Instrument: "LTC"})
+	fetched := b.TickerLastFetch["BTC-AUD"]
+
+	err := b.SaveTickers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := BTCMarkets{}
+	loaded.SetDefaults()
+	err = loaded.LoadTickers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(loaded.Ticker, b.Ticker) {
+		t.Fatalf("loaded %+v, want %+v", loaded.Ticker, b.Ticker)
+	}
+	if !loaded.TickerLastFetch["BTC-AUD"].Equal(fetched) {
+		t.Fatalf("LastFetch = %s, want %s", loaded.TickerLastFetch["BTC-AUD"], fetched)
+	}
+
+	if loaded.LoadTickers(filepath.Join(t.TempDir(), "missing.json")) == nil {
+		t.Fatal("loaded a missing file")
+	}
+}
+
+func TestRunLoadsTickerCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tickers.json")
+	cached := BTCMarkets{}
+	cached.SetDefaults()
+	cached.UpdateTicker("BTC", BTCMarketsTicker{LastPrice: 5, Instrument: "BTC"})
+	err := cached.SaveTickers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := BTCMarkets{}
+	b.SetDefaults()
+	b.Enabled = false
+	b.EnabledPairs = []string{"BTC"}
+	b.TickerCachePath = path
+	b.Run()
+
+	if b.Ticker["BTC-AUD"].LastPrice != 5 {
+		t.Fatalf("Ticker = %+v", b.Ticker)
+	}
+}
+
+func TestShutdownWaitsForFetch(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		wantErr error
+		waited  bool
+	}{
+		{name: "waits", timeout: time.Second, waited: true},
+		{name: "context expires", timeout: 10 * time.Millisecond, wantErr: context.DeadlineExceeded},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var calls, done int32
+			started := make(chan struct{})
+			b := newTestBTCMarkets(t, func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&calls, 1) == 2 {
+					close(started)
+					time.Sleep(200 * time.Millisecond)
+					atomic.StoreInt32(&done, 1)
+				}
+				w.Write([]byte(testBTCMarketsTicker))
+			})
+			b.EnabledPairs = []string{"BTC"}
+			b.RESTPollingDelay = 10 * time.Millisecond
+			b.PollingJitter = 0
+
+			go b.Run()
+			<-started
+
+			ctx, cancel := context.WithTimeout(context.Background(), test.timeout)
+			defer cancel()
+			err := b.Shutdown(ctx)
+			if err != test.wantErr {
+				t.Fatalf("Shutdown = %v, want %v", err, test.wantErr)
+			}
+			if waited := atomic.LoadInt32(&done) == 1; waited != test.waited {
+				t.Fatalf("waited for the fetch = %t, want %t", waited, test.waited)
+			}
+
+			err = b.Shutdown(context.Background())
+			if err != nil {
+				t.Fatalf("second Shutdown = %v", err)
+			}
+		})
+	}
+}
+
+func TestGetTickersConcurrencyLimit(t *testing.T) {
+	var inFlight, peak int32
+	b := newTestBTCMarkets(t, func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&peak)
+			if n <= max || atomic.CompareAndSwapInt32(&peak, max, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		w.Write([]byte(testBTCMarketsTicker))
+	})
+	b.MaxConcurrentRequests = 5
+
+	pairs := []string{}
+	for i := 0; i < 50; i++ {
+		pairs = append(pairs, fmt.Sprintf("C%02d", i))
+	}
+
+	tickers, err := b.GetTickers(pairs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tickers) != 50 {
+		t.Fatalf("fetched %d tickers, want 50", len(tickers))
+	}
+	if p := atomic.LoadInt32(&peak); p > 5 || p < 2 {
+		t.Fatalf("peak concurrency %d, want between 2 and 5", p)
+	}
+}
+
+func TestGetTickerRejectsErrorPayload(t *testing.T) {
+	b := newTestBTCMarkets(t, respondWith(http.StatusOK, `{"success":false,"errorCode":3,"errorMessage":"Invalid argument."}`))
+
+	ticker, err := b.GetTicker("BTC")
+	if err == nil {
+		t.Fatalf("accepted an error payload as %+v", ticker)
+	}
+	if ticker != (BTCMarketsTicker{}) {
+		t.Fatalf("ticker = %+v, want the zero ticker", ticker)
+	}
+	if len(b.Ticker) != 0 {
+		t.Fatalf("cached %+v", b.Ticker)
+	}
+}
+
+func TestValidateTicker(t *testing.T) {
+	b := BTCMarkets{}
+	b.SetDefaults()
+
+	tests := []struct {
+		name   string
+		ticker BTCMarketsTicker
+		valid  bool
+	}{
+		{name: "valid", ticker: BTCMarketsTicker{BestBID: 1, BestAsk: 2, LastPrice: 1.5, Instrument: "BTC"}, valid: true},
+		{name: "last price only", ticker: BTCMarketsTicker{LastPrice: 1.5, Instrument: "BTC"}, valid: true},
+		{name: "no instrument", ticker: BTCMarketsTicker{BestBID: 1, BestAsk: 2, LastPrice: 1.5}},
+		{name: "zero prices", ticker: BTCMarketsTicker{Instrument: "BTC"}},
+	}
+
+	for _, test := range tests {
+		if err := b.ValidateTicker(test.ticker); (err == nil) != test.valid {
+			t.Errorf("%s: ValidateTicker = %v", test.name, err)
+		}
+	}
+}
+
+func TestWaitForOrder(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []string
+		timeout  time.Duration
+		want     string
+		wantErr  error
+	}{
+		{name: "fills", statuses: []string{BTCMARKETS_ORDER_STATUS_PLACED, BTCMARKETS_ORDER_STATUS_FULLY_MATCHED}, timeout: time.Second, want: BTCMARKETS_ORDER_STATUS_FULLY_MATCHED},
+		{name: "cancelled", statuses: []string{BTCMARKETS_ORDER_STATUS_CANCELLED}, timeout: time.Second, want: BTCMARKETS_ORDER_STATUS_CANCELLED},
+		{name: "times out", statuses: []string{BTCMARKETS_ORDER_STATUS_PLACED}, timeout: 30 * time.Millisecond, want: BTCMARKETS_ORDER_STATUS_PLACED, wantErr: context.DeadlineExceeded},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var polls int32
+			b := newTestBTCMarketsAuth(t, func(w http.ResponseWriter, r *http.Request) {
+				n := int(atomic.AddInt32(&polls, 1))
+				if n > len(test.statuses) {
+					n = len(test.statuses)
+				}
+				w.Write([]byte(`{"success":true,"orders":[{"id":5,"status":"` + test.statuses[n-1] + `"}]}`))
+			})
+
+			order, err := b.WaitForOrder(5, 10*time.Millisecond, test.timeout)
+			if err != test.wantErr {
+				t.Fatalf("err = %v, want %v", err, test.wantErr)
+			}
+			if order.ID != 5 || order.Status != test.want {
+				t.Fatalf("order = %+v", order)
+			}
+			if test.wantErr == nil && int(atomic.LoadInt32(&polls)) != len(test.statuses) {
+				t.Fatalf("polled %d times, want %d", polls, len(test.statuses))
+			}
+		})
+	}
+}
+
+func TestSetProxy(t *testing.T) {
+	proxied := ""
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		w.Write([]byte(testBTCMarketsTicker))
+	}))
+	defer proxy.Close()
+
+	b := BTCMarkets{}
+	b.SetDefaults()
+	b.SetURL("http://api.btcmarkets.invalid")
+
+	for _, x := range []string{"", "127.0.0.1:8080", "ftp://127.0.0.1:21", "http://", "http://%zz"} {
+		if b.SetProxy(x) == nil {
+			t.Errorf("accepted proxy %q", x)
+		}
+	}
+
+	err := b.SetProxy(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.ProxyURL != proxy.URL {
+		t.Fatalf("ProxyURL = %q", b.ProxyURL)
+	}
+
+	_, err = b.GetTicker("BTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxied != "http://api.btcmarkets.invalid/market/BTC/AUD/tick" {
+		t.Fatalf("proxied %q", proxied)
+	}
+}
+
+// testRequestMetrics records each ObserveRequest call.
+type testRequestMetrics struct {
+	mtx       sync.Mutex
+	endpoints []string
+	errs      []error
+}
+
+func (m *testRequestMetrics) ObserveRequest(endpoint string, duration time.Duration, err error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.endpoints = append(m.endpoints, endpoint)
+	m.errs = append(m.errs, err)
+}
+
+func TestRequestMetrics(t *testing.T) {
+	b := newTestBTCMarketsAuth(t, testBTCMarketsRoutes(map[string]string{
+		"/market/BTC/AUD/tick":     testBTCMarketsTicker,
+		BTCMARKETS_ACCOUNT_BALANCE: testBTCMarketsBalances,
+	}))
+	metrics := &testRequestMetrics{}
+	b.Metrics = metrics
+
+	_, err := b.GetTicker("BTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.GetTicker("LTC")
+	if err == nil {
+		t.Fatal("expected an error for an unrouted ticker")
+	}
+	_, err = b.GetAccountBalance()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{BTCMARKETS_MARKET_TICK, BTCMARKETS_MARKET_TICK, BTCMARKETS_ACCOUNT_BALANCE}
+	if !reflect.DeepEqual(metrics.endpoints, want) {
+		t.Fatalf("endpoints = %v, want %v", metrics.endpoints, want)
+	}
+	if metrics.errs[0] != nil || metrics.errs[1] == nil || metrics.errs[2] != nil {
+		t.Fatalf("errs = %v", metrics.errs)
+	}
+}
+
+func TestPlaceOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		detail  string
+		status  int
+		wantErr bool
+	}{
+		{name: "success", status: http.StatusOK, detail: `{"success":true,"orders":[{"id":12345,"currency":"AUD","instrument":"BTC","orderSide":"Bid","ordertype":"Limit","status":"Placed","price":10000000000,"volume":100000000,"openVolume":100000000}]}`},
+		{name: "detail fails", status: http.StatusOK, detail: `{"success":false,"errorMessage":"Order not found."}`, wantErr: true},
+		{name: "detail empty", status: http.StatusOK, detail: `{"success":true,"orders":[]}`, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			paths := []string{}
+			b := newTestBTCMarketsAuth(t, func(w http.ResponseWriter, r *http.Request) {
+				paths = append(paths, r.URL.Path)
+				if r.URL.Path == BTCMARKETS_ORDER_CREATE {
+					w.Write([]byte(`{"success":true,"id":12345,"clientRequestId":"abc"}`))
+					return
+				}
+				respondWith(test.status, test.detail)(w, r)
+			})
+
+			order, err := b.PlaceOrder("AUD", "BTC", 10000000000, 100000000, BTCMARKETS_ORDER_SIDE_BID, BTCMARKETS_ORDER_TYPE_LIMIT, "abc")
+			if !reflect.DeepEqual(paths, []string{BTCMARKETS_ORDER_CREATE, BTCMARKETS_ORDER_DETAIL}) {
+				t.Fatalf("requested %v", paths)
+			}
+			if order.ID != 12345 {
+				t.Fatalf("order ID = %f, want 12345", order.ID)
+			}
+
+			if test.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "12345") {
+					t.Fatalf("err = %v, want an error naming the order ID", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if order.Status != BTCMARKETS_ORDER_STATUS_PLACED || order.OpenVolume != 100000000 || order.Price != 10000000000 {
+				t.Fatalf("order = %+v", order)
+			}
+		})
+	}
+}
+
+func TestOrderClientRequestID(t *testing.T) {
+	sent := []string{}
+	b := newTestBTCMarketsAuth(t, func(w http.ResponseWriter, r *http.Request) {
+		order := struct {
+			ClientRequestID string `json:"clientRequestId"`
+		}{}
+		body, _ := ioutil.ReadAll(r.Body)
+		JSONDecode(body, &order)
+		sent = append(sent, order.ClientRequestID)
+		w.Write([]byte(`{"success":true,"id":1}`))
+	})
+
+	seen := make(map[string]bool)
+	for i := 0; i < 5; i++ {
+		_, clientReq, err := b.Order("AUD", "BTC", 100000000, 100000000, BTCMARKETS_ORDER_SIDE_BID, BTCMARKETS_ORDER_TYPE_LIMIT, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(clientReq) != 36 || seen[clientReq] {
+			t.Fatalf("generated client request ID %q", clientReq)
+		}
+		if sent[i] != clientReq {
+			t.Fatalf("sent %q, returned %q", sent[i], clientReq)
+		}
+		seen[clientReq] = true
+	}
+
+	if !b.RecordClientRequestID(sent[0]) {
+		t.Fatal("reused client request ID wasn't reported")
+	}
+	if b.RecordClientRequestID("new") {
+		t.Fatal("new client request ID reported as reused")
+	}
+}
+
+func TestExportTickers(t *testing.T) {
+	b := BTCMarkets{}
+	b.SetDefaults()
+
+	var buf bytes.Buffer
+	err := b.ExportTickers("csv", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "pair,bestBid,bestAsk,lastPrice,timestamp\n" {
+		t.Errorf("empty CSV export = %q, want just the header", buf.String())
+	}
+
+	b.Ticker = map[string]BTCMarketsTicker{
+		"LTC-AUD": {BestBID: 50.5, BestAsk: 51, LastPrice: 50.75, Currency: "AUD", Instrument: "LTC", Timestamp: 1500000001},
+		"BTC-AUD": {BestBID: 100, BestAsk: 101.25, LastPrice: 100.5, Currency: "AUD", Instrument: "BTC", Timestamp: 1500000000},
+	}
+
+	buf.Reset()
+	err = b.ExportTickers("csv", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "pair,bestBid,bestAsk,lastPrice,timestamp\n" +
+		"BTC-AUD,100,101.25,100.5,1500000000\n" +
+		"LTC-AUD,50.5,51,50.75,1500000001\n"
+	if buf.String() != want {
+		t.Errorf("CSV export = %q, want %q", buf.String(), want)
+	}
+
+	buf.Reset()
+	err = b.ExportTickers("json", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := map[string]BTCMarketsTicker{}
+	err = JSONDecode(buf.Bytes(), &decoded)
+	if err != nil {
+		t.Fatalf("decoding JSON export: %s", err)
+	}
+	if !reflect.DeepEqual(decoded, b.Ticker) {
+		t.Errorf("JSON export = %+v, want %+v", decoded, b.Ticker)
+	}
+
+	err = b.ExportTickers("xml", &buf)
+	if err == nil {
+		t.Error("ExportTickers accepted an unsupported format")
+	}
+}
+
+func TestDisablePairWhileRunning(t *testing.T) {
+	var btc, ltc int32
+	b := newTestBTCMarkets(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.Path, "/BTC/"):
+			atomic.AddInt32(&btc, 1)
+			w.Write([]byte(testBTCMarketsTicker))
+		case strings.Contains(r.URL.Path, "/LTC/"):
+			atomic.AddInt32(&ltc, 1)
+			w.Write([]byte(`{"bestBid":50,"bestAsk":51,"lastPrice":50.5,"currency":"AUD","instrument":"LTC","timestamp":1500000000}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	b.AvailablePairs = []string{"BTC", "LTC"}
+	b.EnabledPairs = []string{"BTC-AUD", "LTC-AUD"}
+	b.RESTPollingDelay = 5 * time.Millisecond
+	b.PollingJitter = 0
+	defer b.Close()
+
+	waitFor := func(counter *int32, n int32) {
+		deadline := time.Now().Add(5 * time.Second)
+		for atomic.LoadInt32(counter) < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %d requests", n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	go b.Run()
+	waitFor(&ltc, 1)
+
+	if b.EnablePair("ETH-AUD") == nil {
+		t.Error("EnablePair accepted a pair that isn't available")
+	}
+	b.DisablePair("LTC-AUD")
+	if b.IsPairEnabled("LTC-AUD") {
+		t.Fatal("LTC-AUD is still enabled")
+	}
+
+	// A cycle already in progress may still fetch LTC once.
+	disabled := atomic.LoadInt32(&ltc)
+	waitFor(&btc, atomic.LoadInt32(&btc)+5)
+	if n := atomic.LoadInt32(&ltc); n > disabled+1 {
+		t.Errorf("LTC fetched %d more times after being disabled", n-disabled)
+	}
+}
+
+func TestAmendOrder(t *testing.T) {
+	const (
+		placed = `{"success":true,"orders":[{"id":7,"currency":"AUD","instrument":"BTC","orderSide":"Bid","ordertype":"Limit","status":"Placed","price":10000000000,"volume":100000000,"openVolume":100000000}]}`
+		filled = `{"success":true,"orders":[{"id":7,"currency":"AUD","instrument":"BTC","orderSide":"Bid","ordertype":"Limit","status":"Fully Matched","price":10000000000,"volume":100000000,"openVolume":0}]}`
+	)
+
+	tests := []struct {
+		name        string
+		details     []string
+		cancel      string
+		wantID      int
+		wantErr     error
+		wantCreates int
+	}{
+		{
+			name:        "replaced",
+			details:     []string{placed},
+			cancel:      `{"success":true,"responses":[{"success":true,"id":7}]}`,
+			wantID:      8,
+			wantCreates: 1,
+		},
+		{
+			name:    "already filled",
+			details: []string{filled},
+			wantErr: ErrBTCMarketsOrderFilled,
+		},
+		{
+			name:    "filled before the cancel",
+			details: []string{placed, filled},
+			cancel:  `{"success":true,"responses":[{"success":false,"id":7,"errorMessage":"Order is not open."}]}`,
+			wantErr: ErrBTCMarketsOrderFilled,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var details int
+			var creates []string
+			b := newTestBTCMarketsAuth(t, func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case BTCMARKETS_ORDER_DETAIL:
+					w.Write([]byte(test.details[details]))
+					details++
+				case BTCMARKETS_ORDER_CANCEL:
+					w.Write([]byte(test.cancel))
+				case BTCMARKETS_ORDER_CREATE:
+					body, _ := ioutil.ReadAll(r.Body)
+					creates = append(creates, string(body))
+					w.Write([]byte(`{"success":true,"id":8}`))
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			})
+
+			id, err := b.AmendOrder(7, 101.5, 0.5)
+			if err != test.wantErr {
+				t.Fatalf("AmendOrder error = %v, want %v", err, test.wantErr)
+			}
+			if id != test.wantID {
+				t.Errorf("AmendOrder id = %d, want %d", id, test.wantID)
+			}
+			if len(creates) != test.wantCreates {
+				t.Fatalf("placed %d replacement orders, want %d", len(creates), test.wantCreates)
+			}
+			if test.wantCreates > 0 && (!strings.Contains(creates[0], `"price":10150000000`) || !strings.Contains(creates[0], `"volume":50000000`) || !strings.Contains(creates[0], `"orderSide":"Bid"`)) {
+				t.Errorf("replacement order = %s", creates[0])
+			}
+		})
+	}
+}
+
+func TestValidateOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		instrument string
+		price      float64
+		volume     float64
+		wantErr    string
+	}{
+		{name: "valid", instrument: "TST", price: 100.05, volume: 0.5},
+		{name: "below minimum volume", instrument: "TST", price: 100, volume: 0.001, wantErr: "below the TST minimum of 0.010000"},
+		{name: "below minimum notional", instrument: "TST", price: 0.05, volume: 1, wantErr: "order value"},
+		{name: "off the price increment", instrument: "TST", price: 100.03, volume: 1, wantErr: "price increment"},
+		{name: "market order skips price checks", instrument: "TST", price: 0, volume: 1},
+		{name: "unknown instrument", instrument: "XYZ", price: 100.03, volume: 0.001},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := BTCMarkets{}
+			b.SetDefaults()
+			b.SetInstrumentRules(BTCMarketsInstrumentRules{Instrument: "TST", Currency: "AUD", MinVolume: 0.01, MinNotional: 5, PriceIncrement: 0.05})
+
+			err := b.ValidateOrder(test.instrument, test.price, test.volume)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("ValidateOrder = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("ValidateOrder = %v, want an error containing %q", err, test.wantErr)
+			}
+		})
+	}
+
+	rules, err := (&BTCMarkets{}).GetInstrumentRules("XYZ")
+	if err != ErrBTCMarketsUnknownInstrument {
+		t.Errorf("GetInstrumentRules(XYZ) = %+v %v, want ErrBTCMarketsUnknownInstrument", rules, err)
+	}
+}
+
+func TestOrderValidatedBeforeSending(t *testing.T) {
+	b := newTestBTCMarketsAuth(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Unexpected request %s for an invalid order.", r.URL.Path)
+		w.Write([]byte(`{"success":true,"id":1}`))
+	})
+	b.SetInstrumentRules(BTCMarketsInstrumentRules{Instrument: "BTC", Currency: "AUD", MinVolume: 0.01, PriceIncrement: 0.01})
+
+	_, _, err := b.Order("AUD", "BTC", 10000000000, 100000, BTCMARKETS_ORDER_SIDE_BID, BTCMARKETS_ORDER_TYPE_LIMIT, "")
+	if err == nil || !strings.Contains(err.Error(), "minimum") {
+		t.Fatalf("Order error = %v, want a minimum volume error", err)
+	}
+}
+
+func TestRefreshAvailablePairs(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	markets := `{"success":true,"markets":[` +
+		`{"instrument":"BTC","currency":"AUD","status":"Online"},` +
+		`{"instrument":"ETH","currency":"AUD","status":"Online"},` +
+		`{"instrument":"LTC","currency":"BTC","status":"Online"}]}`
+	b := newTestBTCMarkets(t, testBTCMarketsRoutes(map[string]string{BTCMARKETS_MARKETS_ACTIVE: markets}))
+	b.AvailablePairs = []string{"BTC", "LTC"}
+	b.EnabledPairs = []string{"BTC-AUD", "LTC-AUD"}
+
+	err := b.RefreshAvailablePairs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(b.AvailablePairs, []string{"BTC", "ETH"}) {
+		t.Errorf("AvailablePairs = %v, want [BTC ETH]", b.AvailablePairs)
+	}
+	if !reflect.DeepEqual(b.EnabledPairs, []string{"BTC-AUD"}) {
+		t.Errorf("EnabledPairs = %v, want [BTC-AUD]", b.EnabledPairs)
+	}
+	if !strings.Contains(logged.String(), "pair LTC-AUD is no longer listed") {
+		t.Errorf("delisting wasn't logged: %q", logged.String())
+	}
+
+	b = newTestBTCMarkets(t, respondWith(http.StatusInternalServerError, `{}`))
+	b.AvailablePairs = []string{"BTC", "LTC"}
+	b.EnabledPairs = []string{"BTC-AUD", "LTC-AUD"}
+	if b.RefreshAvailablePairs() == nil {
+		t.Fatal("RefreshAvailablePairs ignored a failed request")
+	}
+	if !reflect.DeepEqual(b.AvailablePairs, []string{"BTC", "LTC"}) || !reflect.DeepEqual(b.EnabledPairs, []string{"BTC-AUD", "LTC-AUD"}) {
+		t.Errorf("pairs changed after a failed refresh: %v %v", b.AvailablePairs, b.EnabledPairs)
+	}
+}
+
+func TestSendAuthenticatedRequestRaw(t *testing.T) {
+	body := "{ \"success\" : true,\n  \"orders\" : [ ] , \"extra\":\"\\u00e9\" }\n"
+	b := newTestBTCMarketsAuth(t, respondWith(http.StatusOK, body))
+
+	raw, err := b.SendAuthenticatedRequestRaw("POST", BTCMARKETS_ORDER_OPEN, []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != body {
+		t.Errorf("raw = %q, want %q", raw, body)
+	}
+
+	var resp struct {
+		Success bool `json:"success"`
+	}
+	err = b.SendAuthenticatedRequest("POST", BTCMARKETS_ORDER_OPEN, []byte(`{}`), &resp)
+	if err != nil || !resp.Success {
+		t.Errorf("SendAuthenticatedRequest = %+v %v", resp, err)
+	}
+
+	b = newTestBTCMarketsAuth(t, respondWith(http.StatusOK, `<html>maintenance</html>`))
+	_, err = b.SendAuthenticatedRequestRaw("POST", BTCMARKETS_ORDER_OPEN, []byte(`{}`))
+	if err != ErrExchangeUnavailable {
+		t.Errorf("raw HTML response error = %v, want ErrExchangeUnavailable", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	b := BTCMarkets{}
+	b.SetDefaults()
+	b.Ticker["BTC-AUD"] = BTCMarketsTicker{LastPrice: 100}
+	b.Orderbook["BTC-AUD"] = BTCMarketsOrderbook{Currency: "AUD", Instrument: "BTC"}
+
+	for i := 0; i < 2; i++ {
+		err := b.Close()
+		if err != nil {
+			t.Fatalf("Close #%d = %v", i+1, err)
+		}
+	}
+	if !b.IsStopped() {
+		t.Error("Close didn't stop the instance")
+	}
+	if len(b.Ticker) != 0 || len(b.Orderbook) != 0 {
+		t.Errorf("caches not cleared: %v %v", b.Ticker, b.Orderbook)
+	}
+
+	b2 := newTestBTCMarkets(t, respondWith(http.StatusOK, testBTCMarketsTicker))
+	b2.EnabledPairs = []string{"BTC-AUD"}
+	b2.RESTPollingDelay = 5 * time.Millisecond
+	b2.PollingJitter = 0
+
+	done := make(chan struct{})
+	go func() {
+		b2.Run()
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	err := b2.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after Close")
+	}
+	if b2.Close() != nil {
+		t.Error("second Close after Run returned an error")
+	}
+}
+
+func TestRequestHeaders(t *testing.T) {
+	var headers []http.Header
+	b := newTestBTCMarketsAuth(t, func(w http.ResponseWriter, r *http.Request) {
+		headers = append(headers, r.Header.Clone())
+		w.Write([]byte(`{"success":true,"orders":[]}`))
+	})
+	if b.UserAgent != BTCMARKETS_USER_AGENT {
+		t.Errorf("UserAgent = %q, want %q", b.UserAgent, BTCMARKETS_USER_AGENT)
+	}
+
+	b.GetOpenOrders("AUD", "BTC")
+	if len(headers) != 1 || headers[0].Get("User-Agent") != BTCMARKETS_USER_AGENT || headers[0].Get("X-Request-ID") != "" {
+		t.Fatalf("headers = %v, want the default User-Agent and no request ID", headers)
+	}
+
+	b.UserAgent = "support-ticket-42"
+	b.SendRequestID = true
+	b.GetOpenOrders("AUD", "BTC")
+	b.GetOpenOrders("AUD", "BTC")
+	if len(headers) != 3 {
+		t.Fatalf("server saw %d requests, want 3", len(headers))
+	}
+	for _, x := range headers[1:] {
+		if x.Get("User-Agent") != "support-ticket-42" || len(x.Get("X-Request-ID")) != 36 {
+			t.Errorf("headers = %v, want the custom User-Agent and a request ID", x)
+		}
+		if x.Get("apikey") != testBTCMarketsAPIKey || x.Get("signature") == "" || x.Get("timestamp") == "" {
+			t.Errorf("signed headers missing: %v", x)
+		}
+	}
+	if headers[1].Get("X-Request-ID") == headers[2].Get("X-Request-ID") {
+		t.Error("request ID reused across requests")
+	}
+}
+
+func TestBTCMarketsAmount(t *testing.T) {
+	tests := []struct {
+		value float64
+		units int64
+	}{
+		{0.07, 7000000},
+		{0.1 + 0.2, 30000000},
+		{0.29, 29000000},
+		{1.005, 100500000},
+		{4.35, 435000000},
+		{1234.56789012, 123456789012},
+		{-0.07, -7000000},
+		{0.00000001, 1},
+	}
+
+	for _, test := range tests {
+		if got := ConvertToBTCMarketsUnits(test.value); got != test.units {
+			t.Errorf("ConvertToBTCMarketsUnits(%v) = %d, want %d", test.value, got, test.units)
+		}
+		if got := ConvertFromBTCMarketsUnits(test.units); got != test.value && test.value != 0.1+0.2 {
+			t.Errorf("ConvertFromBTCMarketsUnits(%d) = %v, want %v", test.units, got, test.value)
+		}
+	}
+
+	parsed := []struct {
+		value  string
+		units  BTCMarketsAmount
+		format string
+	}{
+		{"0.07", 7000000, "0.07000000"},
+		{"-1.5", -150000000, "-1.50000000"},
+		{"+2", 200000000, "2.00000000"},
+		{".5", 50000000, "0.50000000"},
+		{"12.34567890", 1234567890, "12.34567890"},
+	}
+	for _, test := range parsed {
+		a, err := ParseBTCMarketsAmount(test.value)
+		if err != nil || a != test.units || a.String() != test.format {
+			t.Errorf("ParseBTCMarketsAmount(%q) = %d %q %v, want %d %q", test.value, a, a.String(), err, test.units, test.format)
+		}
+	}
+
+	for _, x := range []string{"", ".", "-+1", "1.123456789", "abc", "1e8", "99999999999999999999"} {
+		if _, err := ParseBTCMarketsAmount(x); err == nil {
+			t.Errorf("ParseBTCMarketsAmount(%q) accepted an invalid amount", x)
+		}
+	}
+}
+
+func TestOrderVolumeConversion(t *testing.T) {
+	var body []byte
+	b := newTestBTCMarketsAuth(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		w.Write([]byte(`{"success":true,"id":1}`))
+	})
+
+	_, _, err := b.Order("AUD", "BTC", b.ConvertOrderUnits(100.07), b.ConvertOrderUnits(0.07), BTCMARKETS_ORDER_SIDE_BID, BTCMARKETS_ORDER_TYPE_LIMIT, "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), `"price":10007000000,"volume":7000000`) {
+		t.Errorf("0.07 BTC order body = %s, want 7000000 units", body)
+	}
+}
+
+func TestGetQuote(t *testing.T) {
+	var requests int32
+	b := newTestBTCMarkets(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte(`{"bestBid":100.5,"bestAsk":101.25,"lastPrice":100.75,"currency":"AUD","instrument":"BTC","timestamp":1500000000}`))
+	})
+	b.TickerCacheTTL = time.Minute
+
+	for i := 0; i < 2; i++ {
+		bid, ask, last, ts, err := b.GetQuote("btc/aud")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bid != 100.5 || ask != 101.25 || last != 100.75 || !ts.Equal(time.Unix(1500000000, 0)) {
+			t.Errorf("GetQuote = %f %f %f %s", bid, ask, last, ts)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("ticker fetched %d times, want 1 while the cache is fresh", n)
+	}
+
+	b.TickerCacheTTL = 0
+	b.GetQuote("BTC-AUD")
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("ticker fetched %d times, want 2 once the cache is stale", n)
+	}
+
+	b = newTestBTCMarkets(t, respondWith(http.StatusInternalServerError, `{}`))
+	if _, _, _, _, err := b.GetQuote("BTC-AUD"); err == nil {
+		t.Error("GetQuote ignored a failed request")
+	}
+}
+
+func TestExchangeUnavailable(t *testing.T) {
+	maintenance := respondWith(http.StatusOK, `<html><body>Down for maintenance</body></html>`)
+
+	b := newTestBTCMarketsAuth(t, maintenance)
+	if _, err := b.GetTicker("BTC-AUD"); err != ErrExchangeUnavailable {
+		t.Errorf("GetTicker = %v, want ErrExchangeUnavailable", err)
+	}
+	if _, err := b.GetTickers([]string{"BTC-AUD", "LTC-AUD"}); err != ErrExchangeUnavailable {
+		t.Errorf("GetTickers = %v, want ErrExchangeUnavailable", err)
+	}
+	if _, err := b.GetAccountBalance(); err != ErrExchangeUnavailable {
+		t.Errorf("GetAccountBalance = %v, want ErrExchangeUnavailable", err)
+	}
+
+	b = newTestBTCMarketsAuth(t, respondWith(http.StatusServiceUnavailable, `{}`))
+	if _, err := b.GetAccountBalance(); err != ErrExchangeUnavailable {
+		t.Errorf("GetAccountBalance on 503 = %v, want ErrExchangeUnavailable", err)
+	}
+}
+
+func TestRunBacksOffWhenUnavailable(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	var requests int32
+	b := newTestBTCMarkets(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte(`<html>maintenance</html>`))
+	})
+	b.EnabledPairs = []string{"BTC-AUD"}
+	b.RESTPollingDelay = time.Millisecond
+	b.PollingJitter = 0
+
+	go b.Run()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&requests) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for polls")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	b.Shutdown(context.Background())
+
+	if delay := b.GetPollingDelay(); delay <= b.RESTPollingDelay {
+		t.Errorf("polling delay = %s, want more than %s after repeated unavailability", delay, b.RESTPollingDelay)
+	}
+	if n := strings.Count(logged.String(), "exchange unavailable, backing off"); n != 1 {
+		t.Errorf("logged the outage %d times, want 1", n)
+	}
+	if strings.Contains(logged.String(), "invalid character") {
+		t.Errorf("logged a JSON parse error: %q", logged.String())
+	}
+}
+
+func TestGetClosedOrders(t *testing.T) {
+	start := time.Date(2017, 7, 1, 0, 0, 0, 0, time.UTC)
+	created := func(id int64) int64 {
+		return start.Add(time.Duration(id)*time.Minute).UnixNano() / int64(time.Millisecond)
+	}
+
+	var pages []int64
+	b := newTestBTCMarketsAuth(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != BTCMARKETS_ORDER_HISTORY {
+			t.Errorf("Unexpected request %s.", r.URL.Path)
+		}
+		var req struct {
+			Since int64 `json:"since"`
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		JSONDecode(body, &req)
+		pages = append(pages, req.Since)
+
+		count := int64(BTCMARKETS_ORDER_LIMIT)
+		if req.Since > 0 {
+			count = 3
+		}
+		orders := []string{}
+		for id := req.Since + 1; id <= req.Since+count; id++ {
+			status := BTCMARKETS_ORDER_STATUS_FULLY_MATCHED
+			if id == 200 {
+				status = BTCMARKETS_ORDER_STATUS_PLACED
+			}
+			// Creation times arrive both as numbers and as quoted numbers.
+			creation := fmt.Sprintf("%d", created(id))
+			if id%2 == 0 {
+				creation = fmt.Sprintf(`"%d"`, created(id))
+			}
+			orders = append(orders, fmt.Sprintf(`{"id":%d,"currency":"AUD","instrument":"BTC","status":%q,"creationTime":%s}`, id, status, creation))
+		}
+		fmt.Fprintf(w, `{"success":true,"orders":[%s]}`, strings.Join(orders, ","))
+	})
+
+	from := start.Add(199 * time.Minute)
+	to := start.Add(202 * time.Minute)
+	orders, err := b.GetClosedOrders("AUD", "BTC", from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []float64{}
+	for _, x := range orders {
+		ids = append(ids, x.ID)
+	}
+	if !reflect.DeepEqual(ids, []float64{199, 201, 202}) {
+		t.Errorf("closed order IDs = %v, want [199 201 202]", ids)
+	}
+	if !reflect.DeepEqual(pages, []int64{0, BTCMARKETS_ORDER_LIMIT}) {
+		t.Errorf("requested pages since %v, want [0 %d]", pages, BTCMARKETS_ORDER_LIMIT)
+	}
+	if len(orders) > 0 && !orders[0].CreatedAt().Equal(from) {
+		t.Errorf("CreatedAt = %s, want %s", orders[0].CreatedAt(), from)
+	}
+}
+
+func TestPortfolioValue(t *testing.T) {
+	routes := map[string]string{
+		BTCMARKETS_ACCOUNT_BALANCE: `[{"balance":100000000000,"pendingFunds":0,"currency":"AUD"},` +
+			`{"balance":50000000,"pendingFunds":0,"currency":"BTC"},` +
+			`{"balance":200000000,"pendingFunds":0,"currency":"ETH"},` +
+			`{"balance":1,"pendingFunds":0,"currency":"XRP"}]`,
+		"/market/BTC/AUD/tick": `{"bestBid":9990,"bestAsk":10010,"lastPrice":10000,"currency":"AUD","instrument":"BTC","timestamp":1500000000}`,
+		"/market/ETH/AUD/tick": `{"bestBid":299,"bestAsk":301,"lastPrice":300,"currency":"AUD","instrument":"ETH","timestamp":1500000000}`,
+	}
+
+	b := newTestBTCMarketsAuth(t, testBTCMarketsRoutes(routes))
+	b.DustThreshold = 0.0001
+	total, err := b.PortfolioValue("AUD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(total-6600) > 1e-9 {
+		t.Errorf("AUD portfolio value = %f, want 6600", total)
+	}
+
+	b.Converter = CurrencyConverterFunc(func(amount float64, from, to string) (float64, error) {
+		return amount * 0.7, nil
+	})
+	total, err = b.PortfolioValue("USD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(total-4620) > 1e-9 {
+		t.Errorf("USD portfolio value = %f, want 4620", total)
+	}
+
+	routes[BTCMARKETS_ACCOUNT_BALANCE] = `[{"balance":100000000000,"pendingFunds":0,"currency":"AUD"},{"balance":1000000000,"pendingFunds":0,"currency":"DOGE"}]`
+	b = newTestBTCMarketsAuth(t, testBTCMarketsRoutes(routes))
+	total, err = b.PortfolioValue("AUD")
+	if err == nil || !strings.Contains(err.Error(), "DOGE") {
+		t.Errorf("PortfolioValue error = %v, want DOGE listed as unpriced", err)
+	}
+	if total != 1000 {
+		t.Errorf("partial portfolio value = %f, want 1000", total)
+	}
+}
+
+func TestBuildSignature(t *testing.T) {
+	b := BTCMarkets{}
+	b.SetDefaults()
+	b.EnableAuthenticatedAPI()
+	err := b.SetAPIKeys("sample-api-key", "c2FtcGxlLXByaXZhdGUta2V5LWZvci1zaWduaW5n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path  string
+		nonce string
+		body  string
+		want  string
+	}{
+		{
+			path:  "/order/history",
+			nonce: "1378818710123",
+			body:  `{"currency":"AUD","instrument":"BTC","limit":10,"since":33434568724}`,
+			want:  "/SQqr7cqFEhSoqLvp5Mbx1JlnMsbMGWvf/Loz/hLmwcBQDoB2770/LZkfujBu/vqGbC9m/YB7JjGJvBEPV6Dlw==",
+		},
+		{
+			path:  "/account/balance",
+			nonce: "1378818710123",
+			want:  "cC8EREe87e7uuTR5aDpQeUsZ2LNFsRgIa18xSc2wCMjjDWDqTZ1vI3dSPaqk8hUliPhu+dYUPK+05xM7weoeyA==",
+		},
+	}
+
+	for _, test := range tests {
+		got, err := b.BuildSignature(test.path, test.nonce, []byte(test.body))
+		if err != nil || got != test.want {
+			t.Errorf("BuildSignature(%s) = %q %v, want %q", test.path, got, err, test.want)
+		}
+	}
+
+	if payload := BuildSignaturePayload("/account/balance", "1378818710123", nil); payload != "/account/balance\n1378818710123\n" {
+		t.Errorf("BuildSignaturePayload = %q", payload)
+	}
+}
+
+func TestRoundingMode(t *testing.T) {
+	tests := []struct {
+		value float64
+		mode  BTCMarketsRoundingMode
+		want  BTCMarketsAmount
+	}{
+		{0.000000015, BTCMARKETS_ROUND_NEAREST, 2},
+		{0.000000015, BTCMARKETS_ROUND_FLOOR, 1},
+		{0.000000015, BTCMARKETS_ROUND_CEIL, 2},
+		{-0.000000015, BTCMARKETS_ROUND_NEAREST, -2},
+		{-0.000000015, BTCMARKETS_ROUND_FLOOR, -2},
+		{-0.000000015, BTCMARKETS_ROUND_CEIL, -1},
+		{1.123456785, BTCMARKETS_ROUND_NEAREST, 112345679},
+		{1.123456785, BTCMARKETS_ROUND_FLOOR, 112345678},
+		{1.123456785, BTCMARKETS_ROUND_CEIL, 112345679},
+		{0.07, BTCMARKETS_ROUND_FLOOR, 7000000},
+		{0.07, BTCMARKETS_ROUND_CEIL, 7000000},
+		{1e-10, BTCMARKETS_ROUND_CEIL, 1},
+		{1e-10, BTCMARKETS_ROUND_NEAREST, 0},
+	}
+
+	for _, test := range tests {
+		if got := NewBTCMarketsAmountRounded(test.value, test.mode); got != test.want {
+			t.Errorf("NewBTCMarketsAmountRounded(%v, %d) = %d, want %d", test.value, test.mode, got, test.want)
+		}
+	}
+
+	b := BTCMarkets{}
+	b.SetDefaults()
+	if b.RoundingMode != BTCMARKETS_ROUND_NEAREST {
+		t.Errorf("default RoundingMode = %d, want nearest", b.RoundingMode)
+	}
+	for mode, want := range map[BTCMarketsRoundingMode]int64{BTCMARKETS_ROUND_NEAREST: 2, BTCMARKETS_ROUND_FLOOR: 1, BTCMARKETS_ROUND_CEIL: 2} {
+		b.RoundingMode = mode
+		if got := b.ConvertOrderUnits(0.000000015); got != want {
+			t.Errorf("ConvertOrderUnits with mode %d = %d, want %d", mode, got, want)
+		}
+	}
+}
+
+func TestGetMinMaxOrderSize(t *testing.T) {
+	b := newTestBTCMarkets(t, testBTCMarketsRoutes(map[string]string{
+		BTCMARKETS_MARKETS_ACTIVE: `{"success":true,"markets":[{"instrument":"ETH","currency":"AUD","minOrderAmount":0.01,"maxOrderAmount":500,"priceDecimals":2,"amountDecimals":4,"status":"Online"}]}`,
+	}))
+
+	min, max, err := b.GetMinMaxOrderSize("BTC")
+	if err != nil || min != 0.001 || !math.IsInf(max, 1) {
+		t.Errorf("GetMinMaxOrderSize(BTC) = %f %f %v, want 0.001 +Inf", min, max, err)
+	}
+
+	_, _, err = b.GetMinMaxOrderSize("XYZ")
+	if err != ErrBTCMarketsUnknownInstrument {
+		t.Errorf("GetMinMaxOrderSize(XYZ) error = %v, want ErrBTCMarketsUnknownInstrument", err)
+	}
+
+	err = b.RefreshAvailablePairs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	min, max, err = b.GetMinMaxOrderSize("ETH")
+	if err != nil || min != 0.01 || max != 500 {
+		t.Errorf("GetMinMaxOrderSize(ETH) = %f %f %v, want 0.01 500 from the markets list", min, max, err)
+	}
+}
+
+func TestSetDefaultsIfUnset(t *testing.T) {
+	b := BTCMarkets{
+		Verbose:          true,
+		Fee:              0.5,
+		APIUrl:           "http://localhost:1234",
+		RESTPollingDelay: time.Minute,
+		Ticker:           map[string]BTCMarketsTicker{"BTC-AUD": {LastPrice: 100}},
+	}
+	b.SetDefaultsIfUnset()
+
+	if !b.Verbose || b.Enabled || b.Fee != 0.5 || b.APIUrl != "http://localhost:1234" || b.RESTPollingDelay != time.Minute {
+		t.Errorf("configured values overwritten: Verbose %t Enabled %t Fee %f APIUrl %s RESTPollingDelay %s", b.Verbose, b.Enabled, b.Fee, b.APIUrl, b.RESTPollingDelay)
+	}
+	if b.Ticker["BTC-AUD"].LastPrice != 100 {
+		t.Errorf("Ticker = %v, want the existing entry kept", b.Ticker)
+	}
+	if b.Name != "BTC Markets" || b.HTTPClient == nil || b.UserAgent != BTCMARKETS_USER_AGENT || b.Orderbook == nil || b.TickerLastFetch == nil {
+		t.Errorf("unset fields not defaulted: Name %q UserAgent %q", b.Name, b.UserAgent)
+	}
+
+	if b.ReportingCurrency != BTCMARKETS_DEFAULT_REPORTING_CURRENCY || b.RoundingMode != BTCMARKETS_ROUND_NEAREST {
+		t.Errorf("ReportingCurrency %q RoundingMode %d, want the defaults", b.ReportingCurrency, b.RoundingMode)
+	}
+
+	b.SetDefaultsIfUnset()
+	if b.Fee != 0.5 || !b.Verbose {
+		t.Error("second SetDefaultsIfUnset changed the configuration")
+	}
+
+	configured := BTCMarkets{ReportingCurrency: "AUD", RoundingMode: BTCMARKETS_ROUND_FLOOR}
+	configured.SetDefaultsIfUnset()
+	if configured.ReportingCurrency != "AUD" || configured.RoundingMode != BTCMARKETS_ROUND_FLOOR {
+		t.Errorf("ReportingCurrency %q RoundingMode %d, want the configured AUD and floor", configured.ReportingCurrency, configured.RoundingMode)
+	}
+	invalid := BTCMarkets{RoundingMode: BTCMarketsRoundingMode(7)}
+	invalid.SetDefaultsIfUnset()
+	if invalid.RoundingMode != BTCMARKETS_ROUND_NEAREST {
+		t.Errorf("unknown RoundingMode left as %d, want nearest", invalid.RoundingMode)
+	}
+}
+
+func TestPublicFetchContext(t *testing.T) {
+	fetches := map[string]func(ctx context.Context, b *BTCMarkets) error{
+		"ticker": func(ctx context.Context, b *BTCMarkets) error {
+			_, err := b.GetTickerContext(ctx, "BTC-AUD")
+			return err
+		},
+		"orderbook": func(ctx context.Context, b *BTCMarkets) error {
+			_, err := b.GetOrderbookContext(ctx, "BTC-AUD")
+			return err
+		},
+		"trades": func(ctx context.Context, b *BTCMarkets) error {
+			_, err := b.GetTradesContext(ctx, "BTC-AUD", "")
+			return err
+		},
+	}
+
+	for name, fetch := range fetches {
+		b := newTestBTCMarkets(t, func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		start := time.Now()
+		err := fetch(ctx, b)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("%s with a cancelled context = %v, want context.Canceled", name, err)
+		}
+		if time.Since(start) > time.Second {
+			t.Errorf("%s took %s with a cancelled context", name, time.Since(start))
+		}
+
+		ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+		err = fetch(ctx, b)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s past its deadline = %v, want context.DeadlineExceeded", name, err)
+		}
+	}
+
+	b := newTestBTCMarkets(t, testBTCMarketsRoutes(map[string]string{
+		"/market/BTC/AUD/tick":      testBTCMarketsTicker,
+		"/market/BTC/AUD/orderbook": testBTCMarketsOrderbook,
+		"/market/BTC/AUD/trades":    testBTCMarketsTrades,
+	}))
+	ctx := context.Background()
+	if _, err := b.GetTickerContext(ctx, " btc/aud "); err != nil {
+		t.Errorf("ticker for a lowercase pair: %s", err)
+	}
+	if _, err := b.GetOrderbookContext(ctx, " btc/aud "); err != nil {
+		t.Errorf("orderbook for a lowercase pair: %s", err)
+	}
+	if _, err := b.GetTradesContext(ctx, " btc/aud ", ""); err != nil {
+		t.Errorf("trades for a lowercase pair: %s", err)
+	}
+}
+
+func TestBuildCandles(t *testing.T) {
+	trades := []BTCMarketsTrade{
+		{TradeID: 4, Price: 12, Amount: 0.5, Date: 200},
+		{TradeID: 1, Price: 10, Amount: 1, Date: 60},
+		{TradeID: 3, Price: 9, Amount: 0.25, Date: 110},
+		{TradeID: 2, Price: 11, Amount: 2, Date: 70},
+	}
+	minute := func(n int64) time.Time {
+		return time.Unix(n*60, 0).UTC()
+	}
+
+	want := []Candle{
+		{Time: minute(1), Open: 10, High: 11, Low: 9, Close: 9, Volume: 3.25},
+		{Time: minute(2), Open: 9, High: 9, Low: 9, Close: 9},
+		{Time: minute(3), Open: 12, High: 12, Low: 12, Close: 12, Volume: 0.5},
+	}
+	candles := BuildCandles(trades, time.Minute)
+	if !reflect.DeepEqual(candles, want) {
+		t.Errorf("BuildCandles = %+v, want %+v", candles, want)
+	}
+
+	candles = BuildCandlesFill(trades, time.Minute, false)
+	if !reflect.DeepEqual(candles, []Candle{want[0], want[2]}) {
+		t.Errorf("BuildCandlesFill without filling = %+v", candles)
+	}
+
+	if candles := BuildCandles(nil, time.Minute); len(candles) != 0 {
+		t.Errorf("BuildCandles with no trades = %+v", candles)
+	}
+	if candles := BuildCandles(trades, 0); len(candles) != 0 {
+		t.Errorf("BuildCandles with a zero interval = %+v", candles)
+	}
+}
+
+func TestGetRecentTrades(t *testing.T) {
+	var queries []string
+	polls := []string{
+		`[{"tid":2,"amount":1,"price":100,"date":1500000010},{"tid":1,"amount":1,"price":100,"date":1500000000}]`,
+		`[{"tid":3,"amount":0.5,"price":101,"date":1500000020},{"tid":2,"amount":1,"price":100,"date":1500000010}]`,
+		`[{"tid":3,"amount":0.5,"price":101,"date":1500000020}]`,
+	}
+	b := newTestBTCMarkets(t, func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query().Get("since"))
+		w.Write([]byte(polls[len(queries)-1]))
+	})
+
+	ids := func(trades []BTCMarketsTrade) []int64 {
+		tids := []int64{}
+		for _, x := range trades {
+			tids = append(tids, x.TradeID)
+		}
+		return tids
+	}
+
+	want := [][]int64{{2, 1}, {3}, {}}
+	for i, symbol := range []string{"BTC-AUD", "btc/aud", "BTC"} {
+		trades, err := b.GetRecentTrades(symbol)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ids(trades), want[i]) {
+			t.Errorf("poll %d trades = %v, want %v", i+1, ids(trades), want[i])
+		}
+	}
+	if !reflect.DeepEqual(queries, []string{"", "2", "3"}) {
+		t.Errorf("since parameters = %q, want [\"\" \"2\" \"3\"]", queries)
+	}
+}
+
+func TestFeeConcurrentAccess(t *testing.T) {
+	b := BTCMarkets{}
+	b.SetDefaults()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			b.SetFee(float64(i%5) / 10)
+			b.SetTradingFee("BTC", 0.2)
+		}(i)
+		go func() {
+			defer wg.Done()
+			if fee := b.GetFee(); fee < 0 || fee > 0.85 {
+				t.Errorf("GetFee = %f", fee)
+			}
+			b.GetTradingFee("BTC")
+			b.GetTradingFee("LTC")
+		}()
+	}
+	wg.Wait()
+
+	b.SetFee(0.5)
+	if fee := b.GetTradingFee("LTC"); fee != 0.5 {
+		t.Errorf("GetTradingFee(LTC) = %f, want the 0.5 default fee", fee)
+	}
+	if fee := b.GetTradingFee("BTC"); fee != 0.2 {
+		t.Errorf("GetTradingFee(BTC) = %f, want the 0.2 table fee", fee)
+	}
+}
+
+func TestGetMarkets(t *testing.T) {
+	payload := `{"success":true,"markets":[` +
+		`{"instrument":"BTC","currency":"AUD","minOrderAmount":0.0001,"maxOrderAmount":1000000,"priceDecimals":2,"amountDecimals":8,"status":"Online"},` +
+		`{"instrument":"XRP","currency":"AUD","minOrderAmount":1,"priceDecimals":4,"amountDecimals":2,"status":"Offline"}]}`
+	b := newTestBTCMarkets(t, testBTCMarketsRoutes(map[string]string{BTCMARKETS_MARKETS_ACTIVE: payload}))
+
+	markets, err := b.GetMarkets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []BTCMarketsMarket{
+		{Instrument: "BTC", Currency: "AUD", MinOrderAmount: 0.0001, MaxOrderAmount: 1000000, PriceDecimals: 2, AmountDecimals: 8, Status: "Online"},
+		{Instrument: "XRP", Currency: "AUD", MinOrderAmount: 1, PriceDecimals: 4, AmountDecimals: 2, Status: "Offline"},
+	}
+	if !reflect.DeepEqual(markets, want) {
+		t.Errorf("GetMarkets = %+v, want %+v", markets, want)
+	}
+
+	err = b.RefreshAvailablePairs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := b.GetInstrumentRules("BTC")
+	if err != nil || rules.MinVolume != 0.0001 || rules.MaxVolume != 1000000 || rules.PriceIncrement != 0.01 || rules.VolumeDecimals != 8 {
+		t.Errorf("BTC rules = %+v %v", rules, err)
+	}
+
+	b = newTestBTCMarkets(t, respondWith(http.StatusOK, `{"success":false,"errorCode":1,"errorMessage":"Service unavailable."}`))
+	_, err = b.GetMarkets()
+	if err == nil || !strings.Contains(err.Error(), "Service unavailable.") {
+		t.Errorf("GetMarkets error = %v, want the API error message", err)
+	}
+}
+
+func TestOrderCost(t *testing.T) {
+	b := BTCMarkets{}
+	b.SetDefaults()
+	b.SetFee(0.5)
+	b.SetTradingFee("ETH", 0.2)
+
+	tests := []struct {
+		name       string
+		instrument string
+		price      float64
+		volume     float64
+		side       BTCMarketsOrderSide
+		notional   float64
+		fee        float64
+		total      float64
+		wantErr    bool
+	}{
+		{name: "bid", instrument: "BTC", price: 1000, volume: 2, side: BTCMARKETS_ORDER_SIDE_BID, notional: 2000, fee: 10, total: 2010},
+		{name: "ask", instrument: "BTC", price: 1000, volume: 2, side: BTCMARKETS_ORDER_SIDE_ASK, notional: 2000, fee: 10, total: 1990},
+		{name: "lowercase ask", instrument: "BTC", price: 1000, volume: 2, side: "ask", notional: 2000, fee: 10, total: 1990},
+		{name: "table fee", instrument: "ETH", price: 300, volume: 1, side: BTCMARKETS_ORDER_SIDE_BID, notional: 300, fee: 0.6, total: 300.6},
+		{name: "invalid side", instrument: "BTC", price: 1000, volume: 2, side: "Sideways", wantErr: true},
+		{name: "zero volume", instrument: "BTC", price: 1000, side: BTCMARKETS_ORDER_SIDE_BID, wantErr: true},
+	}
+
+	for _, test := range tests {
+		notional, fee, total, err := b.OrderCost(test.instrument, test.price, test.volume, test.side)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if math.Abs(notional-test.notional) > 1e-9 || math.Abs(fee-test.fee) > 1e-9 || math.Abs(total-test.total) > 1e-9 {
+			t.Errorf("%s: OrderCost = %f %f %f, want %f %f %f", test.name, notional, fee, total, test.notional, test.fee, test.total)
+		}
+	}
+
+	proceeds, err := b.NetProceeds("BTC", 1000, 2)
+	if err != nil || math.Abs(proceeds-1990) > 1e-9 {
+		t.Errorf("NetProceeds = %f %v, want 1990", proceeds, err)
+	}
+}
+
+func TestSetAPIKeysFromEnv(t *testing.T) {
+	b := BTCMarkets{}
+	b.SetDefaults()
+	b.EnableAuthenticatedAPI()
+
+	t.Setenv("BTCM_TEST_API_KEY", "")
+	t.Setenv("BTCM_TEST_API_SECRET", "")
+	err := b.SetAPIKeysFromEnv("BTCM_TEST")
+	if err == nil || !strings.Contains(err.Error(), "BTCM_TEST_API_KEY") {
+		t.Errorf("missing key error = %v, want it to name BTCM_TEST_API_KEY", err)
+	}
+
+	t.Setenv("BTCM_TEST_API_KEY", testBTCMarketsAPIKey)
+	err = b.SetAPIKeysFromEnv("BTCM_TEST")
+	if err == nil || !strings.Contains(err.Error(), "BTCM_TEST_API_SECRET") {
+		t.Errorf("missing secret error = %v, want it to name BTCM_TEST_API_SECRET", err)
+	}
+
+	t.Setenv("BTCM_TEST_API_SECRET", "not base64!!")
+	err = b.SetAPIKeysFromEnv("BTCM_TEST")
+	if err == nil || !strings.Contains(err.Error(), "unable to decode secret") {
+		t.Errorf("bad secret error = %v, want a decode error", err)
+	}
+	if b.APIKey != "" || b.APISecret != "" {
+		t.Fatalf("keys set after errors: %q %q", b.APIKey, b.APISecret)
+	}
+
+	t.Setenv("BTCM_TEST_API_SECRET", base64.StdEncoding.EncodeToString([]byte(testBTCMarketsAPISecret)))
+	err = b.SetAPIKeysFromEnv("BTCM_TEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.APIKey != testBTCMarketsAPIKey || b.APISecret != testBTCMarketsAPISecret {
+		t.Errorf("keys = %q %q", b.APIKey, b.APISecret)
+	}
+}
+
+func TestStatusAfterPoll(t *testing.T) {
+	b := newTestBTCMarkets(t, respondWith(http.StatusOK, testBTCMarketsTicker))
+	b.EnabledPairs = []string{"btc/aud"}
+	b.RESTPollingDelay = 5 * time.Millisecond
+	b.PollingJitter = 0
+
+	status := b.Status()
+	if len(status.LastPoll) != 0 || status.Tickers != 0 || status.LastError != "" {
+		t.Fatalf("initial status = %+v", status)
+	}
+
+	start := time.Now()
+	go b.Run()
+	deadline := time.Now().Add(5 * time.Second)
+	for b.Status().LastPoll["BTC-AUD"].IsZero() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for a poll")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	b.Shutdown(context.Background())
+
+	status = b.Status()
+	if polled := status.LastPoll["BTC-AUD"]; polled.Before(start) || polled.After(time.Now()) {
+		t.Errorf("LastPoll = %s, want during Run", polled)
+	}
+	if !status.Enabled || status.WebsocketConnected || status.Tickers != 1 || status.LastError != "" {
+		t.Errorf("status = %+v", status)
+	}
+
+	b = newTestBTCMarkets(t, respondWith(http.StatusInternalServerError, `{}`))
+	b.EnabledPairs = []string{"BTC-AUD"}
+	b.RESTPollingDelay = 5 * time.Millisecond
+	go b.Run()
+	deadline = time.Now().Add(5 * time.Second)
+	for b.Status().LastError == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the poll error")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	b.Shutdown(context.Background())
+	if status = b.Status(); len(status.LastPoll) != 0 || status.LastErrorTime.IsZero() {
+		t.Errorf("status after a failed poll = %+v", status)
+	}
+}
+
+func TestPollingJitter(t *testing.T) {
+	b := BTCMarkets{}
+	b.SetDefaults()
+	if b.PollingJitter != BTCMARKETS_DEFAULT_POLLING_JITTER {
+		t.Errorf("PollingJitter = %f, want %d", b.PollingJitter, BTCMARKETS_DEFAULT_POLLING_JITTER)
+	}
+
+	tests := []struct {
+		jitter float64
+		min    time.Duration
+		max    time.Duration
+	}{
+		{jitter: 10, min: 9 * time.Second, max: 11 * time.Second},
+		{jitter: 50, min: 5 * time.Second, max: 15 * time.Second},
+	}
+	for _, test := range tests {
+		b.PollingJitter = test.jitter
+		seen := map[time.Duration]bool{}
+		for i := 0; i < 100; i++ {
+			delay := b.GetPollingDelay()
+			if delay < test.min || delay > test.max {
+				t.Fatalf("jitter %f%%: delay %s outside [%s, %s]", test.jitter, delay, test.min, test.max)
+			}
+			seen[delay] = true
+		}
+		if len(seen) < 2 {
+			t.Errorf("jitter %f%%: every delay was the same", test.jitter)
+		}
+	}
+
+	b.PollingJitter = 0
+	for i := 0; i < 10; i++ {
+		if delay := b.GetPollingDelay(); delay != BTCMARKETS_DEFAULT_POLLING_DELAY {
+			t.Fatalf("delay without jitter = %s, want %s", delay, BTCMARKETS_DEFAULT_POLLING_DELAY)
+		}
+	}
+}
+
+func TestRESTPollingDelay(t *testing.T) {
+	b := BTCMarkets{}
+	b.SetDefaults()
+	if b.RESTPollingDelay != 10*time.Second {
+		t.Fatalf("RESTPollingDelay = %s, want 10s", b.RESTPollingDelay)
+	}
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	var mtx sync.Mutex
+	var polls []time.Time
+	b2 := newTestBTCMarkets(t, func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		polls = append(polls, time.Now())
+		mtx.Unlock()
+		w.Write([]byte(testBTCMarketsTicker))
+	})
+	b2.Verbose = true
+	b2.EnabledPairs = []string{"BTC-AUD"}
+	b2.RESTPollingDelay = 50 * time.Millisecond
+	b2.PollingJitter = 0
+
+	go b2.Run()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mtx.Lock()
+		n := len(polls)
+		mtx.Unlock()
+		if n >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for two polls")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	b2.Shutdown(context.Background())
+
+	mtx.Lock()
+	gap := polls[1].Sub(polls[0])
+	mtx.Unlock()
+	if gap < 40*time.Millisecond || gap > 2*time.Second {
+		t.Errorf("gap between polls = %s, want about 50ms", gap)
+	}
+	if !strings.Contains(logged.String(), "polling delay: 50ms.") {
+		t.Errorf("verbose log doesn't show the polling delay as a duration: %q", logged.String())
+	}
+}
+
+func TestOrderWithOptions(t *testing.T) {
+	tests := []struct {
+		name      string
+		orderType BTCMarketsOrderType
+		price     int64
+		opts      BTCMarketsOrderOptions
+		contains  []string
+		excludes  []string
+		wantErr   bool
+	}{
+		{name: "no flags", orderType: BTCMARKETS_ORDER_TYPE_LIMIT, price: 10000000000, excludes: []string{"postOnly", "hidden"}},
+		{name: "post-only", orderType: BTCMARKETS_ORDER_TYPE_LIMIT, price: 10000000000, opts: BTCMarketsOrderOptions{PostOnly: true}, contains: []string{`"postOnly":true`}, excludes: []string{"hidden"}},
+		{name: "hidden", orderType: BTCMARKETS_ORDER_TYPE_LIMIT, price: 10000000000, opts: BTCMarketsOrderOptions{Hidden: true}, contains: []string{`"hidden":true`}, excludes: []string{"postOnly"}},
+		{name: "both", orderType: BTCMARKETS_ORDER_TYPE_LIMIT, price: 10000000000, opts: BTCMarketsOrderOptions{PostOnly: true, Hidden: true}, contains: []string{`"postOnly":true`, `"hidden":true`}},
+		{name: "post-only market order", orderType: BTCMARKETS_ORDER_TYPE_MARKET, opts: BTCMarketsOrderOptions{PostOnly: true}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var bodies []string
+			b := newTestBTCMarketsAuth(t, func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				bodies = append(bodies, string(body))
+				w.Write([]byte(`{"success":true,"id":5}`))
+			})
+
+			_, _, err := b.OrderWithOptions("AUD", "BTC", test.price, 100000000, BTCMARKETS_ORDER_SIDE_BID, test.orderType, "abc", test.opts)
+			if test.wantErr {
+				if err == nil || len(bodies) != 0 {
+					t.Fatalf("OrderWithOptions = %v with %d requests, want an error and no request", err, len(bodies))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(bodies) != 1 {
+				t.Fatalf("sent %d requests, want 1", len(bodies))
+			}
+			for _, x := range test.contains {
+				if !strings.Contains(bodies[0], x) {
+					t.Errorf("body %s doesn't contain %s", bodies[0], x)
+				}
+			}
+			for _, x := range test.excludes {
+				if strings.Contains(bodies[0], x) {
+					t.Errorf("body %s contains %s", bodies[0], x)
+				}
+			}
+		})
+	}
+}
+
+func TestSubscribeTicker(t *testing.T) {
+	b := BTCMarkets{}
+	b.SetDefaults()
+
+	first, unsubscribeFirst := b.SubscribeTicker("BTC-AUD")
+	second, unsubscribeSecond := b.SubscribeTicker("btc/aud")
+
+	b.ProcessTicker("BTC", BTCMarketsTicker{LastPrice: 5})
+	for i, ch := range []<-chan BTCMarketsTicker{first, second} {
+		select {
+		case ticker := <-ch:
+			if ticker.LastPrice != 5 {
+				t.Errorf("subscriber %d got %+v", i+1, ticker)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("subscriber %d didn't receive the update", i+1)
+		}
+	}
+
+	unsubscribeFirst()
+	unsubscribeFirst()
+	if _, ok := <-first; ok {
+		t.Error("channel still open after unsubscribing")
+	}
+
+	err := b.WebsocketHandleMessage([]byte(`{"marketId":"BTC-AUD","bestBid":"5","bestAsk":"7","lastPrice":"6","timestamp":"2017-07-01T00:00:00Z","messageType":"tick"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ticker := <-second:
+		if ticker.LastPrice != 6 {
+			t.Errorf("websocket update = %+v", ticker)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("remaining subscriber didn't receive the websocket update")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < BTCMARKETS_TICKER_SUBSCRIBER_BUFFER+10; i++ {
+			b.PublishTicker("BTC-AUD", BTCMarketsTicker{LastPrice: float64(i)})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("a slow subscriber blocked the publisher")
+	}
+
+	unsubscribeSecond()
+	b.tickerSubsMtx.Lock()
+	defer b.tickerSubsMtx.Unlock()
+	if len(b.tickerSubs) != 0 {
+		t.Errorf("subscriptions left after unsubscribing: %v", b.tickerSubs)
+	}
+}
+
+func TestNetProceeds(t *testing.T) {
+	b := BTCMarkets{}
+	b.SetDefaults()
+	b.SetTradingFee("ETH", 0.2)
+
+	for _, fee := range []float64{0, 0.22, 0.85} {
+		b.SetFee(fee)
+		proceeds, err := b.NetProceeds("BTC", 1234.5, 0.4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 1234.5 * 0.4 * (1 - fee/100)
+		if math.Abs(proceeds-want) > 1e-9 {
+			t.Errorf("fee %f: NetProceeds = %f, want %f", fee, proceeds, want)
+		}
+	}
+
+	proceeds, err := b.NetProceeds("ETH", 300, 1)
+	if err != nil || math.Abs(proceeds-299.4) > 1e-9 {
+		t.Errorf("ETH NetProceeds = %f %v, want 299.4", proceeds, err)
+	}
+
+	if _, err := b.NetProceeds("BTC", 0, 1); err == nil {
+		t.Error("expected an error for a zero price")
+	}
+}
+
+func TestHasSufficientBalanceFromAccount(t *testing.T) {
+	b := newTestBTCMarketsAuth(t, testBTCMarketsRoutes(map[string]string{
+		BTCMARKETS_ACCOUNT_BALANCE: testBTCMarketsBalances,
+	}))
+	b.SetFee(1)
+
+	tests := []struct {
+		side      BTCMarketsOrderSide
+		pair      string
+		price     float64
+		volume    float64
+		ok        bool
+		shortfall float64
+	}{
+		{side: BTCMARKETS_ORDER_SIDE_BID, pair: "BTC-AUD", price: 1485, volume: 1, ok: true},
+		{side: BTCMARKETS_ORDER_SIDE_BID, pair: "BTC-AUD", price: 1490, volume: 1, shortfall: 4.9},
+		{side: BTCMARKETS_ORDER_SIDE_ASK, pair: "BTC-AUD", price: 1000, volume: 1.5, ok: true},
+		{side: BTCMARKETS_ORDER_SIDE_ASK, pair: "BTC-AUD", price: 1000, volume: 1.6, shortfall: 0.1},
+		{side: BTCMARKETS_ORDER_SIDE_ASK, pair: "ETH-AUD", price: 300, volume: 2, shortfall: 2},
+	}
+
+	for _, test := range tests {
+		ok, shortfall, err := b.HasSufficientBalance(test.pair, test.side, test.price, test.volume)
+		if err != nil {
+			t.Fatalf("%s %s: %s", test.pair, test.side, err)
+		}
+		if ok != test.ok || math.Abs(shortfall-test.shortfall) > 1e-9 {
+			t.Errorf("%s %s %f at %f: ok %t shortfall %f, want %t %f", test.pair, test.side, test.volume, test.price, ok, shortfall, test.ok, test.shortfall)
+		}
+	}
+
+	failing := newTestBTCMarketsAuth(t, respondWith(http.StatusInternalServerError, `{"success":false,"errorCode":3,"errorMessage":"Internal error"}`))
+	if _, _, err := failing.HasSufficientBalance("BTC-AUD", BTCMARKETS_ORDER_SIDE_BID, 1000, 1); err == nil {
+		t.Error("expected the balance request error")
+	}
+}
+
+func TestLenientNumbers(t *testing.T) {
+	for _, body := range []string{
+		`{"bestBid":100.5,"bestAsk":101.25,"lastPrice":101,"currency":"AUD","instrument":"BTC","timestamp":1500000000}`,
+		`{"bestBid":"100.5","bestAsk":"101.25","lastPrice":"101","currency":"AUD","instrument":"BTC","timestamp":"1500000000"}`,
+	} {
+		ticker := BTCMarketsTicker{}
+		err := JSONDecode([]byte(body), &ticker)
+		if err != nil {
+			t.Fatalf("%s: %s", body, err)
+		}
+		if ticker.LastPrice != 101 || ticker.BestBID != 100.5 || ticker.BestAsk != 101.25 || ticker.Timestamp != 1500000000 || ticker.Instrument != "BTC" {
+			t.Errorf("%s decoded to %+v", body, ticker)
+		}
+	}
+
+	ticker := BTCMarketsTicker{}
+	if err := JSONDecode([]byte(`{"lastPrice":"abc"}`), &ticker); err == nil {
+		t.Error("accepted a non-numeric lastPrice")
+	}
+
+	order := BTCMarketsOrderResponse{}
+	err := JSONDecode([]byte(`{"id":"5","price":"10000000000","volume":100000000,"openVolume":"0","status":"Placed","trades":[{"id":1}]}`), &order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.ID != 5 || order.Price != 10000000000 || order.Volume != 100000000 || order.Status != "Placed" || len(order.Trades) != 1 {
+		t.Errorf("order decoded to %+v", order)
+	}
+
+	b := newTestBTCMarkets(t, respondWith(http.StatusOK, `{"bestBid":"100.5","bestAsk":101.25,"lastPrice":"101","currency":"AUD","instrument":"BTC","timestamp":1500000000}`))
+	got, err := b.GetTicker("BTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.LastPrice != 101 || got.BestBID != 100.5 {
+		t.Errorf("GetTicker = %+v", got)
+	}
+}
+
+func TestAllTickers(t *testing.T) {
+	b := newTestBTCMarkets(t, testBTCMarketsRoutes(map[string]string{
+		"/market/BTC/AUD/tick": testBTCMarketsTicker,
+		"/market/LTC/AUD/tick": `{"bestBid":49,"bestAsk":51,"lastPrice":50,"currency":"AUD","instrument":"LTC","timestamp":1500000000}`,
+	}))
+	b.EnabledPairs = []string{"BTC-AUD", "LTC-AUD"}
+	b.RESTPollingDelay = 5 * time.Millisecond
+	b.PollingJitter = 0
+
+	tickers := b.AllTickers()
+	if b.AllTickers() != tickers {
+		t.Fatal("AllTickers returned a different channel on the second call")
+	}
+
+	go b.Run()
+	defer b.Shutdown(context.Background())
+
+	got := map[string]float64{}
+	timeout := time.After(5 * time.Second)
+	for len(got) < 2 {
+		select {
+		case ticker := <-tickers:
+			got[ticker.Instrument+"-"+ticker.Currency] = ticker.LastPrice
+		case <-timeout:
+			t.Fatalf("timed out waiting for both pairs, got %v", got)
+		}
+	}
+	if got["BTC-AUD"] != 101 || got["LTC-AUD"] != 50 {
+		t.Errorf("combined stream = %v", got)
+	}
+
+	untagged := BTCMarkets{}
+	untagged.SetDefaults()
+	tickers = untagged.AllTickers()
+	untagged.PublishTicker("eth/btc", BTCMarketsTicker{LastPrice: 0.05})
+	select {
+	case ticker := <-tickers:
+		if ticker.Instrument != "ETH" || ticker.Currency != "BTC" {
+			t.Errorf("untagged update was tagged %s-%s, want ETH-BTC", ticker.Instrument, ticker.Currency)
+		}
+	default:
+		t.Error("untagged update wasn't published")
+	}
+}
+
+func TestNormalizeCurrency(t *testing.T) {
+	var mtx sync.Mutex
+	paths := []string{}
+	b := newTestBTCMarkets(t, func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		paths = append(paths, r.URL.Path)
+		mtx.Unlock()
+		w.Write([]byte(testBTCMarketsTicker))
+	})
+	b.AvailablePairs = []string{"BTC-AUD", "LTC-AUD"}
+
+	for _, code := range []string{"btc", "Btc", " BTC\n"} {
+		if got := NormalizeCurrency(code); got != "BTC" {
+			t.Errorf("NormalizeCurrency(%q) = %q, want BTC", code, got)
+		}
+		if err := b.ValidateCurrency(NormalizeCurrency(code)); err != nil {
+			t.Errorf("ValidateCurrency(%q): %s", code, err)
+		}
+		if _, err := b.GetTicker(code); err != nil {
+			t.Fatalf("GetTicker(%q): %s", code, err)
+		}
+	}
+	for _, x := range paths {
+		if x != "/market/BTC/AUD/tick" {
+			t.Errorf("requested %s, want /market/BTC/AUD/tick", x)
+		}
+	}
+
+	if err := b.ValidateCurrency("XYZ"); err != ErrBTCMarketsUnknownCurrency {
+		t.Errorf("ValidateCurrency(XYZ) = %v, want ErrBTCMarketsUnknownCurrency", err)
+	}
+	if _, err := b.GetTicker("xyz"); err == nil {
+		t.Error("GetTicker accepted an unknown currency")
+	}
+	if len(paths) != 3 {
+		t.Errorf("made %d requests, want 3 with the unknown currency rejected locally", len(paths))
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var failing, hits int32 = 1, 0
+	b := newTestBTCMarketsAuth(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(testBTCMarketsTicker))
+	})
+	b.Breaker.Threshold = 3
+	b.Breaker.Cooldown = 50 * time.Millisecond
+
+	for i := 0; i < 3; i++ {
+		if _, err := b.GetTicker("BTC"); err == nil || err == ErrCircuitOpen {
+			t.Fatalf("request %d: error = %v, want the server error", i+1, err)
+		}
+	}
+	if state := b.Status().Circuit; state != CIRCUIT_OPEN {
+		t.Fatalf("state after 3 failures = %s, want open", state)
+	}
+	if _, err := b.GetTicker("BTC"); err != ErrCircuitOpen {
+		t.Errorf("public request while open = %v, want ErrCircuitOpen", err)
+	}
+	if _, err := b.GetAccountBalance(); err != ErrCircuitOpen {
+		t.Errorf("authenticated request while open = %v, want ErrCircuitOpen", err)
+	}
+	if n := atomic.LoadInt32(&hits); n != 3 {
+		t.Errorf("server saw %d requests, want 3", n)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if state := b.Breaker.State(); state != CIRCUIT_HALF_OPEN {
+		t.Fatalf("state after the cooldown = %s, want half-open", state)
+	}
+	if _, err := b.GetTicker("BTC"); err == nil || err == ErrCircuitOpen {
+		t.Fatalf("half-open probe error = %v, want the server error", err)
+	}
+	if _, err := b.GetTicker("BTC"); err != ErrCircuitOpen {
+		t.Fatalf("request after a failed probe = %v, want ErrCircuitOpen", err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	atomic.StoreInt32(&failing, 0)
+	if _, err := b.GetTicker("BTC"); err != nil {
+		t.Fatalf("half-open probe: %s", err)
+	}
+	if state := b.Breaker.State(); state != CIRCUIT_CLOSED {
+		t.Errorf("state after a successful probe = %s, want closed", state)
+	}
+}
+
+func TestCompute24hStats(t *testing.T) {
+	now := time.Unix(100000, 0)
+	trades := []BTCMarketsTrade{
+		{TradeID: 3, Price: 120, Amount: 1, Date: 99000},
+		{TradeID: 1, Price: 100, Amount: 2, Date: 20000},
+		{TradeID: 2, Price: 90, Amount: 0.5, Date: 50000},
+		{TradeID: 0, Price: 1000, Amount: 9, Date: 1000},
+	}
+
+	stats := Compute24hStats(trades, now)
+	want := BTCMarkets24hStats{Open: 100, Last: 120, High: 120, Low: 90, Volume: 3.5, Change: 20, ChangePercent: 20, Trades: 3}
+	if stats != want {
+		t.Errorf("Compute24hStats = %+v, want %+v", stats, want)
+	}
+
+	if stats := Compute24hStats(trades[3:], now); stats != (BTCMarkets24hStats{}) {
+		t.Errorf("stats with no trades in the window = %+v, want zero", stats)
+	}
+
+	recent := time.Now().Unix()
+	b := newTestBTCMarkets(t, respondWith(http.StatusOK, fmt.Sprintf(`[{"tid":2,"amount":0.25,"price":110,"date":%d},{"tid":1,"amount":1,"price":100,"date":%d},{"tid":0,"amount":5,"price":1,"date":%d}]`, recent-10, recent-3600, recent-2*86400)))
+	stats, err := b.Get24hStats("BTC-AUD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Open != 100 || stats.Last != 110 || stats.Low != 100 || stats.Volume != 1.25 || stats.Trades != 2 {
+		t.Errorf("Get24hStats = %+v", stats)
+	}
+}
+
+func TestSecretIsBase64(t *testing.T) {
+	const raw = "sample-private-key-for-signing"
+	const want = "cC8EREe87e7uuTR5aDpQeUsZ2LNFsRgIa18xSc2wCMjjDWDqTZ1vI3dSPaqk8hUliPhu+dYUPK+05xM7weoeyA=="
+
+	encoded := BTCMarkets{}
+	encoded.SetDefaults()
+	encoded.EnableAuthenticatedAPI()
+	if !encoded.SecretIsBase64 {
+		t.Fatal("SecretIsBase64 should default to true")
+	}
+	if err := encoded.SetAPIKeys("sample-api-key", "not base64!!"); err == nil {
+		t.Error("accepted a secret that isn't base64")
+	}
+	if err := encoded.SetAPIKeys("sample-api-key", base64.StdEncoding.EncodeToString([]byte(raw))); err != nil {
+		t.Fatal(err)
+	}
+
+	plain := BTCMarkets{}
+	plain.SetDefaults()
+	plain.EnableAuthenticatedAPI()
+	plain.SecretIsBase64 = false
+	if err := plain.SetAPIKeys("sample-api-key", raw); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, b := range map[string]*BTCMarkets{"base64": &encoded, "raw": &plain} {
+		if got, err := b.BuildSignature("/account/balance", "1378818710123", nil); err != nil || got != want {
+			t.Errorf("%s secret signature = %s %v, want %s", name, got, err, want)
+		}
+	}
+
+	server := newTestBTCMarkets(t, func(w http.ResponseWriter, r *http.Request) {
+		hmac, _ := GetHMAC(HASH_SHA512, []byte(r.URL.Path+"\n"+r.Header.Get("timestamp")+"\n"), []byte(raw))
+		if r.Header.Get("signature") != Base64Encode(hmac) {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"success":false,"errorCode":1,"errorMessage":"Authentication failed."}`))
+			return
+		}
+		w.Write([]byte(testBTCMarketsBalances))
+	})
+	server.EnableAuthenticatedAPI()
+	server.SecretIsBase64 = false
+	if err := server.SetAPIKeys(testBTCMarketsAPIKey, raw); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.GetAccountBalance(); err != nil {
+		t.Errorf("request signed with a raw secret: %s", err)
+	}
+}
+
+func TestNoncePersistedAcrossRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nonce")
+
+	b := BTCMarkets{}
+	b.SetDefaults()
+	b.Nonce.Path = path
+	first, _ := strconv.ParseInt(b.GetNonce(), 10, 64)
+	second, _ := strconv.ParseInt(b.GetNonce(), 10, 64)
+	if second <= first {
+		t.Fatalf("nonces %d then %d, want increasing", first, second)
+	}
+	b.Stop()
+	data, err := ioutil.ReadFile(path)
+	if err != nil || string(data) != strconv.FormatInt(second, 10) {
+		t.Fatalf("persisted nonce %q %v, want %d", data, err, second)
+	}
+
+	// Simulate a clock rollback: the last run used nonces an hour ahead.
+	persisted := time.Now().Add(time.Hour).UnixNano() / int64(time.Millisecond)
+	err = ioutil.WriteFile(path, []byte(strconv.FormatInt(persisted, 10)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sent int64
+	restarted := newTestBTCMarketsAuth(t, func(w http.ResponseWriter, r *http.Request) {
+		nonce, _ := strconv.ParseInt(r.Header.Get("timestamp"), 10, 64)
+		atomic.StoreInt64(&sent, nonce)
+		w.Write([]byte(testBTCMarketsBalances))
+	})
+	restarted.Nonce.Path = path
+	if _, err := restarted.GetAccountBalance(); err != nil {
+		t.Fatal(err)
+	}
+	if nonce := atomic.LoadInt64(&sent); nonce != persisted+1 {
+		t.Errorf("first nonce after restart = %d, want %d", nonce, persisted+1)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	corrupt := BTCMarkets{}
+	corrupt.SetDefaults()
+	corrupt.Nonce.Path = path
+	if nonce, err := strconv.ParseInt(corrupt.GetNonce(), 10, 64); err != nil || nonce <= 0 {
+		t.Errorf("nonce with a corrupt file = %d %v", nonce, err)
+	}
+}
+
+func TestGetOrderByClientID(t *testing.T) {
+	b := newTestBTCMarketsAuth(t, testBTCMarketsRoutes(map[string]string{
+		BTCMARKETS_ORDER_OPEN:    `{"success":true,"orders":[{"id":1,"clientRequestId":"a","status":"Placed"}]}`,
+		BTCMARKETS_ORDER_HISTORY: `{"success":true,"orders":[{"id":2,"clientRequestId":"b","status":"Fully Matched"},{"id":3,"clientRequestId":"c","price":500000000,"status":"Cancelled"},{"id":4,"status":"Cancelled"}]}`,
+	}))
+	b.EnabledPairs = []string{"BTC-AUD"}
+
+	tests := []struct {
+		clientID string
+		id       float64
+		status   string
+	}{
+		{clientID: "a", id: 1, status: "Placed"},
+		{clientID: "b", id: 2, status: "Fully Matched"},
+		{clientID: "c", id: 3, status: "Cancelled"},
+	}
+	for _, test := range tests {
+		order, err := b.GetOrderByClientID(test.clientID)
+		if err != nil {
+			t.Fatalf("%s: %s", test.clientID, err)
+		}
+		if order.ID != test.id || order.Status != test.status || order.ClientRequestId != test.clientID {
+			t.Errorf("%s: order = %+v", test.clientID, order)
+		}
+	}
+
+	if _, err := b.GetOrderByClientID("missing"); err != ErrBTCMarketsOrderNotFound {
+		t.Errorf("unknown client ID error = %v, want ErrBTCMarketsOrderNotFound", err)
+	}
+}
+
+func TestFormatPriceAndVolume(t *testing.T) {
+	b := BTCMarkets{}
+	b.SetDefaults()
+	b.SetInstrumentRules(BTCMarketsInstrumentRules{Instrument: "XRP", Currency: "AUD", PriceDecimals: 4, VolumeDecimals: 2})
+
+	tests := []struct {
+		instrument string
+		price      float64
+		volume     float64
+		wantPrice  string
+		wantVolume string
+	}{
+		{instrument: "BTC", price: 1234.5, volume: 0.1, wantPrice: "1234.50", wantVolume: "0.10000000"},
+		{instrument: "ETH", price: 300.126, volume: 2, wantPrice: "300.13", wantVolume: "2.00000000"},
+		{instrument: "XRP", price: 0.51234567, volume: 10, wantPrice: "0.5123", wantVolume: "10.00"},
+		{instrument: "ZZZ", price: 1, volume: 1, wantPrice: "1.00", wantVolume: "1.00000000"},
+	}
+	for _, test := range tests {
+		if got := b.FormatPrice(test.instrument, test.price); got != test.wantPrice {
+			t.Errorf("FormatPrice(%s, %f) = %s, want %s", test.instrument, test.price, got, test.wantPrice)
+		}
+		if got := b.FormatVolume(test.instrument, test.volume); got != test.wantVolume {
+			t.Errorf("FormatVolume(%s, %f) = %s, want %s", test.instrument, test.volume, got, test.wantVolume)
+		}
+	}
+}
+
+func TestOrderSideAndTypeJSON(t *testing.T) {
+	for _, side := range []BTCMarketsOrderSide{"bid", "BID", "Bid", "aSK"} {
+		data, err := JSONEncode(side)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded BTCMarketsOrderSide
+		if err := JSONDecode(data, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if decoded != side.Canonical() || !decoded.IsValid() {
+			t.Errorf("%q round tripped through %s to %q", side, data, decoded)
+		}
+	}
+	for _, orderType := range []BTCMarketsOrderType{"limit", "MARKET", "Market"} {
+		data, err := JSONEncode(orderType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded BTCMarketsOrderType
+		if err := JSONDecode(data, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if decoded != orderType.Canonical() || !decoded.IsValid() {
+			t.Errorf("%q round tripped through %s to %q", orderType, data, decoded)
+		}
+	}
+
+	order := BTCMarketsOrderResponse{}
+	err := JSONDecode([]byte(`{"id":1,"orderSide":"bid","ordertype":"LIMIT"}`), &order)
+	if err != nil || order.OrderSide != BTCMARKETS_ORDER_SIDE_BID || order.OrderType != BTCMARKETS_ORDER_TYPE_LIMIT {
+		t.Errorf("order decoded to %+v, %v", order, err)
+	}
+	if BTCMarketsOrderSide("sideways").IsValid() || BTCMarketsOrderType("stop").IsValid() {
+		t.Error("unknown side or type reported as valid")
+	}
+
+	var body []byte
+	b := newTestBTCMarketsAuth(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		w.Write([]byte(`{"success":true,"id":7,"clientRequestId":"abc"}`))
+	})
+	if _, _, err := b.Order("AUD", "BTC", 10000000000, 100000000, "bid", "limit", "abc"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(body, []byte(`"orderSide":"Bid"`)) || !bytes.Contains(body, []byte(`"ordertype":"Limit"`)) {
+		t.Errorf("order body = %s, want canonical side and type", body)
+	}
+
+	body = nil
+	if _, _, err := b.Order("AUD", "BTC", 10000000000, 100000000, "sideways", "limit", ""); err == nil {
+		t.Error("accepted an invalid side")
+	}
+	if body != nil {
+		t.Error("sent an order with an invalid side")
+	}
+}
+
+func TestMarketBuyWithSlippage(t *testing.T) {
+	var body []byte
+	b := newTestBTCMarketsAuth(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/market/BTC/AUD/orderbook":
+			w.Write([]byte(`{"currency":"AUD","instrument":"BTC","timestamp":1500000000,"asks":[[101,1],[100,1],[150,10]],"bids":[[99,1]]}`))
+		case BTCMARKETS_ORDER_CREATE:
+			body, _ = ioutil.ReadAll(r.Body)
+			w.Write([]byte(`{"success":true,"id":7,"clientRequestId":""}`))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	if _, err := b.MarketBuyWithSlippage("BTC", 500, 5); err != ErrSlippageExceeded {
+		t.Fatalf("thin book error = %v, want ErrSlippageExceeded", err)
+	}
+	if body != nil {
+		t.Fatalf("placed an order despite the slippage: %s", body)
+	}
+
+	orderID, err := b.MarketBuyWithSlippage("BTC", 150, 1)
+	if err != nil || orderID != 7 {
+		t.Fatalf("order = %d, %v", orderID, err)
+	}
+	for _, want := range []string{`"price":10100000000`, `"volume":149504950`, `"orderSide":"Bid"`, `"ordertype":"Limit"`} {
+		if !bytes.Contains(body, []byte(want)) {
+			t.Errorf("order body %s doesn't contain %s", body, want)
+		}
+	}
+
+	if _, err := b.MarketBuyWithSlippage("BTC", 0, 1); err == nil {
+		t.Error("accepted a zero spend")
+	}
+
+	volume, avgPrice, bestPrice, err := EstimateMarketBuy(BTCMarketsOrderbook{Asks: [][]float64{{100, 1}, {101, 1}}}, 150)
+	if err != nil || bestPrice != 100 || math.Abs(volume-1.495049504950495) > 1e-9 || math.Abs(avgPrice-150/volume) > 1e-9 {
+		t.Errorf("EstimateMarketBuy = %f %f %f %v", volume, avgPrice, bestPrice, err)
+	}
+}
+
+// testCurrencyConverter converts at a fixed rate and records each request.
+type testCurrencyConverter struct {
+	mtx   sync.Mutex
+	rate  float64
+	pairs []string
+}
+
+func (c *testCurrencyConverter) Convert(amount float64, from, to string) (float64, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.pairs = append(c.pairs, from+to)
+	return amount * c.rate, nil
+}
+
+func TestCurrencyConverterInjection(t *testing.T) {
+	b := newTestBTCMarkets(t, respondWith(http.StatusOK, testBTCMarketsTicker))
+	if b.Converter == nil {
+		t.Fatal("SetDefaults didn't install a converter")
+	}
+
+	converter := &testCurrencyConverter{rate: 0.5}
+	b.Converter = converter
+	b.ReportingCurrency = "EUR"
+	b.EnabledPairs = []string{"BTC-AUD"}
+	b.RESTPollingDelay = 5 * time.Millisecond
+	b.PollingJitter = 0
+
+	go b.Run()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if rate, _, ok := b.LastFXRate("AUD", "EUR"); ok {
+			if rate != 0.5 {
+				t.Errorf("rate = %f, want 0.5 from the injected converter", rate)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for Run to convert a ticker")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	b.Shutdown(context.Background())
+
+	converter.mtx.Lock()
+	defer converter.mtx.Unlock()
+	if len(converter.pairs) == 0 || converter.pairs[0] != "AUDEUR" {
+		t.Errorf("converter saw %v, want AUD to EUR", converter.pairs)
+	}
+}
+
+func TestGetFundTransferHistory(t *testing.T) {
+	var query string
+	b := newTestBTCMarketsAuth(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" || r.URL.Path != BTCMARKETS_FUND_TRANSFERS {
+			t.Errorf("request %s %s", r.Method, r.URL.Path)
+		}
+		query = r.URL.RawQuery
+		w.Write([]byte(`{"success":true,"fundTransfers":[` +
+			`{"fundTransferId":11,"transferType":"DEPOSIT","status":"Complete","creationTime":1500000000000,"currency":"AUD","amount":100000000,"fee":0,"description":"BPAY"},` +
+			`{"fundTransferId":12,"transferType":"WITHDRAW","status":"Pending Authorization","creationTime":1500000100000,"currency":"BTC","amount":5000000,"fee":100000,"cryptoPaymentDetail":{"address":"1BTCAddress","txId":"tx1"}}]}`))
+	})
+
+	transfers, err := b.GetFundTransferHistory(10, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query != "limit=10&since=10" {
+		t.Errorf("query = %s, want limit=10&since=10", query)
+	}
+	if len(transfers) != 2 {
+		t.Fatalf("got %d transfers, want 2", len(transfers))
+	}
+
+	deposit, withdrawal := transfers[0], transfers[1]
+	if deposit.ID != 11 || deposit.TransferType != "DEPOSIT" || deposit.Status != "Complete" || deposit.Currency != "AUD" || deposit.Amount != 100000000 || deposit.Description != "BPAY" {
+		t.Errorf("deposit = %+v", deposit)
+	}
+	if withdrawal.ID != 12 || withdrawal.TransferType != "WITHDRAW" || withdrawal.Currency != "BTC" || withdrawal.Amount != 5000000 || withdrawal.Fee != 100000 {
+		t.Errorf("withdrawal = %+v", withdrawal)
+	}
+	if withdrawal.CryptoPaymentDetail.Address != "1BTCAddress" || withdrawal.CryptoPaymentDetail.TxID != "tx1" {
+		t.Errorf("withdrawal payment detail = %+v", withdrawal.CryptoPaymentDetail)
+	}
+
+	failing := newTestBTCMarketsAuth(t, respondWith(http.StatusOK, `{"success":false,"errorCode":3,"errorMessage":"Invalid argument."}`))
+	if _, err := failing.GetFundTransferHistory(10, 0); err == nil || !strings.Contains(err.Error(), "Invalid argument.") {
+		t.Errorf("error = %v, want the API error message", err)
+	}
+}
+
+func TestEstimateFillLikelihood(t *testing.T) {
+	requests := int32(0)
+	b := newTestBTCMarkets(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte(testBTCMarketsOrderbook))
+	})
+
+	tests := []struct {
+		side     BTCMarketsOrderSide
+		price    float64
+		volume   float64
+		fillable float64
+	}{
+		{side: BTCMARKETS_ORDER_SIDE_BID, price: 101, volume: 1, fillable: 0},
+		{side: BTCMARKETS_ORDER_SIDE_BID, price: 101.25, volume: 1, fillable: 0.5},
+		{side: "bid", price: 105, volume: 10, fillable: 1.5},
+		{side: BTCMARKETS_ORDER_SIDE_BID, price: 105, volume: 1, fillable: 1},
+		{side: BTCMARKETS_ORDER_SIDE_ASK, price: 100.5, volume: 4, fillable: 2},
+		{side: "ASK", price: 99, volume: 4, fillable: 4},
+		{side: BTCMARKETS_ORDER_SIDE_ASK, price: 101, volume: 1, fillable: 0},
+	}
+	for _, test := range tests {
+		fillable, err := b.EstimateFillLikelihood("BTC", test.side, test.price, test.volume)
+		if err != nil {
+			t.Fatalf("%s %f: %s", test.side, test.price, err)
+		}
+		if fillable != test.fillable {
+			t.Errorf("%s %f at %f: fillable %f, want %f", test.side, test.volume, test.price, fillable, test.fillable)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("fetched the orderbook %d times, want 1 from the cache", n)
+	}
+
+	if _, err := b.EstimateFillLikelihood("BTC", "sideways", 100, 1); err == nil {
+		t.Error("accepted an invalid side")
+	}
+}
+
+func TestRunWithoutEnabledPairs(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	strict := BTCMarkets{}
+	strict.SetDefaults()
+	strict.RequireEnabledPairs = true
+	done := make(chan struct{})
+	go func() {
+		strict.Run()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run didn't return with RequireEnabledPairs set")
+	}
+	if n := strings.Count(logged.String(), "no currency pairs are enabled"); n != 1 {
+		t.Errorf("logged the warning %d times, want 1:\n%s", n, logged.String())
+	}
+
+	logged.Reset()
+	requests := int32(0)
+	b := newTestBTCMarkets(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte(testBTCMarketsTicker))
+	})
+	b.RESTPollingDelay = 10 * time.Millisecond
+	b.PollingJitter = 0
+	done = make(chan struct{})
+	go func() {
+		b.Run()
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	b.Shutdown(context.Background())
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run didn't return after Shutdown")
+	}
+
+	if n := strings.Count(logged.String(), "no currency pairs are enabled"); n != 1 {
+		t.Errorf("logged the warning %d times, want 1:\n%s", n, logged.String())
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("made %d requests with no pairs enabled", n)
+	}
+}
+
+func TestEnabledCurrencyPairs(t *testing.T) {
+	var mtx sync.Mutex
+	paths := []string{}
+	b := newTestBTCMarkets(t, func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		paths = append(paths, r.URL.Path)
+		mtx.Unlock()
+		w.Write([]byte(testBTCMarketsTicker))
+	})
+	b.EnabledPairs = []string{"BTC", "ETH/BTC", "LTC-AUD", "A-B-C"}
+
+	want := []CurrencyPair{{Base: "BTC", Quote: "AUD"}, {Base: "ETH", Quote: "BTC"}, {Base: "LTC", Quote: "AUD"}}
+	if got := b.GetEnabledCurrencyPairs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetEnabledCurrencyPairs = %+v, want %+v", got, want)
+	}
+
+	for _, pair := range []string{"ETH/BTC", "BTC"} {
+		if _, err := b.GetTicker(pair); err != nil {
+			t.Fatalf("%s: %s", pair, err)
+		}
+	}
+	if !reflect.DeepEqual(paths, []string{"/market/ETH/BTC/tick", "/market/BTC/AUD/tick"}) {
+		t.Errorf("requested %v", paths)
+	}
+
+	b.PairDelimiter = ":"
+	if key := b.PairKey("eth:btc"); key != "ETH:BTC" {
+		t.Errorf("PairKey with a custom delimiter = %s, want ETH:BTC", key)
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	b := newTestBTCMarkets(t, testBTCMarketsRoutes(map[string]string{
+		"/market/BTC/AUD/tick":      testBTCMarketsTicker,
+		"/market/LTC/AUD/tick":      `{"bestBid":49,"bestAsk":51,"lastPrice":50,"currency":"AUD","instrument":"LTC","timestamp":1500000000}`,
+		"/market/BTC/AUD/orderbook": testBTCMarketsOrderbook,
+		"/market/LTC/AUD/orderbook": `{"currency":"AUD","instrument":"LTC","timestamp":1500000000,"asks":[[51,1]],"bids":[[49,1]]}`,
+	}))
+	b.EnabledPairs = []string{"BTC-AUD", "LTC-AUD"}
+	b.WarmupOrderbooks = true
+	// With an hour between polls, anything cached soon after Run starts came
+	// from the warmup.
+	b.RESTPollingDelay = time.Hour
+
+	go b.Run()
+	defer b.Stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b.tickerMtx.Lock()
+		tickers := len(b.Ticker)
+		b.tickerMtx.Unlock()
+		b.orderbookMtx.Lock()
+		orderbooks := len(b.Orderbook)
+		b.orderbookMtx.Unlock()
+		if tickers == 2 && orderbooks == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("warmup cached %d tickers and %d orderbooks, want 2 of each", tickers, orderbooks)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cancelled := newTestBTCMarkets(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request %s sent after the context was cancelled", r.URL.Path)
+	})
+	cancelled.EnabledPairs = []string{"BTC-AUD"}
+	if err := cancelled.Warmup(ctx); err == nil {
+		t.Error("Warmup succeeded with a cancelled context")
+	}
+
+	bare := newTestBTCMarkets(t, testBTCMarketsRoutes(map[string]string{
+		"/market/BTC/AUD/tick": testBTCMarketsTicker,
+	}))
+	bare.EnabledPairs = []string{"btc"}
+	if err := bare.Warmup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bare.Status().LastPoll["BTC-AUD"]; !ok || len(bare.Status().LastPoll) != 1 {
+		t.Errorf("LastPoll = %v, want only the canonical BTC-AUD key", bare.Status().LastPoll)
+	}
+}
+
+func TestGetBalanceFor(t *testing.T) {
+	b := newTestBTCMarketsAuth(t, testBTCMarketsRoutes(map[string]string{
+		BTCMARKETS_ACCOUNT_BALANCE: testBTCMarketsBalances,
+	}))
+
+	tests := []struct {
+		currency  string
+		available float64
+		pending   float64
+	}{
+		{currency: "BTC", available: 1.5, pending: 0.5},
+		{currency: "btc", available: 1.5, pending: 0.5},
+		{currency: " aud ", available: 1500},
+	}
+	for _, test := range tests {
+		available, pending, err := b.GetBalanceFor(test.currency)
+		if err != nil {
+			t.Fatalf("%q: %s", test.currency, err)
+		}
+		if available != test.available || pending != test.pending {
+			t.Errorf("%q: available %f pending %f, want %f %f", test.currency, available, pending, test.available, test.pending)
+		}
+	}
+
+	if _, _, err := b.GetBalanceFor("ETH"); err != ErrBTCMarketsBalanceNotFound {
+		t.Errorf("ETH error = %v, want ErrBTCMarketsBalanceNotFound", err)
+	}
+}
+
+func TestVerboseRequestRedaction(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	var signature string
+	b := newTestBTCMarketsAuth(t, func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get("signature")
+		w.Write([]byte(testBTCMarketsBalances))
+	})
+	b.Verbose = true
+
+	if _, err := b.GetAccountBalance(); err != nil {
+		t.Fatal(err)
+	}
+	output := logged.String()
+	if strings.Contains(output, signature) || strings.Contains(output, testBTCMarketsAPIKey) {
+		t.Errorf("verbose log leaked the apikey or signature:\n%s", output)
+	}
+	if !strings.Contains(output, "apikey test... and signature "+signature[:4]+"...") {
+		t.Errorf("verbose log doesn't contain the redacted prefixes:\n%s", output)
+	}
+
+	logged.Reset()
+	b.LogSecrets = true
+	if _, err := b.GetAccountBalance(); err != nil {
+		t.Fatal(err)
+	}
+	if output := logged.String(); !strings.Contains(output, "apikey "+testBTCMarketsAPIKey+" and signature "+signature) {
+		t.Errorf("LogSecrets didn't log the full apikey and signature:\n%s", output)
+	}
+
+	for secret, want := range map[string]string{"": "***", "short": "***", "12345678": "***", "123456789": "1234..."} {
+		if got := RedactSecret(secret); got != want {
+			t.Errorf("RedactSecret(%q) = %q, want %q", secret, got, want)
+		}
+	}
+}
+
+func TestOrderbookImbalance(t *testing.T) {
+	tests := []struct {
+		name      string
+		orderbook string
+		depth     int
+		want      float64
+		wantErr   error
+	}{
+		{name: "skewed to bids", orderbook: `{"asks":[[101,1],[100,1],[150,10]],"bids":[[98,3],[99,3],[50,100]]}`, depth: 2, want: 0.5},
+		{name: "top level", orderbook: testBTCMarketsOrderbook, depth: 1, want: 0.6},
+		{name: "full depth", orderbook: testBTCMarketsOrderbook, depth: 10, want: 3.5 / 6.5},
+		{name: "no asks", orderbook: `{"asks":[],"bids":[[1,1]]}`, depth: 2, want: 1},
+		{name: "no bids", orderbook: `{"asks":[[1,1]],"bids":[]}`, depth: 2, want: -1},
+		{name: "empty", orderbook: `{"asks":[],"bids":[]}`, depth: 2, wantErr: ErrBTCMarketsOrderbookEmpty},
+	}
+
+	for _, test := range tests {
+		b := newTestBTCMarkets(t, respondWith(http.StatusOK, test.orderbook))
+		imbalance, err := b.OrderbookImbalance("BTC-AUD", test.depth)
+		if err != test.wantErr {
+			t.Errorf("%s: error = %v, want %v", test.name, err, test.wantErr)
+			continue
+		}
+		if math.Abs(imbalance-test.want) > 1e-12 {
+			t.Errorf("%s: imbalance = %f, want %f", test.name, imbalance, test.want)
+		}
+	}
+
+	b := newTestBTCMarkets(t, respondWith(http.StatusOK, testBTCMarketsOrderbook))
+	if _, err := b.OrderbookImbalance("BTC-AUD", 0); err == nil {
+		t.Error("accepted a depth of 0")
+	}
+}
+
+func TestTickerAndTradeTime(t *testing.T) {
+	want := time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC)
+
+	b := newTestBTCMarkets(t, testBTCMarketsRoutes(map[string]string{
+		"/market/BTC/AUD/tick":   testBTCMarketsTicker,
+		"/market/BTC/AUD/trades": testBTCMarketsTrades,
+	}))
+	ticker, err := b.GetTicker("BTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ticker.Time(); !got.Equal(want) || got.Location() != time.UTC {
+		t.Errorf("ticker Time = %s, want %s", got, want)
+	}
+	if got := (BTCMarketsTicker{}).Time(); !got.IsZero() {
+		t.Errorf("unset ticker Time = %s, want the zero time", got)
+	}
+
+	trades, err := b.GetTrades("BTC", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trades) != 2 {
+		t.Fatalf("got %d trades, want 2", len(trades))
+	}
+	for i, offset := range []time.Duration{10 * time.Second, 0} {
+		if got := trades[i].Time(); !got.Equal(want.Add(offset)) || got.Location() != time.UTC {
+			t.Errorf("trade %d Time = %s, want %s", trades[i].TradeID, got, want.Add(offset))
+		}
+	}
+
+	if got := (BTCMarketsOrderResponse{CreationTime: 1500000000123}).CreatedAt(); !got.Equal(want.Add(123 * time.Millisecond)) {
+		t.Errorf("order CreatedAt = %s, want %s", got, want.Add(123*time.Millisecond))
+	}
+}
+
+func TestPlaceOrders(t *testing.T) {
+	ids := map[string]int{"BTC": 11, "ETH": 12, "XRP": 13, "BCH": 14, "LTC": 0}
+	var inFlight, maxInFlight int32
+	b := newTestBTCMarketsAuth(t, func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		order := struct {
+			Instrument      string `json:"instrument"`
+			ClientRequestID string `json:"clientRequestId"`
+		}{}
+		body, _ := ioutil.ReadAll(r.Body)
+		JSONDecode(body, &order)
+		if order.Instrument == "LTC" {
+			w.Write([]byte(`{"success":false,"errorCode":3,"errorMessage":"Insufficient funds."}`))
+			return
+		}
+		fmt.Fprintf(w, `{"success":true,"id":%d,"clientRequestId":%q}`, ids[order.Instrument], order.ClientRequestID)
+	})
+	b.MaxConcurrentRequests = 2
+
+	instruments := []string{"BTC", "LTC", "ETH", "XRP", "BCH"}
+	orders := []BTCMarketsOrderRequest{}
+	for _, x := range instruments {
+		orders = append(orders, BTCMarketsOrderRequest{Currency: "AUD", Instrument: x, Price: 10000000000, Volume: 100000000, OrderSide: BTCMARKETS_ORDER_SIDE_BID, OrderType: BTCMARKETS_ORDER_TYPE_LIMIT, ClientRequestID: "client-" + x})
+	}
+
+	results, err := b.PlaceOrders(orders)
+	if err == nil || !strings.Contains(err.Error(), "1 of 5") || !strings.Contains(err.Error(), "Insufficient funds.") {
+		t.Errorf("error = %v, want the single rejection summarised", err)
+	}
+	if len(results) != len(orders) {
+		t.Fatalf("got %d results, want %d", len(results), len(orders))
+	}
+	for i, x := range instruments {
+		result := results[i]
+		if x == "LTC" {
+			if result.Err == nil {
+				t.Errorf("%s: expected the rejection", x)
+			}
+			continue
+		}
+		if result.Err != nil || result.ID != ids[x] || result.ClientRequestID != "client-"+x {
+			t.Errorf("%s: result = %+v", x, result)
+		}
+	}
+	if max := atomic.LoadInt32(&maxInFlight); max > 2 {
+		t.Errorf("%d orders in flight at once, want at most 2", max)
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	var mtx sync.Mutex
+	requests := map[string]int{}
+	b := newTestBTCMarkets(t, func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		requests[r.URL.Path]++
+		mtx.Unlock()
+		if strings.HasSuffix(r.URL.Path, "/orderbook") {
+			w.Write([]byte(testBTCMarketsOrderbook))
+			return
+		}
+		w.Write([]byte(testBTCMarketsTrades))
+	})
+
+	for i := 0; i < 2; i++ {
+		if _, err := b.GetTrades("BTC", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := requests["/market/BTC/AUD/trades"]; n != 2 {
+		t.Fatalf("made %d requests with caching disabled, want 2", n)
+	}
+
+	b.SetResponseCacheTTL(BTCMARKETS_MARKET_TRADES, 50*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		trades, err := b.GetTrades("BTC", "")
+		if err != nil || len(trades) != 2 {
+			t.Fatalf("cached GetTrades = %+v, %v", trades, err)
+		}
+	}
+	if n := requests["/market/BTC/AUD/trades"]; n != 3 {
+		t.Errorf("made %d requests within the TTL, want 3", n)
+	}
+
+	if _, err := b.GetTrades("ETH", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.GetOrderbook("BTC"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.GetOrderbook("BTC"); err != nil {
+		t.Fatal(err)
+	}
+	if requests["/market/ETH/AUD/trades"] != 1 || requests["/market/BTC/AUD/orderbook"] != 2 {
+		t.Errorf("requests = %v, want other pairs and endpoints uncached", requests)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	b.GetTrades("BTC", "")
+	if n := requests["/market/BTC/AUD/trades"]; n != 4 {
+		t.Errorf("made %d requests after the TTL expired, want 4", n)
+	}
+
+	b.ClearResponseCache()
+	b.GetTrades("BTC", "")
+	if n := requests["/market/BTC/AUD/trades"]; n != 5 {
+		t.Errorf("made %d requests after clearing the cache, want 5", n)
+	}
+}
+
+func TestCheckOrderbookWarning(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		orderbook string
+		crossed   bool
+		warning   string
+	}{
+		{orderbook: testBTCMarketsOrderbook},
+		{orderbook: `{"bids":[[101,1]],"asks":[[101,1]]}`, crossed: true, warning: "orderbook is locked, best bid 101.000000 best ask 101.000000."},
+		{orderbook: `{"bids":[[101,1],[99,1]],"asks":[[100,1]]}`, crossed: true, warning: "orderbook is crossed, best bid 101.000000 best ask 100.000000."},
+	}
+
+	for _, test := range tests {
+		logged.Reset()
+		b := newTestBTCMarkets(t, respondWith(http.StatusOK, test.orderbook))
+		orderbook, err := b.GetOrderbook("BTC")
+		if err != nil {
+			t.Fatalf("%s: %s", test.orderbook, err)
+		}
+		if orderbook.Crossed != test.crossed {
+			t.Errorf("%s: Crossed = %t, want %t", test.orderbook, orderbook.Crossed, test.crossed)
+		}
+		if test.warning == "" {
+			if strings.Contains(logged.String(), "warning") {
+				t.Errorf("%s: logged a warning for a normal book:\n%s", test.orderbook, logged.String())
+			}
+			continue
+		}
+		if !strings.Contains(logged.String(), "BTC-AUD "+test.warning) {
+			t.Errorf("%s: log = %q, want %q", test.orderbook, logged.String(), test.warning)
+		}
+	}
+}
+
+func TestReportingCurrency(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	b := BTCMarkets{}
+	b.SetDefaults()
+	if b.ReportingCurrency != "USD" {
+		t.Errorf("default ReportingCurrency = %q, want USD", b.ReportingCurrency)
+	}
+
+	b.ReportingCurrency = "EUR"
+	b.Converter = CurrencyConverterFunc(func(amount float64, from, to string) (float64, error) {
+		if from != "AUD" || to != "EUR" {
+			t.Errorf("converting %s to %s, want AUD to EUR", from, to)
+		}
+		return amount * 0.6, nil
+	})
+
+	entries := b.UpdateTicker("BTC", BTCMarketsTicker{LastPrice: 100, BestBID: 99, BestAsk: 101})
+	want := []ExchangeInfo{
+		{Exchange: "BTC Markets", CryptoCurrency: "BTC", FiatCurrency: "AUD", Price: 100},
+		{Exchange: "BTC Markets", CryptoCurrency: "BTC", FiatCurrency: "EUR", Price: 60},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("entries = %+v, want %+v", entries, want)
+	}
+	if !strings.Contains(logged.String(), "Last 60.000000 (100.000000) Bid 59.400000 (99.000000) Ask 60.600000 (101.000000) AUDEUR 0.600000") {
+		t.Errorf("log = %q, want the EUR conversion", logged.String())
+	}
+}
+
+func TestOrderRetryReusesClientRequestID(t *testing.T) {
+	var mtx sync.Mutex
+	clientReqs := []string{}
+	b := newTestBTCMarketsAuth(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != BTCMARKETS_ORDER_CREATE {
+			w.Write([]byte(`{"success":true,"orders":[]}`))
+			return
+		}
+		order := struct {
+			ClientRequestID string `json:"clientRequestId"`
+		}{}
+		body, _ := ioutil.ReadAll(r.Body)
+		JSONDecode(body, &order)
+		mtx.Lock()
+		clientReqs = append(clientReqs, order.ClientRequestID)
+		first := len(clientReqs) == 1
+		mtx.Unlock()
+		if first {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte(`{"success":true,"id":9,"clientRequestId":"` + order.ClientRequestID + `"}`))
+	})
+	b.RequestTimeout = 50 * time.Millisecond
+	b.ConfigureTransport()
+	b.OrderRetryDelay = time.Millisecond
+
+	id, clientReq, err := b.Order("AUD", "BTC", 100000000, 100000000, BTCMARKETS_ORDER_SIDE_BID, BTCMARKETS_ORDER_TYPE_LIMIT, "")
+	if err != nil || id != 9 {
+		t.Fatalf("Order = %d %v", id, err)
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	if len(clientReqs) != 2 || clientReqs[0] == "" || clientReqs[0] != clientReqs[1] || clientReq != clientReqs[0] {
+		t.Errorf("client request IDs sent %v and returned %q, want the same ID reused", clientReqs, clientReq)
+	}
+
+	var creates int32
+	rejected := newTestBTCMarketsAuth(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&creates, 1)
+		w.Write([]byte(`{"success":false,"errorCode":3,"errorMessage":"Insufficient funds."}`))
+	})
+	rejected.OrderRetryDelay = time.Millisecond
+	if _, _, err := rejected.Order("AUD", "BTC", 100000000, 100000000, BTCMARKETS_ORDER_SIDE_BID, BTCMARKETS_ORDER_TYPE_LIMIT, ""); err == nil {
+		t.Error("expected the rejection")
+	}
+	if n := atomic.LoadInt32(&creates); n != 1 {
+		t.Errorf("sent %d requests for a rejected order, want 1 without retrying", n)
+	}
+}
+
+func TestGetTopOfBook(t *testing.T) {
+	var arrived int32
+	both := make(chan struct{})
+	routes := testBTCMarketsRoutes(map[string]string{
+		"/market/BTC/AUD/tick":      testBTCMarketsTicker,
+		"/market/BTC/AUD/orderbook": testBTCMarketsOrderbook,
+	})
+	b := newTestBTCMarkets(t, func(w http.ResponseWriter, r *http.Request) {
+		// Hold each request until the other arrives to show they run in
+		// parallel.
+		if atomic.AddInt32(&arrived, 1) == 2 {
+			close(both)
+		}
+		select {
+		case <-both:
+		case <-time.After(time.Second):
+			t.Errorf("%s wasn't fetched alongside the other request", r.URL.Path)
+		}
+		routes(w, r)
+	})
+
+	top, err := b.GetTopOfBook("btc/aud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := BTCMarketsTopOfBook{
+		BestBid:        100.5,
+		BestAsk:        101.25,
+		BidSize:        2,
+		AskSize:        0.5,
+		LastTradePrice: 101,
+		Timestamp:      time.Unix(1500000000, 0).UTC(),
+	}
+	if top != want {
+		t.Errorf("GetTopOfBook = %+v, want %+v", top, want)
+	}
+
+	failing := newTestBTCMarkets(t, testBTCMarketsRoutes(map[string]string{
+		"/market/BTC/AUD/orderbook": testBTCMarketsOrderbook,
+	}))
+	if _, err := failing.GetTopOfBook("BTC"); err == nil {
+		t.Error("expected the ticker error")
+	}
+}
+
+func TestTradingEnabledPairs(t *testing.T) {
+	var mtx sync.Mutex
+	requests := map[string]int{}
+	b := newTestBTCMarketsAuth(t, func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		requests[r.URL.Path]++
+		mtx.Unlock()
+		switch r.URL.Path {
+		case BTCMARKETS_ORDER_DETAIL:
+			w.Write([]byte(`{"success":true,"orders":[{"id":1,"currency":"AUD","instrument":"ETH","status":"Placed","price":10000000000,"volume":100000000}]}`))
+		case BTCMARKETS_ORDER_CREATE:
+			w.Write([]byte(`{"success":true,"id":5,"clientRequestId":""}`))
+		case BTCMARKETS_ORDER_CANCEL:
+			w.Write([]byte(`{"success":true,"responses":[{"success":true,"id":1}]}`))
+		default:
+			w.Write([]byte(testBTCMarketsTicker))
+		}
+	})
+	b.EnabledPairs = []string{"BTC-AUD", "ETH-AUD"}
+	b.TradingEnabledPairs = []string{"btc/aud"}
+
+	if !b.IsTradingEnabled("AUD", "BTC") || b.IsTradingEnabled("AUD", "ETH") {
+		t.Error("IsTradingEnabled doesn't match TradingEnabledPairs")
+	}
+	if _, err := b.GetTicker("ETH"); err != nil {
+		t.Errorf("data on a data-only pair: %s", err)
+	}
+
+	if _, _, err := b.Order("AUD", "ETH", BTCMARKETS_UNIT, BTCMARKETS_UNIT, BTCMARKETS_ORDER_SIDE_BID, BTCMARKETS_ORDER_TYPE_LIMIT, ""); err != ErrTradingDisabled {
+		t.Errorf("Order on a data-only pair = %v, want ErrTradingDisabled", err)
+	}
+	if requests[BTCMARKETS_ORDER_CREATE] != 0 {
+		t.Fatal("sent an order for a data-only pair")
+	}
+	if id, _, err := b.Order("AUD", "BTC", BTCMARKETS_UNIT, BTCMARKETS_UNIT, BTCMARKETS_ORDER_SIDE_BID, BTCMARKETS_ORDER_TYPE_LIMIT, ""); err != nil || id != 5 {
+		t.Errorf("Order on a tradable pair = %d %v", id, err)
+	}
+
+	if _, err := b.CancelOrder([]int64{1}); err != ErrTradingDisabled {
+		t.Errorf("CancelOrder on a data-only pair = %v, want ErrTradingDisabled", err)
+	}
+	if _, err := b.CancelOrders([]int64{1}); err != ErrTradingDisabled {
+		t.Errorf("CancelOrders on a data-only pair = %v, want ErrTradingDisabled", err)
+	}
+	if _, err := b.CancelAllOrders("AUD", "ETH"); err != ErrTradingDisabled {
+		t.Errorf("CancelAllOrders on a data-only pair = %v, want ErrTradingDisabled", err)
+	}
+	if _, err := b.AmendOrder(1, 101, 1); err != ErrTradingDisabled {
+		t.Errorf("AmendOrder on a data-only pair = %v, want ErrTradingDisabled", err)
+	}
+	if requests[BTCMARKETS_ORDER_CANCEL] != 0 || requests[BTCMARKETS_ORDER_OPEN] != 0 {
+		t.Fatal("cancelled an order on a data-only pair")
+	}
+
+	b.TradingEnabledPairs = nil
+	if ok, err := b.CancelOrder([]int64{1}); err != nil || !ok {
+		t.Errorf("CancelOrder with no restriction = %t %v", ok, err)
+	}
+}
+
+func TestRecentVWAP(t *testing.T) {
+	now := time.Now().Unix()
+	b := newTestBTCMarkets(t, respondWith(http.StatusOK, fmt.Sprintf(`[{"tid":3,"amount":1,"price":100,"date":%d},{"tid":2,"amount":3,"price":200,"date":%d},{"tid":1,"amount":10,"price":1,"date":%d}]`, now-10, now-20, now-7200)))
+
+	vwap, err := b.RecentVWAP("BTC", time.Minute)
+	if err != nil || vwap != 175 {
+		t.Errorf("one minute VWAP = %f %v, want 175", vwap, err)
+	}
+	vwap, err = b.RecentVWAP("BTC", 3*time.Hour)
+	if err != nil || vwap != 710.0/14 {
+		t.Errorf("three hour VWAP = %f %v, want %f", vwap, err, 710.0/14)
+	}
+	if _, err := b.RecentVWAP("BTC", time.Second); err != ErrBTCMarketsNoTradesInWindow {
+		t.Errorf("VWAP with no trades in the window = %v, want ErrBTCMarketsNoTradesInWindow", err)
+	}
+	if _, err := b.RecentVWAP("BTC", 0); err == nil {
+		t.Error("accepted a zero window")
+	}
+
+	at := time.Unix(1000, 0)
+	zeroVolume := []BTCMarketsTrade{{Price: 100, Date: 1000}}
+	if _, err := ComputeVWAP(zeroVolume, at, at); err != ErrBTCMarketsNoTradesInWindow {
+		t.Errorf("VWAP of zero volume trades = %v, want ErrBTCMarketsNoTradesInWindow", err)
+	}
+}
+
+func TestConnectionPooling(t *testing.T) {
+	b := BTCMarkets{}
+	b.SetDefaults()
+	transport, ok := b.HTTPClient.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("transport is %T, want *http.Transport", b.HTTPClient.Transport)
+	}
+	if transport.MaxIdleConns != BTCMARKETS_DEFAULT_MAX_IDLE_CONNS || transport.MaxIdleConnsPerHost != BTCMARKETS_DEFAULT_MAX_IDLE_CONNS_PER_HOST || transport.IdleConnTimeout != BTCMARKETS_DEFAULT_IDLE_CONN_TIMEOUT {
+		t.Errorf("default transport pooling = %d %d %s", transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.IdleConnTimeout)
+	}
+	if transport == http.DefaultTransport {
+		t.Fatal("SetDefaults shares http.DefaultTransport")
+	}
+
+	b.MaxIdleConns, b.MaxIdleConnsPerHost, b.IdleConnTimeout = 7, 3, time.Second
+	b.ConfigureTransport()
+	if transport.MaxIdleConns != 7 || transport.MaxIdleConnsPerHost != 3 || transport.IdleConnTimeout != time.Second {
+		t.Errorf("configured transport pooling = %d %d %s", transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.IdleConnTimeout)
+	}
+	if def := http.DefaultTransport.(*http.Transport); def.MaxIdleConns == 7 {
+		t.Error("ConfigureTransport changed http.DefaultTransport")
+	}
+
+	var connections int32
+	server := httptest.NewUnstartedServer(respondWith(http.StatusOK, testBTCMarketsTicker))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	b.SetURL(server.URL)
+	for i := 0; i < 5; i++ {
+		if _, err := b.GetTicker("BTC"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&connections); n != 1 {
+		t.Errorf("opened %d connections for 5 sequential requests, want 1 reused", n)
+	}
+}
+
+func TestGetInstrumentStatus(t *testing.T) {
+	var requests int32
+	b := newTestBTCMarkets(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte(`{"success":true,"markets":[` +
+			`{"instrument":"BTC","currency":"AUD","status":"Post Only"},` +
+			`{"instrument":"ETH","currency":"AUD","status":"Cancel Only"},` +
+			`{"instrument":"XRP","currency":"AUD","status":"Limit Only"},` +
+			`{"instrument":"BCH","currency":"AUD","status":"Offline"},` +
+			`{"instrument":"ETH","currency":"BTC","status":"Online"},` +
+			`{"instrument":"LTC","currency":"AUD"}]}`))
+	})
+	b.MarketsCacheTTL = 50 * time.Millisecond
+
+	tests := map[string]string{
+		"BTC":     BTCMARKETS_INSTRUMENT_STATUS_POST_ONLY,
+		"eth/aud": BTCMARKETS_INSTRUMENT_STATUS_HALTED,
+		"XRP-AUD": BTCMARKETS_INSTRUMENT_STATUS_LIMIT,
+		"BCH":     BTCMARKETS_INSTRUMENT_STATUS_HALTED,
+		"ETH-BTC": BTCMARKETS_INSTRUMENT_STATUS_ONLINE,
+		"LTC-AUD": BTCMARKETS_INSTRUMENT_STATUS_ONLINE,
+	}
+	for instrument, want := range tests {
+		status, err := b.GetInstrumentStatus(instrument)
+		if err != nil || status != want {
+			t.Errorf("%s: status = %q %v, want %q", instrument, status, err, want)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("fetched the markets %d times within the TTL, want 1", n)
+	}
+
+	if _, err := b.GetInstrumentStatus("DOGE"); err == nil {
+		t.Error("expected an error for an unknown market")
+	}
+	if GetBTCMarketsInstrumentStatus("Maintenance") != BTCMARKETS_INSTRUMENT_STATUS_HALTED {
+		t.Error("an unrecognised status isn't reported as halted")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	b.GetInstrumentStatus("BTC")
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("fetched the markets %d times after the TTL, want 2", n)
+	}
+}
+
+func TestExportOrderHistoryCSV(t *testing.T) {
+	b := newTestBTCMarketsAuth(t, testBTCMarketsRoutes(map[string]string{
+		BTCMARKETS_ORDER_HISTORY: `{"success":true,"orders":[` +
+			`{"id":8,"orderSide":"Ask","ordertype":"Limit","creationTime":1700000100000,"status":"Cancelled","price":12000000000,"volume":100000000,"openVolume":75000000},` +
+			`{"id":7,"orderSide":"Bid","ordertype":"Limit","creationTime":1700000000000,"status":"Fully Matched","price":10000000000,"volume":50000000,"openVolume":0,` +
+			`"trades":[{"id":1,"price":9000000000,"volume":25000000,"fee":500000},{"id":2,"price":11000000000,"volume":25000000,"fee":500000}]},` +
+			`{"id":9,"orderSide":"Bid","ordertype":"Limit","creationTime":1700000200000,"status":"Placed","price":10000000000,"volume":100000000,"openVolume":100000000},` +
+			`{"id":6,"orderSide":"Bid","ordertype":"Market","creationTime":1600000000000,"status":"Fully Matched","price":10000000000,"volume":100000000}]}`,
+	}))
+
+	var buf bytes.Buffer
+	err := b.ExportOrderHistoryCSV(&buf, "AUD", "BTC", time.Unix(1650000000, 0), time.Unix(1800000000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "date,side,type,price,volume,fee,status,orderID\n" +
+		"2023-11-14T22:13:20Z,Bid,Limit,100,0.5,0.01,Fully Matched,7\n" +
+		"2023-11-14T22:15:00Z,Ask,Limit,120,0.25,0,Cancelled,8\n"
+	if buf.String() != want {
+		t.Errorf("CSV =\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	b = newTestBTCMarketsAuth(t, respondWith(http.StatusOK, `{"success":false,"errorCode":3,"errorMessage":"Invalid argument."}`))
+	buf.Reset()
+	if err := b.ExportOrderHistoryCSV(&buf, "AUD", "BTC", time.Unix(0, 0), time.Now()); err == nil || buf.Len() != 0 {
+		t.Errorf("err = %v, output = %q, want an error and no output", err, buf.String())
+	}
+}
+
+func TestDecodeErrorContext(t *testing.T) {
+	padding := strings.Repeat("x", 400)
+	b := newTestBTCMarketsAuth(t, respondWith(http.StatusOK, `{"success":true,"orders":"none","padding":"`+padding+`"}`))
+	_, err := b.GetOpenOrders("AUD", "BTC")
+	decodeErr, ok := err.(*DecodeError)
+	if !ok {
+		t.Fatalf("GetOpenOrders error = %v (%T), want a *DecodeError", err, err)
+	}
+	if decodeErr.Path != BTCMARKETS_ORDER_OPEN {
+		t.Errorf("Path = %s, want %s", decodeErr.Path, BTCMARKETS_ORDER_OPEN)
+	}
+	if !strings.HasPrefix(err.Error(), "decode "+BTCMARKETS_ORDER_OPEN+": ") || !strings.Contains(err.Error(), ` body: {"success":true`) {
+		t.Errorf("error = %q, want the path and the start of the body", err)
+	}
+	if len(decodeErr.Body) != DecodeErrorSnippetSize+len("...") || !strings.HasSuffix(decodeErr.Body, "...") {
+		t.Errorf("Body is %d bytes, want it truncated to %d", len(decodeErr.Body), DecodeErrorSnippetSize)
+	}
+
+	b = newTestBTCMarkets(t, respondWith(http.StatusOK, `{"bestBid":"none"}`))
+	_, err = b.GetTicker("BTC")
+	if _, ok := err.(*DecodeError); !ok || !strings.Contains(err.Error(), "decode /market/BTC/AUD/tick") {
+		t.Errorf("GetTicker error = %v, want a *DecodeError naming the ticker path", err)
+	}
+}
+
+func TestReadOnlyKeyPermissions(t *testing.T) {
+	var requests int32
+	b := newTestBTCMarketsAuth(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte(`{"success":true,"id":1,"clientRequestId":"abc"}`))
+	})
+	b.KeyPermissions = BTCMARKETS_KEY_PERMISSIONS_READ_ONLY
+
+	if _, _, err := b.Order("AUD", "BTC", BTCMARKETS_UNIT, BTCMARKETS_UNIT, BTCMARKETS_ORDER_SIDE_BID, BTCMARKETS_ORDER_TYPE_LIMIT, ""); err != ErrInsufficientKeyPermissions {
+		t.Errorf("Order error = %v, want ErrInsufficientKeyPermissions", err)
+	}
+	if _, err := b.AmendOrder(1, 100, 1); err != ErrInsufficientKeyPermissions {
+		t.Errorf("AmendOrder error = %v, want ErrInsufficientKeyPermissions", err)
+	}
+	if _, err := b.CancelOrders([]int64{1}); err != ErrInsufficientKeyPermissions {
+		t.Errorf("CancelOrders error = %v, want ErrInsufficientKeyPermissions", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("sent %d requests with a read-only key, want none", n)
+	}
+
+	b.KeyPermissions = BTCMARKETS_KEY_PERMISSIONS_TRADE
+	if _, _, err := b.Order("AUD", "BTC", BTCMARKETS_UNIT, BTCMARKETS_UNIT, BTCMARKETS_ORDER_SIDE_BID, BTCMARKETS_ORDER_TYPE_LIMIT, ""); err != nil {
+		t.Errorf("Order with a trading key = %v, want no error", err)
+	}
+	if !BTCMarketsKeyPermissions("read").IsValid() || BTCMarketsKeyPermissions("admin").IsValid() {
+		t.Error("IsValid should accept read and reject admin")
+	}
+}
+
+func TestOnTickerUpdate(t *testing.T) {
+	b := newTestBTCMarkets(t, testBTCMarketsRoutes(map[string]string{
+		"/market/BTC/AUD/tick": testBTCMarketsTicker,
+	}))
+	b.EnabledPairs = []string{"BTC-AUD"}
+	b.RESTPollingDelay = time.Hour
+
+	updates := make(chan string, 10)
+	b.OnTickerUpdate = func(pair string, ticker BTCMarketsTicker) {
+		locked := make(chan struct{})
+		go func() {
+			b.tickerMtx.Lock()
+			b.tickerMtx.Unlock()
+			close(locked)
+		}()
+		select {
+		case <-locked:
+		case <-time.After(time.Second):
+			t.Errorf("OnTickerUpdate for %s called with the ticker lock held", pair)
+		}
+		updates <- fmt.Sprintf("%s %g", pair, ticker.LastPrice)
+	}
+
+	go b.Run()
+	defer b.Stop()
+	select {
+	case x := <-updates:
+		if x != "BTC-AUD 101" {
+			t.Errorf("polled update = %s, want BTC-AUD 101", x)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnTickerUpdate wasn't called for the polled ticker")
+	}
+
+	err := b.WebsocketHandleMessage([]byte(`{"marketId":"BTC-AUD","lastPrice":"102","messageType":"tick"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case x := <-updates:
+		if x != "BTC-AUD 102" {
+			t.Errorf("websocket update = %s, want BTC-AUD 102", x)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnTickerUpdate wasn't called for the websocket ticker")
+	}
+}
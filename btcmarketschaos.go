@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var ErrPaperChaosFailure = errors.New("Simulated paper trading failure.")
+
+// BTCMarketsChaosConfig injects latency, failures and partial fills into
+// paper trading so strategies can be tested against a misbehaving exchange.
+// Each paper Order and GetTicker call is delayed by a duration drawn
+// uniformly from [MinLatency, MaxLatency] and then fails with probability
+// ErrorRate. Orders that aren't failed only fill a random fraction of their
+// matched volume with probability PartialFillRate. Rates range from 0 to 1.
+// The random source is seeded with Seed on first use, so a given Seed
+// reproduces the same sequence of outcomes for the same sequence of calls.
+type BTCMarketsChaosConfig struct {
+	MinLatency      time.Duration
+	MaxLatency      time.Duration
+	ErrorRate       float64
+	PartialFillRate float64
+	Seed            int64
+	mtx             sync.Mutex
+	rng             *rand.Rand
+}
+
+func (c *BTCMarketsChaosConfig) random() float64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.rng == nil {
+		c.rng = rand.New(rand.NewSource(c.Seed))
+	}
+	return c.rng.Float64()
+}
+
+// Latency returns a delay drawn uniformly from [MinLatency, MaxLatency].
+func (c *BTCMarketsChaosConfig) Latency() time.Duration {
+	if c.MaxLatency <= c.MinLatency {
+		return c.MinLatency
+	}
+	return c.MinLatency + time.Duration(c.random()*float64(c.MaxLatency-c.MinLatency))
+}
+
+// Apply sleeps for a random latency and then returns ErrPaperChaosFailure
+// with probability ErrorRate. It returns ctx's error if ctx is done first.
+func (c *BTCMarketsChaosConfig) Apply(ctx context.Context) error {
+	delay := c.Latency()
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if c.ErrorRate > 0 && c.random() < c.ErrorRate {
+		return ErrPaperChaosFailure
+	}
+	return nil
+}
+
+// FillFraction returns the fraction of an order's matched volume to fill,
+// which is 1 unless a partial fill is injected.
+func (c *BTCMarketsChaosConfig) FillFraction() float64 {
+	if c.PartialFillRate <= 0 || c.random() >= c.PartialFillRate {
+		return 1
+	}
+	return c.random()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPaperChaosErrors(t *testing.T) {
+	b := newTestBTCMarketsPaper(t)
+	b.Paper.SetBalance("AUD", 1000*BTCMARKETS_UNIT)
+	b.Paper.Chaos.ErrorRate = 1
+
+	for i := 0; i < 20; i++ {
+		_, _, err := b.Order("AUD", "BTC", 100*BTCMARKETS_UNIT, BTCMARKETS_UNIT, BTCMARKETS_ORDER_SIDE_BID, BTCMARKETS_ORDER_TYPE_LIMIT, "")
+		if err != ErrPaperChaosFailure {
+			t.Fatalf("order %d error = %v, want ErrPaperChaosFailure", i+1, err)
+		}
+	}
+	if _, err := b.GetTicker("BTC"); err != ErrPaperChaosFailure {
+		t.Errorf("GetTicker error = %v, want ErrPaperChaosFailure", err)
+	}
+	if aud := testPaperBalance(t, b, "AUD"); aud.Balance != 1000*BTCMARKETS_UNIT || aud.PendingFunds != 0 {
+		t.Errorf("AUD = %+v, want the failed orders to leave it untouched", aud)
+	}
+}
+
+func TestPaperChaosPartialFill(t *testing.T) {
+	b := newTestBTCMarketsPaper(t)
+	b.Paper.SetBalance("AUD", 1000*BTCMARKETS_UNIT)
+	b.Paper.Chaos.PartialFillRate = 1
+	b.Paper.Chaos.Seed = 7
+
+	orderID, _, err := b.Order("AUD", "BTC", 0, BTCMARKETS_UNIT, BTCMARKETS_ORDER_SIDE_BID, BTCMARKETS_ORDER_TYPE_MARKET, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orders, _ := b.GetOrderDetail([]int64{int64(orderID)})
+	if len(orders) != 1 || orders[0].Status != BTCMARKETS_ORDER_STATUS_PARTIALLY_CANCELLED {
+		t.Errorf("order = %+v, want a partially filled market order", orders)
+	}
+	if btc := testPaperBalance(t, b, "BTC"); btc.Balance <= 0 || btc.Balance >= BTCMARKETS_UNIT {
+		t.Errorf("BTC balance = %f, want part of the 1 BTC ordered", btc.Balance)
+	}
+}
+
+func TestChaosConfigSeed(t *testing.T) {
+	a := BTCMarketsChaosConfig{Seed: 3, PartialFillRate: 0.5, MaxLatency: time.Second}
+	c := BTCMarketsChaosConfig{Seed: 3, PartialFillRate: 0.5, MaxLatency: time.Second}
+	for i := 0; i < 10; i++ {
+		if x, y := a.FillFraction(), c.FillFraction(); x != y {
+			t.Fatalf("call %d: fill fractions %f and %f differ with the same seed", i+1, x, y)
+		}
+		if x, y := a.Latency(), c.Latency(); x != y || x < 0 || x > time.Second {
+			t.Fatalf("call %d: latencies %s and %s, want equal and within [0, 1s]", i+1, x, y)
+		}
+	}
+
+	slow := BTCMarketsChaosConfig{MinLatency: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := slow.Apply(ctx); err != context.Canceled {
+		t.Errorf("Apply with a cancelled context = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	BTCMARKETS_EVENT_BUFFER       = 100
+	BTCMARKETS_EVENT_FILL         = "fill"
+	BTCMARKETS_EVENT_PARTIAL_FILL = "partialFill"
+	BTCMARKETS_EVENT_CANCEL       = "cancel"
+)
+
+// BTCMarketsEvent describes an order fill, partial fill or cancellation.
+// FilledVolume and Price are decimal values, not API units. Price is the
+// volume-weighted average price of the order's trades, or 0 if none are known.
+type BTCMarketsEvent struct {
+	Type         string
+	OrderID      int64
+	Status       string
+	FilledVolume float64
+	Price        float64
+	Time         time.Time
+}
+
+// Events returns the channel order events are published to. It is buffered
+// and, when full, the oldest event is dropped to make room for the newest.
+func (b *BTCMarkets) Events() <-chan BTCMarketsEvent {
+	b.eventsMtx.Lock()
+	defer b.eventsMtx.Unlock()
+
+	if b.events == nil {
+		b.events = make(chan BTCMarketsEvent, BTCMARKETS_EVENT_BUFFER)
+	}
+	return b.events
+}
+
+// DroppedEvents returns how many events were discarded because the Events
+// channel was full.
+func (b *BTCMarkets) DroppedEvents() int64 {
+	b.eventsMtx.Lock()
+	defer b.eventsMtx.Unlock()
+	return b.droppedEvents
+}
+
+func (b *BTCMarkets) PublishEvent(event BTCMarketsEvent) {
+	b.eventsMtx.Lock()
+	defer b.eventsMtx.Unlock()
+
+	if b.events == nil {
+		b.events = make(chan BTCMarketsEvent, BTCMARKETS_EVENT_BUFFER)
+	}
+
+	for {
+		select {
+		case b.events <- event:
+			return
+		default:
+		}
+
+		select {
+		case <-b.events:
+			b.droppedEvents++
+		default:
+		}
+	}
+}
+
+// GetBTCMarketsEventType maps an order status to its event type, returning
+// an empty string for statuses that don't generate events.
+func GetBTCMarketsEventType(status string) string {
+	switch status {
+	case BTCMARKETS_ORDER_STATUS_FULLY_MATCHED:
+		return BTCMARKETS_EVENT_FILL
+	case BTCMARKETS_ORDER_STATUS_PARTIALLY_MATCHED:
+		return BTCMARKETS_EVENT_PARTIAL_FILL
+	case BTCMARKETS_ORDER_STATUS_CANCELLED, BTCMARKETS_ORDER_STATUS_PARTIALLY_CANCELLED:
+		return BTCMARKETS_EVENT_CANCEL
+	}
+	return ""
+}
+
+// PublishOrderEvent publishes an event for order, a REST order response in
+// API units, if its status is a fill, partial fill or cancellation. As with
+// websocket order changes, the event's Price is averaged over order.Trades.
+func (b *BTCMarkets) PublishOrderEvent(order BTCMarketsOrderResponse) {
+	eventType := GetBTCMarketsEventType(order.Status)
+	if eventType == "" {
+		return
+	}
+
+	filled, notional, price := 0.0, 0.0, 0.0
+	for _, x := range order.Trades {
+		filled += x.Volume
+		notional += x.Price * x.Volume
+	}
+	if filled > 0 {
+		price = notional / filled
+	}
+	if len(order.Trades) == 0 && eventType != BTCMARKETS_EVENT_CANCEL {
+		filled = order.Volume - order.OpenVolume
+	}
+
+	b.PublishEvent(BTCMarketsEvent{
+		Type:         eventType,
+		OrderID:      int64(order.ID),
+		Status:       order.Status,
+		FilledVolume: ConvertFromBTCMarketsUnits(int64(filled)),
+		Price:        ConvertFromBTCMarketsUnits(int64(math.Round(price))),
+		Time:         time.Now(),
+	})
+}
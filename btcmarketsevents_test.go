@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testNextEvent(t *testing.T, b *BTCMarkets) BTCMarketsEvent {
+	t.Helper()
+	select {
+	case event := <-b.Events():
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+	return BTCMarketsEvent{}
+}
+
+func TestWaitForOrderEvents(t *testing.T) {
+	responses := []string{
+		`{"success":true,"orders":[{"id":5,"status":"Placed","price":10000000000,"volume":100000000,"openVolume":100000000}]}`,
+		`{"success":true,"orders":[{"id":5,"status":"Partially Matched","price":10000000000,"volume":100000000,"openVolume":40000000}]}`,
+		`{"success":true,"orders":[{"id":5,"status":"Partially Matched","price":10000000000,"volume":100000000,"openVolume":40000000}]}`,
+		`{"success":true,"orders":[{"id":5,"status":"Fully Matched","price":10000000000,"volume":100000000,"openVolume":0,"trades":[{"id":1,"price":10000000000,"volume":60000000},{"id":2,"price":10000000000,"volume":40000000}]}]}`,
+	}
+	var polls int32
+	b := newTestBTCMarketsAuth(t, func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(&polls, 1))
+		if n > len(responses) {
+			n = len(responses)
+		}
+		w.Write([]byte(responses[n-1]))
+	})
+
+	_, err := b.WaitForOrder(5, time.Millisecond, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []BTCMarketsEvent{
+		{Type: BTCMARKETS_EVENT_PARTIAL_FILL, OrderID: 5, Status: BTCMARKETS_ORDER_STATUS_PARTIALLY_MATCHED, FilledVolume: 0.6},
+		{Type: BTCMARKETS_EVENT_FILL, OrderID: 5, Status: BTCMARKETS_ORDER_STATUS_FULLY_MATCHED, FilledVolume: 1, Price: 100},
+	}
+	for _, x := range want {
+		event := testNextEvent(t, b)
+		if event.Time.IsZero() {
+			t.Errorf("event %+v has no time", event)
+		}
+		event.Time = time.Time{}
+		if event != x {
+			t.Errorf("event = %+v, want %+v", event, x)
+		}
+	}
+	if n := len(b.Events()); n != 0 {
+		t.Errorf("%d unexpected events published", n)
+	}
+}
+
+func TestWebsocketOrderChangeEvent(t *testing.T) {
+	b := BTCMarkets{}
+	b.SetDefaults()
+
+	err := b.WebsocketHandleMessage([]byte(`{"orderId":7,"marketId":"BTC-AUD","status":"Fully Matched","openVolume":"0","trades":[{"tradeId":1,"price":"100","volume":"0.5","fee":"0"},{"tradeId":2,"price":"110","volume":"0.5","fee":"0"}],"messageType":"orderChange"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := testNextEvent(t, &b)
+	if event.OrderID != 7 || event.Type != BTCMARKETS_EVENT_FILL || event.FilledVolume != 1 || event.Price != 105 {
+		t.Errorf("event = %+v, want a fill of 1 at 105", event)
+	}
+}
+
+func TestPublishOrderEventFillPrice(t *testing.T) {
+	b := BTCMarkets{}
+	b.SetDefaults()
+
+	b.PublishOrderEvent(BTCMarketsOrderResponse{
+		ID:        8,
+		OrderType: BTCMARKETS_ORDER_TYPE_MARKET,
+		Status:    BTCMARKETS_ORDER_STATUS_FULLY_MATCHED,
+		Volume:    100000000,
+		Trades: []BTCMarketsTradeResponse{
+			{ID: 1, Price: 10000000000, Volume: 50000000},
+			{ID: 2, Price: 11000000000, Volume: 50000000},
+		},
+	})
+
+	event := testNextEvent(t, &b)
+	if event.OrderID != 8 || event.FilledVolume != 1 || event.Price != 105 {
+		t.Errorf("event = %+v, want a market order fill of 1 at 105", event)
+	}
+}
+
+func TestPublishEventDropsOldest(t *testing.T) {
+	b := BTCMarkets{}
+	b.SetDefaults()
+
+	for i := 0; i < BTCMARKETS_EVENT_BUFFER+3; i++ {
+		b.PublishEvent(BTCMarketsEvent{OrderID: int64(i)})
+	}
+	if b.DroppedEvents() != 3 {
+		t.Errorf("DroppedEvents = %d, want 3", b.DroppedEvents())
+	}
+	if event := testNextEvent(t, &b); event.OrderID != 3 {
+		t.Errorf("oldest event = %d, want 3", event.OrderID)
+	}
+	if n := len(b.Events()); n != BTCMARKETS_EVENT_BUFFER-1 {
+		t.Errorf("%d events buffered, want %d", n, BTCMARKETS_EVENT_BUFFER-1)
+	}
+}
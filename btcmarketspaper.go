@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BTCMarketsPaperAccount simulates order execution for BTCMarkets paper
+// trading. Orders are matched once, at placement, against the orderbook
+// supplied by the caller; any limit order remainder rests until cancelled.
+// Prices, volumes and balances use the same 1e8 integer units as the API.
+// Chaos optionally injects latency, failures and partial fills.
+type BTCMarketsPaperAccount struct {
+	Balances    map[string]BTCMarketsAccountBalance
+	Orders      map[int64]BTCMarketsOrderResponse
+	NextOrderID int64
+	Chaos       BTCMarketsChaosConfig
+	mtx         sync.Mutex
+}
+
+var (
+	ErrPaperInsufficientFunds = errors.New("Insufficient paper trading funds.")
+	ErrPaperInvalidOrder      = errors.New("Invalid paper trading order.")
+)
+
+func (p *BTCMarketsPaperAccount) initMaps() {
+	if p.Balances == nil {
+		p.Balances = make(map[string]BTCMarketsAccountBalance)
+	}
+	if p.Orders == nil {
+		p.Orders = make(map[int64]BTCMarketsOrderResponse)
+	}
+}
+
+func (p *BTCMarketsPaperAccount) SetBalance(currency string, balance int64) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.initMaps()
+
+	bal := p.Balances[currency]
+	bal.Currency = currency
+	bal.Balance = float64(balance)
+	p.Balances[currency] = bal
+}
+
+func (p *BTCMarketsPaperAccount) GetBalances() []BTCMarketsAccountBalance {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	balances := []BTCMarketsAccountBalance{}
+	for _, x := range p.Balances {
+		balances = append(balances, x)
+	}
+	sort.Slice(balances, func(i, j int) bool {
+		return balances[i].Currency < balances[j].Currency
+	})
+	return balances
+}
+
+func (p *BTCMarketsPaperAccount) Order(orderbook BTCMarketsOrderbook, currency, instrument string, price, amount int64, orderSide BTCMarketsOrderSide, orderType BTCMarketsOrderType, clientReq string, fee float64) (int, error) {
+	if amount <= 0 || (orderType == BTCMARKETS_ORDER_TYPE_LIMIT && price <= 0) {
+		return 0, ErrPaperInvalidOrder
+	}
+
+	levels := orderbook.Asks
+	if orderSide == BTCMARKETS_ORDER_SIDE_ASK {
+		levels = orderbook.Bids
+	} else if orderSide != BTCMARKETS_ORDER_SIDE_BID {
+		return 0, ErrPaperInvalidOrder
+	}
+
+	filled, cost := 0.0, 0.0
+	for _, level := range levels {
+		if filled >= float64(amount) || len(level) < 2 {
+			break
+		}
+
+		levelPrice := float64(ConvertToBTCMarketsUnits(level[0]))
+		if orderType == BTCMARKETS_ORDER_TYPE_LIMIT {
+			if (orderSide == BTCMARKETS_ORDER_SIDE_BID && levelPrice > float64(price)) || (orderSide == BTCMARKETS_ORDER_SIDE_ASK && levelPrice < float64(price)) {
+				break
+			}
+		}
+
+		volume := math.Min(float64(amount)-filled, float64(ConvertToBTCMarketsUnits(level[1])))
+		filled += volume
+		cost += volume * levelPrice / BTCMARKETS_UNIT
+	}
+
+	fraction := p.Chaos.FillFraction()
+	if fraction < 1 && filled > 0 {
+		partial := math.Floor(filled * fraction)
+		cost *= partial / filled
+		filled = partial
+	}
+
+	resting := 0.0
+	if orderType == BTCMARKETS_ORDER_TYPE_LIMIT {
+		resting = float64(amount) - filled
+	}
+	tradeFee := CalculateFee(cost, fee)
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.initMaps()
+
+	quote := p.Balances[currency]
+	quote.Currency = currency
+	base := p.Balances[instrument]
+	base.Currency = instrument
+
+	if orderSide == BTCMARKETS_ORDER_SIDE_BID {
+		reserved := resting * float64(price) / BTCMARKETS_UNIT
+		if quote.Balance-quote.PendingFunds < cost+tradeFee+reserved {
+			return 0, ErrPaperInsufficientFunds
+		}
+		quote.Balance -= cost + tradeFee
+		quote.PendingFunds += reserved
+		base.Balance += filled
+	} else {
+		if base.Balance-base.PendingFunds < filled+resting {
+			return 0, ErrPaperInsufficientFunds
+		}
+		base.Balance -= filled
+		base.PendingFunds += resting
+		quote.Balance += cost - tradeFee
+	}
+	p.Balances[currency] = quote
+	p.Balances[instrument] = base
+
+	status := BTCMARKETS_ORDER_STATUS_PLACED
+	if filled >= float64(amount) {
+		status = BTCMARKETS_ORDER_STATUS_FULLY_MATCHED
+	} else if filled > 0 && resting > 0 {
+		status = BTCMARKETS_ORDER_STATUS_PARTIALLY_MATCHED
+	} else if resting == 0 {
+		status = BTCMARKETS_ORDER_STATUS_PARTIALLY_CANCELLED
+		if filled == 0 {
+			status = BTCMARKETS_ORDER_STATUS_CANCELLED
+		}
+	}
+
+	p.NextOrderID++
+	order := BTCMarketsOrderResponse{
+		ID:              float64(p.NextOrderID),
+		Currency:        currency,
+		Instrument:      instrument,
+		OrderSide:       orderSide,
+		OrderType:       orderType,
+		CreationTime:    float64(time.Now().UnixNano() / int64(time.Millisecond)),
+		Status:          status,
+		Price:           float64(price),
+		Volume:          float64(amount),
+		OpenVolume:      resting,
+		ClientRequestId: clientReq,
+	}
+	p.Orders[p.NextOrderID] = order
+	return int(p.NextOrderID), nil
+}
+
+func (p *BTCMarketsPaperAccount) CancelOrders(orderID []int64) []BTCMarketsCancelResult {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.initMaps()
+
+	results := []BTCMarketsCancelResult{}
+	for _, x := range orderID {
+		order, ok := p.Orders[x]
+		if !ok || order.OpenVolume == 0 {
+			results = append(results, BTCMarketsCancelResult{ID: x, ErrorMessage: "Order not found or not open."})
+			continue
+		}
+
+		if order.OrderSide == BTCMARKETS_ORDER_SIDE_BID {
+			quote := p.Balances[order.Currency]
+			quote.PendingFunds -= order.OpenVolume * order.Price / BTCMARKETS_UNIT
+			p.Balances[order.Currency] = quote
+		} else {
+			base := p.Balances[order.Instrument]
+			base.PendingFunds -= order.OpenVolume
+			p.Balances[order.Instrument] = base
+		}
+
+		if order.OpenVolume < order.Volume {
+			order.Status = BTCMARKETS_ORDER_STATUS_PARTIALLY_CANCELLED
+		} else {
+			order.Status = BTCMARKETS_ORDER_STATUS_CANCELLED
+		}
+		order.OpenVolume = 0
+		p.Orders[x] = order
+		results = append(results, BTCMarketsCancelResult{ID: x, Success: true})
+	}
+	return results
+}
+
+func (p *BTCMarketsPaperAccount) GetOrderDetail(orderID []int64) []BTCMarketsOrderResponse {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	orders := []BTCMarketsOrderResponse{}
+	for _, x := range orderID {
+		order, ok := p.Orders[x]
+		if ok {
+			orders = append(orders, order)
+		}
+	}
+	return orders
+}
+
+func (p *BTCMarketsPaperAccount) GetOrders(currency, instrument string, limit, since int64, historic bool) []BTCMarketsOrderResponse {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	orders := []BTCMarketsOrderResponse{}
+	for x := since + 1; x <= p.NextOrderID && int64(len(orders)) < limit; x++ {
+		order, ok := p.Orders[x]
+		if !ok || order.Currency != currency || order.Instrument != instrument {
+			continue
+		}
+		if historic == (order.OpenVolume > 0) {
+			continue
+		}
+		orders = append(orders, order)
+	}
+	return orders
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const testBTCMarketsPaperOrderbook = `{"currency":"AUD","instrument":"BTC","timestamp":1500000000,"asks":[[100,0.5],[110,1]],"bids":[[90,1],[80,1]]}`
+
+func newTestBTCMarketsPaper(t *testing.T) *BTCMarkets {
+	b := newTestBTCMarkets(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("apikey") != "" || !strings.HasSuffix(r.URL.Path, "/orderbook") {
+			t.Errorf("Unexpected request %s when paper trading.", r.URL.Path)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(testBTCMarketsPaperOrderbook))
+	})
+	b.PaperTrading = true
+	return b
+}
+
+func testPaperBalance(t *testing.T, b *BTCMarkets, currency string) BTCMarketsAccountBalance {
+	balances, err := b.GetAccountBalance()
+	if err != nil {
+		t.Fatalf("GetAccountBalance: %s", err)
+	}
+	for _, x := range balances {
+		if x.Currency == currency {
+			return x
+		}
+	}
+	return BTCMarketsAccountBalance{Currency: currency}
+}
+
+func testPaperClose(a, b float64) bool {
+	return math.Abs(a-b) < 1
+}
+
+func TestPaperTradingLimitBid(t *testing.T) {
+	b := newTestBTCMarketsPaper(t)
+	b.Paper.SetBalance("AUD", 1000*BTCMARKETS_UNIT)
+
+	orderID, _, err := b.Order("AUD", "BTC", 105*BTCMARKETS_UNIT, 1*BTCMARKETS_UNIT, BTCMARKETS_ORDER_SIDE_BID, BTCMARKETS_ORDER_TYPE_LIMIT, "")
+	if err != nil {
+		t.Fatalf("Order: %s", err)
+	}
+
+	// 0.5 fills at 100 and the remaining 0.5 rests at 105.
+	cost := 50.0 * BTCMARKETS_UNIT
+	fee := CalculateFee(cost, b.GetTradingFee("BTC"))
+	aud := testPaperBalance(t, b, "AUD")
+	if !testPaperClose(aud.Balance, 1000*BTCMARKETS_UNIT-cost-fee) {
+		t.Errorf("AUD balance = %f, want %f", aud.Balance, 1000*BTCMARKETS_UNIT-cost-fee)
+	}
+	if !testPaperClose(aud.PendingFunds, 52.5*BTCMARKETS_UNIT) {
+		t.Errorf("AUD pending = %f, want %f", aud.PendingFunds, 52.5*BTCMARKETS_UNIT)
+	}
+	if btc := testPaperBalance(t, b, "BTC"); !testPaperClose(btc.Balance, 0.5*BTCMARKETS_UNIT) {
+		t.Errorf("BTC balance = %f, want %f", btc.Balance, 0.5*BTCMARKETS_UNIT)
+	}
+
+	orders, err := b.GetOrderDetail([]int64{int64(orderID)})
+	if err != nil || len(orders) != 1 {
+		t.Fatalf("GetOrderDetail = %v, %v", orders, err)
+	}
+	if orders[0].Status != BTCMARKETS_ORDER_STATUS_PARTIALLY_MATCHED || !testPaperClose(orders[0].OpenVolume, 0.5*BTCMARKETS_UNIT) {
+		t.Errorf("Order = %+v, want partially matched with 0.5 open", orders[0])
+	}
+
+	open, err := b.GetOpenOrders("AUD", "BTC")
+	if err != nil || len(open) != 1 {
+		t.Errorf("GetOpenOrders = %v, %v, want the resting order", open, err)
+	}
+
+	ok, err := b.CancelOrder([]int64{int64(orderID)})
+	if err != nil || !ok {
+		t.Fatalf("CancelOrder = %v, %v", ok, err)
+	}
+	if aud := testPaperBalance(t, b, "AUD"); !testPaperClose(aud.PendingFunds, 0) {
+		t.Errorf("AUD pending after cancel = %f, want 0", aud.PendingFunds)
+	}
+	orders, _ = b.GetOrderDetail([]int64{int64(orderID)})
+	if len(orders) != 1 || orders[0].Status != BTCMARKETS_ORDER_STATUS_PARTIALLY_CANCELLED {
+		t.Errorf("Order after cancel = %+v, want partially cancelled", orders)
+	}
+}
+
+func TestPaperTradingMarketAsk(t *testing.T) {
+	b := newTestBTCMarketsPaper(t)
+	b.Paper.SetBalance("BTC", 2*BTCMARKETS_UNIT)
+
+	orderID, _, err := b.Order("AUD", "BTC", 0, 1.5*BTCMARKETS_UNIT, BTCMARKETS_ORDER_SIDE_ASK, BTCMARKETS_ORDER_TYPE_MARKET, "")
+	if err != nil {
+		t.Fatalf("Order: %s", err)
+	}
+
+	// 1 fills at 90 and 0.5 at 80.
+	proceeds := 130.0 * BTCMARKETS_UNIT
+	fee := CalculateFee(proceeds, b.GetTradingFee("BTC"))
+	if aud := testPaperBalance(t, b, "AUD"); !testPaperClose(aud.Balance, proceeds-fee) {
+		t.Errorf("AUD balance = %f, want %f", aud.Balance, proceeds-fee)
+	}
+	if btc := testPaperBalance(t, b, "BTC"); !testPaperClose(btc.Balance, 0.5*BTCMARKETS_UNIT) || btc.PendingFunds != 0 {
+		t.Errorf("BTC = %+v, want 0.5 with nothing pending", btc)
+	}
+
+	orders, _ := b.GetOrderDetail([]int64{int64(orderID)})
+	if len(orders) != 1 || orders[0].Status != BTCMARKETS_ORDER_STATUS_FULLY_MATCHED {
+		t.Errorf("Order = %+v, want fully matched", orders)
+	}
+}
+
+func TestPaperTradingRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		price  int64
+		amount int64
+		side   BTCMarketsOrderSide
+		want   error
+	}{
+		{"insufficient funds", 105 * BTCMARKETS_UNIT, 20 * BTCMARKETS_UNIT, BTCMARKETS_ORDER_SIDE_BID, ErrPaperInsufficientFunds},
+		{"no base balance", 90 * BTCMARKETS_UNIT, 1 * BTCMARKETS_UNIT, BTCMARKETS_ORDER_SIDE_ASK, ErrPaperInsufficientFunds},
+		{"zero amount", 105 * BTCMARKETS_UNIT, 0, BTCMARKETS_ORDER_SIDE_BID, ErrPaperInvalidOrder},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newTestBTCMarketsPaper(t)
+			var paper BTCMarketsPaperAccount
+			orderbook, err := b.GetOrderbook("BTC-AUD")
+			if err != nil {
+				t.Fatalf("GetOrderbook: %s", err)
+			}
+			paper.SetBalance("AUD", 100*BTCMARKETS_UNIT)
+			_, err = paper.Order(orderbook, "AUD", "BTC", test.price, test.amount, test.side, BTCMARKETS_ORDER_TYPE_LIMIT, "", 0)
+			if err != test.want {
+				t.Errorf("Order error = %v, want %v", err, test.want)
+			}
+			if aud := paper.GetBalances(); len(aud) == 0 || aud[0].Balance != 100*BTCMARKETS_UNIT || aud[0].PendingFunds != 0 {
+				t.Errorf("Balances = %+v, want unchanged", aud)
+			}
+		})
+	}
+}
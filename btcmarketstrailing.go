@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	BTCMARKETS_TRAILING_STOP_ACTIVE    = "Active"
+	BTCMARKETS_TRAILING_STOP_TRIGGERED = "Triggered"
+	BTCMARKETS_TRAILING_STOP_CANCELLED = "Cancelled"
+	BTCMARKETS_TRAILING_STOP_FAILED    = "Failed"
+)
+
+var (
+	ErrBTCMarketsTrailingStopNotFound = errors.New("No active trailing stop with that ID.")
+	ErrBTCMarketsNoTickerSource       = errors.New("No ticker updates are received for that pair, enable it and start polling or the websocket.")
+)
+
+// BTCMarketsTrailingStop is a locally emulated trailing stop. Extreme is the
+// highest last price seen for an Ask (sell) stop, or the lowest for a Bid
+// (buy) stop, and TriggerPrice is Extreme moved against the position by
+// TrailPercent. Volume and prices are decimal values, not API units. OrderID
+// is set once the stop has triggered and its market order was placed.
+type BTCMarketsTrailingStop struct {
+	ID           string
+	Instrument   string
+	Side         BTCMarketsOrderSide
+	Volume       float64
+	TrailPercent float64
+	Extreme      float64
+	TriggerPrice float64
+	Status       string
+	OrderID      int
+	Error        string
+	Created      time.Time
+	Updated      time.Time
+}
+
+// Update feeds a last price to the stop, moving Extreme and TriggerPrice
+// when the price moves in the position's favour, and reports whether the
+// price has retraced to TriggerPrice.
+func (s *BTCMarketsTrailingStop) Update(price float64) bool {
+	if price <= 0 {
+		return false
+	}
+
+	if s.Side == BTCMARKETS_ORDER_SIDE_ASK {
+		if s.Extreme == 0 || price > s.Extreme {
+			s.Extreme = price
+			s.TriggerPrice = s.Extreme * (1 - s.TrailPercent/100)
+		}
+		return price <= s.TriggerPrice
+	}
+
+	if s.Extreme == 0 || price < s.Extreme {
+		s.Extreme = price
+		s.TriggerPrice = s.Extreme * (1 + s.TrailPercent/100)
+	}
+	return price >= s.TriggerPrice
+}
+
+// TrailingStop starts a trailing stop for volume of instrument, a pair as
+// accepted by ParsePair. BTC Markets has no native trailing stops, so the
+// stop is emulated by watching ticker updates for instrument, which arrive
+// from Run or the websocket, and a market order is placed when the last
+// price retraces by trailPercent from its best level.
+// ErrBTCMarketsNoTickerSource is returned if HasTickerSource is false.
+//
+// Stops are only held in memory. They fire while this process is running and
+// receiving tickers, and are lost on Close or when the process exits.
+func (b *BTCMarkets) TrailingStop(instrument string, side BTCMarketsOrderSide, volume, trailPercent float64) (stopID string, err error) {
+	side = side.Canonical()
+	if !side.IsValid() {
+		return "", fmt.Errorf("%s invalid order side %s.", b.GetName(), side)
+	}
+	if volume <= 0 {
+		return "", fmt.Errorf("%s invalid trailing stop volume %f.", b.GetName(), volume)
+	}
+	if trailPercent <= 0 || trailPercent >= 100 {
+		return "", fmt.Errorf("%s invalid trailing stop percentage %f.", b.GetName(), trailPercent)
+	}
+	if !b.CanTrade() {
+		return "", ErrInsufficientKeyPermissions
+	}
+
+	pair, err := b.ParsePair(NormalizeCurrency(instrument))
+	if err != nil {
+		return "", err
+	}
+	err = b.ValidatePair(pair)
+	if err != nil {
+		return "", err
+	}
+	instrument = b.FormatPair(pair)
+	if !b.HasTickerSource(instrument) {
+		return "", ErrBTCMarketsNoTickerSource
+	}
+
+	stopID, err = GetUUID()
+	if err != nil {
+		return "", err
+	}
+
+	stop := BTCMarketsTrailingStop{
+		ID:           stopID,
+		Instrument:   instrument,
+		Side:         side,
+		Volume:       volume,
+		TrailPercent: trailPercent,
+		Status:       BTCMARKETS_TRAILING_STOP_ACTIVE,
+		Created:      time.Now(),
+	}
+	stop.Updated = stop.Created
+
+	b.tickerMtx.Lock()
+	ticker, ok := b.Ticker[instrument]
+	b.tickerMtx.Unlock()
+	if ok {
+		stop.Update(ticker.LastPrice)
+	}
+
+	b.runMtx.Lock()
+	shutdown := b.shutdown
+	b.runMtx.Unlock()
+
+	tickers, unsubscribe := b.SubscribeTicker(instrument)
+	done := make(chan struct{})
+
+	b.trailingMtx.Lock()
+	if b.trailingStops == nil {
+		b.trailingStops = make(map[string]BTCMarketsTrailingStop)
+		b.trailingDone = make(map[string]chan struct{})
+	}
+	b.trailingStops[stopID] = stop
+	b.trailingDone[stopID] = done
+	b.trailingMtx.Unlock()
+
+	go b.monitorTrailingStop(stopID, pair, tickers, unsubscribe, done, shutdown)
+	return stopID, nil
+}
+
+func (b *BTCMarkets) monitorTrailingStop(stopID string, pair CurrencyPair, tickers <-chan BTCMarketsTicker, unsubscribe func(), done, shutdown chan struct{}) {
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-shutdown:
+			b.finishTrailingStop(stopID, BTCMARKETS_TRAILING_STOP_CANCELLED, 0, nil)
+			return
+		case ticker := <-tickers:
+			b.trailingMtx.Lock()
+			stop, ok := b.trailingStops[stopID]
+			if !ok || stop.Status != BTCMARKETS_TRAILING_STOP_ACTIVE {
+				b.trailingMtx.Unlock()
+				return
+			}
+			triggered := stop.Update(ticker.LastPrice)
+			stop.Updated = time.Now()
+			b.trailingStops[stopID] = stop
+			b.trailingMtx.Unlock()
+
+			if !triggered {
+				continue
+			}
+
+			log.Printf("%s trailing stop %s triggered at %f, placing %s order for %f %s.\n", b.GetName(), stopID, ticker.LastPrice, stop.Side, stop.Volume, pair.Base)
+			orderID, _, err := b.Order(pair.Quote, pair.Base, 0, b.ConvertOrderUnits(stop.Volume), stop.Side, BTCMARKETS_ORDER_TYPE_MARKET, stopID)
+			if err != nil {
+				log.Printf("%s trailing stop %s unable to place order. Error: %s\n", b.GetName(), stopID, err)
+				b.finishTrailingStop(stopID, BTCMARKETS_TRAILING_STOP_FAILED, 0, err)
+				return
+			}
+			b.finishTrailingStop(stopID, BTCMARKETS_TRAILING_STOP_TRIGGERED, orderID, nil)
+			return
+		}
+	}
+}
+
+func (b *BTCMarkets) finishTrailingStop(stopID, status string, orderID int, err error) {
+	b.trailingMtx.Lock()
+	defer b.trailingMtx.Unlock()
+
+	stop, ok := b.trailingStops[stopID]
+	if !ok || stop.Status != BTCMARKETS_TRAILING_STOP_ACTIVE {
+		return
+	}
+	stop.Status = status
+	stop.OrderID = orderID
+	if err != nil {
+		stop.Error = err.Error()
+	}
+	stop.Updated = time.Now()
+	b.trailingStops[stopID] = stop
+	delete(b.trailingDone, stopID)
+}
+
+// CancelTrailingStop stops monitoring stopID. ErrBTCMarketsTrailingStopNotFound
+// is returned if it is unknown or has already triggered, failed or been
+// cancelled.
+func (b *BTCMarkets) CancelTrailingStop(stopID string) error {
+	b.trailingMtx.Lock()
+	defer b.trailingMtx.Unlock()
+
+	stop, ok := b.trailingStops[stopID]
+	if !ok || stop.Status != BTCMARKETS_TRAILING_STOP_ACTIVE {
+		return ErrBTCMarketsTrailingStopNotFound
+	}
+
+	close(b.trailingDone[stopID])
+	delete(b.trailingDone, stopID)
+	stop.Status = BTCMARKETS_TRAILING_STOP_CANCELLED
+	stop.Updated = time.Now()
+	b.trailingStops[stopID] = stop
+	return nil
+}
+
+// GetTrailingStop returns the current state of stopID.
+func (b *BTCMarkets) GetTrailingStop(stopID string) (BTCMarketsTrailingStop, bool) {
+	b.trailingMtx.Lock()
+	defer b.trailingMtx.Unlock()
+
+	stop, ok := b.trailingStops[stopID]
+	return stop, ok
+}
+
+// ListTrailingStops returns every trailing stop created since the last
+// Close, oldest first, including those no longer active.
+func (b *BTCMarkets) ListTrailingStops() []BTCMarketsTrailingStop {
+	b.trailingMtx.Lock()
+	defer b.trailingMtx.Unlock()
+
+	stops := []BTCMarketsTrailingStop{}
+	for _, x := range b.trailingStops {
+		stops = append(stops, x)
+	}
+	sort.Slice(stops, func(i, j int) bool {
+		return stops[i].Created.Before(stops[j].Created)
+	})
+	return stops
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTrailingStopUpdate(t *testing.T) {
+	tests := []struct {
+		name      string
+		side      BTCMarketsOrderSide
+		prices    []float64
+		extreme   float64
+		triggered bool
+	}{
+		{name: "ask trails up", side: BTCMARKETS_ORDER_SIDE_ASK, prices: []float64{100, 120, 110}, extreme: 120},
+		{name: "ask triggers", side: BTCMARKETS_ORDER_SIDE_ASK, prices: []float64{100, 120, 108}, extreme: 120, triggered: true},
+		{name: "bid trails down", side: BTCMARKETS_ORDER_SIDE_BID, prices: []float64{100, 80, 83}, extreme: 80},
+		{name: "bid triggers", side: BTCMARKETS_ORDER_SIDE_BID, prices: []float64{100, 80, 89}, extreme: 80, triggered: true},
+		{name: "ignores zero", side: BTCMARKETS_ORDER_SIDE_ASK, prices: []float64{100, 0}, extreme: 100},
+	}
+
+	for _, test := range tests {
+		stop := BTCMarketsTrailingStop{Side: test.side, TrailPercent: 10}
+		triggered := false
+		for _, x := range test.prices {
+			triggered = stop.Update(x)
+		}
+		if triggered != test.triggered || stop.Extreme != test.extreme {
+			t.Errorf("%s: triggered %t extreme %f, want %t %f", test.name, triggered, stop.Extreme, test.triggered, test.extreme)
+		}
+	}
+}
+
+func TestTrailingStop(t *testing.T) {
+	var creates int32
+	b := newTestBTCMarketsAuth(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == BTCMARKETS_ORDER_CREATE {
+			atomic.AddInt32(&creates, 1)
+			w.Write([]byte(`{"success":true,"id":42}`))
+			return
+		}
+		w.Write([]byte(`{}`))
+	})
+	defer b.Close()
+
+	_, err := b.TrailingStop("BTC", BTCMARKETS_ORDER_SIDE_ASK, 0.5, 10)
+	if err != ErrBTCMarketsNoTickerSource {
+		t.Fatalf("err = %v, want ErrBTCMarketsNoTickerSource", err)
+	}
+
+	// Enabled and Websocket alone don't deliver tickers until Run is
+	// polling or the websocket is connected.
+	b.Enabled = true
+	b.Websocket = true
+	b.EnabledPairs = []string{"BTC"}
+	_, err = b.TrailingStop("BTC", BTCMARKETS_ORDER_SIDE_ASK, 0.5, 10)
+	if err != ErrBTCMarketsNoTickerSource {
+		t.Fatalf("err = %v without Run or the websocket, want ErrBTCMarketsNoTickerSource", err)
+	}
+
+	b.polling = true
+	b.UpdateTicker("BTC", BTCMarketsTicker{LastPrice: 100})
+
+	id, err := b.TrailingStop("btc/aud", "ask", 0.5, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop, _ := b.GetTrailingStop(id)
+	if stop.Instrument != "BTC-AUD" || stop.Extreme != 100 {
+		t.Fatalf("stop = %+v", stop)
+	}
+
+	id2, err := b.TrailingStop("BTC-AUD", BTCMARKETS_ORDER_SIDE_BID, 1, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.CancelTrailingStop(id2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, x := range []string{"120", "110", "107"} {
+		err = b.WebsocketHandleMessage([]byte(`{"marketId":"BTC-AUD","lastPrice":"` + x + `","messageType":"tick"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stop, _ = b.GetTrailingStop(id)
+	if stop.Status != BTCMARKETS_TRAILING_STOP_TRIGGERED || stop.OrderID != 42 || stop.Extreme != 120 || atomic.LoadInt32(&creates) != 1 {
+		t.Fatalf("stop = %+v, creates = %d", stop, creates)
+	}
+
+	stops := b.ListTrailingStops()
+	if len(stops) != 2 || stops[0].ID != id || stops[1].Status != BTCMARKETS_TRAILING_STOP_CANCELLED {
+		t.Fatalf("stops = %+v", stops)
+	}
+	if b.CancelTrailingStop(id) != ErrBTCMarketsTrailingStopNotFound {
+		t.Fatal("cancelled a triggered stop")
+	}
+}
+
+func TestTrailingStopFailedAndClosed(t *testing.T) {
+	b := newTestBTCMarketsAuth(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"success":false,"errorCode":3,"errorMessage":"Insufficient funds."}`))
+	})
+	b.polling = true
+	b.EnabledPairs = []string{"BTC-AUD"}
+	b.UpdateTicker("BTC", BTCMarketsTicker{LastPrice: 100})
+
+	for _, test := range []struct {
+		side    BTCMarketsOrderSide
+		volume  float64
+		percent float64
+	}{
+		{side: "sideways", volume: 1, percent: 5},
+		{side: BTCMARKETS_ORDER_SIDE_BID, volume: 0, percent: 5},
+		{side: BTCMARKETS_ORDER_SIDE_BID, volume: 1, percent: 0},
+		{side: BTCMARKETS_ORDER_SIDE_BID, volume: 1, percent: 100},
+	} {
+		if _, err := b.TrailingStop("BTC", test.side, test.volume, test.percent); err == nil {
+			t.Errorf("accepted side %s volume %f trail %f%%", test.side, test.volume, test.percent)
+		}
+	}
+
+	failing, err := b.TrailingStop("BTC", BTCMARKETS_ORDER_SIDE_BID, 1, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waiting, err := b.TrailingStop("BTC", BTCMARKETS_ORDER_SIDE_ASK, 1, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 90 moves the bid stop's trigger down to 94.5, which 95 then crosses.
+	for _, x := range []float64{90, 95} {
+		b.UpdateTicker("BTC", BTCMarketsTicker{LastPrice: x})
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stop, _ := b.GetTrailingStop(failing)
+		if stop.Status == BTCMARKETS_TRAILING_STOP_FAILED {
+			if stop.OrderID != 0 || !strings.Contains(stop.Error, "Insufficient funds.") {
+				t.Errorf("failed stop = %+v", stop)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stop = %+v, want it to fail placing the order", stop)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	b.Close()
+	if stops := b.ListTrailingStops(); len(stops) != 0 {
+		t.Errorf("stops after Close = %+v, want none", stops)
+	}
+	if _, ok := b.GetTrailingStop(waiting); ok {
+		t.Error("stop still known after Close")
+	}
+	if err := b.CancelTrailingStop(waiting); err != ErrBTCMarketsTrailingStopNotFound {
+		t.Errorf("CancelTrailingStop after Close = %v, want ErrBTCMarketsTrailingStopNotFound", err)
+	}
+}
+
+func TestHasTickerSource(t *testing.T) {
+	b := newTestBTCMarkets(t, testBTCMarketsRoutes(map[string]string{
+		"/market/BTC/AUD/tick": testBTCMarketsTicker,
+	}))
+	b.Enabled = true
+	b.EnabledPairs = []string{"BTC-AUD"}
+	b.RESTPollingDelay = time.Hour
+	if b.HasTickerSource("BTC") {
+		t.Fatal("HasTickerSource before Run started")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		b.Run()
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for !b.HasTickerSource("BTC") {
+		if time.Now().After(deadline) {
+			t.Fatal("HasTickerSource stayed false while Run was polling")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if b.HasTickerSource("ETH") {
+		t.Error("HasTickerSource for a pair that isn't enabled")
+	}
+
+	b.Stop()
+	<-done
+	if b.IsPolling() || b.HasTickerSource("BTC") {
+		t.Error("still a ticker source after Run returned")
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gorilla/websocket"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	BTCMARKETS_WEBSOCKET                  = "wss://socket.btcmarkets.net/v2"
+	BTCMARKETS_WEBSOCKET_TICK             = "tick"
+	BTCMARKETS_WEBSOCKET_ORDERBOOK_UPDATE = "orderbookUpdate"
+	BTCMARKETS_WEBSOCKET_HEARTBEAT        = "heartbeat"
+	BTCMARKETS_WEBSOCKET_ORDER_CHANGE     = "orderChange"
+	BTCMARKETS_WEBSOCKET_AUTH_PATH        = "/users/self/subscribe"
+	BTCMARKETS_WEBSOCKET_ERROR            = "error"
+	BTCMARKETS_WEBSOCKET_RECONNECT_MIN    = time.Second
+	BTCMARKETS_WEBSOCKET_RECONNECT_MAX    = time.Minute
+)
+
+type BTCMarketsWebsocketSubscribe struct {
+	MarketIDs   []string `json:"marketIds"`
+	Channels    []string `json:"channels"`
+	MessageType string   `json:"messageType"`
+	Key         string   `json:"key,omitempty"`
+	Signature   string   `json:"signature,omitempty"`
+	Timestamp   string   `json:"timestamp,omitempty"`
+}
+
+type BTCMarketsWebsocketMessage struct {
+	MessageType string `json:"messageType"`
+}
+
+type BTCMarketsWebsocketTick struct {
+	MarketID    string  `json:"marketId"`
+	Timestamp   string  `json:"timestamp"`
+	BestBid     float64 `json:"bestBid,string"`
+	BestAsk     float64 `json:"bestAsk,string"`
+	LastPrice   float64 `json:"lastPrice,string"`
+	Volume24h   float64 `json:"volume24h,string"`
+	MessageType string  `json:"messageType"`
+}
+
+// BTCMarketsWebsocketOrderbookUpdate is either a full snapshot or a diff of
+// the levels that changed since the previous update. Levels are
+// [price, volume, count] with price and volume as decimal strings; a zero
+// volume removes the level.
+type BTCMarketsWebsocketOrderbookUpdate struct {
+	MarketID    string          `json:"marketId"`
+	SnapshotID  int64           `json:"snapshotId"`
+	Snapshot    bool            `json:"snapshot"`
+	Timestamp   string          `json:"timestamp"`
+	Bids        [][]interface{} `json:"bids"`
+	Asks        [][]interface{} `json:"asks"`
+	MessageType string          `json:"messageType"`
+}
+
+type BTCMarketsWebsocketOrderTrade struct {
+	TradeID int64   `json:"tradeId"`
+	Price   float64 `json:"price,string"`
+	Volume  float64 `json:"volume,string"`
+	Fee     float64 `json:"fee,string"`
+}
+
+type BTCMarketsWebsocketOrderChange struct {
+	OrderID     int64                           `json:"orderId"`
+	MarketID    string                          `json:"marketId"`
+	Side        string                          `json:"side"`
+	Type        string                          `json:"type"`
+	OpenVolume  float64                         `json:"openVolume,string"`
+	Status      string                          `json:"status"`
+	Trades      []BTCMarketsWebsocketOrderTrade `json:"trades"`
+	Timestamp   string                          `json:"timestamp"`
+	MessageType string                          `json:"messageType"`
+}
+
+type BTCMarketsWebsocketError struct {
+	Code        int    `json:"code"`
+	Message     string `json:"message"`
+	MessageType string `json:"messageType"`
+}
+
+func (b *BTCMarkets) WebsocketSubscribe(conn *websocket.Conn, pairs, channels []string) error {
+	subscribe := BTCMarketsWebsocketSubscribe{MessageType: "subscribe", Channels: channels}
+	for _, x := range pairs {
+		pair, err := b.ParsePair(NormalizeCurrency(x))
+		if err != nil {
+			return fmt.Errorf("%s invalid websocket pair %s. Error: %s", b.GetName(), x, err)
+		}
+		subscribe.MarketIDs = append(subscribe.MarketIDs, pair.Format("-"))
+	}
+
+	if b.AuthenticatedAPISupport {
+		subscribe.Key = b.APIKey
+		subscribe.Timestamp = b.GetNonce()
+		request := BTCMARKETS_WEBSOCKET_AUTH_PATH + "\n" + subscribe.Timestamp
+		hmac, err := GetHMAC(HASH_SHA512, []byte(request), []byte(b.APISecret))
+		if err != nil {
+			return err
+		}
+		subscribe.Signature = Base64Encode(hmac)
+	}
+
+	json, err := JSONEncode(subscribe)
+	if err != nil {
+		return err
+	}
+	return conn.WriteMessage(websocket.TextMessage, json)
+}
+
+func (b *BTCMarkets) WebsocketClient() {
+	channels := []string{BTCMARKETS_WEBSOCKET_TICK, BTCMARKETS_WEBSOCKET_ORDERBOOK_UPDATE, BTCMARKETS_WEBSOCKET_HEARTBEAT}
+	if b.AuthenticatedAPISupport {
+		channels = append(channels, BTCMARKETS_WEBSOCKET_ORDER_CHANGE)
+	}
+	backoff := NewBTCMarketsWebsocketBackoff()
+	reconnect := false
+	for b.Enabled && b.Websocket && !b.IsStopped() {
+		if reconnect {
+			delay := backoff.Next()
+			log.Printf("%s Websocket reconnect attempt %d in %s.\n", b.GetName(), backoff.Attempts(), delay)
+			select {
+			case <-b.shutdown:
+				return
+			case <-time.After(delay):
+			}
+		}
+		reconnect = true
+
+		var Dialer websocket.Dialer
+		conn, _, err := Dialer.Dial(b.WebsocketURL, http.Header{})
+
+		if err != nil {
+			log.Printf("%s Unable to connect to Websocket. Error: %s\n", b.GetName(), err)
+			b.SetLastError(err)
+			continue
+		}
+		backoff.Reset()
+
+		if !b.SetWebsocketConn(conn) {
+			conn.Close()
+			return
+		}
+
+		if b.Verbose {
+			log.Printf("%s Connected to Websocket.\n", b.GetName())
+		}
+
+		err = b.WebsocketSubscribe(conn, b.GetEnabledPairs(), channels)
+		if err != nil {
+			log.Printf("%s Websocket subscription error: %s\n", b.GetName(), err)
+		}
+
+		for b.Enabled && b.Websocket && err == nil {
+			msgType, resp, err := conn.ReadMessage()
+			if err != nil {
+				log.Println(err)
+				b.SetLastError(err)
+				break
+			}
+
+			if msgType != websocket.TextMessage {
+				continue
+			}
+
+			err = b.WebsocketHandleMessage(resp)
+			if err != nil {
+				log.Println(err)
+				b.SetLastError(err)
+			}
+		}
+
+		b.SetWebsocketConn(nil)
+		conn.Close()
+		log.Printf("%s Websocket client disconnected.\n", b.GetName())
+		if !b.IsStopped() {
+			b.CancelOrdersOnDisconnect()
+		}
+	}
+}
+
+// CancelOrdersOnDisconnect cancels the open orders of every enabled pair that
+// IsTradingEnabled allows if CancelOnDisconnect is set. WebsocketClient calls
+// it after an unexpected disconnect, before reconnecting.
+func (b *BTCMarkets) CancelOrdersOnDisconnect() {
+	if !b.CancelOnDisconnect || !b.AuthenticatedAPISupport {
+		return
+	}
+
+	for _, x := range b.GetEnabledCurrencyPairs() {
+		if !b.IsTradingEnabled(x.Quote, x.Base) {
+			continue
+		}
+		log.Printf("%s Websocket disconnected, cancelling open %s orders.\n", b.GetName(), x.Format("/"))
+		_, err := b.CancelAllOrders(x.Quote, x.Base)
+		if err != nil {
+			log.Println(err)
+			b.SetLastError(err)
+		}
+	}
+}
+
+// NewBTCMarketsWebsocketBackoff returns the reconnect backoff, doubling from
+// BTCMARKETS_WEBSOCKET_RECONNECT_MIN up to BTCMARKETS_WEBSOCKET_RECONNECT_MAX
+// with up to half of each delay randomised away.
+func NewBTCMarketsWebsocketBackoff() *Backoff {
+	return &Backoff{Min: BTCMARKETS_WEBSOCKET_RECONNECT_MIN, Max: BTCMARKETS_WEBSOCKET_RECONNECT_MAX, Jitter: 0.5}
+}
+
+func (b *BTCMarkets) WebsocketConnected() bool {
+	b.runMtx.Lock()
+	defer b.runMtx.Unlock()
+	return b.wsConn != nil
+}
+
+// SetWebsocketConn records the active websocket connection so Stop can close
+// it. It returns false, without recording conn, if the exchange is stopped.
+func (b *BTCMarkets) SetWebsocketConn(conn *websocket.Conn) bool {
+	b.runMtx.Lock()
+	defer b.runMtx.Unlock()
+	if conn != nil && b.stopped {
+		return false
+	}
+	b.wsConn = conn
+	return true
+}
+
+func (b *BTCMarkets) WebsocketHandleMessage(resp []byte) error {
+	msg := BTCMarketsWebsocketMessage{}
+	err := JSONDecode(resp, &msg)
+	if err != nil {
+		return err
+	}
+
+	switch msg.MessageType {
+	case BTCMARKETS_WEBSOCKET_TICK:
+		tick := BTCMarketsWebsocketTick{}
+		err = JSONDecode(resp, &tick)
+		if err != nil {
+			return err
+		}
+
+		instrument, currency := SplitBTCMarketsMarketID(tick.MarketID)
+		ticker := BTCMarketsTicker{
+			BestBID:    tick.BestBid,
+			BestAsk:    tick.BestAsk,
+			LastPrice:  tick.LastPrice,
+			Currency:   currency,
+			Instrument: instrument,
+		}
+		ts, err := time.Parse(time.RFC3339, tick.Timestamp)
+		if err == nil {
+			ticker.Timestamp = ts.Unix()
+		}
+		key := b.FormatPair(CurrencyPair{Base: instrument, Quote: currency})
+		b.RecordPoll(key)
+		b.ProcessTicker(key, ticker)
+	case BTCMARKETS_WEBSOCKET_ORDERBOOK_UPDATE:
+		update := BTCMarketsWebsocketOrderbookUpdate{}
+		err = JSONDecode(resp, &update)
+		if err != nil {
+			return err
+		}
+		return b.ApplyWebsocketOrderbookUpdate(update)
+	case BTCMARKETS_WEBSOCKET_ORDER_CHANGE:
+		change := BTCMarketsWebsocketOrderChange{}
+		err = JSONDecode(resp, &change)
+		if err != nil {
+			return err
+		}
+
+		eventType := GetBTCMarketsEventType(change.Status)
+		if eventType == "" {
+			return nil
+		}
+
+		event := BTCMarketsEvent{Type: eventType, OrderID: change.OrderID, Status: change.Status, Time: time.Now()}
+		notional := 0.0
+		for _, x := range change.Trades {
+			event.FilledVolume += x.Volume
+			notional += x.Price * x.Volume
+		}
+		if event.FilledVolume > 0 {
+			event.Price = notional / event.FilledVolume
+		}
+		b.PublishEvent(event)
+	case BTCMARKETS_WEBSOCKET_ERROR:
+		wsErr := BTCMarketsWebsocketError{}
+		err = JSONDecode(resp, &wsErr)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("%s Websocket error %d: %s", b.GetName(), wsErr.Code, wsErr.Message)
+	}
+	return nil
+}
+
+// SplitBTCMarketsMarketID splits a market ID such as "BTC-AUD" into its
+// instrument and currency.
+func SplitBTCMarketsMarketID(marketID string) (instrument, currency string) {
+	split := SplitStrings(marketID, "-")
+	if len(split) != 2 {
+		return marketID, ""
+	}
+	return split[0], split[1]
+}
+
+// ApplyWebsocketOrderbookUpdate applies a snapshot or diff to the cached
+// orderbook used by GetOrderbookCached. Diffs are expected to carry
+// consecutive snapshot IDs; on a gap, or a diff with no prior snapshot, the
+// book is refetched over REST and the next diff is applied on top of it.
+func (b *BTCMarkets) ApplyWebsocketOrderbookUpdate(update BTCMarketsWebsocketOrderbookUpdate) error {
+	instrument, currency := SplitBTCMarketsMarketID(update.MarketID)
+	if currency != "AUD" {
+		return nil
+	}
+	key := b.FormatPair(CurrencyPair{Base: instrument, Quote: currency})
+
+	bids, err := ParseBTCMarketsWebsocketLevels(update.Bids)
+	if err != nil {
+		return fmt.Errorf("%s invalid %s orderbook bids. Error: %s", b.GetName(), update.MarketID, err)
+	}
+
+	asks, err := ParseBTCMarketsWebsocketLevels(update.Asks)
+	if err != nil {
+		return fmt.Errorf("%s invalid %s orderbook asks. Error: %s", b.GetName(), update.MarketID, err)
+	}
+
+	b.orderbookMtx.Lock()
+	if b.Orderbook == nil {
+		b.Orderbook = make(map[string]BTCMarketsOrderbook)
+		b.OrderbookLastFetch = make(map[string]time.Time)
+	}
+	if b.wsSnapshotIDs == nil {
+		b.wsSnapshotIDs = make(map[string]int64)
+	}
+
+	orderbook, ok := b.Orderbook[key]
+	lastID, synced := b.wsSnapshotIDs[key]
+	if update.Snapshot {
+		orderbook = BTCMarketsOrderbook{Currency: currency, Instrument: instrument}
+		orderbook.Bids = ApplyBTCMarketsOrderbookLevels(nil, bids, true)
+		orderbook.Asks = ApplyBTCMarketsOrderbookLevels(nil, asks, false)
+	} else if !ok || (synced && lastID != 0 && update.SnapshotID != lastID+1) {
+		delete(b.wsSnapshotIDs, key)
+		b.orderbookMtx.Unlock()
+
+		if b.Verbose {
+			log.Printf("%s %s orderbook sequence gap at snapshot %d, resnapshotting.\n", b.GetName(), update.MarketID, update.SnapshotID)
+		}
+
+		_, err = b.GetOrderbook(key)
+		if err != nil {
+			return err
+		}
+		if b.IsStopped() {
+			return nil
+		}
+
+		// Close may have cleared the snapshot IDs while the book was fetched.
+		b.orderbookMtx.Lock()
+		defer b.orderbookMtx.Unlock()
+		if b.wsSnapshotIDs == nil {
+			return nil
+		}
+		b.wsSnapshotIDs[key] = 0
+		return nil
+	} else {
+		orderbook.Bids = ApplyBTCMarketsOrderbookLevels(orderbook.Bids, bids, true)
+		orderbook.Asks = ApplyBTCMarketsOrderbookLevels(orderbook.Asks, asks, false)
+	}
+
+	ts, err := time.Parse(time.RFC3339, update.Timestamp)
+	if err == nil {
+		orderbook.Timestamp = ts.Unix()
+	}
+	orderbook.Crossed, _, _ = orderbook.IsCrossed()
+
+	b.Orderbook[key] = orderbook
+	b.OrderbookLastFetch[key] = time.Now()
+	b.wsSnapshotIDs[key] = update.SnapshotID
+	b.orderbookMtx.Unlock()
+	return nil
+}
+
+// ParseBTCMarketsWebsocketLevels converts [price, volume, count] levels with
+// decimal string prices and volumes into the [price, volume] form used by
+// BTCMarketsOrderbook.
+func ParseBTCMarketsWebsocketLevels(levels [][]interface{}) ([][]float64, error) {
+	parsed := [][]float64{}
+	for _, x := range levels {
+		if len(x) < 2 {
+			return nil, fmt.Errorf("level %v is too short", x)
+		}
+
+		level := []float64{}
+		for _, y := range x[:2] {
+			s, ok := y.(string)
+			if !ok {
+				return nil, fmt.Errorf("level %v is not a string pair", x)
+			}
+			value, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return nil, err
+			}
+			level = append(level, value)
+		}
+		parsed = append(parsed, level)
+	}
+	return parsed, nil
+}
+
+// ApplyBTCMarketsOrderbookLevels merges updates into side, which is kept
+// sorted by price (descending for bids). An update with zero volume removes
+// its price level.
+func ApplyBTCMarketsOrderbookLevels(side, updates [][]float64, descending bool) [][]float64 {
+	side = append([][]float64{}, side...)
+	for _, x := range updates {
+		price, volume := x[0], x[1]
+		i := sort.Search(len(side), func(i int) bool {
+			if descending {
+				return side[i][0] <= price
+			}
+			return side[i][0] >= price
+		})
+
+		exists := i < len(side) && side[i][0] == price
+		switch {
+		case exists && volume == 0:
+			side = append(side[:i], side[i+1:]...)
+		case exists:
+			side[i] = []float64{price, volume}
+		case volume != 0:
+			side = append(side, nil)
+			copy(side[i+1:], side[i:])
+			side[i] = []float64{price, volume}
+		}
+	}
+	return side
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestWebsocketConn dials an httptest.Server which upgrades the connection
+// and sends every message it receives on messages.
+func newTestWebsocketConn(t *testing.T) (*websocket.Conn, <-chan []byte) {
+	t.Helper()
+
+	messages := make(chan []byte, 10)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			messages <- msg
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, messages
+}
+
+func TestWebsocketSubscribeMarketIDs(t *testing.T) {
+	b := BTCMarkets{}
+	b.SetDefaults()
+	conn, messages := newTestWebsocketConn(t)
+
+	err := b.WebsocketSubscribe(conn, []string{"btc", "ETH-BTC", "ltc/aud"}, []string{BTCMARKETS_WEBSOCKET_TICK})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subscribe := BTCMarketsWebsocketSubscribe{}
+	err = JSONDecode(<-messages, &subscribe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(subscribe.MarketIDs, []string{"BTC-AUD", "ETH-BTC", "LTC-AUD"}) {
+		t.Fatalf("MarketIDs = %v", subscribe.MarketIDs)
+	}
+
+	if b.WebsocketSubscribe(conn, []string{""}, nil) == nil {
+		t.Fatal("subscribed to an empty pair")
+	}
+}
+
+func TestWebsocketOrderbookCacheKey(t *testing.T) {
+	b := BTCMarkets{}
+	b.SetDefaults()
+
+	err := b.WebsocketHandleMessage([]byte(`{"marketId":"BTC-AUD","snapshotId":1,"snapshot":true,"bids":[["100","1",1]],"asks":[["101","1",1]],"messageType":"orderbookUpdate"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, x := range []string{"BTC", "btc/aud", "BTC-AUD"} {
+		orderbook, err := b.GetOrderbookCached(x)
+		if err != nil {
+			t.Fatalf("%s: %s", x, err)
+		}
+		if !reflect.DeepEqual(orderbook.Bids, [][]float64{{100, 1}}) {
+			t.Fatalf("%s: orderbook = %+v", x, orderbook)
+		}
+	}
+}
+
+func TestWebsocketResnapshotClose(t *testing.T) {
+	b := newTestBTCMarkets(t, respondWith(http.StatusOK, testBTCMarketsOrderbook))
+	diff := BTCMarketsWebsocketOrderbookUpdate{MarketID: "BTC-AUD", SnapshotID: 2}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			b.ApplyWebsocketOrderbookUpdate(diff)
+		}()
+		go func() {
+			defer wg.Done()
+			b.Close()
+		}()
+	}
+	wg.Wait()
+
+	b.orderbookMtx.Lock()
+	defer b.orderbookMtx.Unlock()
+	if len(b.wsSnapshotIDs) != 0 {
+		t.Fatalf("snapshot IDs recorded after Close: %v", b.wsSnapshotIDs)
+	}
+}
+
+func TestWebsocketOrderbookDiffs(t *testing.T) {
+	var requests int
+	b := newTestBTCMarkets(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(testBTCMarketsOrderbook))
+	})
+
+	messages := []string{
+		`{"marketId":"BTC-AUD","snapshotId":1,"snapshot":true,"bids":[["100","1",1],["99","2",1]],"asks":[["101","1",1],["102","3",2]],"messageType":"orderbookUpdate"}`,
+		`{"marketId":"BTC-AUD","snapshotId":2,"bids":[["100","0",0],["99.5","1",1]],"asks":[],"messageType":"orderbookUpdate"}`,
+		`{"marketId":"BTC-AUD","snapshotId":3,"bids":[],"asks":[["101","0.5",1],["101.5","2",1]],"messageType":"orderbookUpdate"}`,
+	}
+	for _, x := range messages {
+		err := b.WebsocketHandleMessage([]byte(x))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	orderbook, err := b.GetOrderbookCached("BTC-AUD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(orderbook.Bids, [][]float64{{99.5, 1}, {99, 2}}) {
+		t.Errorf("bids = %v", orderbook.Bids)
+	}
+	if !reflect.DeepEqual(orderbook.Asks, [][]float64{{101, 0.5}, {101.5, 2}, {102, 3}}) {
+		t.Errorf("asks = %v", orderbook.Asks)
+	}
+	if requests != 0 {
+		t.Fatalf("fetched the orderbook %d times while in sequence", requests)
+	}
+
+	// Snapshot 4 is missing, so the book is refetched over REST and the next
+	// diff is applied on top of it.
+	err = b.WebsocketHandleMessage([]byte(`{"marketId":"BTC-AUD","snapshotId":5,"bids":[["1","1",1]],"asks":[],"messageType":"orderbookUpdate"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 1 {
+		t.Fatalf("fetched the orderbook %d times after a gap, want 1", requests)
+	}
+	err = b.WebsocketHandleMessage([]byte(`{"marketId":"BTC-AUD","snapshotId":6,"bids":[["100.5","0",0]],"asks":[],"messageType":"orderbookUpdate"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orderbook, _ = b.GetOrderbookCached("BTC-AUD")
+	if !reflect.DeepEqual(orderbook.Bids, [][]float64{{100, 3}}) || !reflect.DeepEqual(orderbook.Asks, [][]float64{{101.25, 0.5}, {102, 1}}) {
+		t.Errorf("orderbook after resnapshot = %v %v", orderbook.Bids, orderbook.Asks)
+	}
+}
+
+func TestWebsocketReconnect(t *testing.T) {
+	var connections int32
+	subscribed := make(chan int32, 10)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		n := atomic.AddInt32(&connections, 1)
+
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		subscribe := BTCMarketsWebsocketSubscribe{}
+		if JSONDecode(msg, &subscribe) == nil && subscribe.MessageType == "subscribe" {
+			subscribed <- n
+		}
+
+		// Drop the first connection straight after it subscribes.
+		for n > 1 {
+			_, _, err = conn.ReadMessage()
+			if err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	b := BTCMarkets{}
+	b.SetDefaults()
+	b.Enabled = true
+	b.Websocket = true
+	b.EnabledPairs = []string{"BTC-AUD"}
+	b.WebsocketURL = "ws" + strings.TrimPrefix(server.URL, "http")
+
+	done := make(chan struct{})
+	go func() {
+		b.WebsocketClient()
+		close(done)
+	}()
+
+	for i := int32(1); i <= 2; i++ {
+		select {
+		case n := <-subscribed:
+			if n != i {
+				t.Fatalf("subscription on connection %d, want %d", n, i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for subscription %d", i)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !b.WebsocketConnected() {
+		if time.Now().After(deadline) {
+			t.Fatal("WebsocketConnected is false after reconnecting")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	b.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("WebsocketClient didn't return after Close")
+	}
+	if b.WebsocketConnected() {
+		t.Error("WebsocketConnected is true after Close")
+	}
+}
+
+func TestWebsocketCancelOnDisconnect(t *testing.T) {
+	var connections int32
+	cancelled := make(chan string, 10)
+	upgrader := websocket.Upgrader{}
+	b := newTestBTCMarketsAuth(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case BTCMARKETS_ORDER_OPEN:
+			w.Write([]byte(`{"success":true,"orders":[{"id":1,"status":"Placed"}]}`))
+			return
+		case BTCMARKETS_ORDER_CANCEL:
+			cancelled <- r.URL.Path
+			w.Write([]byte(`{"success":true,"responses":[{"success":true,"id":1}]}`))
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		n := atomic.AddInt32(&connections, 1)
+
+		// Drop the first connection after it subscribes.
+		_, _, err = conn.ReadMessage()
+		for err == nil && n > 1 {
+			_, _, err = conn.ReadMessage()
+		}
+	})
+	b.Enabled = true
+	b.Websocket = true
+	b.CancelOnDisconnect = true
+	b.EnabledPairs = []string{"BTC-AUD"}
+	b.WebsocketURL = "ws" + strings.TrimPrefix(b.APIUrl, "http")
+
+	done := make(chan struct{})
+	go func() {
+		b.WebsocketClient()
+		close(done)
+	}()
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("open orders weren't cancelled after the disconnect")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&connections) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("didn't reconnect after cancelling")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	b.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("WebsocketClient didn't return after Close")
+	}
+	if len(cancelled) != 0 {
+		t.Errorf("cancelled %d more times, want once for the single disconnect", len(cancelled))
+	}
+}
+
+func TestCancelOrdersOnDisconnectTradingPairs(t *testing.T) {
+	var mtx sync.Mutex
+	var requests []string
+	b := newTestBTCMarketsAuth(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mtx.Lock()
+		requests = append(requests, r.URL.Path+" "+string(body))
+		mtx.Unlock()
+		switch r.URL.Path {
+		case BTCMARKETS_ORDER_OPEN:
+			w.Write([]byte(`{"success":true,"orders":[{"id":1,"currency":"AUD","instrument":"BTC","status":"Placed"}]}`))
+		default:
+			w.Write([]byte(`{"success":true,"responses":[{"success":true,"id":1}]}`))
+		}
+	})
+	b.CancelOnDisconnect = true
+	b.EnabledPairs = []string{"BTC-AUD", "ETH-AUD"}
+	b.TradingEnabledPairs = []string{"BTC-AUD"}
+
+	b.CancelOrdersOnDisconnect()
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if len(requests) != 2 {
+		t.Fatalf("requests = %q, want the BTC open orders and one cancel", requests)
+	}
+	for _, x := range requests {
+		if strings.Contains(x, `"instrument":"ETH"`) {
+			t.Errorf("request %s touched the data-only ETH pair", x)
+		}
+	}
+	if status := b.Status(); status.LastError != "" {
+		t.Errorf("last error = %s, want none", status.LastError)
+	}
+}
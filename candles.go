@@ -0,0 +1,15 @@
+package main
+
+import (
+	"time"
+)
+
+// Candle is an OHLCV bucket starting at Time and spanning one interval.
+type Candle struct {
+	Time   time.Time
+	Open   float64
+	High   float64
+	Low    float64
+	Close  float64
+	Volume float64
+}
@@ -640,7 +640,10 @@ func (c *Coinbase) SendAuthenticatedHTTPRequest(method, path string, params map[
 	}
 
 	message := timestamp + method + path + string(payload)
-	hmac := GetHMAC(HASH_SHA256, []byte(message), []byte(c.APISecret))
+	hmac, err := GetHMAC(HASH_SHA256, []byte(message), []byte(c.APISecret))
+	if err != nil {
+		return err
+	}
 	headers := make(map[string]string)
 	headers["CB-ACCESS-SIGN"] = Base64Encode([]byte(hmac))
 	headers["CB-ACCESS-TIMESTAMP"] = timestamp
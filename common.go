@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/md5"
+	"crypto/rand"
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
@@ -10,23 +12,321 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"hash"
 	"io"
 	"io/ioutil"
 	"log"
 	"math"
+	mathrand "math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// HashType selects the hash function used by GetHMAC.
+type HashType int
+
 const (
-	HASH_SHA1 = iota
+	HASH_SHA1 HashType = iota
 	HASH_SHA256
 	HASH_SHA512
 	HASH_SHA512_384
 )
 
+func (h HashType) String() string {
+	switch h {
+	case HASH_SHA1:
+		return "SHA1"
+	case HASH_SHA256:
+		return "SHA256"
+	case HASH_SHA512:
+		return "SHA512"
+	case HASH_SHA512_384:
+		return "SHA512_384"
+	}
+	return fmt.Sprintf("HashType(%d)", int(h))
+}
+
+// ErrExchangeUnavailable is returned when an exchange responds with 503 or a
+// non-JSON body, as it typically does during maintenance.
+var ErrExchangeUnavailable = errors.New("Exchange is unavailable.")
+
+// ErrResponseTooLarge is returned when a response body exceeds
+// MaxResponseBodySize.
+var ErrResponseTooLarge = errors.New("HTTP response body exceeds the maximum size.")
+
+// MaxResponseBodySize caps how many bytes the HTTP request helpers will read
+// from a response body. A value of zero or less disables the cap.
+var MaxResponseBodySize int64 = 4 * 1024 * 1024
+
+// Backoff produces exponentially growing delays starting at Min and capped at
+// Max. Jitter, between 0 and 1, randomly shortens each delay by up to that
+// fraction so clients backing off together don't retry in lockstep. Backoff
+// is not safe for concurrent use.
+type Backoff struct {
+	Min      time.Duration
+	Max      time.Duration
+	Factor   float64
+	Jitter   float64
+	attempts int
+}
+
+// Next returns the delay before the next attempt and advances the backoff.
+// A Factor of zero is treated as 2.
+func (b *Backoff) Next() time.Duration {
+	factor := b.Factor
+	if factor <= 0 {
+		factor = 2
+	}
+
+	delay := float64(b.Min) * math.Pow(factor, float64(b.attempts))
+	if b.Max > 0 && delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+	b.attempts++
+
+	if b.Jitter > 0 {
+		delay -= delay * math.Min(b.Jitter, 1) * mathrand.Float64()
+	}
+	return time.Duration(delay)
+}
+
+func (b *Backoff) Reset() {
+	b.attempts = 0
+}
+
+// Attempts returns how many delays have been handed out since the last Reset.
+func (b *Backoff) Attempts() int {
+	return b.attempts
+}
+
+// IsTimeoutError reports whether err is a network timeout or an exceeded
+// context deadline.
+func IsTimeoutError(err error) bool {
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// CircuitState is the state of a CircuitBreaker.
+type CircuitState int
+
+const (
+	CIRCUIT_CLOSED CircuitState = iota
+	CIRCUIT_OPEN
+	CIRCUIT_HALF_OPEN
+)
+
+func (c CircuitState) String() string {
+	switch c {
+	case CIRCUIT_CLOSED:
+		return "closed"
+	case CIRCUIT_OPEN:
+		return "open"
+	case CIRCUIT_HALF_OPEN:
+		return "half-open"
+	}
+	return fmt.Sprintf("CircuitState(%d)", int(c))
+}
+
+// ErrCircuitOpen is returned instead of sending a request while a
+// CircuitBreaker is open.
+var ErrCircuitOpen = errors.New("Circuit breaker is open, request not sent.")
+
+// CircuitBreaker opens after Threshold consecutive failures and rejects
+// requests until Cooldown has passed. It then half-opens, letting a single
+// request through: success closes the circuit, failure opens it again. A
+// Threshold of zero or less disables the breaker.
+type CircuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+	mtx       sync.Mutex
+	state     CircuitState
+	failures  int
+	openedAt  time.Time
+	probing   bool
+}
+
+// Allow reports whether a request may be sent, returning ErrCircuitOpen if
+// not. Every allowed request must be followed by a call to Record.
+func (c *CircuitBreaker) Allow() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.Threshold <= 0 {
+		return nil
+	}
+
+	switch c.state {
+	case CIRCUIT_OPEN:
+		if time.Since(c.openedAt) < c.Cooldown {
+			return ErrCircuitOpen
+		}
+		c.state = CIRCUIT_HALF_OPEN
+	case CIRCUIT_HALF_OPEN:
+		if c.probing {
+			return ErrCircuitOpen
+		}
+	default:
+		return nil
+	}
+	c.probing = true
+	return nil
+}
+
+// Record updates the breaker with the result of an allowed request.
+func (c *CircuitBreaker) Record(err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.Threshold <= 0 || err == ErrCircuitOpen {
+		return
+	}
+
+	c.probing = false
+	if err == nil {
+		c.state = CIRCUIT_CLOSED
+		c.failures = 0
+		return
+	}
+
+	c.failures++
+	if c.state == CIRCUIT_HALF_OPEN || c.failures >= c.Threshold {
+		c.state = CIRCUIT_OPEN
+		c.openedAt = time.Now()
+	}
+}
+
+// State returns the current state, reporting an open circuit whose cooldown
+// has passed as half-open.
+func (c *CircuitBreaker) State() CircuitState {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.state == CIRCUIT_OPEN && time.Since(c.openedAt) >= c.Cooldown {
+		return CIRCUIT_HALF_OPEN
+	}
+	return c.state
+}
+
+// Reset closes the circuit and clears the failure count.
+func (c *CircuitBreaker) Reset() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.state = CIRCUIT_CLOSED
+	c.failures = 0
+	c.probing = false
+}
+
+// Nonce hands out strictly increasing millisecond timestamps. When Path is
+// set the last nonce is persisted there, at most once per FlushInterval, and
+// read back on first use so a restart or clock rollback can't reuse a nonce
+// that was already sent.
+type Nonce struct {
+	Path          string
+	FlushInterval time.Duration
+	mtx           sync.Mutex
+	last          int64
+	loaded        bool
+	lastFlush     time.Time
+}
+
+// Get returns the next nonce, max(now, last+1).
+func (n *Nonce) Get() int64 {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	if !n.loaded {
+		n.loaded = true
+		err := n.load()
+		if err != nil {
+			log.Printf("Unable to load nonce from %s. Error: %s\n", n.Path, err)
+		}
+	}
+
+	nonce := time.Now().UnixNano() / int64(time.Millisecond)
+	if nonce <= n.last {
+		nonce = n.last + 1
+	}
+	n.last = nonce
+
+	if n.Path != "" && time.Since(n.lastFlush) >= n.FlushInterval {
+		err := n.flush()
+		if err != nil {
+			log.Printf("Unable to persist nonce to %s. Error: %s\n", n.Path, err)
+		}
+	}
+	return nonce
+}
+
+// Flush writes the last nonce to Path.
+func (n *Nonce) Flush() error {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	return n.flush()
+}
+
+func (n *Nonce) load() error {
+	if n.Path == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(n.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	persisted, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return err
+	}
+	if persisted > n.last {
+		n.last = persisted
+	}
+	return nil
+}
+
+func (n *Nonce) flush() error {
+	if n.Path == "" || n.last == 0 {
+		return nil
+	}
+
+	tmp := n.Path + ".tmp"
+	err := ioutil.WriteFile(tmp, []byte(strconv.FormatInt(n.last, 10)), 0600)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, n.Path)
+	if err != nil {
+		return err
+	}
+	n.lastFlush = time.Now()
+	return nil
+}
+
+// RedactSecret returns the first few characters of secret followed by "..."
+// so it can be correlated in logs without being revealed. Short secrets are
+// fully masked.
+func RedactSecret(secret string) string {
+	if len(secret) <= 8 {
+		return "***"
+	}
+	return secret[:4] + "..."
+}
+
 func GetMD5(input []byte) []byte {
 	hash := md5.New()
 	hash.Write(input)
@@ -45,7 +345,7 @@ func GetSHA256(input []byte) []byte {
 	return sha.Sum(nil)
 }
 
-func GetHMAC(hashType int, input, key []byte) []byte {
+func GetHMAC(hashType HashType, input, key []byte) ([]byte, error) {
 	var hash func() hash.Hash
 
 	switch hashType {
@@ -65,11 +365,13 @@ func GetHMAC(hashType int, input, key []byte) []byte {
 		{
 			hash = sha512.New384
 		}
+	default:
+		return nil, fmt.Errorf("Unsupported HMAC hash type %s.", hashType)
 	}
 
 	hmac := hmac.New(hash, []byte(key))
 	hmac.Write(input)
-	return hmac.Sum(nil)
+	return hmac.Sum(nil), nil
 }
 
 func HexEncodeToString(input []byte) string {
@@ -88,6 +390,17 @@ func Base64Encode(input []byte) string {
 	return base64.StdEncoding.EncodeToString(input)
 }
 
+func GetUUID() (string, error) {
+	uuid := make([]byte, 16)
+	_, err := rand.Read(uuid)
+	if err != nil {
+		return "", err
+	}
+	uuid[6] = (uuid[6] & 0x0f) | 0x40
+	uuid[8] = (uuid[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:]), nil
+}
+
 func StringSliceDifference(slice1 []string, slice2 []string) []string {
 	var diff []string
 	for i := 0; i < 2; i++ {
@@ -174,7 +487,43 @@ func CalculateNetProfit(amount, priceThen, priceNow, costs float64) float64 {
 	return (priceNow * amount) - (priceThen * amount) - costs
 }
 
+type RoundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f RoundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+type HTTPMiddleware func(next RoundTripperFunc) RoundTripperFunc
+
+func WrapHTTPClient(httpClient *http.Client, middleware []HTTPMiddleware) *http.Client {
+	if httpClient == nil {
+		httpClient = &http.Client{}
+	}
+
+	if len(middleware) == 0 {
+		return httpClient
+	}
+
+	transport := httpClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	next := RoundTripperFunc(transport.RoundTrip)
+	for i := len(middleware) - 1; i >= 0; i-- {
+		next = middleware[i](next)
+	}
+
+	wrapped := *httpClient
+	wrapped.Transport = next
+	return &wrapped
+}
+
 func SendHTTPRequest(method, path string, headers map[string]string, body io.Reader) (string, error) {
+	return SendHTTPRequestWithClient(nil, method, path, headers, body)
+}
+
+func SendHTTPRequestWithClient(httpClient *http.Client, method, path string, headers map[string]string, body io.Reader) (string, error) {
 	result := strings.ToUpper(method)
 
 	if result != "POST" && result != "GET" && result != "DELETE" {
@@ -191,16 +540,22 @@ func SendHTTPRequest(method, path string, headers map[string]string, body io.Rea
 		req.Header.Add(k, v)
 	}
 
-	httpClient := &http.Client{}
+	if httpClient == nil {
+		httpClient = &http.Client{}
+	}
 	resp, err := httpClient.Do(req)
 
 	if err != nil {
 		return "", err
 	}
-
-	contents, err := ioutil.ReadAll(resp.Body)
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		return "", ErrExchangeUnavailable
+	}
+
+	contents, err := ReadResponseBody(resp.Body)
+
 	if err != nil {
 		return "", err
 	}
@@ -209,26 +564,52 @@ func SendHTTPRequest(method, path string, headers map[string]string, body io.Rea
 }
 
 func SendHTTPGetRequest(url string, jsonDecode bool, result interface{}) (err error) {
-	res, err := http.Get(url)
+	return SendHTTPGetRequestWithClient(nil, url, jsonDecode, result)
+}
+
+func SendHTTPGetRequestWithClient(httpClient *http.Client, url string, jsonDecode bool, result interface{}) (err error) {
+	return SendHTTPGetRequestWithContext(context.Background(), httpClient, url, jsonDecode, result)
+}
 
+// SendHTTPGetRequestWithContext is SendHTTPGetRequestWithClient with the
+// request bound to ctx, so cancelling ctx aborts the request.
+func SendHTTPGetRequestWithContext(ctx context.Context, httpClient *http.Client, url string, jsonDecode bool, result interface{}) (err error) {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return err
 	}
 
+	res, err := httpClient.Do(req.WithContext(ctx))
+
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusServiceUnavailable {
+		return ErrExchangeUnavailable
+	}
+
 	if res.StatusCode != 200 {
 		log.Printf("HTTP status code: %d\n", res.StatusCode)
 		return errors.New("Status code was not 200.")
 	}
 
-	contents, err := ioutil.ReadAll(res.Body)
+	contents, err := ReadResponseBody(res.Body)
 
 	if err != nil {
 		return err
 	}
 
-	defer res.Body.Close()
-
 	if jsonDecode {
+		if !IsJSONResponse(contents) {
+			return ErrExchangeUnavailable
+		}
+
 		err := JSONDecode(contents, &result)
 
 		if err != nil {
@@ -241,6 +622,32 @@ func SendHTTPGetRequest(url string, jsonDecode bool, result interface{}) (err er
 	return nil
 }
 
+// ReadResponseBody reads body, returning ErrResponseTooLarge if it is longer
+// than MaxResponseBodySize.
+func ReadResponseBody(body io.Reader) ([]byte, error) {
+	limit := MaxResponseBodySize
+	if limit <= 0 {
+		return ioutil.ReadAll(body)
+	}
+
+	contents, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(contents)) > limit {
+		return nil, ErrResponseTooLarge
+	}
+	return contents, nil
+}
+
+// IsJSONResponse reports whether contents looks like a JSON object or array,
+// as opposed to an HTML error or maintenance page.
+func IsJSONResponse(contents []byte) bool {
+	trimmed := strings.TrimSpace(string(contents))
+	return strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")
+}
+
 func JSONEncode(v interface{}) ([]byte, error) {
 	json, err := json.Marshal(&v)
 
@@ -261,6 +668,37 @@ func JSONDecode(data []byte, to interface{}) error {
 	return nil
 }
 
+// DecodeErrorSnippetSize caps how many bytes of the response body a
+// DecodeError includes.
+var DecodeErrorSnippetSize = 256
+
+// DecodeError is returned when a response body from Path can't be decoded.
+// Body holds the start of the response, truncated to DecodeErrorSnippetSize.
+type DecodeError struct {
+	Path string
+	Body string
+	Err  error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("decode %s: %s body: %s", e.Path, e.Err, e.Body)
+}
+
+// JSONDecodeWithContext is JSONDecode, returning any error as a *DecodeError
+// carrying path and a snippet of data.
+func JSONDecodeWithContext(path string, data []byte, to interface{}) error {
+	err := JSONDecode(data, to)
+	if err == nil {
+		return nil
+	}
+
+	body := string(data)
+	if DecodeErrorSnippetSize >= 0 && len(body) > DecodeErrorSnippetSize {
+		body = body[:DecodeErrorSnippetSize] + "..."
+	}
+	return &DecodeError{Path: path, Body: body, Err: err}
+}
+
 func EncodeURLValues(url string, values url.Values) string {
 	path := url
 	if len(values) > 0 {
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testClosingBody counts Close calls on a response body.
+type testClosingBody struct {
+	io.ReadCloser
+	closed *int32
+}
+
+func (b testClosingBody) Close() error {
+	atomic.AddInt32(b.closed, 1)
+	return b.ReadCloser.Close()
+}
+
+// newTestClosingClient returns a client whose response bodies increment
+// closed when they are closed.
+func newTestClosingClient(closed *int32) *http.Client {
+	return &http.Client{Transport: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = testClosingBody{ReadCloser: resp.Body, closed: closed}
+		return resp, nil
+	})}
+}
+
+func TestHTTPRequestBodyClosed(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		limit   int64
+		wantErr bool
+	}{
+		{name: "ok", status: http.StatusOK, body: `{}`},
+		{name: "http error", status: http.StatusInternalServerError, body: `{}`, wantErr: true},
+		{name: "unavailable", status: http.StatusServiceUnavailable, body: `{}`, wantErr: true},
+		{name: "too large", status: http.StatusOK, body: `{"a":"` + strings.Repeat("a", 64) + `"}`, limit: 16, wantErr: true},
+	}
+
+	defer func(limit int64) { MaxResponseBodySize = limit }(MaxResponseBodySize)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(respondWith(test.status, test.body))
+			defer server.Close()
+			if test.limit > 0 {
+				MaxResponseBodySize = test.limit
+			}
+
+			var closed int32
+			client := newTestClosingClient(&closed)
+
+			result := make(map[string]interface{})
+			err := SendHTTPGetRequestWithClient(client, server.URL, true, &result)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("SendHTTPGetRequestWithClient err = %v", err)
+			}
+
+			_, err = SendHTTPRequestWithClient(client, "GET", server.URL, nil, nil)
+			if test.status == http.StatusServiceUnavailable && err != ErrExchangeUnavailable {
+				t.Fatalf("SendHTTPRequestWithClient err = %v", err)
+			}
+
+			if atomic.LoadInt32(&closed) != 2 {
+				t.Fatalf("closed %d response bodies, want 2", closed)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := Backoff{Min: time.Second, Max: 10 * time.Second}
+	for _, x := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		if d := b.Next(); d != x*time.Second {
+			t.Fatalf("Next = %s, want %s", d, x*time.Second)
+		}
+	}
+	if b.Attempts() != 6 {
+		t.Errorf("Attempts = %d, want 6", b.Attempts())
+	}
+
+	b.Reset()
+	if d := b.Next(); d != time.Second {
+		t.Errorf("Next after Reset = %s, want 1s", d)
+	}
+
+	jittered := Backoff{Min: time.Second, Jitter: 0.5}
+	for i := 0; i < 20; i++ {
+		jittered.Reset()
+		if d := jittered.Next(); d < 500*time.Millisecond || d > time.Second {
+			t.Fatalf("jittered Next = %s, want between 500ms and 1s", d)
+		}
+	}
+}
+
+func TestBackoffFactor(t *testing.T) {
+	b := Backoff{Min: 100 * time.Millisecond, Factor: 3}
+	for _, x := range []time.Duration{100, 300, 900, 2700, 8100} {
+		if d := b.Next(); d != x*time.Millisecond {
+			t.Fatalf("Next = %s, want %s", d, x*time.Millisecond)
+		}
+	}
+
+	capped := Backoff{Min: time.Second, Max: time.Minute, Jitter: 2}
+	for i := 0; i < 20; i++ {
+		if d := capped.Next(); d < 0 || d > time.Minute {
+			t.Fatalf("attempt %d: Next = %s, want between 0 and 1m", i+1, d)
+		}
+	}
+}
+
+func TestNewBTCMarketsWebsocketBackoff(t *testing.T) {
+	b := NewBTCMarketsWebsocketBackoff()
+	for i := 0; i < 12; i++ {
+		want := BTCMARKETS_WEBSOCKET_RECONNECT_MIN << uint(i)
+		if want > BTCMARKETS_WEBSOCKET_RECONNECT_MAX {
+			want = BTCMARKETS_WEBSOCKET_RECONNECT_MAX
+		}
+		if d := b.Next(); d < want/2 || d > want {
+			t.Fatalf("attempt %d: Next = %s, want between %s and %s", i+1, d, want/2, want)
+		}
+	}
+}
+
+func TestGetHMAC(t *testing.T) {
+	tests := []struct {
+		hashType HashType
+		name     string
+		want     string
+	}{
+		{HASH_SHA1, "SHA1", "effcdf6ae5eb2fa2d27416d5f184df9c259a7c79"},
+		{HASH_SHA256, "SHA256", "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"},
+		{HASH_SHA512, "SHA512", "164b7a7bfcf819e2e395fbe73b56e0a387bd64222e831fd610270cd7ea2505549758bf75c05a994a6d034f65f8f0e6fdcaeab1a34d4a6b4b636e070a38bce737"},
+		{HASH_SHA512_384, "SHA512_384", "af45d2e376484031617f78d2b58a6b1b9c7ef464f5a01b47e42ec3736322445e8e2240ca5e69e2c78b3239ecfab21649"},
+	}
+
+	for _, test := range tests {
+		if test.hashType.String() != test.name {
+			t.Errorf("String = %q, want %q", test.hashType.String(), test.name)
+		}
+		hmac, err := GetHMAC(test.hashType, []byte("what do ya want for nothing?"), []byte("Jefe"))
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if got := hex.EncodeToString(hmac); got != test.want {
+			t.Errorf("%s HMAC = %s, want %s", test.name, got, test.want)
+		}
+	}
+
+	hmac, err := GetHMAC(HashType(42), []byte("input"), []byte("key"))
+	if err == nil || hmac != nil {
+		t.Fatalf("GetHMAC with an unknown hash type = %x, %v, want an error", hmac, err)
+	}
+	if !strings.Contains(err.Error(), "HashType(42)") {
+		t.Errorf("error %q doesn't name the hash type", err)
+	}
+}
@@ -55,6 +55,10 @@ type Exchanges struct {
 	APIKey                  string
 	APISecret               string
 	ClientID                string
+	ProxyURL                string `json:",omitempty"`
+	APISecretIsRaw          bool   `json:",omitempty"`
+	TradingEnabledPairs     string `json:",omitempty"`
+	APIKeyPermissions       string `json:",omitempty"`
 	AvailablePairs          string
 	EnabledPairs            string
 	BaseCurrencies          string
@@ -479,7 +479,10 @@ func (c *Cryptsy) SendAuthenticatedHTTPRequest(method, path string, params url.V
 	nonce := strconv.FormatInt(time.Now().Unix(), 10)
 	params.Set("nonce", nonce)
 	encoded := params.Encode()
-	hmac := GetHMAC(HASH_SHA512, []byte(encoded), []byte(c.APISecret))
+	hmac, err := GetHMAC(HASH_SHA512, []byte(encoded), []byte(c.APISecret))
+	if err != nil {
+		return err
+	}
 	readStr := ""
 
 	if method == "GET" || method == "DELETE" {
@@ -46,8 +46,61 @@ var (
 	ErrCurrencyDataNotFetched = errors.New("Yahoo currency data has not been fetched yet.")
 	ErrCurrencyNotFound       = errors.New("Unable to find specified currency.")
 	ErrQueryingYahoo          = errors.New("Unable to query Yahoo currency values.")
+	ErrInvalidCurrencyPair    = errors.New("Invalid currency pair.")
 )
 
+// NormalizeCurrency returns currency trimmed and uppercased, the form the
+// exchange APIs expect.
+func NormalizeCurrency(currency string) string {
+	return StringToUpper(strings.TrimSpace(currency))
+}
+
+// CurrencyPair is a base and quote currency, such as BTC and AUD.
+type CurrencyPair struct {
+	Base, Quote string
+}
+
+// String returns the pair in the concatenated form, e.g. BTCAUD.
+func (c CurrencyPair) String() string {
+	return c.Base + c.Quote
+}
+
+// Format returns the pair joined by delimiter.
+func (c CurrencyPair) Format(delimiter string) string {
+	return c.Base + delimiter + c.Quote
+}
+
+// ParseCurrencyPair parses pairs such as "BTC-AUD", "btc/aud" or "BTCAUD".
+// The pair is split on delimiter if given, otherwise on the first of "-",
+// "/" or "_" it contains. Undelimited six character pairs are split in half
+// and anything else is taken to be a base currency with an empty Quote.
+func ParseCurrencyPair(pair, delimiter string) (CurrencyPair, error) {
+	pair = strings.TrimSpace(pair)
+	delimiters := []string{"-", "/", "_"}
+	if delimiter != "" {
+		delimiters = []string{delimiter}
+	}
+
+	for _, x := range delimiters {
+		if !strings.Contains(pair, x) {
+			continue
+		}
+		split := strings.Split(pair, x)
+		if len(split) != 2 || NormalizeCurrency(split[0]) == "" || NormalizeCurrency(split[1]) == "" {
+			return CurrencyPair{}, ErrInvalidCurrencyPair
+		}
+		return CurrencyPair{Base: NormalizeCurrency(split[0]), Quote: NormalizeCurrency(split[1])}, nil
+	}
+
+	switch len(pair) {
+	case 0:
+		return CurrencyPair{}, ErrInvalidCurrencyPair
+	case 6:
+		return CurrencyPair{Base: NormalizeCurrency(pair[:3]), Quote: NormalizeCurrency(pair[3:])}, nil
+	}
+	return CurrencyPair{Base: NormalizeCurrency(pair)}, nil
+}
+
 func IsFiatCurrency(currency string) bool {
 	if StringContains(BaseCurrencies, StringToUpper(currency)) {
 		return true
@@ -102,6 +155,21 @@ func MakecurrencyPairs(supportedCurrencies string) string {
 	return JoinStrings(pairs, ",")
 }
 
+// CurrencyConverter converts an amount from one currency to another.
+type CurrencyConverter interface {
+	Convert(amount float64, from, to string) (float64, error)
+}
+
+// CurrencyConverterFunc adapts a function to a CurrencyConverter.
+type CurrencyConverterFunc func(amount float64, from, to string) (float64, error)
+
+func (f CurrencyConverterFunc) Convert(amount float64, from, to string) (float64, error) {
+	return f(amount, from, to)
+}
+
+// DefaultCurrencyConverter converts using the fetched Yahoo currency data.
+var DefaultCurrencyConverter CurrencyConverter = CurrencyConverterFunc(ConvertCurrency)
+
 func ConvertCurrency(amount float64, from, to string) (float64, error) {
 	if CurrencyStore.Query.YahooJSONResponseInfo.Count == 0 {
 		return 0, ErrCurrencyDataNotFetched
@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestParseCurrencyPair(t *testing.T) {
+	tests := []struct {
+		pair      string
+		delimiter string
+		want      CurrencyPair
+		wantErr   bool
+	}{
+		{pair: "BTC-AUD", want: CurrencyPair{Base: "BTC", Quote: "AUD"}},
+		{pair: "btc/aud", want: CurrencyPair{Base: "BTC", Quote: "AUD"}},
+		{pair: "ETH_BTC", want: CurrencyPair{Base: "ETH", Quote: "BTC"}},
+		{pair: " BTCAUD ", want: CurrencyPair{Base: "BTC", Quote: "AUD"}},
+		{pair: "BTC:AUD", delimiter: ":", want: CurrencyPair{Base: "BTC", Quote: "AUD"}},
+		{pair: "BTC", want: CurrencyPair{Base: "BTC"}},
+		{pair: "BTC-", wantErr: true},
+		{pair: "", wantErr: true},
+		{pair: "A-B-C", wantErr: true},
+	}
+
+	for _, test := range tests {
+		pair, err := ParseCurrencyPair(test.pair, test.delimiter)
+		if test.wantErr {
+			if err != ErrInvalidCurrencyPair {
+				t.Errorf("%q: error = %v, want ErrInvalidCurrencyPair", test.pair, err)
+			}
+			continue
+		}
+		if err != nil || pair != test.want {
+			t.Errorf("%q: got %+v %v, want %+v", test.pair, pair, err, test.want)
+		}
+	}
+
+	if got := (CurrencyPair{Base: "ETH", Quote: "BTC"}).Format("/"); got != "ETH/BTC" {
+		t.Errorf("Format = %s, want ETH/BTC", got)
+	}
+}
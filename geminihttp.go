@@ -318,7 +318,10 @@ func (g *Gemini) SendAuthenticatedHTTPRequest(method, path string, params map[st
 	}
 
 	PayloadBase64 := Base64Encode(PayloadJson)
-	hmac := GetHMAC(HASH_SHA512_384, []byte(PayloadBase64), []byte(g.APISecret))
+	hmac, err := GetHMAC(HASH_SHA512_384, []byte(PayloadBase64), []byte(g.APISecret))
+	if err != nil {
+		return err
+	}
 	headers := make(map[string]string)
 	headers["X-GEMINI-APIKEY"] = g.APIKey
 	headers["X-GEMINI-PAYLOAD"] = PayloadBase64
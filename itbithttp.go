@@ -327,7 +327,10 @@ func (i *ItBit) SendAuthenticatedHTTPRequest(method string, path string, params
 	}
 
 	hash := GetSHA256([]byte(nonceStr + string(message)))
-	hmac := GetHMAC(HASH_SHA512, []byte(url+string(hash)), []byte(i.APISecret))
+	hmac, err := GetHMAC(HASH_SHA512, []byte(url+string(hash)), []byte(i.APISecret))
+	if err != nil {
+		return err
+	}
 	signature := Base64Encode(hmac)
 
 	headers := make(map[string]string)
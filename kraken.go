@@ -565,7 +565,11 @@ func (k *Kraken) SendAuthenticatedHTTPRequest(method string, values url.Values)
 	}
 
 	shasum := GetSHA256([]byte(values.Get("nonce") + values.Encode()))
-	signature := Base64Encode(GetHMAC(HASH_SHA512, append([]byte(path), shasum...), secret))
+	hmac, err := GetHMAC(HASH_SHA512, append([]byte(path), shasum...), secret)
+	if err != nil {
+		return nil, err
+	}
+	signature := Base64Encode(hmac)
 
 	if k.Verbose {
 		log.Printf("Sending POST request to %s, path: %s.", KRAKEN_API_URL, path)
@@ -213,7 +213,10 @@ func (l *LakeBTC) SendAuthenticatedHTTPRequest(method, params string) (err error
 	v.Set("params", params)
 
 	encoded := v.Encode()
-	hmac := GetHMAC(HASH_SHA256, []byte(encoded), []byte(l.APISecret))
+	hmac, err := GetHMAC(HASH_SHA256, []byte(encoded), []byte(l.APISecret))
+	if err != nil {
+		return err
+	}
 
 	if l.Verbose {
 		log.Printf("Sending POST request to %s calling method %s with params %s\n", LAKEBTC_API_URL, method, encoded)
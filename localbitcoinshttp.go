@@ -386,7 +386,10 @@ func (l *LocalBitcoins) SendAuthenticatedHTTPRequest(method, path string, values
 	}
 
 	message := string(nonce) + l.APIKey + path + payload
-	hmac := GetHMAC(HASH_SHA256, []byte(message), []byte(l.APISecret))
+	hmac, err := GetHMAC(HASH_SHA256, []byte(message), []byte(l.APISecret))
+	if err != nil {
+		return err
+	}
 	headers := make(map[string]string)
 	headers["Apiauth-Key"] = l.APIKey
 	headers["Apiauth-Nonce"] = string(nonce)
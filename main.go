@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"log"
 	"os"
@@ -8,6 +9,7 @@ import (
 	"runtime"
 	"strconv"
 	"syscall"
+	"time"
 )
 
 type Exchange struct {
@@ -181,13 +183,34 @@ func main() {
 				bot.exchange.btcmarkets.SetEnabled(false)
 			} else {
 				bot.exchange.btcmarkets.AuthenticatedAPISupport = exch.AuthenticatedAPISupport
-				bot.exchange.btcmarkets.SetAPIKeys(exch.APIKey, exch.APISecret)
-				bot.exchange.btcmarkets.RESTPollingDelay = exch.RESTPollingDelay
+				bot.exchange.btcmarkets.SecretIsBase64 = !exch.APISecretIsRaw
+				bot.exchange.btcmarkets.KeyPermissions = BTCMarketsKeyPermissions(exch.APIKeyPermissions)
+				if !bot.exchange.btcmarkets.KeyPermissions.IsValid() {
+					log.Printf("%s unknown API key permissions %s, assuming the key can trade.\n", exch.Name, exch.APIKeyPermissions)
+					bot.exchange.btcmarkets.KeyPermissions = BTCMARKETS_KEY_PERMISSIONS_UNKNOWN
+				}
+				if exch.AuthenticatedAPISupport {
+					err = bot.exchange.btcmarkets.SetAPIKeys(exch.APIKey, exch.APISecret)
+					if err != nil {
+						log.Println(err)
+						bot.exchange.btcmarkets.SetEnabled(false)
+					}
+				}
+				if exch.ProxyURL != "" {
+					err = bot.exchange.btcmarkets.SetProxy(exch.ProxyURL)
+					if err != nil {
+						log.Println(err)
+					}
+				}
+				bot.exchange.btcmarkets.RESTPollingDelay = exch.RESTPollingDelay * time.Second
 				bot.exchange.btcmarkets.Verbose = exch.Verbose
 				bot.exchange.btcmarkets.Websocket = exch.Websocket
 				bot.exchange.btcmarkets.BaseCurrencies = SplitStrings(exch.BaseCurrencies, ",")
 				bot.exchange.btcmarkets.AvailablePairs = SplitStrings(exch.AvailablePairs, ",")
 				bot.exchange.btcmarkets.EnabledPairs = SplitStrings(exch.EnabledPairs, ",")
+				if exch.TradingEnabledPairs != "" {
+					bot.exchange.btcmarkets.TradingEnabledPairs = SplitStrings(exch.TradingEnabledPairs, ",")
+				}
 				go bot.exchange.btcmarkets.Run()
 			}
 		} else if bot.exchange.coinbase.GetName() == exch.Name {
@@ -382,7 +405,15 @@ func HandleInterrupt() {
 
 func Shutdown() {
 	log.Println("Bot shutting down..")
-	err := SaveConfig()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	err := bot.exchange.btcmarkets.Shutdown(ctx)
+	cancel()
+
+	if err != nil {
+		log.Printf("%s unable to wait for in-flight requests. Error: %s\n", bot.exchange.btcmarkets.GetName(), err)
+	}
+
+	err = SaveConfig()
 
 	if err != nil {
 		log.Println("Unable to save config.")
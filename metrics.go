@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type RequestMetrics interface {
+	ObserveRequest(endpoint string, duration time.Duration, err error)
+}
+
+type NopRequestMetrics struct{}
+
+func (n NopRequestMetrics) ObserveRequest(endpoint string, duration time.Duration, err error) {}
+
+// DefaultLatencyBuckets are the upper bounds of the request latency histogram
+// buckets used by NewRequestCounter.
+var DefaultLatencyBuckets = []time.Duration{
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// RequestCounter counts successful and failed requests per endpoint and keeps
+// a latency histogram per endpoint. Latency[endpoint][i] counts requests that
+// took at most Buckets[i] and over the previous bound; the final element
+// counts those slower than the last bound.
+type RequestCounter struct {
+	Success map[string]int64
+	Failure map[string]int64
+	Buckets []time.Duration
+	Latency map[string][]int64
+	mtx     sync.Mutex
+}
+
+func NewRequestCounter() *RequestCounter {
+	counter := &RequestCounter{}
+	counter.Success = make(map[string]int64)
+	counter.Failure = make(map[string]int64)
+	counter.Buckets = append([]time.Duration{}, DefaultLatencyBuckets...)
+	counter.Latency = make(map[string][]int64)
+	return counter
+}
+
+func (r *RequestCounter) ObserveRequest(endpoint string, duration time.Duration, err error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if err != nil {
+		r.Failure[endpoint]++
+	} else {
+		r.Success[endpoint]++
+	}
+
+	histogram, ok := r.Latency[endpoint]
+	if !ok {
+		histogram = make([]int64, len(r.Buckets)+1)
+		r.Latency[endpoint] = histogram
+	}
+	bucket := sort.Search(len(r.Buckets), func(i int) bool {
+		return duration <= r.Buckets[i]
+	})
+	histogram[bucket]++
+}
+
+func (r *RequestCounter) GetCounts(endpoint string) (success, failure int64) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.Success[endpoint], r.Failure[endpoint]
+}
+
+// GetLatencyHistogram returns a copy of the latency bucket counts for
+// endpoint, laid out as Latency.
+func (r *RequestCounter) GetLatencyHistogram(endpoint string) []int64 {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	histogram := make([]int64, len(r.Buckets)+1)
+	copy(histogram, r.Latency[endpoint])
+	return histogram
+}
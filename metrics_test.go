@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRequestCounter(t *testing.T) {
+	counter := NewRequestCounter()
+	counter.ObserveRequest(BTCMARKETS_MARKET_TICK, 0, nil)
+	counter.ObserveRequest(BTCMARKETS_MARKET_TICK, 0, nil)
+	counter.ObserveRequest(BTCMARKETS_MARKET_TICK, 0, errors.New("failed"))
+	counter.ObserveRequest(BTCMARKETS_ORDER_CREATE, 0, errors.New("failed"))
+
+	tests := []struct {
+		endpoint         string
+		success, failure int64
+	}{
+		{endpoint: BTCMARKETS_MARKET_TICK, success: 2, failure: 1},
+		{endpoint: BTCMARKETS_ORDER_CREATE, failure: 1},
+		{endpoint: BTCMARKETS_ACCOUNT_BALANCE},
+	}
+
+	for _, test := range tests {
+		success, failure := counter.GetCounts(test.endpoint)
+		if success != test.success || failure != test.failure {
+			t.Errorf("%s: %d successes %d failures, want %d %d", test.endpoint, success, failure, test.success, test.failure)
+		}
+	}
+}
+
+func TestRequestCounterLatency(t *testing.T) {
+	counter := NewRequestCounter()
+	counter.Buckets = []time.Duration{10 * time.Millisecond, 100 * time.Millisecond, time.Second}
+
+	for _, x := range []time.Duration{0, 10 * time.Millisecond, 11 * time.Millisecond, 100 * time.Millisecond, 999 * time.Millisecond, 5 * time.Second} {
+		counter.ObserveRequest(BTCMARKETS_MARKET_TICK, x, nil)
+	}
+	counter.ObserveRequest(BTCMARKETS_ORDER_CREATE, 2*time.Second, errors.New("failed"))
+
+	if got, want := counter.GetLatencyHistogram(BTCMARKETS_MARKET_TICK), []int64{2, 2, 1, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("tick histogram = %v, want %v", got, want)
+	}
+	if got, want := counter.GetLatencyHistogram(BTCMARKETS_ORDER_CREATE), []int64{0, 0, 0, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("create histogram = %v, want %v", got, want)
+	}
+	if got, want := counter.GetLatencyHistogram(BTCMARKETS_ACCOUNT_BALANCE), []int64{0, 0, 0, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unused endpoint histogram = %v, want %v", got, want)
+	}
+
+	b := newTestBTCMarkets(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte(testBTCMarketsTicker))
+	})
+	counter = NewRequestCounter()
+	counter.Buckets = []time.Duration{10 * time.Millisecond, time.Minute}
+	b.Metrics = counter
+	if _, err := b.GetTicker("BTC"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := counter.GetLatencyHistogram(BTCMARKETS_MARKET_TICK), []int64{0, 1, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("measured histogram = %v, want the 20ms request in the second bucket", got)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"sort"
+	"sync"
 )
 
 type ExchangeInfo struct {
@@ -14,6 +15,9 @@ type ExchangeInfo struct {
 
 var ExchInfo []ExchangeInfo
 
+// exchInfoMtx guards ExchInfo.
+var exchInfoMtx sync.Mutex
+
 type ByPrice []ExchangeInfo
 
 func (this ByPrice) Len() int {
@@ -43,6 +47,22 @@ func (this ByVolume) Swap(i, j int) {
 }
 
 func AddExchangeInfo(exchange, crypto, fiat string, price, volume float64) {
+	exchInfoMtx.Lock()
+	defer exchInfoMtx.Unlock()
+	addExchangeInfo(exchange, crypto, fiat, price, volume)
+}
+
+// AddExchangeInfoBatch adds entries in order, as AddExchangeInfo would, while
+// taking the store lock only once.
+func AddExchangeInfoBatch(entries []ExchangeInfo) {
+	exchInfoMtx.Lock()
+	defer exchInfoMtx.Unlock()
+	for _, x := range entries {
+		addExchangeInfo(x.Exchange, x.CryptoCurrency, x.FiatCurrency, x.Price, x.Volume)
+	}
+}
+
+func addExchangeInfo(exchange, crypto, fiat string, price, volume float64) {
 	if !IsFiatCurrency(fiat) {
 		return
 	}
@@ -80,11 +100,13 @@ func ExchangeInfoAlreadyExists(exchange, crypto, fiat string, price, volume floa
 func SortExchangesByVolume(crypto, fiat string, reverse bool) []ExchangeInfo {
 	info := []ExchangeInfo{}
 
+	exchInfoMtx.Lock()
 	for _, x := range ExchInfo {
 		if x.CryptoCurrency == crypto && x.FiatCurrency == fiat {
 			info = append(info, x)
 		}
 	}
+	exchInfoMtx.Unlock()
 
 	if reverse {
 		sort.Sort(sort.Reverse(ByVolume(info)))
@@ -97,11 +119,13 @@ func SortExchangesByVolume(crypto, fiat string, reverse bool) []ExchangeInfo {
 func SortExchangesByPrice(crypto, fiat string, reverse bool) []ExchangeInfo {
 	info := []ExchangeInfo{}
 
+	exchInfoMtx.Lock()
 	for _, x := range ExchInfo {
 		if x.CryptoCurrency == crypto && x.FiatCurrency == fiat {
 			info = append(info, x)
 		}
 	}
+	exchInfoMtx.Unlock()
 
 	if reverse {
 		sort.Sort(sort.Reverse(ByPrice(info)))
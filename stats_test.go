@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// withTestExchangeInfo runs f against an empty ExchInfo store with AUD and USD
+// as the fiat currencies, restoring the globals afterwards.
+func withTestExchangeInfo(f func()) {
+	info, base := ExchInfo, BaseCurrencies
+	defer func() {
+		ExchInfo, BaseCurrencies = info, base
+	}()
+	ExchInfo, BaseCurrencies = nil, "AUD,USD"
+	f()
+}
+
+func testExchangeInfoEntries(pairs int) []ExchangeInfo {
+	entries := make([]ExchangeInfo, 0, pairs*2)
+	for i := 0; i < pairs; i++ {
+		crypto := fmt.Sprintf("C%d", i)
+		entries = append(entries,
+			ExchangeInfo{Exchange: "BTC Markets", CryptoCurrency: crypto, FiatCurrency: "AUD", Price: float64(i)},
+			ExchangeInfo{Exchange: "BTC Markets", CryptoCurrency: crypto, FiatCurrency: "USD", Price: float64(i) * 0.7},
+		)
+	}
+	return entries
+}
+
+func TestAddExchangeInfoBatch(t *testing.T) {
+	withTestExchangeInfo(func() {
+		AddExchangeInfoBatch([]ExchangeInfo{
+			{Exchange: "BTC Markets", CryptoCurrency: "BTC", FiatCurrency: "AUD", Price: 100},
+			{Exchange: "BTC Markets", CryptoCurrency: "BTC", FiatCurrency: "USD", Price: 70},
+			{Exchange: "BTC Markets", CryptoCurrency: "ETH", FiatCurrency: "BTC", Price: 0.05},
+			{Exchange: "BTC Markets", CryptoCurrency: "LTC", FiatCurrency: "AUD", Price: 50},
+			{Exchange: "BTC Markets", CryptoCurrency: "BTC", FiatCurrency: "AUD", Price: 101},
+		})
+
+		want := []ExchangeInfo{
+			{Exchange: "BTC Markets", CryptoCurrency: "BTC", FiatCurrency: "AUD", Price: 101},
+			{Exchange: "BTC Markets", CryptoCurrency: "BTC", FiatCurrency: "USD", Price: 70},
+			{Exchange: "BTC Markets", CryptoCurrency: "LTC", FiatCurrency: "AUD", Price: 50},
+		}
+		if !reflect.DeepEqual(ExchInfo, want) {
+			t.Errorf("ExchInfo = %+v, want %+v", ExchInfo, want)
+		}
+	})
+
+	withTestExchangeInfo(func() {
+		entries := testExchangeInfoEntries(10)
+		for _, x := range entries {
+			AddExchangeInfo(x.Exchange, x.CryptoCurrency, x.FiatCurrency, x.Price, x.Volume)
+		}
+		perCall := ExchInfo
+
+		ExchInfo = nil
+		AddExchangeInfoBatch(entries)
+		if !reflect.DeepEqual(ExchInfo, perCall) {
+			t.Errorf("batched store differs from per-call store:\n%+v\n%+v", ExchInfo, perCall)
+		}
+	})
+}
+
+func BenchmarkAddExchangeInfo(b *testing.B) {
+	for _, pairs := range []int{10, 100} {
+		entries := testExchangeInfoEntries(pairs)
+
+		b.Run(fmt.Sprintf("PerCall/%d", pairs), func(b *testing.B) {
+			withTestExchangeInfo(func() {
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						for _, x := range entries {
+							AddExchangeInfo(x.Exchange, x.CryptoCurrency, x.FiatCurrency, x.Price, x.Volume)
+						}
+					}
+				})
+			})
+		})
+
+		b.Run(fmt.Sprintf("Batch/%d", pairs), func(b *testing.B) {
+			withTestExchangeInfo(func() {
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						AddExchangeInfoBatch(entries)
+					}
+				})
+			})
+		})
+	}
+}